@@ -0,0 +1,40 @@
+// Package compression implements the compression algorithms used in UEFI
+// firmware images, both for decoding and encoding, without depending on
+// external tools.
+package compression
+
+// Compressor compresses and decompresses data with a given algorithm
+type Compressor interface {
+	// Name returns the name of the algorithm
+	Name() string
+	// Decode decompresses data
+	Decode(data []byte) ([]byte, error)
+	// Encode compresses data. The output is deterministic: encoding the same
+	// data always returns the same bytes.
+	Encode(data []byte) ([]byte, error)
+}
+
+// GUIDs of the GUID-defined sections holding compressed data
+const (
+	LZMAGUID  = "ee4e5898-3914-4259-9d6e-dc7bd79403cf"
+	TianoGUID = "a31280ad-481e-41b6-95e8-127f4c984779"
+)
+
+// Available compressors
+var (
+	LZMA  Compressor = lzmaCompressor{}
+	EFI   Compressor = efiCompressor{pbit: 4, windowBits: 13}
+	Tiano Compressor = efiCompressor{pbit: 5, windowBits: 19}
+)
+
+// CompressorForGUID returns the compressor for the data of a GUID-defined
+// section with the given definition GUID, or nil if there is none.
+func CompressorForGUID(guid string) Compressor {
+	switch guid {
+	case LZMAGUID:
+		return LZMA
+	case TianoGUID:
+		return Tiano
+	}
+	return nil
+}
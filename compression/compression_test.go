@@ -0,0 +1,114 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// testInputs returns the data compressed by the round trip tests: empty,
+// single byte, repetitive, text and incompressible data, at sizes below and
+// above the maximum EFI block size
+func testInputs() map[string][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	var text bytes.Buffer
+	for i := 0; text.Len() < 0x20000; i++ {
+		fmt.Fprintf(&text, "Firmware volume %d at offset 0x%x\n", i, i*0x1000)
+	}
+	return map[string][]byte{
+		"empty":        {},
+		"one byte":     {0x5a},
+		"zeros 4K":     make([]byte, 0x1000),
+		"erased 96K":   bytes.Repeat([]byte{0xff}, 0x18000),
+		"text 1K":      text.Bytes()[:0x400],
+		"text 128K":    text.Bytes(),
+		"random 300":   random(300),
+		"random 70000": random(70000),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range []Compressor{LZMA, EFI, Tiano} {
+		for name, data := range testInputs() {
+			encoded, err := c.Encode(data)
+			if err != nil {
+				t.Errorf("%s %s: Encode: %v", c.Name(), name, err)
+				continue
+			}
+			decoded, err := c.Decode(encoded)
+			if err != nil {
+				t.Errorf("%s %s: Decode: %v", c.Name(), name, err)
+				continue
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("%s %s: round trip returned %d different bytes", c.Name(), name, len(decoded))
+			}
+			again, err := c.Encode(data)
+			if err != nil || !bytes.Equal(again, encoded) {
+				t.Errorf("%s %s: Encode is not deterministic", c.Name(), name)
+			}
+		}
+	}
+}
+
+func TestDecodeVectors(t *testing.T) {
+	for _, v := range []struct {
+		name string
+		c    Compressor
+		data []byte
+		want []byte
+	}{
+		{
+			// LZMA SDK stream, with the EDK2 LzmaCompress settings (lc 3,
+			// lp 0, pb 2, 8MB dictionary), produced by xz --format=lzma.
+			// The size is unknown, the stream ends with a marker.
+			name: "LZMA",
+			c:    LZMA,
+			data: []byte{
+				0x5d, 0x00, 0x00, 0x80, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0x00, 0x2a, 0x1a, 0x08, 0xa2, 0x03, 0x25, 0x66, 0xf1, 0x4b, 0x78,
+				0xc5, 0xa2, 0x05, 0xff, 0x2e, 0xe6, 0xd9, 0xd2, 0x20, 0x1a, 0xad, 0x34,
+				0xf8, 0xe2, 0x1d, 0xe8, 0x41, 0x36, 0xfa, 0xdc, 0x06, 0x69, 0xbb, 0x3c,
+				0xe4, 0x10, 0x34, 0x27, 0x09, 0xeb, 0xb3, 0x66, 0xe3, 0xed, 0x37, 0x4b,
+				0x51, 0x00, 0x28, 0x9c, 0xd0, 0xff, 0xff, 0xfd, 0x34, 0xf0, 0x00,
+			},
+			want: []byte("The quick brown fox jumps over the lazy dog. The quick brown fox jumps over the lazy dog.\n"),
+		},
+		{
+			// a block of 4 symbols with single-symbol trees, as described
+			// by the UEFI specification: the literal 'A' takes no bits
+			name: "EFI",
+			c:    EFI,
+			data: []byte{
+				0x07, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00,
+				0x00, 0x04, 0x00, 0x00, 0x04, 0x10, 0x10,
+			},
+			want: []byte("AAAA"),
+		},
+		{
+			// the same block, with the 5-bit position set size of Tiano
+			name: "Tiano",
+			c:    Tiano,
+			data: []byte{
+				0x07, 0x00, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00,
+				0x00, 0x04, 0x00, 0x00, 0x04, 0x10, 0x04,
+			},
+			want: []byte("AAAA"),
+		},
+	} {
+		got, err := v.c.Decode(v.data)
+		if err != nil {
+			t.Errorf("%s: Decode: %v", v.name, err)
+			continue
+		}
+		if !bytes.Equal(got, v.want) {
+			t.Errorf("%s: Decode returned %q, want %q", v.name, got, v.want)
+		}
+	}
+}
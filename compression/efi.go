@@ -0,0 +1,466 @@
+package compression
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EFI and Tiano compression constants. The two formats only differ in the
+// number of bits used to store the number of position codes, and the Tiano
+// encoder uses a larger window.
+const (
+	efiHeaderSize = 8
+	efiMaxMatch   = 256
+	efiThreshold  = 3
+	efiNC         = 0xff + efiMaxMatch + 2 - efiThreshold
+	efiCBit       = 9
+	efiNT         = 16 + 3
+	efiTBit       = 5
+	efiMaxNP      = 1<<5 - 1
+	efiMaxBlock   = 0xffff
+)
+
+// efiCompressor implements the EFI compression algorithm (pbit 4) and the
+// Tiano one (pbit 5): LZ77 followed by Huffman coding.
+type efiCompressor struct {
+	pbit       uint
+	windowBits uint
+}
+
+func (c efiCompressor) Name() string {
+	if c.pbit == 4 {
+		return "EFI"
+	}
+	return "Tiano"
+}
+
+// readPTLen reads the code lengths of the position or extra sets
+func readPTLen(r *bitReader, nn int, nbit uint, special int) (*huffmanDecoder, error) {
+	number := int(r.read(nbit))
+	if number == 0 {
+		return newSingleDecoder(int(r.read(nbit))), nil
+	}
+	if number > nn {
+		return nil, errCorrupted
+	}
+	lengths := make([]uint8, nn)
+	for i := 0; i < number; {
+		l := r.read(3)
+		if l == 7 {
+			for r.read(1) == 1 {
+				l++
+				if l > 16 {
+					return nil, errCorrupted
+				}
+			}
+		}
+		lengths[i] = uint8(l)
+		i++
+		if i == special {
+			for zeros := r.read(2); zeros > 0 && i < nn; zeros-- {
+				lengths[i] = 0
+				i++
+			}
+		}
+	}
+	return newHuffmanDecoder(lengths)
+}
+
+// readCLen reads the code lengths of the char and length set
+func readCLen(r *bitReader, t *huffmanDecoder) (*huffmanDecoder, error) {
+	number := int(r.read(efiCBit))
+	if number == 0 {
+		return newSingleDecoder(int(r.read(efiCBit))), nil
+	}
+	if number > efiNC {
+		return nil, errCorrupted
+	}
+	lengths := make([]uint8, efiNC)
+	for i := 0; i < number; {
+		c, err := t.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		if c > 2 {
+			lengths[i] = uint8(c - 2)
+			i++
+			continue
+		}
+		var zeros int
+		switch c {
+		case 0:
+			zeros = 1
+		case 1:
+			zeros = int(r.read(4)) + 3
+		case 2:
+			zeros = int(r.read(efiCBit)) + 20
+		}
+		if i+zeros > efiNC {
+			return nil, errCorrupted
+		}
+		i += zeros
+	}
+	return newHuffmanDecoder(lengths)
+}
+
+// Decode decompresses data starting with the compressed and original sizes
+func (c efiCompressor) Decode(data []byte) ([]byte, error) {
+	if len(data) < efiHeaderSize {
+		return nil, fmt.Errorf("%s data too short: %v bytes", c.Name(), len(data))
+	}
+	compSize := binary.LittleEndian.Uint32(data)
+	origSize := binary.LittleEndian.Uint32(data[4:])
+	if uint64(compSize) > uint64(len(data)-efiHeaderSize) {
+		return nil, fmt.Errorf("%s compressed size %v too large, %v bytes available", c.Name(), compSize, len(data)-efiHeaderSize)
+	}
+	r := bitReader{buf: data[efiHeaderSize : efiHeaderSize+compSize]}
+	out := make([]byte, 0, origSize)
+	var (
+		blockSize  int
+		cDec, pDec *huffmanDecoder
+	)
+	for uint32(len(out)) < origSize {
+		if r.overrun() {
+			return nil, errCorrupted
+		}
+		if blockSize == 0 {
+			blockSize = int(r.read(16))
+			tDec, err := readPTLen(&r, efiNT, efiTBit, 3)
+			if err != nil {
+				return nil, err
+			}
+			if cDec, err = readCLen(&r, tDec); err != nil {
+				return nil, err
+			}
+			if pDec, err = readPTLen(&r, efiMaxNP, c.pbit, -1); err != nil {
+				return nil, err
+			}
+		}
+		blockSize--
+		sym, err := cDec.decode(&r)
+		if err != nil {
+			return nil, err
+		}
+		if sym < 256 {
+			out = append(out, byte(sym))
+			continue
+		}
+		length := sym - (0xff + 1 - efiThreshold)
+		pcode, err := pDec.decode(&r)
+		if err != nil {
+			return nil, err
+		}
+		pos := pcode
+		if pcode > 1 {
+			pos = 1<<uint(pcode-1) + int(r.read(uint(pcode-1)))
+		}
+		src := len(out) - pos - 1
+		if src < 0 {
+			return nil, errCorrupted
+		}
+		for i := 0; i < length && uint32(len(out)) < origSize; i++ {
+			out = append(out, out[src+i])
+		}
+	}
+	return out, nil
+}
+
+// efiToken is a literal, or a match if length is not zero
+type efiToken struct {
+	literal  byte
+	length   int
+	distance int
+}
+
+// matchFinder finds repeated sequences with hash chains. It is shared with
+// the LZMA encoder.
+type matchFinder struct {
+	data     []byte
+	window   int
+	maxMatch int
+	head     []int
+	prev     []int
+}
+
+// Match finder constants
+const (
+	hashBits = 16
+	// maxChain limits the number of candidates examined for each position
+	maxChain = 64
+)
+
+func newMatchFinder(data []byte, window, maxMatch int) *matchFinder {
+	head := make([]int, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	return &matchFinder{data: data, window: window, maxMatch: maxMatch, head: head, prev: make([]int, len(data))}
+}
+
+// hash returns the hash of the 3 bytes at pos
+func (m *matchFinder) hash(pos int) uint32 {
+	v := uint32(m.data[pos]) | uint32(m.data[pos+1])<<8 | uint32(m.data[pos+2])<<16
+	return (v * 2654435761) >> (32 - hashBits)
+}
+
+// insert adds pos to the hash chains
+func (m *matchFinder) insert(pos int) {
+	if pos+3 > len(m.data) {
+		return
+	}
+	h := m.hash(pos)
+	m.prev[pos] = m.head[h]
+	m.head[h] = pos
+}
+
+// find returns the longest match for the data at pos, which must not have
+// been inserted yet, as length and distance. The length is 0 if there is no
+// match of at least 3 bytes.
+func (m *matchFinder) find(pos int) (int, int) {
+	if pos+3 > len(m.data) {
+		return 0, 0
+	}
+	p := m.head[m.hash(pos)]
+	maxLen := len(m.data) - pos
+	if maxLen > m.maxMatch {
+		maxLen = m.maxMatch
+	}
+	bestLen, bestDist := 0, 0
+	for chain := 0; p >= 0 && pos-p <= m.window && chain < maxChain; chain++ {
+		l := 0
+		for l < maxLen && m.data[p+l] == m.data[pos+l] {
+			l++
+		}
+		if l > bestLen {
+			bestLen, bestDist = l, pos-p
+			if l == maxLen {
+				break
+			}
+		}
+		p = m.prev[p]
+	}
+	if bestLen < 3 {
+		return 0, 0
+	}
+	return bestLen, bestDist
+}
+
+// efiPositionCode returns the position code and the extra bits of a match
+// position, which is the distance minus one.
+func efiPositionCode(pos int) (int, uint32, uint) {
+	if pos <= 1 {
+		return pos, 0, 0
+	}
+	code := 0
+	for v := pos; v != 0; v >>= 1 {
+		code++
+	}
+	return code, uint32(pos) - 1<<uint(code-1), uint(code - 1)
+}
+
+// writePTLen writes the code lengths of the position or extra sets
+func writePTLen(w *bitWriter, lengths []uint8, nbit uint, special int) {
+	number := len(lengths)
+	for number > 0 && lengths[number-1] == 0 {
+		number--
+	}
+	w.write(uint32(number), nbit)
+	for i := 0; i < number; {
+		l := uint32(lengths[i])
+		if l < 7 {
+			w.write(l, 3)
+		} else {
+			// 7 followed by l-7 ones and a zero
+			w.write(7, 3)
+			for ; l > 7; l-- {
+				w.write(1, 1)
+			}
+			w.write(0, 1)
+		}
+		i++
+		if i == special {
+			zeros := 0
+			for zeros < 3 && i+zeros < number && lengths[i+zeros] == 0 {
+				zeros++
+			}
+			w.write(uint32(zeros), 2)
+			i += zeros
+		}
+	}
+}
+
+// symbolLengths returns the code lengths for the given frequencies, or the
+// only used symbol if there are less than two of them.
+func symbolLengths(freq []uint32) ([]uint8, int) {
+	used, last := 0, 0
+	for sym, f := range freq {
+		if f > 0 {
+			used++
+			last = sym
+		}
+	}
+	if used < 2 {
+		return nil, last
+	}
+	return huffmanLengths(freq, 16), -1
+}
+
+// encodeBlock writes a block of tokens
+func (c efiCompressor) encodeBlock(w *bitWriter, tokens []efiToken) {
+	cFreq := make([]uint32, efiNC)
+	pFreq := make([]uint32, efiMaxNP)
+	for _, t := range tokens {
+		if t.length == 0 {
+			cFreq[t.literal]++
+			continue
+		}
+		cFreq[t.length+0xff+1-efiThreshold]++
+		p, _, _ := efiPositionCode(t.distance - 1)
+		pFreq[p]++
+	}
+	w.write(uint32(len(tokens)), 16)
+
+	cLengths, cSingle := symbolLengths(cFreq)
+	if cLengths == nil {
+		// a single char/length symbol: empty extra set, then the symbol
+		w.write(0, efiTBit)
+		w.write(0, efiTBit)
+		w.write(0, efiCBit)
+		w.write(uint32(cSingle), efiCBit)
+	} else {
+		// the char/length code lengths are encoded with the extra set
+		number := len(cLengths)
+		for number > 0 && cLengths[number-1] == 0 {
+			number--
+		}
+		type tSym struct {
+			sym   int
+			extra uint32
+			nbits uint
+		}
+		var tSyms []tSym
+		for i := 0; i < number; {
+			if cLengths[i] != 0 {
+				tSyms = append(tSyms, tSym{int(cLengths[i]) + 2, 0, 0})
+				i++
+				continue
+			}
+			run := 0
+			for i+run < number && cLengths[i+run] == 0 {
+				run++
+			}
+			i += run
+			for run > 0 {
+				switch {
+				case run <= 2:
+					tSyms = append(tSyms, tSym{0, 0, 0})
+					run--
+				case run <= 18:
+					tSyms = append(tSyms, tSym{1, uint32(run - 3), 4})
+					run = 0
+				case run == 19:
+					tSyms = append(tSyms, tSym{0, 0, 0}, tSym{1, 15, 4})
+					run = 0
+				default:
+					n := run
+					if n > 20+511 {
+						n = 20 + 511
+					}
+					tSyms = append(tSyms, tSym{2, uint32(n - 20), efiCBit})
+					run -= n
+				}
+			}
+		}
+		tFreq := make([]uint32, efiNT)
+		for _, t := range tSyms {
+			tFreq[t.sym]++
+		}
+		tLengths, tSingle := symbolLengths(tFreq)
+		var tCodes []uint32
+		if tLengths == nil {
+			w.write(0, efiTBit)
+			w.write(uint32(tSingle), efiTBit)
+		} else {
+			writePTLen(w, tLengths, efiTBit, 3)
+			tCodes = huffmanCodes(tLengths)
+		}
+		w.write(uint32(number), efiCBit)
+		for _, t := range tSyms {
+			if tLengths != nil {
+				w.write(tCodes[t.sym], uint(tLengths[t.sym]))
+			}
+			w.write(t.extra, t.nbits)
+		}
+	}
+
+	pLengths, pSingle := symbolLengths(pFreq)
+	var pCodes []uint32
+	if pLengths == nil {
+		w.write(0, c.pbit)
+		w.write(uint32(pSingle), c.pbit)
+	} else {
+		writePTLen(w, pLengths, c.pbit, -1)
+		pCodes = huffmanCodes(pLengths)
+	}
+
+	var cCodes []uint32
+	if cLengths != nil {
+		cCodes = huffmanCodes(cLengths)
+	}
+	for _, t := range tokens {
+		sym := int(t.literal)
+		if t.length != 0 {
+			sym = t.length + 0xff + 1 - efiThreshold
+		}
+		if cLengths != nil {
+			w.write(cCodes[sym], uint(cLengths[sym]))
+		}
+		if t.length == 0 {
+			continue
+		}
+		p, extra, nbits := efiPositionCode(t.distance - 1)
+		if pLengths != nil {
+			w.write(pCodes[p], uint(pLengths[p]))
+		}
+		w.write(extra, nbits)
+	}
+}
+
+// Encode compresses data, prefixed by the compressed and original sizes
+func (c efiCompressor) Encode(data []byte) ([]byte, error) {
+	if uint64(len(data)) > 0xffffffff {
+		return nil, fmt.Errorf("%s: data too large", c.Name())
+	}
+	// the largest position is limited by the number of position codes that
+	// can be stored in pbit bits
+	window := 1 << c.windowBits
+	mf := newMatchFinder(data, window, efiMaxMatch)
+	var tokens []efiToken
+	for pos := 0; pos < len(data); {
+		length, distance := mf.find(pos)
+		if length == 0 {
+			tokens = append(tokens, efiToken{literal: data[pos]})
+			mf.insert(pos)
+			pos++
+			continue
+		}
+		tokens = append(tokens, efiToken{length: length, distance: distance})
+		for end := pos + length; pos < end; pos++ {
+			mf.insert(pos)
+		}
+	}
+	var w bitWriter
+	for len(tokens) > 0 {
+		n := len(tokens)
+		if n > efiMaxBlock {
+			n = efiMaxBlock
+		}
+		c.encodeBlock(&w, tokens[:n])
+		tokens = tokens[n:]
+	}
+	body := w.flush()
+	out := make([]byte, efiHeaderSize, efiHeaderSize+len(body))
+	binary.LittleEndian.PutUint32(out, uint32(len(body)))
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(data)))
+	return append(out, body...), nil
+}
@@ -0,0 +1,240 @@
+package compression
+
+import (
+	"errors"
+	"sort"
+)
+
+var errCorrupted = errors.New("Corrupted compressed data")
+
+// bitReader reads bits MSB-first. Reading past the end returns zeros, like
+// the reference decoder does.
+type bitReader struct {
+	buf   []byte
+	pos   int
+	bits  uint64
+	nbits uint
+}
+
+func (r *bitReader) fill(n uint) {
+	for r.nbits < n {
+		var b byte
+		if r.pos < len(r.buf) {
+			b = r.buf[r.pos]
+		}
+		r.pos++
+		r.bits = r.bits<<8 | uint64(b)
+		r.nbits += 8
+	}
+}
+
+// peek returns the next n bits without consuming them
+func (r *bitReader) peek(n uint) uint32 {
+	r.fill(n)
+	return uint32(r.bits>>(r.nbits-n)) & (1<<n - 1)
+}
+
+func (r *bitReader) read(n uint) uint32 {
+	if n == 0 {
+		return 0
+	}
+	v := r.peek(n)
+	r.nbits -= n
+	return v
+}
+
+// overrun returns whether the reader went past the end of the data
+func (r *bitReader) overrun() bool {
+	return r.pos > len(r.buf)+8
+}
+
+// bitWriter writes bits MSB-first
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nbits uint
+}
+
+func (w *bitWriter) write(v uint32, n uint) {
+	w.bits = w.bits<<n | uint64(v)&(1<<n-1)
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.bits>>(w.nbits-8)))
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.write(0, 8-w.nbits)
+	}
+	return w.buf
+}
+
+// huffmanDecoder decodes canonical Huffman codes, assigned in order of length
+// and then of symbol. A decoder with a single symbol and no lengths decodes
+// that symbol without reading any bits.
+type huffmanDecoder struct {
+	count  [17]uint16
+	symbol []uint16
+	single int
+}
+
+func newHuffmanDecoder(lengths []uint8) (*huffmanDecoder, error) {
+	d := huffmanDecoder{single: -1}
+	for _, l := range lengths {
+		if l > 16 {
+			return nil, errCorrupted
+		}
+		d.count[l]++
+	}
+	// the code must be complete
+	left := 1
+	for l := 1; l <= 16; l++ {
+		left = left<<1 - int(d.count[l])
+		if left < 0 {
+			return nil, errCorrupted
+		}
+	}
+	if left != 0 {
+		return nil, errCorrupted
+	}
+	for l := 1; l <= 16; l++ {
+		for sym, sl := range lengths {
+			if int(sl) == l {
+				d.symbol = append(d.symbol, uint16(sym))
+			}
+		}
+	}
+	return &d, nil
+}
+
+func newSingleDecoder(symbol int) *huffmanDecoder {
+	return &huffmanDecoder{single: symbol}
+}
+
+func (d *huffmanDecoder) decode(r *bitReader) (int, error) {
+	if d.single >= 0 {
+		return d.single, nil
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l <= 16; l++ {
+		code |= int(r.read(1))
+		count := int(d.count[l])
+		if code-count < first {
+			return int(d.symbol[index+code-first]), nil
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	return 0, errCorrupted
+}
+
+// huffmanLengths returns the code lengths of an optimal prefix code for the
+// given frequencies, limited to maxBits. Symbols with zero frequency get a
+// zero length. At least two symbols must have a non-zero frequency.
+func huffmanLengths(freq []uint32, maxBits int) []uint8 {
+	type node struct {
+		weight      uint64
+		left, right int
+	}
+	var nodes []node
+	var leaves []int
+	for sym, f := range freq {
+		if f > 0 {
+			nodes = append(nodes, node{uint64(f), -1, sym})
+			leaves = append(leaves, len(nodes)-1)
+		}
+	}
+	// sort the leaves by weight, then by symbol, so the result is stable
+	sort.SliceStable(leaves, func(i, j int) bool {
+		return nodes[leaves[i]].weight < nodes[leaves[j]].weight
+	})
+	// two-queue construction
+	var merged []int
+	pop := func() int {
+		if len(merged) == 0 || (len(leaves) > 0 && nodes[leaves[0]].weight <= nodes[merged[0]].weight) {
+			n := leaves[0]
+			leaves = leaves[1:]
+			return n
+		}
+		n := merged[0]
+		merged = merged[1:]
+		return n
+	}
+	for len(leaves)+len(merged) > 1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{nodes[a].weight + nodes[b].weight, a, b})
+		merged = append(merged, len(nodes)-1)
+	}
+	// compute the depth of the leaves
+	depth := make([]int, len(freq))
+	var walk func(n, d int)
+	walk = func(n, d int) {
+		if nodes[n].left == -1 {
+			depth[nodes[n].right] = d
+			return
+		}
+		walk(nodes[n].left, d+1)
+		walk(nodes[n].right, d+1)
+	}
+	walk(merged[0], 0)
+	// count the codes of each length, then limit them to maxBits with the
+	// algorithm described in the JPEG specification, annex K.3
+	bits := make([]int, len(freq)+1)
+	var syms []int
+	for sym, f := range freq {
+		if f > 0 {
+			bits[depth[sym]]++
+			syms = append(syms, sym)
+		}
+	}
+	for i := len(bits) - 1; i > maxBits; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// assign the shortest lengths to the most frequent symbols
+	sort.SliceStable(syms, func(i, j int) bool {
+		return freq[syms[i]] > freq[syms[j]]
+	})
+	lengths := make([]uint8, len(freq))
+	l := 1
+	for _, sym := range syms {
+		for bits[l] == 0 {
+			l++
+		}
+		lengths[sym] = uint8(l)
+		bits[l]--
+	}
+	return lengths
+}
+
+// huffmanCodes returns the canonical codes for the given lengths
+func huffmanCodes(lengths []uint8) []uint32 {
+	var count [17]uint32
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [18]uint32
+	for l := 1; l <= 16; l++ {
+		next[l+1] = (next[l] + count[l]) << 1
+	}
+	codes := make([]uint32, len(lengths))
+	for sym, l := range lengths {
+		if l != 0 {
+			codes[sym] = next[l]
+			next[l]++
+		}
+	}
+	return codes
+}
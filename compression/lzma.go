@@ -0,0 +1,577 @@
+package compression
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// LZMA constants, as defined by the LZMA SDK
+const (
+	lzmaHeaderSize      = 13
+	lzmaNumStates       = 12
+	lzmaPosBitsMax      = 4
+	lzmaLenToPosStates  = 4
+	lzmaNumAlignBits    = 4
+	lzmaStartPosModel   = 4
+	lzmaEndPosModel     = 14
+	lzmaNumFullDists    = 1 << (lzmaEndPosModel >> 1)
+	lzmaMatchMinLen     = 2
+	lzmaMatchMaxLen     = 273
+	lzmaProbInit        = 1 << 10
+	lzmaTopValue        = 1 << 24
+	lzmaNumBitModelBits = 11
+	lzmaMoveBits        = 5
+
+	// encoder settings, matching the defaults used by EDK2
+	lzmaLC       = 3
+	lzmaLP       = 0
+	lzmaPB       = 2
+	lzmaDictSize = 1 << 23
+)
+
+type lzmaCompressor struct{}
+
+func (lzmaCompressor) Name() string {
+	return "LZMA"
+}
+
+// lenCoder holds the probabilities used to code match lengths
+type lenCoder struct {
+	choice  uint16
+	choice2 uint16
+	low     [1 << lzmaPosBitsMax][1 << 3]uint16
+	mid     [1 << lzmaPosBitsMax][1 << 3]uint16
+	high    [1 << 8]uint16
+}
+
+// lzmaModel holds the probabilities shared by the encoder and the decoder
+type lzmaModel struct {
+	lc, lp, pb uint
+	literal    []uint16
+	isMatch    [lzmaNumStates << lzmaPosBitsMax]uint16
+	isRep      [lzmaNumStates]uint16
+	isRepG0    [lzmaNumStates]uint16
+	isRepG1    [lzmaNumStates]uint16
+	isRepG2    [lzmaNumStates]uint16
+	isRep0Long [lzmaNumStates << lzmaPosBitsMax]uint16
+	posSlot    [lzmaLenToPosStates][1 << 6]uint16
+	// posSpecial is shifted by one compared to the LZMA SDK, so that slot 4
+	// does not need a negative offset
+	posSpecial [1 + lzmaNumFullDists - lzmaEndPosModel]uint16
+	align      [1 << lzmaNumAlignBits]uint16
+	lenCoder   lenCoder
+	repLen     lenCoder
+}
+
+func initProbs(probs []uint16) {
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+}
+
+func (l *lenCoder) init() {
+	l.choice, l.choice2 = lzmaProbInit, lzmaProbInit
+	for i := range l.low {
+		initProbs(l.low[i][:])
+		initProbs(l.mid[i][:])
+	}
+	initProbs(l.high[:])
+}
+
+func newLZMAModel(lc, lp, pb uint) *lzmaModel {
+	m := lzmaModel{lc: lc, lp: lp, pb: pb, literal: make([]uint16, 0x300<<(lc+lp))}
+	initProbs(m.literal)
+	initProbs(m.isMatch[:])
+	initProbs(m.isRep[:])
+	initProbs(m.isRepG0[:])
+	initProbs(m.isRepG1[:])
+	initProbs(m.isRepG2[:])
+	initProbs(m.isRep0Long[:])
+	for i := range m.posSlot {
+		initProbs(m.posSlot[i][:])
+	}
+	initProbs(m.posSpecial[:])
+	initProbs(m.align[:])
+	m.lenCoder.init()
+	m.repLen.init()
+	return &m
+}
+
+// literalProbs returns the probabilities for the literal at pos
+func (m *lzmaModel) literalProbs(pos uint64, prev byte) []uint16 {
+	lpMask := uint64(1)<<m.lp - 1
+	idx := ((pos & lpMask) << m.lc) + uint64(prev>>(8-m.lc))
+	return m.literal[0x300*idx : 0x300*(idx+1)]
+}
+
+// State transitions
+func stateAfterLiteral(s int) int {
+	switch {
+	case s < 4:
+		return 0
+	case s < 10:
+		return s - 3
+	}
+	return s - 6
+}
+
+func stateAfterMatch(s int) int {
+	if s < 7 {
+		return 7
+	}
+	return 10
+}
+
+func stateAfterRep(s int) int {
+	if s < 7 {
+		return 8
+	}
+	return 11
+}
+
+func stateAfterShortRep(s int) int {
+	if s < 7 {
+		return 9
+	}
+	return 11
+}
+
+func lenToPosState(length int) int {
+	if length-lzmaMatchMinLen < lzmaLenToPosStates {
+		return length - lzmaMatchMinLen
+	}
+	return lzmaLenToPosStates - 1
+}
+
+// rangeDecoder decodes the LZMA range coded bits
+type rangeDecoder struct {
+	buf   []byte
+	pos   int
+	rng   uint32
+	code  uint32
+	extra int
+}
+
+func newRangeDecoder(buf []byte) (*rangeDecoder, error) {
+	if len(buf) < 5 || buf[0] != 0 {
+		return nil, errCorrupted
+	}
+	d := rangeDecoder{buf: buf, pos: 5, rng: 0xffffffff}
+	d.code = binary.BigEndian.Uint32(buf[1:])
+	return &d, nil
+}
+
+func (d *rangeDecoder) next() byte {
+	if d.pos < len(d.buf) {
+		d.pos++
+		return d.buf[d.pos-1]
+	}
+	d.extra++
+	return 0
+}
+
+func (d *rangeDecoder) normalize() {
+	if d.rng < lzmaTopValue {
+		d.rng <<= 8
+		d.code = d.code<<8 | uint32(d.next())
+	}
+}
+
+func (d *rangeDecoder) bit(prob *uint16) uint32 {
+	bound := (d.rng >> lzmaNumBitModelBits) * uint32(*prob)
+	var b uint32
+	if d.code < bound {
+		d.rng = bound
+		*prob += (1<<lzmaNumBitModelBits - *prob) >> lzmaMoveBits
+	} else {
+		d.code -= bound
+		d.rng -= bound
+		*prob -= *prob >> lzmaMoveBits
+		b = 1
+	}
+	d.normalize()
+	return b
+}
+
+func (d *rangeDecoder) direct(n uint) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		d.rng >>= 1
+		var b uint32
+		if d.code >= d.rng {
+			d.code -= d.rng
+			b = 1
+		}
+		v = v<<1 | b
+		d.normalize()
+	}
+	return v
+}
+
+func (d *rangeDecoder) tree(probs []uint16, n uint) uint32 {
+	m := uint32(1)
+	for i := uint(0); i < n; i++ {
+		m = m<<1 | d.bit(&probs[m])
+	}
+	return m - 1<<n
+}
+
+func (d *rangeDecoder) reverseTree(probs []uint16, n uint) uint32 {
+	m, v := uint32(1), uint32(0)
+	for i := uint(0); i < n; i++ {
+		b := d.bit(&probs[m])
+		m = m<<1 | b
+		v |= b << i
+	}
+	return v
+}
+
+func (d *rangeDecoder) length(l *lenCoder, posState uint64) int {
+	if d.bit(&l.choice) == 0 {
+		return int(d.tree(l.low[posState][:], 3)) + lzmaMatchMinLen
+	}
+	if d.bit(&l.choice2) == 0 {
+		return int(d.tree(l.mid[posState][:], 3)) + lzmaMatchMinLen + 8
+	}
+	return int(d.tree(l.high[:], 8)) + lzmaMatchMinLen + 16
+}
+
+// distance decodes the distance of a match, minus one
+func (d *rangeDecoder) distance(m *lzmaModel, length int) uint32 {
+	slot := d.tree(m.posSlot[lenToPosState(length)][:], 6)
+	if slot < lzmaStartPosModel {
+		return slot
+	}
+	footerBits := uint(slot>>1) - 1
+	dist := (2 | slot&1) << footerBits
+	if slot < lzmaEndPosModel {
+		return dist + d.reverseTree(m.posSpecial[dist-slot:], footerBits)
+	}
+	dist += d.direct(footerBits-lzmaNumAlignBits) << lzmaNumAlignBits
+	return dist + d.reverseTree(m.align[:], lzmaNumAlignBits)
+}
+
+// Decode decompresses data starting with the LZMA header: the properties,
+// the dictionary size and the uncompressed size.
+func (lzmaCompressor) Decode(data []byte) ([]byte, error) {
+	if len(data) < lzmaHeaderSize {
+		return nil, fmt.Errorf("LZMA data too short: %v bytes", len(data))
+	}
+	props := uint(data[0])
+	if props >= 9*5*5 {
+		return nil, fmt.Errorf("Invalid LZMA properties 0x%02x", props)
+	}
+	m := newLZMAModel(props%9, props/9%5, props/45)
+	size := binary.LittleEndian.Uint64(data[5:])
+	knownSize := size != 0xffffffffffffffff
+	d, err := newRangeDecoder(data[lzmaHeaderSize:])
+	if err != nil {
+		return nil, err
+	}
+	var (
+		out   []byte
+		state int
+		reps  [4]uint32
+	)
+	if knownSize && size <= lzmaDictSize {
+		out = make([]byte, 0, size)
+	}
+	pbMask := uint64(1)<<m.pb - 1
+	for !knownSize || uint64(len(out)) < size {
+		if d.extra > 4 {
+			return nil, errCorrupted
+		}
+		pos := uint64(len(out))
+		posState := pos & pbMask
+		if d.bit(&m.isMatch[state<<lzmaPosBitsMax+int(posState)]) == 0 {
+			var prev byte
+			if pos > 0 {
+				prev = out[pos-1]
+			}
+			probs := m.literalProbs(pos, prev)
+			symbol := uint32(1)
+			if state >= 7 {
+				if uint64(reps[0]) >= pos {
+					return nil, errCorrupted
+				}
+				matchByte := uint32(out[pos-uint64(reps[0])-1])
+				offs := uint32(0x100)
+				for symbol < 0x100 {
+					matchByte <<= 1
+					b := matchByte & offs
+					bit := d.bit(&probs[offs+b+symbol])
+					symbol = symbol<<1 | bit
+					if bit == 0 {
+						offs &^= b
+					} else {
+						offs &= b
+					}
+				}
+			} else {
+				for symbol < 0x100 {
+					symbol = symbol<<1 | d.bit(&probs[symbol])
+				}
+			}
+			out = append(out, byte(symbol))
+			state = stateAfterLiteral(state)
+			continue
+		}
+		var length int
+		if d.bit(&m.isRep[state]) == 0 {
+			length = d.length(&m.lenCoder, posState)
+			dist := d.distance(m, length)
+			if dist == 0xffffffff {
+				// end marker
+				break
+			}
+			reps[3], reps[2], reps[1], reps[0] = reps[2], reps[1], reps[0], dist
+			state = stateAfterMatch(state)
+		} else {
+			if pos == 0 {
+				return nil, errCorrupted
+			}
+			if d.bit(&m.isRepG0[state]) == 0 {
+				if d.bit(&m.isRep0Long[state<<lzmaPosBitsMax+int(posState)]) == 0 {
+					// short rep: a single byte at distance rep0
+					if uint64(reps[0]) >= pos {
+						return nil, errCorrupted
+					}
+					state = stateAfterShortRep(state)
+					out = append(out, out[pos-uint64(reps[0])-1])
+					continue
+				}
+			} else {
+				var dist uint32
+				if d.bit(&m.isRepG1[state]) == 0 {
+					dist = reps[1]
+				} else {
+					if d.bit(&m.isRepG2[state]) == 0 {
+						dist = reps[2]
+					} else {
+						dist = reps[3]
+						reps[3] = reps[2]
+					}
+					reps[2] = reps[1]
+				}
+				reps[1] = reps[0]
+				reps[0] = dist
+			}
+			length = d.length(&m.repLen, posState)
+			state = stateAfterRep(state)
+		}
+		if uint64(reps[0]) >= pos {
+			return nil, errCorrupted
+		}
+		src := pos - uint64(reps[0]) - 1
+		for i := 0; i < length && (!knownSize || uint64(len(out)) < size); i++ {
+			out = append(out, out[src+uint64(i)])
+		}
+	}
+	return out, nil
+}
+
+// rangeEncoder encodes bits with the LZMA range coder
+type rangeEncoder struct {
+	out       []byte
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+}
+
+func newRangeEncoder() *rangeEncoder {
+	return &rangeEncoder{rng: 0xffffffff, cacheSize: 1}
+}
+
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xff000000 || e.low>>32 != 0 {
+		carry := byte(e.low >> 32)
+		temp := e.cache
+		for ; e.cacheSize > 0; e.cacheSize-- {
+			e.out = append(e.out, temp+carry)
+			temp = 0xff
+		}
+		e.cache = byte(e.low >> 24)
+	}
+	e.cacheSize++
+	e.low = (e.low & 0x00ffffff) << 8
+}
+
+func (e *rangeEncoder) bit(prob *uint16, b uint32) {
+	bound := (e.rng >> lzmaNumBitModelBits) * uint32(*prob)
+	if b == 0 {
+		e.rng = bound
+		*prob += (1<<lzmaNumBitModelBits - *prob) >> lzmaMoveBits
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+		*prob -= *prob >> lzmaMoveBits
+	}
+	for e.rng < lzmaTopValue {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+func (e *rangeEncoder) direct(v uint32, n uint) {
+	for n > 0 {
+		n--
+		e.rng >>= 1
+		if (v>>n)&1 != 0 {
+			e.low += uint64(e.rng)
+		}
+		for e.rng < lzmaTopValue {
+			e.rng <<= 8
+			e.shiftLow()
+		}
+	}
+}
+
+func (e *rangeEncoder) tree(probs []uint16, n uint, v uint32) {
+	m := uint32(1)
+	for n > 0 {
+		n--
+		b := (v >> n) & 1
+		e.bit(&probs[m], b)
+		m = m<<1 | b
+	}
+}
+
+func (e *rangeEncoder) reverseTree(probs []uint16, n uint, v uint32) {
+	m := uint32(1)
+	for i := uint(0); i < n; i++ {
+		b := v & 1
+		v >>= 1
+		e.bit(&probs[m], b)
+		m = m<<1 | b
+	}
+}
+
+func (e *rangeEncoder) flush() []byte {
+	for i := 0; i < 5; i++ {
+		e.shiftLow()
+	}
+	return e.out
+}
+
+func (e *rangeEncoder) length(l *lenCoder, posState uint64, length int) {
+	length -= lzmaMatchMinLen
+	switch {
+	case length < 8:
+		e.bit(&l.choice, 0)
+		e.tree(l.low[posState][:], 3, uint32(length))
+	case length < 16:
+		e.bit(&l.choice, 1)
+		e.bit(&l.choice2, 0)
+		e.tree(l.mid[posState][:], 3, uint32(length-8))
+	default:
+		e.bit(&l.choice, 1)
+		e.bit(&l.choice2, 1)
+		e.tree(l.high[:], 8, uint32(length-16))
+	}
+}
+
+// posSlot returns the slot of a distance minus one
+func posSlot(dist uint32) uint32 {
+	if dist < lzmaStartPosModel {
+		return dist
+	}
+	n := uint32(31)
+	for dist>>n == 0 {
+		n--
+	}
+	return n<<1 | (dist>>(n-1))&1
+}
+
+func (e *rangeEncoder) distance(m *lzmaModel, length int, dist uint32) {
+	slot := posSlot(dist)
+	e.tree(m.posSlot[lenToPosState(length)][:], 6, slot)
+	if slot < lzmaStartPosModel {
+		return
+	}
+	footerBits := uint(slot>>1) - 1
+	base := (2 | slot&1) << footerBits
+	reduced := dist - base
+	if slot < lzmaEndPosModel {
+		e.reverseTree(m.posSpecial[base-slot:], footerBits, reduced)
+		return
+	}
+	e.direct(reduced>>lzmaNumAlignBits, footerBits-lzmaNumAlignBits)
+	e.reverseTree(m.align[:], lzmaNumAlignBits, reduced&(1<<lzmaNumAlignBits-1))
+}
+
+// Encode compresses data with the LZMA header used by EDK2: lc=3, lp=0, pb=2,
+// with the uncompressed size and no end marker. Only literals, matches and
+// repeated matches at the last distance are emitted.
+func (lzmaCompressor) Encode(data []byte) ([]byte, error) {
+	m := newLZMAModel(lzmaLC, lzmaLP, lzmaPB)
+	e := newRangeEncoder()
+	mf := newMatchFinder(data, lzmaDictSize, lzmaMatchMaxLen)
+	pbMask := uint64(1)<<lzmaPB - 1
+	var (
+		state int
+		rep0  uint32
+	)
+	for pos := 0; pos < len(data); {
+		posState := uint64(pos) & pbMask
+		length, distance := mf.find(pos)
+		// check for a match at the last distance, which is cheaper
+		repLen := 0
+		if pos > int(rep0) {
+			src := pos - int(rep0) - 1
+			for pos+repLen < len(data) && repLen < lzmaMatchMaxLen && data[src+repLen] == data[pos+repLen] {
+				repLen++
+			}
+		}
+		switch {
+		case repLen >= lzmaMatchMinLen && repLen+1 >= length:
+			e.bit(&m.isMatch[state<<lzmaPosBitsMax+int(posState)], 1)
+			e.bit(&m.isRep[state], 1)
+			e.bit(&m.isRepG0[state], 0)
+			e.bit(&m.isRep0Long[state<<lzmaPosBitsMax+int(posState)], 1)
+			e.length(&m.repLen, posState, repLen)
+			state = stateAfterRep(state)
+			length = repLen
+		case length != 0:
+			e.bit(&m.isMatch[state<<lzmaPosBitsMax+int(posState)], 1)
+			e.bit(&m.isRep[state], 0)
+			e.length(&m.lenCoder, posState, length)
+			rep0 = uint32(distance - 1)
+			e.distance(m, length, rep0)
+			state = stateAfterMatch(state)
+		default:
+			e.bit(&m.isMatch[state<<lzmaPosBitsMax+int(posState)], 0)
+			var prev byte
+			if pos > 0 {
+				prev = data[pos-1]
+			}
+			probs := m.literalProbs(uint64(pos), prev)
+			symbol := uint32(data[pos]) | 0x100
+			if state >= 7 {
+				matchByte := uint32(data[pos-int(rep0)-1])
+				offs := uint32(0x100)
+				for symbol < 0x10000 {
+					matchByte <<= 1
+					e.bit(&probs[offs+(matchByte&offs)+(symbol>>8)], (symbol>>7)&1)
+					symbol <<= 1
+					offs &^= matchByte ^ symbol
+				}
+			} else {
+				for symbol < 0x10000 {
+					e.bit(&probs[symbol>>8], (symbol>>7)&1)
+					symbol <<= 1
+				}
+			}
+			state = stateAfterLiteral(state)
+			length = 1
+		}
+		for end := pos + length; pos < end; pos++ {
+			mf.insert(pos)
+		}
+	}
+	out := make([]byte, lzmaHeaderSize)
+	out[0] = byte((lzmaPB*5+lzmaLP)*9 + lzmaLC)
+	binary.LittleEndian.PutUint32(out[1:], lzmaDictSize)
+	binary.LittleEndian.PutUint64(out[5:], uint64(len(data)))
+	return append(out, e.flush()...), nil
+}
@@ -0,0 +1,169 @@
+// libuefi exposes the parser as a C shared library, so that it can be used
+// from other languages. All the functions take the raw image and an optional
+// JSON string of options, and return a JSON string that must be released with
+// uefi_free.
+//
+// Build it with:
+//
+//	go build -buildmode=c-shared -o libuefi.so ./libuefi
+//
+// Supported options: {"permissive": true} to enable the permissive parse
+// mode, {"redact": "nvram,mac"} to redact the image as described in
+// uefi.NewRedactionPolicy, and {"offset": N} for uefi_extract.
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+
+	"github.com/insomniacslk/uefi/uefi"
+)
+
+type options struct {
+	Permissive bool   `json:"permissive"`
+	Offset     uint64 `json:"offset"`
+	Redact     string `json:"redact"`
+}
+
+type parseResult struct {
+	Summary string     `json:"summary,omitempty"`
+	Tree    *uefi.Node `json:"tree,omitempty"`
+	Errors  []string   `json:"errors"`
+}
+
+type extractResult struct {
+	Path []*uefi.Node `json:"path"`
+	// Data is the content of the deepest node, base64-encoded by encoding/json
+	Data []byte `json:"data"`
+}
+
+type errorResult struct {
+	Error string `json:"error"`
+}
+
+// toJSON marshals v into a C string allocated with malloc
+func toJSON(v interface{}) *C.char {
+	out, err := json.Marshal(v)
+	if err != nil {
+		out, _ = json.Marshal(errorResult{Error: err.Error()})
+	}
+	return C.CString(string(out))
+}
+
+func errorsToStrings(errs []error) []string {
+	s := make([]string, 0, len(errs))
+	for _, err := range errs {
+		s = append(s, err.Error())
+	}
+	return s
+}
+
+// parse decodes the options and parses the image, in the parse mode of the
+// options whatever the other callers use
+func parse(data *C.char, length C.int, opts *C.char) (uefi.Firmware, []byte, *options, error) {
+	var o options
+	if opts != nil {
+		if err := json.Unmarshal([]byte(C.GoString(opts)), &o); err != nil {
+			return nil, nil, nil, fmt.Errorf("Invalid options: %v", err)
+		}
+	}
+	mode := uefi.ParseStrict
+	if o.Permissive {
+		mode = uefi.ParsePermissive
+	}
+	buf := C.GoBytes(unsafe.Pointer(data), length)
+	var (
+		fw  uefi.Firmware
+		err error
+	)
+	uefi.WithParseMode(mode, func() {
+		fw, buf, err = parseImage(buf, o)
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return fw, buf, &o, nil
+}
+
+// parseImage parses buf, and redacts it if requested by the options
+func parseImage(buf []byte, o options) (uefi.Firmware, []byte, error) {
+	fw, err := uefi.Parse(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if image, ok := fw.(*uefi.FlashImage); ok && o.Redact != "" {
+		if image, err = image.Redacted(uefi.NewRedactionPolicy(o.Redact)); err != nil {
+			return nil, nil, err
+		}
+		if buf, err = image.MarshalBinary(); err != nil {
+			return nil, nil, err
+		}
+		fw = image
+	}
+	return fw, buf, nil
+}
+
+//export uefi_parse
+func uefi_parse(data *C.char, length C.int, opts *C.char) *C.char {
+	fw, _, _, err := parse(data, length, opts)
+	if err != nil {
+		return toJSON(errorResult{Error: err.Error()})
+	}
+	res := parseResult{
+		Summary: fw.Summary(),
+		Errors:  errorsToStrings(fw.Validate()),
+	}
+	if image, ok := fw.(*uefi.FlashImage); ok {
+		res.Tree = image.Tree()
+	}
+	return toJSON(res)
+}
+
+//export uefi_validate
+func uefi_validate(data *C.char, length C.int, opts *C.char) *C.char {
+	fw, _, _, err := parse(data, length, opts)
+	if err != nil {
+		return toJSON(errorResult{Error: err.Error()})
+	}
+	return toJSON(parseResult{Errors: errorsToStrings(fw.Validate())})
+}
+
+//export uefi_extract
+func uefi_extract(data *C.char, length C.int, opts *C.char) *C.char {
+	fw, buf, o, err := parse(data, length, opts)
+	if err != nil {
+		return toJSON(errorResult{Error: err.Error()})
+	}
+	image, ok := fw.(*uefi.FlashImage)
+	if !ok {
+		return toJSON(errorResult{Error: "Extraction is only supported on flash images"})
+	}
+	path, err := image.NodeAt(o.Offset)
+	if err != nil {
+		return toJSON(errorResult{Error: err.Error()})
+	}
+	res := extractResult{}
+	for _, n := range path {
+		// only describe the nodes along the path, not their children
+		res.Path = append(res.Path, &uefi.Node{Type: n.Type, Name: n.Name, Offset: n.Offset, Size: n.Size})
+	}
+	node := path[len(path)-1]
+	// the nodes kept in permissive mode may exceed the image
+	if node.Offset+node.Size < node.Offset || node.Offset+node.Size > uint64(len(buf)) {
+		return toJSON(errorResult{Error: fmt.Sprintf("%s %s 0x%x-0x%x out of the image boundaries (size 0x%x)",
+			node.Type, node.Name, node.Offset, node.Offset+node.Size, len(buf))})
+	}
+	res.Data = buf[node.Offset : node.Offset+node.Size]
+	return toJSON(res)
+}
+
+//export uefi_free
+func uefi_free(p *C.char) {
+	C.free(unsafe.Pointer(p))
+}
+
+func main() {}
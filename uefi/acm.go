@@ -0,0 +1,205 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	// ACMHeaderSize is the size of the fixed part of the header of an
+	// Authenticated Code Module, up to the public key
+	ACMHeaderSize = 128
+	// ACMTypeChipset is the module type of the chipset ACMs
+	ACMTypeChipset = 2
+	// ACMVendorIntel is the vendor of the Intel ACMs
+	ACMVendorIntel = 0x8086
+	// ACMHeaderVersion3 is the header version with 3072-bit keys and no
+	// public exponent
+	ACMHeaderVersion3 = 0x00030000
+	// acmFlagPreProduction is set in the flags of the debug signed modules
+	acmFlagPreProduction = 1 << 15
+	// acmSignatureSizeV0 and acmSignatureSizeV3 are the sizes of the RSA
+	// signatures of the header versions 0 and 3
+	acmSignatureSizeV0 = 256
+	acmSignatureSizeV3 = 384
+)
+
+// ACMHeader is the header of an Authenticated Code Module. The sizes are in
+// 32-bit words.
+type ACMHeader struct {
+	ModuleType      uint16
+	ModuleSubType   uint16
+	HeaderLen       uint32
+	HeaderVersion   uint32
+	ChipsetID       uint16
+	Flags           uint16
+	ModuleVendor    uint32
+	Date            uint32
+	Size            uint32
+	TxtSVN          uint16
+	SeSVN           uint16
+	CodeControl     uint32
+	ErrorEntryPoint uint32
+	GDTLimit        uint32
+	GDTBasePtr      uint32
+	SegSel          uint32
+	EntryPoint      uint32
+	Reserved        [64]uint8
+	KeySize         uint32
+	ScratchSize     uint32
+}
+
+// ACM is an Authenticated Code Module, the Intel signed module that
+// establishes the root of trust of TXT and Boot Guard
+type ACM struct {
+	Header    ACMHeader
+	PublicKey []byte
+	// PublicExponent is only present in the modules with header version 0
+	PublicExponent uint32
+	Signature      []byte
+	// Offset is the position of the module from the start of the BIOS
+	// region
+	Offset uint64
+	// Holds the raw buffer, including the header
+	buf []byte
+}
+
+// Buf returns the raw bytes of the module
+func (a ACM) Buf() []byte {
+	return a.buf
+}
+
+// TypeName returns the kind of module, from its type and subtype
+func (a ACM) TypeName() string {
+	if a.Header.ModuleType != ACMTypeChipset {
+		return fmt.Sprintf("Type%d", a.Header.ModuleType)
+	}
+	if a.Header.ModuleSubType&1 != 0 {
+		return "Startup"
+	}
+	return "TXT"
+}
+
+// Date returns the date of the module as YYYY-MM-DD
+func (a ACM) Date() string {
+	d := a.Header.Date
+	return fmt.Sprintf("%04x-%02x-%02x", d>>16, (d>>8)&0xff, d&0xff)
+}
+
+// PreProduction returns whether the module is debug signed
+func (a ACM) PreProduction() bool {
+	return a.Header.Flags&acmFlagPreProduction != 0
+}
+
+func (a ACM) String() string {
+	return fmt.Sprintf("ACM{Type=%s, Vendor=0x%04x, Date=%s, SVN=%d, Size=%v}",
+		a.TypeName(), a.Header.ModuleVendor, a.Date(), a.Header.TxtSVN, len(a.buf))
+}
+
+// Summary prints a multi-line description of the module
+func (a ACM) Summary() string {
+	return fmt.Sprintf("ACM{\n"+
+		"    Offset=0x%x\n"+
+		"    Type=%s\n"+
+		"    HeaderVersion=0x%08x\n"+
+		"    ChipsetID=0x%04x\n"+
+		"    Vendor=0x%04x\n"+
+		"    Date=%s\n"+
+		"    Size=%v\n"+
+		"    TxtSVN=%d\n"+
+		"    SeSVN=%d\n"+
+		"    PreProduction=%v\n"+
+		"    KeySize=%v bits\n"+
+		"    PublicExponent=%v\n"+
+		"}",
+		a.Offset,
+		a.TypeName(),
+		a.Header.HeaderVersion,
+		a.Header.ChipsetID,
+		a.Header.ModuleVendor,
+		a.Date(),
+		len(a.buf),
+		a.Header.TxtSVN,
+		a.Header.SeSVN,
+		a.PreProduction(),
+		len(a.PublicKey)*8,
+		a.PublicExponent,
+	)
+}
+
+// Validate checks the type and the vendor of the module
+func (a ACM) Validate() []error {
+	errors := make([]error, 0)
+	if a.Header.ModuleType != ACMTypeChipset {
+		errors = append(errors, fmt.Errorf("ACM at 0x%x has type %d, expected %d", a.Offset, a.Header.ModuleType, ACMTypeChipset))
+	}
+	if a.Header.ModuleVendor != ACMVendorIntel {
+		errors = append(errors, fmt.Errorf("ACM at 0x%x has vendor 0x%x, expected 0x%x", a.Offset, a.Header.ModuleVendor, ACMVendorIntel))
+	}
+	return errors
+}
+
+// NewACM parses the Authenticated Code Module at the start of buf
+func NewACM(buf []byte) (*ACM, error) {
+	if len(buf) < ACMHeaderSize {
+		return nil, fmt.Errorf("ACM header too small: expected %v bytes, got %v", ACMHeaderSize, len(buf))
+	}
+	var a ACM
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &a.Header); err != nil {
+		return nil, err
+	}
+	size := uint64(a.Header.Size) * 4
+	if size < ACMHeaderSize || size > uint64(len(buf)) {
+		return nil, fmt.Errorf("Invalid ACM size 0x%x, the buffer is 0x%x bytes", size, len(buf))
+	}
+	a.buf = buf[:size]
+	sigSize := uint64(acmSignatureSizeV0)
+	if a.Header.HeaderVersion >= ACMHeaderVersion3 {
+		sigSize = acmSignatureSizeV3
+	}
+	keyEnd := ACMHeaderSize + uint64(a.Header.KeySize)*4
+	sigStart := keyEnd
+	if a.Header.HeaderVersion < ACMHeaderVersion3 {
+		sigStart += 4
+	}
+	if sigStart+sigSize > size || sigStart+sigSize > uint64(a.Header.HeaderLen)*4 {
+		return nil, fmt.Errorf("ACM key and signature [0x%x-0x%x] exceed the header", ACMHeaderSize, sigStart+sigSize)
+	}
+	a.PublicKey = a.buf[ACMHeaderSize:keyEnd]
+	if a.Header.HeaderVersion < ACMHeaderVersion3 {
+		a.PublicExponent = binary.LittleEndian.Uint32(a.buf[keyEnd:])
+	}
+	a.Signature = a.buf[sigStart : sigStart+sigSize]
+	return &a, nil
+}
+
+// ACMs returns the Authenticated Code Modules referenced by the FIT, sorted
+// by offset
+func (br BiosRegion) ACMs() []*ACM {
+	if br.FIT == nil {
+		return nil
+	}
+	var acms []*ACM
+	seen := make(map[uint64]bool)
+	for _, e := range br.FIT.Entries {
+		if e.Type() != FITTypeStartupACM && e.Type() != FITTypeDiagnosticACM {
+			continue
+		}
+		offset, err := br.AddressToOffset(e.Address)
+		if err != nil || seen[offset] {
+			continue
+		}
+		seen[offset] = true
+		a, err := NewACM(br.buf[offset:])
+		if err != nil {
+			debugf("FIT entry of type %v at 0x%x: %v", e.Type(), e.Address, err)
+			continue
+		}
+		a.Offset = offset
+		acms = append(acms, a)
+	}
+	sort.Slice(acms, func(i, j int) bool { return acms[i].Offset < acms[j].Offset })
+	return acms
+}
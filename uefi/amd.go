@@ -0,0 +1,529 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// AMD firmware constants
+const (
+	// AMDEFSSignature starts the Embedded Firmware Structure, which points
+	// to the PSP and BIOS directories of the AMD images
+	AMDEFSSignature = 0x55aa55aa
+	// AMDDirectoryHeaderSize is the size of the header of the PSP and BIOS
+	// directories
+	AMDDirectoryHeaderSize = 16
+	amdComboHeaderSize     = 32
+	amdComboEntrySize      = 16
+	amdPSPEntrySize        = 16
+	amdBIOSEntrySize       = 24
+	// amdAddressMask masks the address mode out of the directory locations
+	amdAddressMask = 1<<62 - 1
+	// amdAddressModeDirectory marks the locations relative to the directory
+	amdAddressModeDirectory = 2
+	// APCBHeaderSize is the size of the header of an APCB
+	APCBHeaderSize = 32
+	// AMDMicrocodeHeaderSize is the size of the header of an AMD microcode
+	// patch
+	AMDMicrocodeHeaderSize = 32
+)
+
+// AMDEFSOffsets are the positions where the Embedded Firmware Structure is
+// looked for, from the start of a 16MB flash
+var AMDEFSOffsets = []uint64{0x20000, 0x820000, 0xc20000, 0xe20000, 0xf20000, 0xfa0000}
+
+// AGESASignature precedes the version strings of the AMD Generic Encapsulated
+// Software Architecture (AGESA), the AMD platform initialization code
+var AGESASignature = []byte("AGESA!")
+
+// Cookies of the AMD directories
+const (
+	AMDCookiePSP       = "$PSP"
+	AMDCookiePSPL2     = "$PL2"
+	AMDCookiePSPCombo  = "2PSP"
+	AMDCookieBIOS      = "$BHD"
+	AMDCookieBIOSL2    = "$BL2"
+	AMDCookieBIOSCombo = "2BHD"
+)
+
+// Types of the AMD directory entries that are decoded or followed
+const (
+	AMDPSPEntryL2Directory     = 0x40
+	AMDPSPEntryL2ADirectory    = 0x48
+	AMDPSPEntryBIOSL2Directory = 0x49
+	AMDPSPEntryL2BDirectory    = 0x4a
+	AMDBIOSEntryAPCB           = 0x60
+	AMDBIOSEntryAPOB           = 0x61
+	AMDBIOSEntryAPOBNV         = 0x63
+	AMDBIOSEntryMicrocode      = 0x66
+	AMDBIOSEntryAPCBBackup     = 0x68
+	AMDBIOSEntryL2Directory    = 0x70
+)
+
+// AMDPSPEntryNames maps the types of the PSP directory entries to names
+var AMDPSPEntryNames = map[uint8]string{
+	0x00: "AMD public key",
+	0x01: "PSP boot loader",
+	0x02: "PSP secure OS",
+	0x03: "PSP recovery boot loader",
+	0x04: "PSP NV data",
+	0x08: "SMU firmware",
+	0x09: "Debug unlock key",
+	0x0a: "OEM public key",
+	0x0b: "PSP soft fuse chain",
+	0x0c: "PSP trustlets",
+	0x0d: "PSP trustlet key",
+	0x12: "SMU firmware 2",
+	0x13: "PSP early secure unlock",
+	0x21: "Wrapped iKEK",
+	0x22: "PSP token unlock",
+	0x24: "Security policy",
+	0x25: "MP2 firmware",
+	0x28: "PSP system driver",
+	0x30: "ABL0",
+	0x31: "ABL1",
+	0x32: "ABL2",
+	0x33: "ABL3",
+	0x34: "ABL4",
+	0x35: "ABL5",
+	0x36: "ABL6",
+	0x37: "ABL7",
+	0x3a: "Firmware whitelist",
+	0x40: "PSP L2 directory",
+	0x48: "PSP L2A directory",
+	0x49: "BIOS L2 directory",
+	0x4a: "PSP L2B directory",
+}
+
+// AMDBIOSEntryNames maps the types of the BIOS directory entries to names
+var AMDBIOSEntryNames = map[uint8]string{
+	0x05: "BIOS signing key",
+	0x07: "BIOS signature",
+	0x60: "APCB",
+	0x61: "APOB",
+	0x62: "BIOS binary",
+	0x63: "APOB NV copy",
+	0x64: "PMU firmware instructions",
+	0x65: "PMU firmware data",
+	0x66: "Microcode patch",
+	0x67: "MCE data",
+	0x68: "APCB backup",
+	0x69: "Early VGA image",
+	0x6a: "MP2 configuration",
+	0x70: "BIOS L2 directory",
+}
+
+// APCBHeader is the header of an AMD PSP Customization Block, the platform
+// configuration read by the AGESA boot loaders
+type APCBHeader struct {
+	Signature          [4]byte
+	SizeOfHeader       uint16
+	Version            uint16
+	SizeOfAPCB         uint32
+	UniqueAPCBInstance uint32
+	Checksum           uint8
+	Reserved1          [3]uint8
+	Reserved2          [3]uint32
+}
+
+// AMDMicrocodeHeader is the header of an AMD microcode patch
+type AMDMicrocodeHeader struct {
+	// Date is BCD encoded as mmddyyyy
+	Date                uint32
+	PatchID             uint32
+	PatchDataID         uint16
+	PatchDataLen        uint8
+	InitFlag            uint8
+	PatchDataChecksum   uint32
+	NbDevID             uint32
+	SbDevID             uint32
+	ProcessorRevisionID uint16
+	NbRevID             uint8
+	SbRevID             uint8
+	BIOSAPIRevision     uint8
+	Reserved            [3]uint8
+}
+
+// DateString returns the date of the patch as yyyy-mm-dd
+func (h AMDMicrocodeHeader) DateString() string {
+	return fmt.Sprintf("%04x-%02x-%02x", h.Date&0xffff, h.Date>>24, (h.Date>>16)&0xff)
+}
+
+// AMDDirectoryEntry is an entry of a PSP or BIOS directory
+type AMDDirectoryEntry struct {
+	Type       uint8
+	Subprogram uint8
+	Size       uint32
+	// Location is the raw location, with the address mode in the top bits
+	Location uint64
+	// Destination is the memory address the BIOS entries are copied to
+	Destination uint64
+	// Offset is the position of the data from the start of the region. It
+	// is only valid if Data is set.
+	Offset uint64
+	Data   []byte
+	// Placeholder is set for the entries without data in the flash, e.g.
+	// the APOB that the PSP writes to memory, or whose area is erased, e.g.
+	// the APOB NV copy before the first boot
+	Placeholder bool
+	// APCB is set on the APCB entries with a valid header
+	APCB *APCBHeader
+	// Microcode is set on the microcode patch entries
+	Microcode *AMDMicrocodeHeader
+	bios      bool
+}
+
+// Name returns the name of the entry type
+func (e AMDDirectoryEntry) Name() string {
+	names := AMDPSPEntryNames
+	if e.bios {
+		names = AMDBIOSEntryNames
+	}
+	if name, ok := names[e.Type]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown 0x%02x", e.Type)
+}
+
+func (e AMDDirectoryEntry) String() string {
+	s := fmt.Sprintf("%s (type 0x%02x, subprogram %d)", e.Name(), e.Type, e.Subprogram)
+	switch {
+	case e.Placeholder:
+		s += " placeholder"
+	case e.Data != nil:
+		s += fmt.Sprintf(" [0x%x-0x%x]", e.Offset, e.Offset+uint64(len(e.Data)))
+	}
+	if e.APCB != nil {
+		s += fmt.Sprintf(" version 0x%x instance %d", e.APCB.Version, e.APCB.UniqueAPCBInstance)
+	}
+	if e.Microcode != nil {
+		s += fmt.Sprintf(" patch 0x%08x date %s equivalence ID 0x%04x", e.Microcode.PatchID, e.Microcode.DateString(), e.Microcode.ProcessorRevisionID)
+	}
+	return s
+}
+
+// AMDDirectory is a PSP or BIOS directory, listing the firmware components
+// loaded by the AMD Platform Security Processor and by the AGESA
+type AMDDirectory struct {
+	Cookie   string
+	Offset   uint64
+	Checksum uint32
+	Entries  []*AMDDirectoryEntry
+	// Holds the raw buffer of the header and of the entries
+	buf []byte
+}
+
+// IsBIOS returns whether the directory is a BIOS directory
+func (d AMDDirectory) IsBIOS() bool {
+	return d.Cookie == AMDCookieBIOS || d.Cookie == AMDCookieBIOSL2
+}
+
+// AGESAVersion is an AGESA version string found in the image
+type AGESAVersion struct {
+	Offset  uint64
+	Version string
+}
+
+// AMDFirmware holds the AMD specific components of an image, as returned
+// by BiosRegion.AMDFirmware
+type AMDFirmware struct {
+	// EFSOffset is the position of the Embedded Firmware Structure, -1 if
+	// none was found
+	EFSOffset   int64
+	Directories []*AMDDirectory
+	AGESA       []AGESAVersion
+	// Errors holds the directories that could not be parsed and the
+	// invalid checksums
+	Errors []error
+}
+
+// Summary prints a multi-line description of the AMD components
+func (a AMDFirmware) Summary() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "AMDFirmware{\n")
+	if a.EFSOffset >= 0 {
+		fmt.Fprintf(&b, "    EFSOffset=0x%x\n", a.EFSOffset)
+	}
+	for _, v := range a.AGESA {
+		fmt.Fprintf(&b, "    AGESA=%q at 0x%x\n", v.Version, v.Offset)
+	}
+	for _, d := range a.Directories {
+		fmt.Fprintf(&b, "    Directory %s at 0x%x=[\n", d.Cookie, d.Offset)
+		for _, e := range d.Entries {
+			fmt.Fprintf(&b, "        %v\n", e)
+		}
+		fmt.Fprintf(&b, "    ]\n")
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// Validate returns the errors found while parsing the directories
+func (a AMDFirmware) Validate() []error {
+	return append([]error{}, a.Errors...)
+}
+
+// amdFletcher32 returns the checksum of the AMD directories
+func amdFletcher32(buf []byte) uint32 {
+	c0, c1 := uint32(0xffff), uint32(0xffff)
+	for i := 0; i+1 < len(buf); {
+		n := 0
+		for ; n < 359 && i+1 < len(buf); n, i = n+1, i+2 {
+			c0 += uint32(binary.LittleEndian.Uint16(buf[i:]))
+			c1 += c0
+		}
+		c0 = c0&0xffff + c0>>16
+		c1 = c1&0xffff + c1>>16
+	}
+	c0 = c0&0xffff + c0>>16
+	c1 = c1&0xffff + c1>>16
+	return c1<<16 | c0
+}
+
+// amdOffset converts the location of an AMD structure to an offset in buf.
+// The locations are either x86 addresses of the flash mapped below 4GB,
+// offsets from the start of the flash, or offsets from the directory.
+func amdOffset(location, dirOffset uint64, size uint64) (uint64, bool) {
+	addr := location & amdAddressMask
+	switch {
+	case location>>62 == amdAddressModeDirectory:
+		addr += dirOffset
+	case addr >= 1<<32-size && addr < 1<<32:
+		addr -= 1<<32 - size
+	case addr >= 1<<32-0x1000000 && addr < 1<<32 && size&(size-1) == 0:
+		// a 16MB address map, with a smaller power of two image
+		addr &= size - 1
+	}
+	return addr, addr < size
+}
+
+// parseAMDEntryData sets the data of an entry, and decodes the APCBs and
+// microcode patches
+func (a *AMDFirmware) parseAMDEntryData(buf []byte, e *AMDDirectoryEntry, dirOffset uint64) {
+	if e.bios && e.Type == AMDBIOSEntryAPOB {
+		e.Placeholder = true
+		return
+	}
+	// the soft fuse chain and similar entries hold a value in Location
+	if e.Size == 0 || e.Size == 0xffffffff {
+		return
+	}
+	offset, ok := amdOffset(e.Location, dirOffset, uint64(len(buf)))
+	if !ok || offset+uint64(e.Size) > uint64(len(buf)) {
+		a.Errors = append(a.Errors, fmt.Errorf("AMD entry %s at 0x%x exceeds the image", e.Name(), offset))
+		return
+	}
+	e.Offset = offset
+	e.Data = buf[offset : offset+uint64(e.Size)]
+	if isErased(e.Data) {
+		e.Placeholder = true
+		return
+	}
+	if !e.bios {
+		return
+	}
+	switch e.Type {
+	case AMDBIOSEntryAPCB, AMDBIOSEntryAPCBBackup:
+		var h APCBHeader
+		if len(e.Data) < APCBHeaderSize || string(e.Data[:4]) != "APCB" {
+			return
+		}
+		if err := binary.Read(bytes.NewReader(e.Data), binary.LittleEndian, &h); err != nil {
+			return
+		}
+		e.APCB = &h
+		if uint64(h.SizeOfAPCB) > uint64(len(e.Data)) {
+			a.Errors = append(a.Errors, fmt.Errorf("APCB at 0x%x: size 0x%x exceeds the entry", offset, h.SizeOfAPCB))
+			return
+		}
+		var sum uint8
+		for _, b := range e.Data[:h.SizeOfAPCB] {
+			sum += b
+		}
+		if sum != 0 {
+			a.Errors = append(a.Errors, fmt.Errorf("APCB at 0x%x: invalid checksum 0x%02x", offset, h.Checksum))
+		}
+	case AMDBIOSEntryMicrocode:
+		var h AMDMicrocodeHeader
+		if len(e.Data) < AMDMicrocodeHeaderSize {
+			return
+		}
+		if err := binary.Read(bytes.NewReader(e.Data), binary.LittleEndian, &h); err != nil {
+			return
+		}
+		e.Microcode = &h
+	}
+}
+
+// parseAMDDirectory parses the directory at the given offset, and the
+// directories it points to
+func (a *AMDFirmware) parseAMDDirectory(buf []byte, offset uint64, seen map[uint64]bool) {
+	if seen[offset] || offset+AMDDirectoryHeaderSize > uint64(len(buf)) {
+		return
+	}
+	seen[offset] = true
+	cookie := string(buf[offset : offset+4])
+	count := uint64(binary.LittleEndian.Uint32(buf[offset+8:]))
+	switch cookie {
+	case AMDCookiePSPCombo, AMDCookieBIOSCombo:
+		end := offset + amdComboHeaderSize + count*amdComboEntrySize
+		if end > uint64(len(buf)) {
+			a.Errors = append(a.Errors, fmt.Errorf("AMD directory %s at 0x%x exceeds the image", cookie, offset))
+			return
+		}
+		for i := uint64(0); i < count; i++ {
+			location := binary.LittleEndian.Uint64(buf[offset+amdComboHeaderSize+i*amdComboEntrySize+8:])
+			if next, ok := amdOffset(location, offset, uint64(len(buf))); ok {
+				a.parseAMDDirectory(buf, next, seen)
+			}
+		}
+		return
+	case AMDCookiePSP, AMDCookiePSPL2, AMDCookieBIOS, AMDCookieBIOSL2:
+	default:
+		return
+	}
+	d := AMDDirectory{Cookie: cookie, Offset: offset, Checksum: binary.LittleEndian.Uint32(buf[offset+4:])}
+	entrySize := uint64(amdPSPEntrySize)
+	if d.IsBIOS() {
+		entrySize = amdBIOSEntrySize
+	}
+	end := offset + AMDDirectoryHeaderSize + count*entrySize
+	if end > uint64(len(buf)) {
+		a.Errors = append(a.Errors, fmt.Errorf("AMD directory %s at 0x%x exceeds the image", cookie, offset))
+		return
+	}
+	d.buf = buf[offset:end]
+	if sum := amdFletcher32(d.buf[8:]); sum != d.Checksum {
+		a.Errors = append(a.Errors, fmt.Errorf("AMD directory %s at 0x%x: invalid checksum 0x%08x, expected 0x%08x", cookie, offset, d.Checksum, sum))
+	}
+	a.Directories = append(a.Directories, &d)
+	for i := uint64(0); i < count; i++ {
+		raw := d.buf[AMDDirectoryHeaderSize+i*entrySize:]
+		e := AMDDirectoryEntry{Type: raw[0], bios: d.IsBIOS()}
+		if e.bios {
+			e.Subprogram = raw[3] & 0x7
+			e.Size = binary.LittleEndian.Uint32(raw[4:])
+			e.Location = binary.LittleEndian.Uint64(raw[8:])
+			e.Destination = binary.LittleEndian.Uint64(raw[16:])
+		} else {
+			e.Subprogram = raw[1]
+			e.Size = binary.LittleEndian.Uint32(raw[4:])
+			e.Location = binary.LittleEndian.Uint64(raw[8:])
+		}
+		d.Entries = append(d.Entries, &e)
+		isDirectory := (!e.bios && (e.Type == AMDPSPEntryL2Directory || e.Type == AMDPSPEntryL2ADirectory ||
+			e.Type == AMDPSPEntryBIOSL2Directory || e.Type == AMDPSPEntryL2BDirectory)) ||
+			(e.bios && e.Type == AMDBIOSEntryL2Directory)
+		if isDirectory {
+			if next, ok := amdOffset(e.Location, offset, uint64(len(buf))); ok {
+				a.parseAMDDirectory(buf, next, seen)
+			}
+			continue
+		}
+		a.parseAMDEntryData(buf, &e, offset)
+	}
+}
+
+// NewAMDFirmware finds the AMD components of an image: the directories
+// pointed to by the Embedded Firmware Structure and the AGESA version
+// strings. It returns nil if there are none.
+func NewAMDFirmware(buf []byte) *AMDFirmware {
+	a := AMDFirmware{EFSOffset: -1}
+	for _, offset := range AMDEFSOffsets {
+		// images smaller than 16MB are at the top of the address map
+		if uint64(len(buf)) < 0x1000000 {
+			if offset < 0x1000000-uint64(len(buf)) {
+				continue
+			}
+			offset -= 0x1000000 - uint64(len(buf))
+		}
+		if offset+0x2c > uint64(len(buf)) || binary.LittleEndian.Uint32(buf[offset:]) != AMDEFSSignature {
+			continue
+		}
+		a.EFSOffset = int64(offset)
+		seen := make(map[uint64]bool)
+		// the pointers to the PSP directories and to the BIOS directories
+		// of the successive families
+		for _, ptr := range []uint64{0x10, 0x14, 0x18, 0x1c, 0x20, 0x28} {
+			location := uint64(binary.LittleEndian.Uint32(buf[offset+ptr:]))
+			if location == 0 || location == 0xffffffff {
+				continue
+			}
+			if dir, ok := amdOffset(location, 0, uint64(len(buf))); ok {
+				a.parseAMDDirectory(buf, dir, seen)
+			}
+		}
+		break
+	}
+	for offset := 0; offset < len(buf); {
+		idx := bytes.Index(buf[offset:], AGESASignature)
+		if idx == -1 {
+			break
+		}
+		offset += idx
+		// the signature is followed by the format, e.g. V9, and by the
+		// version, both NUL-terminated
+		fields := bytes.SplitN(buf[offset+len(AGESASignature):], []byte{0}, 3)
+		if len(fields) == 3 && len(fields[1]) > 0 && len(fields[1]) < 64 && isASCII(fields[1]) {
+			a.AGESA = append(a.AGESA, AGESAVersion{Offset: uint64(offset), Version: strings.TrimSpace(string(fields[1]))})
+		}
+		offset += len(AGESASignature)
+	}
+	if a.EFSOffset == -1 && len(a.AGESA) == 0 {
+		return nil
+	}
+	return &a
+}
+
+// isASCII returns whether buf only holds printable ASCII characters
+func isASCII(buf []byte) bool {
+	for _, b := range buf {
+		if !isPrintable(b) {
+			return false
+		}
+	}
+	return true
+}
+
+// AMDFirmware returns the AMD components of the region, which on AMD
+// platforms is the whole image, or nil if there are none
+func (br BiosRegion) AMDFirmware() *AMDFirmware {
+	return NewAMDFirmware(br.buf)
+}
+
+// nodes returns the typed nodes of the directories and of the entries with
+// data in the flash, based at the given absolute offset
+func (a AMDFirmware) nodes(base uint64) []*Node {
+	var nodes []*Node
+	for _, d := range a.Directories {
+		nodes = append(nodes, &Node{Type: "AmdDirectory", Name: d.Cookie, Offset: base + d.Offset, Size: uint64(len(d.buf))})
+		for _, e := range d.Entries {
+			if e.Data == nil {
+				continue
+			}
+			t := "AmdEntry"
+			switch {
+			case e.bios && (e.Type == AMDBIOSEntryAPCB || e.Type == AMDBIOSEntryAPCBBackup):
+				t = "APCB"
+			case e.bios && e.Type == AMDBIOSEntryAPOBNV:
+				t = "APOB"
+			case e.bios && e.Type == AMDBIOSEntryMicrocode:
+				t = "AmdMicrocode"
+			}
+			nodes = append(nodes, &Node{Type: t, Name: e.Name(), Offset: base + e.Offset, Size: uint64(len(e.Data))})
+		}
+	}
+	return nodes
+}
+
+// agesaNodes returns the nodes of the AGESA version strings, based at the
+// given absolute offset
+func (a AMDFirmware) agesaNodes(base uint64) []*Node {
+	var nodes []*Node
+	for _, v := range a.AGESA {
+		nodes = append(nodes, &Node{Type: "AGESA", Name: v.Version, Offset: base + v.Offset, Size: uint64(len(AGESASignature))})
+	}
+	return nodes
+}
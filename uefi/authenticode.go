@@ -0,0 +1,373 @@
+package uefi
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+
+	// register the hashes used by the signatures
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+const (
+	// winCertificateHeaderSize is the size of the header of a
+	// WIN_CERTIFICATE, before the certificate data
+	winCertificateHeaderSize = 8
+	// winCertTypePKCSSignedData is the type of the WIN_CERTIFICATE holding
+	// an Authenticode signature
+	winCertTypePKCSSignedData = 0x0002
+	// peSecurityDirectory is the index of the data directory of the
+	// certificate table
+	peSecurityDirectory = 4
+)
+
+var (
+	oidSignedData      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSpcIndirectData = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 1, 4}
+)
+
+var authenticodeHashes = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+	name string
+	rsa  x509.SignatureAlgorithm
+	ec   x509.SignatureAlgorithm
+}{
+	{asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}, crypto.SHA1, "SHA1", x509.SHA1WithRSA, x509.ECDSAWithSHA1},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}, crypto.SHA256, "SHA256", x509.SHA256WithRSA, x509.ECDSAWithSHA256},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}, crypto.SHA384, "SHA384", x509.SHA384WithRSA, x509.ECDSAWithSHA384},
+	{asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}, crypto.SHA512, "SHA512", x509.SHA512WithRSA, x509.ECDSAWithSHA512},
+}
+
+// pkcs7ContentInfo, pkcs7SignedData, pkcs7SignerInfo and pkcs7Attribute are
+// the PKCS #7 structures of an Authenticode signature
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      pkcs7ContentInfo
+	Certificates     asn1.RawValue     `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue     `asn1:"optional,tag:1"`
+	SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+}
+
+type pkcs7IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type pkcs7SignerInfo struct {
+	Version                   int
+	IssuerAndSerial           pkcs7IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+	UnauthenticatedAttributes asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type pkcs7Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue
+}
+
+// spcIndirectDataContent is the content signed by Authenticode, which holds
+// the hash of the image
+type spcIndirectDataContent struct {
+	Data          asn1.RawValue
+	MessageDigest struct {
+		DigestAlgorithm pkix.AlgorithmIdentifier
+		Digest          []byte
+	}
+}
+
+// Authenticode is the result of the verification of the Authenticode
+// signature of a PE image
+type Authenticode struct {
+	DigestAlgorithm string
+	// Digest is the hash of the image in the signature, ComputedDigest the
+	// hash of the image
+	Digest         []byte
+	ComputedDigest []byte
+	// Chain holds the names of the signer certificate and of its issuers
+	// found in the signature, signer first
+	Chain []string
+	// SignatureError is why the signature of the signer is not valid, empty
+	// if it is
+	SignatureError string
+	// Certificates are the certificates embedded in the signature
+	Certificates []*x509.Certificate `json:"-"`
+}
+
+// DigestMatch returns whether the image hash matches the signed one
+func (a Authenticode) DigestMatch() bool {
+	return bytes.Equal(a.Digest, a.ComputedDigest)
+}
+
+// Valid returns whether the image hash matches and the signature is valid.
+// The chain is not checked against trusted roots.
+func (a Authenticode) Valid() bool {
+	return a.DigestMatch() && a.SignatureError == ""
+}
+
+func (a Authenticode) String() string {
+	status := "valid"
+	switch {
+	case !a.DigestMatch():
+		status = "image digest mismatch"
+	case a.SignatureError != "":
+		status = "invalid signature: " + a.SignatureError
+	}
+	return fmt.Sprintf("Authenticode{%s, %s, Chain=[%s]}", a.DigestAlgorithm, status, strings.Join(a.Chain, " <- "))
+}
+
+// certificateName returns a short name of a certificate subject
+func certificateName(c *x509.Certificate) string {
+	if c.Subject.CommonName != "" {
+		return c.Subject.CommonName
+	}
+	if len(c.Subject.Organization) > 0 {
+		return c.Subject.Organization[0]
+	}
+	return fmt.Sprintf("serial %x", c.SerialNumber)
+}
+
+// peCertificateTable returns the offsets of the security data directory
+// entry and of the certificate table of a PE image, and the size of the
+// table, which is 0 if the image is not signed
+func peCertificateTable(img []byte) (int, uint64, uint64, error) {
+	if peChecksumOffset(img) == -1 {
+		return 0, 0, 0, fmt.Errorf("Not a PE image")
+	}
+	optional := int(binary.LittleEndian.Uint32(img[0x3c:])) + 4 + 20
+	if optional+2 > len(img) {
+		return 0, 0, 0, fmt.Errorf("PE optional header exceeds the image")
+	}
+	var countOffset, dirs int
+	switch binary.LittleEndian.Uint16(img[optional:]) {
+	case 0x10b:
+		countOffset, dirs = optional+92, optional+96
+	case 0x20b:
+		countOffset, dirs = optional+108, optional+112
+	default:
+		return 0, 0, 0, fmt.Errorf("Unknown PE optional header magic 0x%x", binary.LittleEndian.Uint16(img[optional:]))
+	}
+	entry := dirs + peSecurityDirectory*8
+	if entry+8 > len(img) || binary.LittleEndian.Uint32(img[countOffset:]) <= peSecurityDirectory {
+		return 0, 0, 0, nil
+	}
+	// the address of the certificate table is a file offset
+	start := uint64(binary.LittleEndian.Uint32(img[entry:]))
+	size := uint64(binary.LittleEndian.Uint32(img[entry+4:]))
+	if size != 0 && (start < uint64(entry)+8 || start+size > uint64(len(img))) {
+		return 0, 0, 0, fmt.Errorf("PE certificate table [0x%x-0x%x] exceeds the image size 0x%x", start, start+size, len(img))
+	}
+	return entry, start, size, nil
+}
+
+// authenticodeDigest returns the Authenticode hash of a PE image: the hash
+// of the image without the checksum, the security directory entry and the
+// certificate table
+func authenticodeDigest(img []byte, h crypto.Hash, entry int, tableStart, tableSize uint64) []byte {
+	cs := peChecksumOffset(img)
+	d := h.New()
+	d.Write(img[:cs])
+	d.Write(img[cs+4 : entry])
+	d.Write(img[entry+8 : tableStart])
+	d.Write(img[tableStart+tableSize:])
+	return d.Sum(nil)
+}
+
+// VerifyAuthenticode verifies the Authenticode signature of a PE image: the
+// signed hash of the image, and the signature of the signer. It returns nil
+// and no error if the image is not signed.
+func VerifyAuthenticode(img []byte) (*Authenticode, error) {
+	entry, tableStart, tableSize, err := peCertificateTable(img)
+	if err != nil || tableSize == 0 {
+		return nil, err
+	}
+	table := img[tableStart : tableStart+tableSize]
+	if len(table) < winCertificateHeaderSize {
+		return nil, fmt.Errorf("PE certificate table too small: %v bytes", len(table))
+	}
+	length := uint64(binary.LittleEndian.Uint32(table))
+	if certType := binary.LittleEndian.Uint16(table[6:]); certType != winCertTypePKCSSignedData {
+		return nil, fmt.Errorf("Unsupported WIN_CERTIFICATE type 0x%x", certType)
+	}
+	if length < winCertificateHeaderSize || length > uint64(len(table)) {
+		return nil, fmt.Errorf("Invalid WIN_CERTIFICATE length 0x%x", length)
+	}
+
+	var ci pkcs7ContentInfo
+	if _, err := asn1.Unmarshal(table[winCertificateHeaderSize:length], &ci); err != nil {
+		return nil, fmt.Errorf("Cannot parse the PKCS #7 content: %v", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, fmt.Errorf("PKCS #7 content type %v is not SignedData", ci.ContentType)
+	}
+	var sd pkcs7SignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("Cannot parse the SignedData: %v", err)
+	}
+	if !sd.ContentInfo.ContentType.Equal(oidSpcIndirectData) {
+		return nil, fmt.Errorf("Signed content type %v is not SpcIndirectDataContent", sd.ContentInfo.ContentType)
+	}
+	// the raw content holds the explicit tag, and the signed bytes are the
+	// value of the SpcIndirectDataContent sequence
+	var content asn1.RawValue
+	if _, err := asn1.Unmarshal(sd.ContentInfo.Content.Bytes, &content); err != nil {
+		return nil, fmt.Errorf("Cannot parse the signed content: %v", err)
+	}
+	var spc spcIndirectDataContent
+	if _, err := asn1.Unmarshal(content.FullBytes, &spc); err != nil {
+		return nil, fmt.Errorf("Cannot parse the SpcIndirectDataContent: %v", err)
+	}
+	var a Authenticode
+	var h crypto.Hash
+	for _, c := range authenticodeHashes {
+		if c.oid.Equal(spc.MessageDigest.DigestAlgorithm.Algorithm) {
+			a.DigestAlgorithm, h = c.name, c.hash
+		}
+	}
+	if h == 0 {
+		return nil, fmt.Errorf("Unsupported digest algorithm %v", spc.MessageDigest.DigestAlgorithm.Algorithm)
+	}
+	a.Digest = spc.MessageDigest.Digest
+	a.ComputedDigest = authenticodeDigest(img, h, entry, tableStart, tableSize)
+	if a.Certificates, err = x509.ParseCertificates(sd.Certificates.Bytes); err != nil {
+		return nil, fmt.Errorf("Cannot parse the certificates: %v", err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("Expected 1 signer, got %v", len(sd.SignerInfos))
+	}
+	signer, err := a.verifySigner(sd.SignerInfos[0], content.Bytes)
+	if err != nil {
+		a.SignatureError = err.Error()
+	}
+	a.Chain = chainNames(signer, a.Certificates)
+	return &a, nil
+}
+
+// verifySigner checks the signature of the signer over the signed content,
+// and returns the certificate of the signer if found
+func (a Authenticode) verifySigner(si pkcs7SignerInfo, content []byte) (*x509.Certificate, error) {
+	var signer *x509.Certificate
+	for _, c := range a.Certificates {
+		if c.SerialNumber.Cmp(si.IssuerAndSerial.SerialNumber) == 0 && bytes.Equal(c.RawIssuer, si.IssuerAndSerial.Issuer.FullBytes) {
+			signer = c
+		}
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("signer certificate not found")
+	}
+	var algo x509.SignatureAlgorithm
+	var h crypto.Hash
+	for _, c := range authenticodeHashes {
+		if !c.oid.Equal(si.DigestAlgorithm.Algorithm) {
+			continue
+		}
+		h = c.hash
+		switch signer.PublicKey.(type) {
+		case *rsa.PublicKey:
+			algo = c.rsa
+		case *ecdsa.PublicKey:
+			algo = c.ec
+		}
+	}
+	if algo == x509.UnknownSignatureAlgorithm {
+		return signer, fmt.Errorf("unsupported signer digest algorithm %v", si.DigestAlgorithm.Algorithm)
+	}
+	signed := content
+	if len(si.AuthenticatedAttributes.FullBytes) != 0 {
+		// the attributes hold the hash of the content, and are signed
+		// with their implicit tag replaced by the one of a SET
+		var digest []byte
+		for rest := si.AuthenticatedAttributes.Bytes; len(rest) > 0; {
+			var attr pkcs7Attribute
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+				return signer, fmt.Errorf("cannot parse the authenticated attributes: %v", err)
+			}
+			if attr.Type.Equal(oidMessageDigest) {
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+					return signer, fmt.Errorf("cannot parse the message digest: %v", err)
+				}
+			}
+		}
+		d := h.New()
+		d.Write(content)
+		if !bytes.Equal(digest, d.Sum(nil)) {
+			return signer, fmt.Errorf("message digest mismatch")
+		}
+		signed = append([]byte{0x31}, si.AuthenticatedAttributes.FullBytes[1:]...)
+	}
+	if err := signer.CheckSignature(algo, signed, si.EncryptedDigest); err != nil {
+		return signer, err
+	}
+	return signer, nil
+}
+
+// chainNames returns the names of the certificate and of its issuers found
+// in certs
+func chainNames(c *x509.Certificate, certs []*x509.Certificate) []string {
+	var names []string
+	for c != nil && len(names) <= len(certs) {
+		names = append(names, certificateName(c))
+		var issuer *x509.Certificate
+		for _, p := range certs {
+			if p != c && bytes.Equal(p.RawSubject, c.RawIssuer) && c.CheckSignatureFrom(p) == nil {
+				issuer = p
+			}
+		}
+		c = issuer
+	}
+	return names
+}
+
+// SignedImage is a PE image of the BIOS region with an Authenticode
+// signature, as returned by BiosRegion.SignedImages
+type SignedImage struct {
+	// File is the GUID of the file holding the image, Name its module
+	// name, see File.ModuleName
+	File string
+	Name string
+	Authenticode
+}
+
+func (s SignedImage) String() string {
+	return fmt.Sprintf("%s %s: %v", s.File, s.Name, s.Authenticode)
+}
+
+// SignedImages returns the PE images of the region that carry an
+// Authenticode signature, including the ones in compressed sections and
+// nested volumes, with the result of their verification
+func (br BiosRegion) SignedImages() []SignedImage {
+	var images []SignedImage
+	isPE := func(s *Section) bool { return s.Type == SectionTypePE32 }
+	br.walkFileData(isPE, func(f *File, data []byte) {
+		if _, _, size, err := peCertificateTable(data); err != nil || size == 0 {
+			return
+		}
+		a, err := VerifyAuthenticode(data)
+		if err != nil {
+			a = &Authenticode{SignatureError: err.Error()}
+		}
+		images = append(images, SignedImage{File: f.GUID(), Name: f.ModuleName(), Authenticode: *a})
+	})
+	return images
+}
@@ -0,0 +1,249 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// BIOSGuardHeaderSize is the size of the header of a BIOS Guard package
+	BIOSGuardHeaderSize = 0x30
+	// BIOSGuardInstructionSize is the size of an instruction of a BIOS Guard
+	// script
+	BIOSGuardInstructionSize = 8
+	// biosGuardScriptMaxSize and biosGuardDataMaxSize bound the sizes of a
+	// package, to reject garbage
+	biosGuardScriptMaxSize = 0x10000
+	biosGuardDataMaxSize   = 0x1000000
+	// biosGuardSignatureHeaderSize is the size of the fields preceding the
+	// modulus in the signature of a package
+	biosGuardSignatureHeaderSize = 8
+	// biosGuardExponent is the public exponent of the keys signing the
+	// packages, used to tell the 2048 and 3072 bit signatures apart
+	biosGuardExponent = 0x10001
+)
+
+// BIOSGuardOpcodeBegin is the opcode of the first instruction of the BIOS
+// Guard scripts
+const BIOSGuardOpcodeBegin = 0x0001
+
+// BIOS Guard package attributes
+const (
+	BIOSGuardAttributeSFAM          = 0x1
+	BIOSGuardAttributeProtectEC     = 0x2
+	BIOSGuardAttributeGFXMitigation = 0x4
+	BIOSGuardAttributeFTU           = 0x8
+)
+
+var biosGuardAttributeNames = []struct {
+	bit  uint32
+	name string
+}{
+	{BIOSGuardAttributeSFAM, "SFAM"},
+	{BIOSGuardAttributeProtectEC, "ProtectEC"},
+	{BIOSGuardAttributeGFXMitigation, "GFXMitigation"},
+	{BIOSGuardAttributeFTU, "FTU"},
+}
+
+// BIOSGuardHeader is the header of an Intel BIOS Guard (PFAT) update
+// package, which holds a signed script run by the BIOS Guard ACM to write
+// the flash
+type BIOSGuardHeader struct {
+	VersionMajor uint16
+	VersionMinor uint16
+	// PlatformID is an ASCII string padded with zeros
+	PlatformID         [16]byte
+	Attributes         uint32
+	ScriptVersionMajor uint16
+	ScriptVersionMinor uint16
+	ScriptSize         uint32
+	DataSize           uint32
+	BIOSSVN            uint32
+	ECSVN              uint32
+	VendorInfo         uint32
+}
+
+// BIOSGuardInstruction is an instruction of a BIOS Guard script
+type BIOSGuardInstruction struct {
+	Opcode   uint16
+	Operands [6]byte
+}
+
+// BIOSGuardPackage is an Intel BIOS Guard update package: the header, the
+// script, the data the script writes, and the signature of all of them
+type BIOSGuardPackage struct {
+	Header BIOSGuardHeader
+	Script []BIOSGuardInstruction
+	Data   []byte
+	// Modulus, Exponent and Signature are empty if the package is not
+	// followed by a signature
+	Modulus   []byte
+	Exponent  uint32
+	Signature []byte
+	// Offset is the position of the package from the start of the BIOS
+	// region
+	Offset uint64
+	// Source is the GUID of the file holding the package, if any
+	Source string
+	// Holds the raw buffer, including the header and the signature
+	buf []byte
+}
+
+// Buf returns the raw bytes of the package
+func (p BIOSGuardPackage) Buf() []byte {
+	return p.buf
+}
+
+// PlatformID returns the platform identifier of the package
+func (p BIOSGuardPackage) PlatformID() string {
+	return strings.TrimRight(string(p.Header.PlatformID[:]), "\x00")
+}
+
+// AttributeNames returns the names of the attributes set in the header
+func (p BIOSGuardPackage) AttributeNames() []string {
+	var names []string
+	for _, a := range biosGuardAttributeNames {
+		if p.Header.Attributes&a.bit != 0 {
+			names = append(names, a.name)
+		}
+	}
+	return names
+}
+
+func (p BIOSGuardPackage) String() string {
+	return fmt.Sprintf("BIOSGuardPackage{Platform=%s, BIOSSVN=%d, ECSVN=%d, Script=%d instructions, Data=%v, Key=%d bits}",
+		p.PlatformID(), p.Header.BIOSSVN, p.Header.ECSVN, len(p.Script), len(p.Data), len(p.Modulus)*8)
+}
+
+// Summary prints a multi-line description of the package
+func (p BIOSGuardPackage) Summary() string {
+	return fmt.Sprintf("BIOSGuardPackage{\n"+
+		"    Offset=0x%x\n"+
+		"    Source=%s\n"+
+		"    Version=%d.%d\n"+
+		"    PlatformID=%s\n"+
+		"    Attributes=0x%x %v\n"+
+		"    ScriptVersion=%d.%d\n"+
+		"    ScriptSize=%v\n"+
+		"    DataSize=%v\n"+
+		"    BIOSSVN=%d\n"+
+		"    ECSVN=%d\n"+
+		"    VendorInfo=0x%x\n"+
+		"    KeySize=%d bits\n"+
+		"}",
+		p.Offset,
+		p.Source,
+		p.Header.VersionMajor, p.Header.VersionMinor,
+		p.PlatformID(),
+		p.Header.Attributes, p.AttributeNames(),
+		p.Header.ScriptVersionMajor, p.Header.ScriptVersionMinor,
+		p.Header.ScriptSize,
+		p.Header.DataSize,
+		p.Header.BIOSSVN,
+		p.Header.ECSVN,
+		p.Header.VendorInfo,
+		len(p.Modulus)*8,
+	)
+}
+
+// isBIOSGuardPlatformID returns whether id is printable ASCII padded with
+// zeros
+func isBIOSGuardPlatformID(id []byte) bool {
+	end := bytes.IndexByte(id, 0)
+	if end == -1 {
+		end = len(id)
+	}
+	if end == 0 {
+		return false
+	}
+	for i, c := range id {
+		if i < end && (c < 0x20 || c > 0x7e) || i >= end && c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NewBIOSGuardPackage parses the BIOS Guard package at the start of buf
+func NewBIOSGuardPackage(buf []byte) (*BIOSGuardPackage, error) {
+	if len(buf) < BIOSGuardHeaderSize {
+		return nil, fmt.Errorf("BIOS Guard header too small: expected %v bytes, got %v", BIOSGuardHeaderSize, len(buf))
+	}
+	var p BIOSGuardPackage
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &p.Header); err != nil {
+		return nil, err
+	}
+	h := p.Header
+	if h.VersionMajor != 2 || !isBIOSGuardPlatformID(h.PlatformID[:]) {
+		return nil, fmt.Errorf("No BIOS Guard header found")
+	}
+	if h.ScriptSize == 0 || h.ScriptSize > biosGuardScriptMaxSize || h.ScriptSize%BIOSGuardInstructionSize != 0 || h.DataSize > biosGuardDataMaxSize {
+		return nil, fmt.Errorf("Invalid BIOS Guard script size 0x%x or data size 0x%x", h.ScriptSize, h.DataSize)
+	}
+	scriptEnd := uint64(BIOSGuardHeaderSize) + uint64(h.ScriptSize)
+	dataEnd := scriptEnd + uint64(h.DataSize)
+	if dataEnd > uint64(len(buf)) {
+		return nil, fmt.Errorf("BIOS Guard package of 0x%x bytes exceeds the buffer size 0x%x", dataEnd, len(buf))
+	}
+	p.Script = make([]BIOSGuardInstruction, h.ScriptSize/BIOSGuardInstructionSize)
+	if err := binary.Read(bytes.NewReader(buf[BIOSGuardHeaderSize:scriptEnd]), binary.LittleEndian, p.Script); err != nil {
+		return nil, err
+	}
+	if p.Script[0].Opcode != BIOSGuardOpcodeBegin {
+		return nil, fmt.Errorf("BIOS Guard script starts with opcode 0x%04x, expected 0x%04x", p.Script[0].Opcode, BIOSGuardOpcodeBegin)
+	}
+	p.Data = buf[scriptEnd:dataEnd]
+	p.buf = buf[:dataEnd]
+
+	// the signature has no size field: the exponent, which follows the
+	// modulus, tells the key size
+	for _, keySize := range []uint64{256, 384} {
+		exponent := dataEnd + biosGuardSignatureHeaderSize + keySize
+		end := exponent + 4 + keySize
+		if end > uint64(len(buf)) || binary.LittleEndian.Uint32(buf[exponent:]) != biosGuardExponent {
+			continue
+		}
+		p.Modulus = buf[exponent-keySize : exponent]
+		p.Exponent = biosGuardExponent
+		p.Signature = buf[exponent+4 : end]
+		p.buf = buf[:end]
+		break
+	}
+	return &p, nil
+}
+
+// FindBIOSGuardPackages returns the BIOS Guard packages in buf, with their
+// offsets from the start of buf
+func FindBIOSGuardPackages(buf []byte) []*BIOSGuardPackage {
+	var found []*BIOSGuardPackage
+	version := []byte{2, 0, 0, 0}
+	for offset := 0; offset+BIOSGuardHeaderSize <= len(buf); {
+		idx := bytes.Index(buf[offset:], version)
+		if idx == -1 {
+			break
+		}
+		offset += idx
+		p, err := NewBIOSGuardPackage(buf[offset:])
+		if err != nil {
+			offset++
+			continue
+		}
+		p.Offset = uint64(offset)
+		found = append(found, p)
+		offset += len(p.buf)
+	}
+	return found
+}
+
+// BIOSGuardPackages returns the BIOS Guard packages embedded in the region
+func (br BiosRegion) BIOSGuardPackages() []*BIOSGuardPackage {
+	packages := FindBIOSGuardPackages(br.buf)
+	for _, p := range packages {
+		if f, _, ok := br.fileAt(p.Offset); ok {
+			p.Source = f.GUID()
+		}
+	}
+	return packages
+}
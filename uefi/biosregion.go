@@ -1,6 +1,7 @@
 package uefi
 
 import (
+	"encoding/binary"
 	"fmt"
 	"strings"
 )
@@ -10,6 +11,68 @@ import (
 // TODO(ganshun): handle padding
 type BiosRegion struct {
 	FirmwareVolumes []FirmwareVolume
+	// FIT is the Firmware Interface Table, nil if the region has none
+	FIT *FIT
+	// Broken holds the elements that could not be parsed in permissive mode
+	Broken []BrokenNode
+	// Holds the raw buffer
+	buf []byte
+}
+
+// ParseErrors returns the errors tolerated while parsing the region and its
+// volumes in permissive mode. They are not reported by Validate.
+func (br BiosRegion) ParseErrors() []error {
+	errors := brokenErrors("BIOS region", br.Broken)
+	for _, fv := range br.FirmwareVolumes {
+		errors = append(errors, brokenErrors("Firmware volume "+fv.guidString(), fv.Broken)...)
+		if fv.VariableStore != nil {
+			errors = append(errors, brokenErrors("Variable store", fv.VariableStore.Broken)...)
+		}
+	}
+	return errors
+}
+
+// Type returns RegionTypeBIOS
+func (br BiosRegion) Type() FlashRegionType {
+	return RegionTypeBIOS
+}
+
+// Buf returns the raw bytes of the region
+func (br BiosRegion) Buf() []byte {
+	return br.buf
+}
+
+// Validate runs a set of checks on the BIOS region and returns a list of
+// errors specifying what is wrong.
+func (br BiosRegion) Validate() []error {
+	errors := make([]error, 0)
+	if len(br.FirmwareVolumes) == 0 {
+		errors = append(errors, fmt.Errorf("No firmware volume found in the BIOS region"))
+	}
+	for _, fv := range br.FirmwareVolumes {
+		errors = append(errors, fv.Validate()...)
+	}
+	if br.FIT != nil {
+		errors = append(errors, br.FIT.Validate(uint64(len(br.buf)))...)
+	}
+	for _, a := range br.ACMs() {
+		errors = append(errors, a.Validate()...)
+	}
+	if km, err := br.KeyManifest(); err != nil {
+		errors = append(errors, err)
+	} else if km != nil {
+		errors = append(errors, km.Validate()...)
+	}
+	if bpm, err := br.BootPolicyManifest(); err != nil {
+		errors = append(errors, err)
+	} else if bpm != nil {
+		errors = append(errors, bpm.Validate(uint64(len(br.buf)))...)
+	}
+	if amd := br.AMDFirmware(); amd != nil {
+		errors = append(errors, amd.Validate()...)
+	}
+	errors = append(errors, br.vulnerabilityErrors()...)
+	return errors
 }
 
 // Summary prints a multi-line description of the Bios Region
@@ -18,31 +81,167 @@ func (br BiosRegion) Summary() string {
 	for _, fv := range br.FirmwareVolumes {
 		fvols = append(fvols, fv.Summary())
 	}
+	fit := "<none>"
+	if br.FIT != nil {
+		fit = br.FIT.Summary()
+	}
+	var microcodes []string
+	for _, m := range br.Microcodes() {
+		microcodes = append(microcodes, m.String())
+	}
+	var acms []string
+	for _, a := range br.ACMs() {
+		acms = append(acms, a.String())
+	}
+	var packages []string
+	for _, p := range br.BIOSGuardPackages() {
+		packages = append(packages, p.String())
+	}
+	km := "<none>"
+	if m, err := br.KeyManifest(); err != nil {
+		km = fmt.Sprintf("<%v>", err)
+	} else if m != nil {
+		km = m.Summary()
+	}
+	bpm := "<none>"
+	if m, err := br.BootPolicyManifest(); err != nil {
+		bpm = fmt.Sprintf("<%v>", err)
+	} else if m != nil {
+		bpm = m.Summary()
+	}
+	amd := "<none>"
+	if a := br.AMDFirmware(); a != nil {
+		amd = a.Summary()
+	}
 	return fmt.Sprintf("BiosRegion{\n"+
+		"    Platform=%v\n"+
 		"    FirmwareVolumes=[\n"+
 		"        %v\n"+
 		"    ]\n"+
-		"}", Indent(strings.Join(fvols, "\n"), 8))
+		"    FIT=%v\n"+
+		"    Microcodes=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    ACMs=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    BIOSGuardPackages=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    KeyManifest=%v\n"+
+		"    BootPolicyManifest=%v\n"+
+		"    AMDFirmware=%v\n"+
+		"}",
+		br.Platform(),
+		Indent(strings.Join(fvols, "\n"), 8),
+		Indent(fit, 4),
+		Indent(strings.Join(microcodes, "\n"), 8),
+		Indent(strings.Join(acms, "\n"), 8),
+		Indent(strings.Join(packages, "\n"), 8),
+		Indent(km, 4),
+		Indent(bpm, 4),
+		Indent(amd, 4),
+	)
+}
+
+// MarshalBinary serializes the BIOS region, with each firmware volume at its
+// offset. Anything else is copied from the parsed buffer. It fails if a
+// volume grew over the next one, or over a FIT stored outside of it.
+func (br BiosRegion) MarshalBinary() ([]byte, error) {
+	out := append([]byte{}, br.buf...)
+	// ends holds the end of each serialized volume
+	ends := make([]uint64, len(br.FirmwareVolumes))
+	for i, fv := range br.FirmwareVolumes {
+		fvb, err := fv.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		ends[i] = fv.Offset + uint64(len(fvb))
+		for j, other := range br.FirmwareVolumes[:i] {
+			if fv.Offset < ends[j] && other.Offset < ends[i] {
+				return nil, fmt.Errorf("Cannot serialize firmware volume %s at 0x%x-0x%x: it overlaps firmware volume %s at 0x%x-0x%x",
+					fv.guidString(), fv.Offset, ends[i], other.guidString(), other.Offset, ends[j],
+				)
+			}
+		}
+		if err := splice(out, fv.Offset, fvb, "firmware volume "+fv.guidString()); err != nil {
+			return nil, err
+		}
+	}
+	// the FIT usually lives in a file of the last volume, and is written
+	// over it with its pointer
+	if br.FIT != nil {
+		fit, err := br.FIT.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		end := br.FIT.Offset + uint64(len(fit))
+		for i, fv := range br.FirmwareVolumes {
+			inside := br.FIT.Offset >= fv.Offset && end <= ends[i]
+			if !inside && br.FIT.Offset < ends[i] && fv.Offset < end {
+				return nil, fmt.Errorf("Cannot serialize the FIT at 0x%x-0x%x: it crosses the boundary of firmware volume %s at 0x%x-0x%x",
+					br.FIT.Offset, end, fv.guidString(), fv.Offset, ends[i],
+				)
+			}
+		}
+		if err := splice(out, br.FIT.Offset, fit, "FIT"); err != nil {
+			return nil, err
+		}
+		pointer, _ := br.AddressToOffset(FITPointerAddress)
+		binary.LittleEndian.PutUint64(out[pointer:], br.offsetToAddress(br.FIT.Offset))
+	}
+	return out, nil
 }
 
 // NewBiosRegion parses a sequence of bytes and returns a BiosRegion
 // object, if a valid one is passed, or an error
 func NewBiosRegion(data []byte) (*BiosRegion, error) {
-	var br BiosRegion
+	var (
+		br   = BiosRegion{buf: data}
+		base uint64
+	)
 	for {
 		offset := FindFirmwareVolumeOffset(data)
 		if offset == -1 {
 			// no firmware volume found, stop searching
 			break
 		}
+		infof("Firmware volume found at offset 0x%x", base+uint64(offset))
 		fv, err := NewFirmwareVolume(data[offset:])
 		if err != nil {
-			return nil, err
+			// skip past the signature and look for the next volume
+			next := uint64(offset) + FirmwareVolumeFixedHeaderSize - 8
+			if next > uint64(len(data)) {
+				next = uint64(len(data))
+			}
+			if n := FindFirmwareVolumeOffset(data[next:]); n != -1 {
+				next += uint64(n)
+			} else {
+				next = uint64(len(data))
+			}
+			if err := tolerate(&br.Broken, base+uint64(offset), data[offset:next], err); err != nil {
+				return nil, err
+			}
+			base += next
+			data = data[next:]
+			continue
+		}
+		fv.Offset = base + uint64(offset)
+		// always move past the signature, so the volume is not found again
+		next := uint64(offset) + fv.Length
+		if min := uint64(offset) + FirmwareVolumeFixedHeaderSize - 8; next < min {
+			next = min
 		}
-		data = data[uint64(offset)+fv.Length:]
+		base += next
+		data = data[next:]
 		br.FirmwareVolumes = append(br.FirmwareVolumes, *fv)
-		// FIXME remove the `break` and move the offset to the next location to
-		// search for FVs (i.e. offset + fv.size)
+	}
+	if _, err := FindFIT(br.buf); err != nil {
+		debugf("No FIT in the BIOS region: %v", err)
+	} else if fit, err := NewFIT(br.buf); err != nil {
+		warnf("FIT: %v", err)
+	} else {
+		br.FIT = fit
 	}
 	return &br, nil
 }
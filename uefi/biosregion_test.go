@@ -0,0 +1,60 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// parseWithTimeout parses buf, failing the test if the parser does not
+// return
+func parseWithTimeout(t *testing.T, buf []byte) (*FlashImage, error) {
+	type result struct {
+		f   *FlashImage
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		f, err := NewFlashImage(buf)
+		done <- result{f, err}
+	}()
+	select {
+	case r := <-done:
+		return r.f, r.err
+	case <-time.After(10 * time.Second):
+		t.Fatal("the parser did not return")
+	}
+	return nil, nil
+}
+
+func TestNewBiosRegionZeroLengthVolume(t *testing.T) {
+	buf, err := NewSyntheticImage(DefaultSyntheticConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// zero the length of the second volume, 8 bytes before its signature
+	first := bytes.Index(buf, []byte("_FVH"))
+	second := bytes.Index(buf[first+4:], []byte("_FVH"))
+	if first == -1 || second == -1 {
+		t.Fatal("the synthetic image has less than two volumes")
+	}
+	binary.LittleEndian.PutUint64(buf[first+4+second-8:], 0)
+
+	if _, err := parseWithTimeout(t, buf); err == nil {
+		t.Error("strict mode: expected an error")
+	}
+
+	SetParseMode(ParsePermissive)
+	defer SetParseMode(ParseStrict)
+	f, err := parseWithTimeout(t, buf)
+	if err != nil {
+		t.Fatalf("permissive mode: %v", err)
+	}
+	if len(f.ParseErrors()) == 0 {
+		t.Error("permissive mode: expected the broken volume to be reported")
+	}
+	if len(f.BiosRegion.FirmwareVolumes) == 0 {
+		t.Error("permissive mode: expected the valid volumes to be kept")
+	}
+}
@@ -0,0 +1,255 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Load option attributes
+const (
+	LoadOptionActive         = 0x00000001
+	LoadOptionForceReconnect = 0x00000002
+	LoadOptionHidden         = 0x00000008
+	LoadOptionCategory       = 0x00001f00
+	LoadOptionCategoryApp    = 0x00000100
+)
+
+// LoadOption is an EFI_LOAD_OPTION, the content of the Boot#### variables:
+// a description, the device paths of the boot loader and its arguments
+type LoadOption struct {
+	Attributes  uint32
+	Description string
+	FilePaths   []DevicePath
+	// OptionalData is passed to the loaded image
+	OptionalData []byte
+}
+
+// Active returns whether the option is considered by the boot manager
+func (o LoadOption) Active() bool {
+	return o.Attributes&LoadOptionActive != 0
+}
+
+// Hidden returns whether the option is hidden from the boot menu
+func (o LoadOption) Hidden() bool {
+	return o.Attributes&LoadOptionHidden != 0
+}
+
+// ParseLoadOption parses an EFI_LOAD_OPTION
+func ParseLoadOption(buf []byte) (*LoadOption, error) {
+	if len(buf) < 6 {
+		return nil, fmt.Errorf("Load option too small: %v bytes", len(buf))
+	}
+	o := LoadOption{Attributes: binary.LittleEndian.Uint32(buf)}
+	pathsSize := uint64(binary.LittleEndian.Uint16(buf[4:]))
+	// the description is a null-terminated UCS-2 string
+	end := uint64(6)
+	for ; end+1 < uint64(len(buf)) && (buf[end] != 0 || buf[end+1] != 0); end += 2 {
+	}
+	if end+2 > uint64(len(buf)) {
+		return nil, fmt.Errorf("Load option description is not terminated")
+	}
+	o.Description = decodeUCS2(buf[6:end])
+	start := end + 2
+	if start+pathsSize > uint64(len(buf)) {
+		return nil, fmt.Errorf("Load option device paths of 0x%x bytes exceed the option", pathsSize)
+	}
+	paths := buf[start : start+pathsSize]
+	for offset := uint64(0); offset < pathsSize; {
+		p, size, err := ParseDevicePath(paths[offset:])
+		if err != nil {
+			return nil, err
+		}
+		o.FilePaths = append(o.FilePaths, p)
+		offset += size
+	}
+	o.OptionalData = buf[start+pathsSize:]
+	return &o, nil
+}
+
+// BootEntry is a Boot#### variable, as reported by BootConfiguration
+type BootEntry struct {
+	Number      uint16
+	Description string
+	Active      bool
+	Hidden      bool
+	// Application is set for the applications that are not boot options,
+	// e.g. the setup menu
+	Application bool
+	DevicePaths []string
+	// InBootOrder tells whether the entry is listed in BootOrder
+	InBootOrder      bool
+	OptionalDataSize int
+}
+
+func (e BootEntry) String() string {
+	var flags []string
+	if e.Active {
+		flags = append(flags, "active")
+	}
+	if e.Hidden {
+		flags = append(flags, "hidden")
+	}
+	if e.Application {
+		flags = append(flags, "application")
+	}
+	if !e.InBootOrder {
+		flags = append(flags, "not in BootOrder")
+	}
+	s := fmt.Sprintf("Boot%04X %q [%s]", e.Number, e.Description, strings.Join(flags, ", "))
+	for _, p := range e.DevicePaths {
+		if p != "" {
+			s += " " + p
+		}
+	}
+	return s
+}
+
+// BootConfiguration is the boot configuration stored in the NVRAM of an
+// image, as returned by BiosRegion.BootConfiguration
+type BootConfiguration struct {
+	// Timeout is the number of seconds the boot menu waits, -1 if it is not
+	// set
+	Timeout   int
+	BootOrder []uint16
+	// BootNext is the entry to boot once, -1 if it is not set
+	BootNext int
+	Entries  []BootEntry
+	// ConIn, ConOut and ErrOut are the device paths of the consoles
+	ConIn  string `json:",omitempty"`
+	ConOut string `json:",omitempty"`
+	ErrOut string `json:",omitempty"`
+	// Errors holds the variables that could not be decoded
+	Errors []string `json:",omitempty"`
+}
+
+// Summary prints a multi-line description of the boot configuration
+func (c BootConfiguration) Summary() string {
+	var b bytes.Buffer
+	order := make([]string, 0, len(c.BootOrder))
+	for _, n := range c.BootOrder {
+		order = append(order, fmt.Sprintf("%04X", n))
+	}
+	fmt.Fprintf(&b, "BootConfiguration{\n")
+	fmt.Fprintf(&b, "    Timeout=%d\n", c.Timeout)
+	fmt.Fprintf(&b, "    BootOrder=%s\n", strings.Join(order, ","))
+	if c.BootNext >= 0 {
+		fmt.Fprintf(&b, "    BootNext=%04X\n", c.BootNext)
+	}
+	fmt.Fprintf(&b, "    ConIn=%s\n", c.ConIn)
+	fmt.Fprintf(&b, "    ConOut=%s\n", c.ConOut)
+	fmt.Fprintf(&b, "    ErrOut=%s\n", c.ErrOut)
+	fmt.Fprintf(&b, "    Entries=[\n")
+	for _, e := range c.Entries {
+		fmt.Fprintf(&b, "        %v\n", e)
+	}
+	fmt.Fprintf(&b, "    ]\n")
+	for _, err := range c.Errors {
+		fmt.Fprintf(&b, "    Error=%s\n", err)
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// bootEntryNumber returns the number of a Boot#### variable name
+func bootEntryNumber(name string) (uint16, bool) {
+	if len(name) != 8 || !strings.HasPrefix(name, "Boot") || strings.ToUpper(name[4:]) != name[4:] {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(name[4:], 16, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+// BootConfiguration decodes the boot variables of the NVRAM (Timeout,
+// BootOrder, BootNext, the Boot#### load options and the consoles) into a
+// single report. The entries are sorted in boot order, followed by the ones
+// missing from BootOrder.
+func (br BiosRegion) BootConfiguration() *BootConfiguration {
+	c := BootConfiguration{Timeout: -1, BootOrder: make([]uint16, 0), BootNext: -1, Entries: make([]BootEntry, 0)}
+	if v := br.FindVariable("Timeout", GlobalVariableGUID); v != nil && len(v.Data()) >= 2 {
+		c.Timeout = int(binary.LittleEndian.Uint16(v.Data()))
+	}
+	if v := br.FindVariable("BootNext", GlobalVariableGUID); v != nil && len(v.Data()) >= 2 {
+		c.BootNext = int(binary.LittleEndian.Uint16(v.Data()))
+	}
+	position := make(map[uint16]int)
+	if v := br.FindVariable("BootOrder", GlobalVariableGUID); v != nil {
+		data := v.Data()
+		for i := 0; i+2 <= len(data); i += 2 {
+			n := binary.LittleEndian.Uint16(data[i:])
+			c.BootOrder = append(c.BootOrder, n)
+			if _, ok := position[n]; !ok {
+				position[n] = len(position)
+			}
+		}
+	}
+	for _, name := range []string{"ConIn", "ConOut", "ErrOut"} {
+		v := br.FindVariable(name, GlobalVariableGUID)
+		if v == nil {
+			continue
+		}
+		p, _, err := ParseDevicePath(v.Data())
+		if err != nil {
+			c.Errors = append(c.Errors, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		switch name {
+		case "ConIn":
+			c.ConIn = p.String()
+		case "ConOut":
+			c.ConOut = p.String()
+		case "ErrOut":
+			c.ErrOut = p.String()
+		}
+	}
+
+	seen := make(map[uint16]bool)
+	for _, fv := range br.FirmwareVolumes {
+		if fv.VariableStore == nil {
+			continue
+		}
+		for _, v := range fv.VariableStore.ValidVariables() {
+			n, ok := bootEntryNumber(v.Name)
+			if !ok || v.GUID() != GlobalVariableGUID || seen[n] {
+				continue
+			}
+			seen[n] = true
+			o, err := ParseLoadOption(v.Data())
+			if err != nil {
+				c.Errors = append(c.Errors, fmt.Sprintf("%s: %v", v.Name, err))
+				continue
+			}
+			e := BootEntry{
+				Number:           n,
+				Description:      o.Description,
+				Active:           o.Active(),
+				Hidden:           o.Hidden(),
+				Application:      o.Attributes&LoadOptionCategory == LoadOptionCategoryApp,
+				DevicePaths:      make([]string, 0, len(o.FilePaths)),
+				OptionalDataSize: len(o.OptionalData),
+			}
+			for _, p := range o.FilePaths {
+				e.DevicePaths = append(e.DevicePaths, p.String())
+			}
+			_, e.InBootOrder = position[n]
+			c.Entries = append(c.Entries, e)
+		}
+	}
+	sort.SliceStable(c.Entries, func(i, j int) bool {
+		a, b := c.Entries[i], c.Entries[j]
+		if a.InBootOrder != b.InBootOrder {
+			return a.InBootOrder
+		}
+		if a.InBootOrder {
+			return position[a.Number] < position[b.Number]
+		}
+		return a.Number < b.Number
+	})
+	return &c
+}
@@ -0,0 +1,793 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Structure IDs of the Boot Guard manifests and of the elements of the Boot
+// Policy Manifest
+var (
+	KeyManifestID        = []byte("__KEYM__")
+	BootPolicyManifestID = []byte("__ACBP__")
+	ibbElementID         = []byte("__IBBS__")
+	platformDataID       = []byte("__PMDA__")
+	policySignatureID    = []byte("__PMSG__")
+)
+
+const (
+	// bootGuardVersion2 is the first structure version of Boot Guard 2.0;
+	// the versions of Boot Guard 1.0 are 0x1x
+	bootGuardVersion2 = 0x20
+	// bootGuardKeyRSA is the key algorithm of the RSA keys
+	bootGuardKeyRSA = 0x0001
+	// ibbSegmentNotHashed is set in the flags of the segments that are not
+	// part of the IBB hash
+	ibbSegmentNotHashed = 0x1
+	// bootGuardElementHeaderSize is the size of the header of the Boot
+	// Guard 2.0 elements, whose total size is at offset 10
+	bootGuardElementHeaderSize = 12
+)
+
+// HashAlgorithm is a TPM 2.0 algorithm ID, as used by the Boot Guard
+// manifests
+type HashAlgorithm uint16
+
+// Hash algorithms
+const (
+	HashAlgorithmSHA1   HashAlgorithm = 0x0004
+	HashAlgorithmSHA256 HashAlgorithm = 0x000b
+	HashAlgorithmSHA384 HashAlgorithm = 0x000c
+	HashAlgorithmSHA512 HashAlgorithm = 0x000d
+	HashAlgorithmNull   HashAlgorithm = 0x0010
+	HashAlgorithmSM3    HashAlgorithm = 0x0012
+)
+
+var hashAlgorithmNames = map[HashAlgorithm]string{
+	HashAlgorithmSHA1:   "SHA1",
+	HashAlgorithmSHA256: "SHA256",
+	HashAlgorithmSHA384: "SHA384",
+	HashAlgorithmSHA512: "SHA512",
+	HashAlgorithmNull:   "Null",
+	HashAlgorithmSM3:    "SM3",
+}
+
+var hashAlgorithmSizes = map[HashAlgorithm]int{
+	HashAlgorithmSHA1:   20,
+	HashAlgorithmSHA256: 32,
+	HashAlgorithmSHA384: 48,
+	HashAlgorithmSHA512: 64,
+	HashAlgorithmNull:   0,
+	HashAlgorithmSM3:    32,
+}
+
+func (a HashAlgorithm) String() string {
+	if name, ok := hashAlgorithmNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("HashAlgorithm(0x%04x)", uint16(a))
+}
+
+// BootGuardHash is a digest of a Boot Guard manifest, with its algorithm
+type BootGuardHash struct {
+	Algorithm HashAlgorithm
+	Digest    []byte
+}
+
+func (h BootGuardHash) String() string {
+	if h.Algorithm == 0 && len(h.Digest) == 0 {
+		return "<none>"
+	}
+	return fmt.Sprintf("%v:%s", h.Algorithm, hex.EncodeToString(h.Digest))
+}
+
+// validate checks that the size of the digest matches its algorithm
+func (h BootGuardHash) validate(name string) error {
+	size, ok := hashAlgorithmSizes[h.Algorithm]
+	if !ok {
+		return fmt.Errorf("%s has unknown hash algorithm %v", name, h.Algorithm)
+	}
+	if size != len(h.Digest) {
+		return fmt.Errorf("%s is %v bytes, expected %v for %v", name, len(h.Digest), size, h.Algorithm)
+	}
+	return nil
+}
+
+func readBootGuardHash(r *bytes.Reader) (BootGuardHash, error) {
+	var hdr struct {
+		Algorithm HashAlgorithm
+		Size      uint16
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return BootGuardHash{}, err
+	}
+	h := BootGuardHash{Algorithm: hdr.Algorithm, Digest: make([]byte, hdr.Size)}
+	if _, err := io.ReadFull(r, h.Digest); err != nil {
+		return BootGuardHash{}, err
+	}
+	return h, nil
+}
+
+// BootGuardKeySignature is the public key and the signature of a Boot Guard
+// manifest. Only RSA keys are supported.
+type BootGuardKeySignature struct {
+	Version      uint8
+	KeyAlgorithm uint16
+	KeyVersion   uint8
+	// KeySize is in bits
+	KeySize  uint16
+	Exponent uint32
+	// Modulus and Signature are little endian
+	Modulus          []byte
+	SignatureScheme  uint16
+	SignatureVersion uint8
+	// SignatureKeySize is in bits
+	SignatureKeySize       uint16
+	SignatureHashAlgorithm HashAlgorithm
+	Signature              []byte
+}
+
+func (k BootGuardKeySignature) String() string {
+	return fmt.Sprintf("KeySignature{Key=RSA%d, Exponent=%d, Scheme=0x%04x, Hash=%v}",
+		k.KeySize, k.Exponent, k.SignatureScheme, k.SignatureHashAlgorithm)
+}
+
+// validate checks that the signature matches the size of the key
+func (k BootGuardKeySignature) validate(name string) []error {
+	errors := make([]error, 0)
+	if k.SignatureKeySize != k.KeySize {
+		errors = append(errors, fmt.Errorf("%s signature is %v bits, but the key is %v bits", name, k.SignatureKeySize, k.KeySize))
+	}
+	if _, ok := hashAlgorithmSizes[k.SignatureHashAlgorithm]; !ok {
+		errors = append(errors, fmt.Errorf("%s signature has unknown hash algorithm %v", name, k.SignatureHashAlgorithm))
+	}
+	return errors
+}
+
+func readBootGuardKeySignature(r *bytes.Reader) (*BootGuardKeySignature, error) {
+	var k BootGuardKeySignature
+	var key struct {
+		Version      uint8
+		KeyAlgorithm uint16
+		KeyVersion   uint8
+		KeySize      uint16
+		Exponent     uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &key); err != nil {
+		return nil, err
+	}
+	if key.KeyAlgorithm != bootGuardKeyRSA {
+		return nil, fmt.Errorf("Unsupported key algorithm 0x%04x", key.KeyAlgorithm)
+	}
+	k.Version, k.KeyAlgorithm, k.KeyVersion, k.KeySize, k.Exponent = key.Version, key.KeyAlgorithm, key.KeyVersion, key.KeySize, key.Exponent
+	k.Modulus = make([]byte, k.KeySize/8)
+	if _, err := io.ReadFull(r, k.Modulus); err != nil {
+		return nil, err
+	}
+	var sig struct {
+		Scheme        uint16
+		Version       uint8
+		KeySize       uint16
+		HashAlgorithm HashAlgorithm
+	}
+	if err := binary.Read(r, binary.LittleEndian, &sig); err != nil {
+		return nil, err
+	}
+	k.SignatureScheme, k.SignatureVersion, k.SignatureKeySize, k.SignatureHashAlgorithm = sig.Scheme, sig.Version, sig.KeySize, sig.HashAlgorithm
+	k.Signature = make([]byte, k.SignatureKeySize/8)
+	if _, err := io.ReadFull(r, k.Signature); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// KeyManifestHash is a key hash of the Key Manifest, with the mask of the
+// manifests the key is allowed to sign
+type KeyManifestHash struct {
+	Usage uint64
+	Hash  BootGuardHash
+}
+
+// KeyManifest is the Boot Guard Key Manifest, signed by the OEM key whose
+// hash is fused in the chipset. It holds the hash of the key of the Boot
+// Policy Manifest.
+type KeyManifest struct {
+	// Version is the structure version: 0x1x for Boot Guard 1.0, 0x2x for
+	// Boot Guard 2.0
+	Version   uint8
+	KMVersion uint8
+	KMSVN     uint8
+	KMID      uint8
+	// FPFHashAlgorithm is the algorithm of the key hash fused in the
+	// chipset, only set on Boot Guard 2.0
+	FPFHashAlgorithm HashAlgorithm
+	// Hashes holds the hash of the Boot Policy Manifest key, with usage 1
+	// on Boot Guard 1.0
+	Hashes       []KeyManifestHash
+	KeySignature BootGuardKeySignature
+	// Offset is the position of the manifest from the start of the BIOS
+	// region
+	Offset uint64
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the manifest
+func (km KeyManifest) Buf() []byte {
+	return km.buf
+}
+
+func (km KeyManifest) String() string {
+	return fmt.Sprintf("KeyManifest{Version=0x%02x, ID=%d, SVN=%d, Size=%v}", km.Version, km.KMID, km.KMSVN, len(km.buf))
+}
+
+// Summary prints a multi-line description of the manifest
+func (km KeyManifest) Summary() string {
+	var hashes []string
+	for _, h := range km.Hashes {
+		hashes = append(hashes, fmt.Sprintf("Usage=0x%x %v", h.Usage, h.Hash))
+	}
+	return fmt.Sprintf("KeyManifest{\n"+
+		"    Offset=0x%x\n"+
+		"    Version=0x%02x\n"+
+		"    KMVersion=0x%02x\n"+
+		"    KMSVN=%d\n"+
+		"    KMID=%d\n"+
+		"    Hashes=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    %v\n"+
+		"}",
+		km.Offset,
+		km.Version,
+		km.KMVersion,
+		km.KMSVN,
+		km.KMID,
+		Indent(strings.Join(hashes, "\n"), 8),
+		km.KeySignature,
+	)
+}
+
+// Validate checks the sizes of the hashes and of the key
+func (km KeyManifest) Validate() []error {
+	errors := make([]error, 0)
+	for i, h := range km.Hashes {
+		if err := h.Hash.validate(fmt.Sprintf("Key Manifest hash %d", i+1)); err != nil {
+			errors = append(errors, err)
+		}
+	}
+	errors = append(errors, km.KeySignature.validate("Key Manifest")...)
+	return errors
+}
+
+// NewKeyManifest parses the Key Manifest at the start of buf
+func NewKeyManifest(buf []byte) (*KeyManifest, error) {
+	if len(buf) < len(KeyManifestID)+1 || !bytes.Equal(buf[:len(KeyManifestID)], KeyManifestID) {
+		return nil, fmt.Errorf("Key Manifest signature %q not found", KeyManifestID)
+	}
+	km := KeyManifest{Version: buf[len(KeyManifestID)]}
+	r := bytes.NewReader(buf)
+	if km.Version < bootGuardVersion2 {
+		var hdr struct {
+			ID        [8]byte
+			Version   uint8
+			KMVersion uint8
+			KMSVN     uint8
+			KMID      uint8
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			return nil, err
+		}
+		km.KMVersion, km.KMSVN, km.KMID = hdr.KMVersion, hdr.KMSVN, hdr.KMID
+		h, err := readBootGuardHash(r)
+		if err != nil {
+			return nil, fmt.Errorf("Key Manifest hash: %v", err)
+		}
+		km.Hashes = []KeyManifestHash{{Usage: 1, Hash: h}}
+	} else {
+		var hdr struct {
+			ID                 [8]byte
+			Version            uint8
+			Reserved0          [3]uint8
+			KeySignatureOffset uint16
+			Reserved1          [3]uint8
+			KMVersion          uint8
+			KMSVN              uint8
+			KMID               uint8
+			FPFHashAlgorithm   HashAlgorithm
+			KeyCount           uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			return nil, err
+		}
+		km.KMVersion, km.KMSVN, km.KMID, km.FPFHashAlgorithm = hdr.KMVersion, hdr.KMSVN, hdr.KMID, hdr.FPFHashAlgorithm
+		for i := 0; i < int(hdr.KeyCount); i++ {
+			var usage uint64
+			if err := binary.Read(r, binary.LittleEndian, &usage); err != nil {
+				return nil, err
+			}
+			h, err := readBootGuardHash(r)
+			if err != nil {
+				return nil, fmt.Errorf("Key Manifest hash %d: %v", i+1, err)
+			}
+			km.Hashes = append(km.Hashes, KeyManifestHash{Usage: usage, Hash: h})
+		}
+		if _, err := r.Seek(int64(hdr.KeySignatureOffset), io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	k, err := readBootGuardKeySignature(r)
+	if err != nil {
+		return nil, fmt.Errorf("Key Manifest signature: %v", err)
+	}
+	km.KeySignature = *k
+	km.buf = buf[:r.Size()-int64(r.Len())]
+	return &km, nil
+}
+
+// IBBSegment is a range of the flash, mapped below 4GB, that is part of the
+// Initial Boot Block
+type IBBSegment struct {
+	Reserved uint16
+	Flags    uint16
+	Base     uint32
+	Size     uint32
+}
+
+// Hashed returns whether the segment is measured in the IBB hash
+func (s IBBSegment) Hashed() bool {
+	return s.Flags&ibbSegmentNotHashed == 0
+}
+
+func (s IBBSegment) String() string {
+	return fmt.Sprintf("IBBSegment{Base=0x%08x, Size=0x%x, Hashed=%v}", s.Base, s.Size, s.Hashed())
+}
+
+// IBB flags
+const (
+	IBBFlagEnableVTd          = 0x1
+	IBBFlagInitialMeasureLoc3 = 0x2
+)
+
+// IBBFlags are the security flags of an IBB element
+type IBBFlags uint32
+
+func (f IBBFlags) String() string {
+	var names []string
+	if f&IBBFlagEnableVTd != 0 {
+		names = append(names, "EnableVTd")
+	}
+	if f&IBBFlagInitialMeasureLoc3 != 0 {
+		names = append(names, "InitialMeasureLoc3")
+	}
+	if rest := f &^ (IBBFlagEnableVTd | IBBFlagInitialMeasureLoc3); rest != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(rest)))
+	}
+	if len(names) == 0 {
+		return "0"
+	}
+	return strings.Join(names, "|")
+}
+
+// IBBElement is the element of the Boot Policy Manifest describing the
+// Initial Boot Block: the segments verified by the ACM, their hashes and the
+// entry point
+type IBBElement struct {
+	Version uint8
+	// SetNumber and PBETValue are only set on Boot Guard 2.0
+	SetNumber           uint8
+	PBETValue           uint8
+	Flags               IBBFlags
+	MCHBar              uint64
+	VTdBar              uint64
+	DMAProtectionBase0  uint32
+	DMAProtectionLimit0 uint32
+	DMAProtectionBase1  uint64
+	DMAProtectionLimit1 uint64
+	PostIBBHash         BootGuardHash
+	EntryPoint          uint32
+	// Hashes holds the IBB hash, one per algorithm on Boot Guard 2.0
+	Hashes []BootGuardHash
+	// OBBHash is only set on Boot Guard 2.0
+	OBBHash  BootGuardHash
+	Segments []IBBSegment
+}
+
+// Summary prints a multi-line description of the element
+func (e IBBElement) Summary() string {
+	var hashes, segments []string
+	for _, h := range e.Hashes {
+		hashes = append(hashes, h.String())
+	}
+	for _, s := range e.Segments {
+		segments = append(segments, s.String())
+	}
+	return fmt.Sprintf("IBBElement{\n"+
+		"    Version=0x%02x\n"+
+		"    SetNumber=%d\n"+
+		"    Flags=%v\n"+
+		"    MCHBar=0x%x\n"+
+		"    VTdBar=0x%x\n"+
+		"    DMAProtection=[0x%x-0x%x] [0x%x-0x%x]\n"+
+		"    PostIBBHash=%v\n"+
+		"    EntryPoint=0x%08x\n"+
+		"    Hashes=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    OBBHash=%v\n"+
+		"    Segments=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		e.Version,
+		e.SetNumber,
+		e.Flags,
+		e.MCHBar,
+		e.VTdBar,
+		e.DMAProtectionBase0, e.DMAProtectionLimit0, e.DMAProtectionBase1, e.DMAProtectionLimit1,
+		e.PostIBBHash,
+		e.EntryPoint,
+		Indent(strings.Join(hashes, "\n"), 8),
+		e.OBBHash,
+		Indent(strings.Join(segments, "\n"), 8),
+	)
+}
+
+func readIBBElement(r *bytes.Reader) (*IBBElement, error) {
+	var e IBBElement
+	var hdr struct {
+		ID        [8]byte
+		Version   uint8
+		Reserved0 uint8
+		Size      uint16
+		Reserved1 uint8
+		SetNumber uint8
+		Reserved2 uint8
+		PBETValue uint8
+	}
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	e.Version = hdr.Version
+	if e.Version < bootGuardVersion2 {
+		// the Boot Guard 1.0 element has 3 reserved bytes after the
+		// version, and no set
+		if _, err := r.Seek(-4, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	} else {
+		e.SetNumber, e.PBETValue = hdr.SetNumber, hdr.PBETValue
+	}
+	var fixed struct {
+		Flags               IBBFlags
+		MCHBar              uint64
+		VTdBar              uint64
+		DMAProtectionBase0  uint32
+		DMAProtectionLimit0 uint32
+		DMAProtectionBase1  uint64
+		DMAProtectionLimit1 uint64
+	}
+	if err := binary.Read(r, binary.LittleEndian, &fixed); err != nil {
+		return nil, err
+	}
+	e.Flags, e.MCHBar, e.VTdBar = fixed.Flags, fixed.MCHBar, fixed.VTdBar
+	e.DMAProtectionBase0, e.DMAProtectionLimit0 = fixed.DMAProtectionBase0, fixed.DMAProtectionLimit0
+	e.DMAProtectionBase1, e.DMAProtectionLimit1 = fixed.DMAProtectionBase1, fixed.DMAProtectionLimit1
+	var err error
+	if e.PostIBBHash, err = readBootGuardHash(r); err != nil {
+		return nil, fmt.Errorf("Post-IBB hash: %v", err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &e.EntryPoint); err != nil {
+		return nil, err
+	}
+	if e.Version < bootGuardVersion2 {
+		h, err := readBootGuardHash(r)
+		if err != nil {
+			return nil, fmt.Errorf("IBB hash: %v", err)
+		}
+		e.Hashes = []BootGuardHash{h}
+	} else {
+		var list struct {
+			Size  uint16
+			Count uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &list); err != nil {
+			return nil, err
+		}
+		for i := 0; i < int(list.Count); i++ {
+			h, err := readBootGuardHash(r)
+			if err != nil {
+				return nil, fmt.Errorf("IBB hash %d: %v", i+1, err)
+			}
+			e.Hashes = append(e.Hashes, h)
+		}
+		if e.OBBHash, err = readBootGuardHash(r); err != nil {
+			return nil, fmt.Errorf("OBB hash: %v", err)
+		}
+		if _, err := r.Seek(3, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+	}
+	var count uint8
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	e.Segments = make([]IBBSegment, count)
+	if err := binary.Read(r, binary.LittleEndian, e.Segments); err != nil {
+		return nil, fmt.Errorf("IBB segments: %v", err)
+	}
+	return &e, nil
+}
+
+// BootPolicyManifest is the Boot Guard Boot Policy Manifest, which describes
+// the Initial Boot Block the ACM verifies before executing the firmware
+type BootPolicyManifest struct {
+	// Version is the structure version: 0x1x for Boot Guard 1.0, 0x2x for
+	// Boot Guard 2.0
+	Version  uint8
+	Revision uint8
+	SVN      uint8
+	ACMSVN   uint8
+	// NEMDataSize is the size of the cache used as RAM, in 4KB pages
+	NEMDataSize uint16
+	IBBs        []IBBElement
+	// PlatformData is the content of the optional platform manufacturer
+	// element
+	PlatformData []byte
+	// Elements lists the IDs of the elements of the manifest, in order
+	Elements     []string
+	KeySignature BootGuardKeySignature
+	// Offset is the position of the manifest from the start of the BIOS
+	// region
+	Offset uint64
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the manifest
+func (bpm BootPolicyManifest) Buf() []byte {
+	return bpm.buf
+}
+
+func (bpm BootPolicyManifest) String() string {
+	return fmt.Sprintf("BootPolicyManifest{Version=0x%02x, Revision=%d, SVN=%d, IBBs=%d, Size=%v}",
+		bpm.Version, bpm.Revision, bpm.SVN, len(bpm.IBBs), len(bpm.buf))
+}
+
+// Summary prints a multi-line description of the manifest
+func (bpm BootPolicyManifest) Summary() string {
+	var ibbs []string
+	for _, e := range bpm.IBBs {
+		ibbs = append(ibbs, e.Summary())
+	}
+	return fmt.Sprintf("BootPolicyManifest{\n"+
+		"    Offset=0x%x\n"+
+		"    Version=0x%02x\n"+
+		"    Revision=%d\n"+
+		"    SVN=%d\n"+
+		"    ACMSVN=%d\n"+
+		"    NEMDataSize=%d pages\n"+
+		"    Elements=%v\n"+
+		"    IBBs=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    PlatformData=%d bytes\n"+
+		"    %v\n"+
+		"}",
+		bpm.Offset,
+		bpm.Version,
+		bpm.Revision,
+		bpm.SVN,
+		bpm.ACMSVN,
+		bpm.NEMDataSize,
+		strings.Join(bpm.Elements, ","),
+		Indent(strings.Join(ibbs, "\n"), 8),
+		len(bpm.PlatformData),
+		bpm.KeySignature,
+	)
+}
+
+// Validate checks the hashes, that the IBB segments are inside a BIOS region
+// of the given size, and that the entry point is in a hashed segment
+func (bpm BootPolicyManifest) Validate(regionSize uint64) []error {
+	errors := make([]error, 0)
+	if len(bpm.IBBs) == 0 {
+		errors = append(errors, fmt.Errorf("Boot Policy Manifest has no IBB element"))
+	}
+	for i, e := range bpm.IBBs {
+		name := fmt.Sprintf("IBB element %d", i+1)
+		for _, h := range e.Hashes {
+			if err := h.validate(name + " hash"); err != nil {
+				errors = append(errors, err)
+			}
+		}
+		entryHashed := false
+		for j, s := range e.Segments {
+			if s.Size == 0 {
+				errors = append(errors, fmt.Errorf("%s segment %d at 0x%x is empty", name, j+1, s.Base))
+			} else if _, err := addressToOffset(uint64(s.Base), regionSize); err != nil {
+				errors = append(errors, fmt.Errorf("%s segment %d: %v", name, j+1, err))
+			} else if _, err := addressToOffset(uint64(s.Base)+uint64(s.Size)-1, regionSize); err != nil {
+				errors = append(errors, fmt.Errorf("%s segment %d [0x%x-0x%x] exceeds the BIOS region", name, j+1, s.Base, uint64(s.Base)+uint64(s.Size)))
+			}
+			if s.Hashed() && e.EntryPoint >= s.Base && uint64(e.EntryPoint) < uint64(s.Base)+uint64(s.Size) {
+				entryHashed = true
+			}
+		}
+		if !entryHashed {
+			errors = append(errors, fmt.Errorf("%s entry point 0x%08x is not in a hashed segment", name, e.EntryPoint))
+		}
+	}
+	errors = append(errors, bpm.KeySignature.validate("Boot Policy Manifest")...)
+	return errors
+}
+
+// NewBootPolicyManifest parses the Boot Policy Manifest at the start of buf
+func NewBootPolicyManifest(buf []byte) (*BootPolicyManifest, error) {
+	if len(buf) < len(BootPolicyManifestID)+1 || !bytes.Equal(buf[:len(BootPolicyManifestID)], BootPolicyManifestID) {
+		return nil, fmt.Errorf("Boot Policy Manifest signature %q not found", BootPolicyManifestID)
+	}
+	bpm := BootPolicyManifest{Version: buf[len(BootPolicyManifestID)]}
+	r := bytes.NewReader(buf)
+	if bpm.Version < bootGuardVersion2 {
+		var hdr struct {
+			ID          [8]byte
+			Version     uint8
+			Reserved0   uint8
+			Revision    uint8
+			SVN         uint8
+			ACMSVN      uint8
+			Reserved1   uint8
+			NEMDataSize uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			return nil, err
+		}
+		bpm.Revision, bpm.SVN, bpm.ACMSVN, bpm.NEMDataSize = hdr.Revision, hdr.SVN, hdr.ACMSVN, hdr.NEMDataSize
+	} else {
+		var hdr struct {
+			ID                 [8]byte
+			Version            uint8
+			HeaderVersion      uint8
+			HeaderSize         uint16
+			KeySignatureOffset uint16
+			Revision           uint8
+			SVN                uint8
+			ACMSVN             uint8
+			Reserved           uint8
+			NEMDataSize        uint16
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			return nil, err
+		}
+		bpm.Revision, bpm.SVN, bpm.ACMSVN, bpm.NEMDataSize = hdr.Revision, hdr.SVN, hdr.ACMSVN, hdr.NEMDataSize
+	}
+
+	// the elements follow the header, up to the signature element, which
+	// is the last one
+	for {
+		start := r.Size() - int64(r.Len())
+		var hdr struct {
+			ID      [8]byte
+			Version uint8
+		}
+		if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+			return nil, fmt.Errorf("Boot Policy Manifest element at 0x%x: %v", start, err)
+		}
+		if _, err := r.Seek(start, io.SeekStart); err != nil {
+			return nil, err
+		}
+		id := string(hdr.ID[:])
+		bpm.Elements = append(bpm.Elements, strings.Trim(id, "_"))
+		switch {
+		case id == string(ibbElementID):
+			e, err := readIBBElement(r)
+			if err != nil {
+				return nil, fmt.Errorf("IBB element at 0x%x: %v", start, err)
+			}
+			bpm.IBBs = append(bpm.IBBs, *e)
+		case id == string(policySignatureID):
+			// 3 reserved bytes follow the version on Boot Guard 2.0
+			skip := int64(len(policySignatureID) + 1)
+			if hdr.Version >= bootGuardVersion2 {
+				skip += 3
+			}
+			if _, err := r.Seek(skip, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			k, err := readBootGuardKeySignature(r)
+			if err != nil {
+				return nil, fmt.Errorf("Boot Policy Manifest signature: %v", err)
+			}
+			bpm.KeySignature = *k
+			bpm.buf = buf[:r.Size()-int64(r.Len())]
+			return &bpm, nil
+		case id == string(platformDataID) && hdr.Version < bootGuardVersion2:
+			var size uint16
+			if _, err := r.Seek(int64(len(platformDataID)+1), io.SeekCurrent); err != nil {
+				return nil, err
+			}
+			if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+				return nil, err
+			}
+			bpm.PlatformData = make([]byte, size)
+			if _, err := io.ReadFull(r, bpm.PlatformData); err != nil {
+				return nil, fmt.Errorf("Platform data element at 0x%x: %v", start, err)
+			}
+		case hdr.Version >= bootGuardVersion2:
+			// the Boot Guard 2.0 elements have their size in the header
+			var eh struct {
+				ID       [8]byte
+				Version  uint8
+				Reserved uint8
+				Size     uint16
+			}
+			if err := binary.Read(r, binary.LittleEndian, &eh); err != nil {
+				return nil, err
+			}
+			if eh.Size < bootGuardElementHeaderSize || start+int64(eh.Size) > r.Size() {
+				return nil, fmt.Errorf("Invalid size 0x%x of element %q at 0x%x", eh.Size, id, start)
+			}
+			data := buf[start+bootGuardElementHeaderSize : start+int64(eh.Size)]
+			if id == string(platformDataID) {
+				bpm.PlatformData = data
+			}
+			if _, err := r.Seek(start+int64(eh.Size), io.SeekStart); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("Unknown Boot Policy Manifest element %q at 0x%x", id, start)
+		}
+	}
+}
+
+// fitComponent returns the buffer and the offset of the component of the
+// first FIT entry of the given type, or a nil buffer if there is none
+func (br BiosRegion) fitComponent(typ FITEntryType) ([]byte, uint64, error) {
+	if br.FIT == nil {
+		return nil, 0, nil
+	}
+	entries := br.FIT.EntriesOfType(typ)
+	if len(entries) == 0 {
+		return nil, 0, nil
+	}
+	offset, err := br.AddressToOffset(entries[0].Address)
+	if err != nil {
+		return nil, 0, fmt.Errorf("FIT entry of type %v: %v", typ, err)
+	}
+	return br.buf[offset:], offset, nil
+}
+
+// KeyManifest returns the Boot Guard Key Manifest referenced by the FIT, or
+// nil if there is none
+func (br BiosRegion) KeyManifest() (*KeyManifest, error) {
+	buf, offset, err := br.fitComponent(FITTypeKeyManifest)
+	if buf == nil || err != nil {
+		return nil, err
+	}
+	km, err := NewKeyManifest(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Key Manifest at 0x%x: %v", offset, err)
+	}
+	km.Offset = offset
+	return km, nil
+}
+
+// BootPolicyManifest returns the Boot Guard Boot Policy Manifest referenced
+// by the FIT, or nil if there is none
+func (br BiosRegion) BootPolicyManifest() (*BootPolicyManifest, error) {
+	buf, offset, err := br.fitComponent(FITTypeBootPolicyManifest)
+	if buf == nil || err != nil {
+		return nil, err
+	}
+	bpm, err := NewBootPolicyManifest(buf)
+	if err != nil {
+		return nil, fmt.Errorf("Boot Policy Manifest at 0x%x: %v", offset, err)
+	}
+	bpm.Offset = offset
+	return bpm, nil
+}
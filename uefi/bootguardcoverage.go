@@ -0,0 +1,118 @@
+package uefi
+
+import (
+	"fmt"
+	"sort"
+)
+
+// BootGuardCoverage is the part of a firmware volume of the BIOS region
+// verified by Boot Guard, as computed by BiosRegion.BootGuardCoverage
+type BootGuardCoverage struct {
+	// Volume is the file system GUID of the volume, with its name
+	Volume string
+	// Offset is the position of the volume from the start of the BIOS
+	// region
+	Offset uint64
+	Size   uint64
+	// Covered is the number of bytes of the volume in the hashed IBB
+	// segments
+	Covered uint64
+}
+
+// Status returns whether the volume is fully, partially or not covered
+func (c BootGuardCoverage) Status() string {
+	switch {
+	case c.Covered == 0:
+		return "not covered"
+	case c.Covered == c.Size:
+		return "covered"
+	}
+	return "partially covered"
+}
+
+func (c BootGuardCoverage) String() string {
+	return fmt.Sprintf("FV %s at 0x%x: 0x%x of 0x%x bytes verified (%.1f%%), %s",
+		c.Volume, c.Offset, c.Covered, c.Size, 100*float64(c.Covered)/float64(c.Size), c.Status())
+}
+
+// ibbRange is a range of the BIOS region, [start, end)
+type ibbRange struct {
+	start, end uint64
+}
+
+// hashedRanges returns the ranges of a BIOS region of the given size that
+// are in the hashed segments of the IBB elements, sorted and merged
+func (bpm BootPolicyManifest) hashedRanges(regionSize uint64) []ibbRange {
+	const top = 1 << 32
+	var ranges []ibbRange
+	for _, e := range bpm.IBBs {
+		for _, s := range e.Segments {
+			if !s.Hashed() {
+				continue
+			}
+			start, end := uint64(s.Base), uint64(s.Base)+uint64(s.Size)
+			if start < top-regionSize {
+				start = top - regionSize
+			}
+			if end > top {
+				end = top
+			}
+			if start < end {
+				ranges = append(ranges, ibbRange{start - (top - regionSize), end - (top - regionSize)})
+			}
+		}
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	var merged []ibbRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.start <= merged[n-1].end {
+			if r.end > merged[n-1].end {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// BootGuardCoverage returns, for each firmware volume of the region, how
+// much of it is in the hashed IBB segments of the Boot Policy Manifest, and
+// so verified by Boot Guard before the firmware runs. The volumes that are
+// not covered are only protected if the IBB verifies them itself.
+func (br BiosRegion) BootGuardCoverage() ([]BootGuardCoverage, error) {
+	bpm, err := br.BootPolicyManifest()
+	if err != nil {
+		return nil, err
+	}
+	if bpm == nil {
+		return nil, fmt.Errorf("The BIOS region has no Boot Policy Manifest")
+	}
+	ranges := bpm.hashedRanges(uint64(len(br.buf)))
+	coverage := make([]BootGuardCoverage, 0, len(br.FirmwareVolumes))
+	for _, fv := range br.FirmwareVolumes {
+		name, ok := FirmwareVolumeGUIDs[fv.guidString()]
+		if !ok {
+			name = "Unknown"
+		}
+		c := BootGuardCoverage{
+			Volume: fmt.Sprintf("%s (%s)", fv.guidString(), name),
+			Offset: fv.Offset,
+			Size:   fv.Length,
+		}
+		for _, r := range ranges {
+			start, end := r.start, r.end
+			if start < fv.Offset {
+				start = fv.Offset
+			}
+			if end > fv.Offset+fv.Length {
+				end = fv.Offset + fv.Length
+			}
+			if start < end {
+				c.Covered += end - start
+			}
+		}
+		coverage = append(coverage, c)
+	}
+	return coverage, nil
+}
@@ -0,0 +1,276 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// BPDTSignature is the signature of the boot partition descriptor
+	// tables, and of the sub-tables
+	BPDTSignature = 0x000055aa
+	// BPDTHeaderSize is the size of the header of a BPDT
+	BPDTHeaderSize = 24
+	// BPDTEntrySize is the size of an entry of a BPDT
+	BPDTEntrySize = 12
+	// bpdtEntriesMax bounds the number of entries, to reject garbage
+	bpdtEntriesMax = 64
+)
+
+// BPDTEntryType is the type of the subpartition described by a BPDT entry
+type BPDTEntryType uint16
+
+// BPDT entry types
+const (
+	BPDTTypeSMIP BPDTEntryType = iota
+	BPDTTypeRBEP
+	BPDTTypeFTPR
+	BPDTTypeUCOD
+	BPDTTypeIBBP
+	BPDTTypeSBPDT
+	BPDTTypeOBBP
+	BPDTTypeNFTP
+	BPDTTypeISHP
+	BPDTTypeDLMP
+	BPDTTypeIFPOverride
+	BPDTTypeDebugTokens
+	BPDTTypeUFSPhy
+	BPDTTypeUFSGPP
+	BPDTTypePMCP
+	BPDTTypeIUNP
+	BPDTTypeNVMConfig
+	BPDTTypeUEP
+	BPDTTypeUFSRateB
+)
+
+var bpdtEntryTypeNames = map[BPDTEntryType]string{
+	BPDTTypeSMIP:        "SMIP",
+	BPDTTypeRBEP:        "RBEP",
+	BPDTTypeFTPR:        "FTPR",
+	BPDTTypeUCOD:        "UCOD",
+	BPDTTypeIBBP:        "IBBP",
+	BPDTTypeSBPDT:       "S_BPDT",
+	BPDTTypeOBBP:        "OBBP",
+	BPDTTypeNFTP:        "NFTP",
+	BPDTTypeISHP:        "ISHP",
+	BPDTTypeDLMP:        "DLMP",
+	BPDTTypeIFPOverride: "IFP_OVERRIDE",
+	BPDTTypeDebugTokens: "DEBUG_TOKENS",
+	BPDTTypeUFSPhy:      "UFS_PHY",
+	BPDTTypeUFSGPP:      "UFS_GPP",
+	BPDTTypePMCP:        "PMCP",
+	BPDTTypeIUNP:        "IUNP",
+	BPDTTypeNVMConfig:   "NVM_CONFIG",
+	BPDTTypeUEP:         "UEP",
+	BPDTTypeUFSRateB:    "UFS_RATE_B",
+}
+
+func (t BPDTEntryType) String() string {
+	if name, ok := bpdtEntryTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("BPDTEntryType(%d)", uint16(t))
+}
+
+// BPDTHeader is the header of a boot partition descriptor table
+type BPDTHeader struct {
+	Signature       uint32
+	DescriptorCount uint16
+	Version         uint16
+	XorChecksum     uint32
+	IFWIVersion     uint32
+	// FitMajor, FitMinor, FitHotfix and FitBuild are the version of the
+	// tool that built the image
+	FitMajor  uint16
+	FitMinor  uint16
+	FitHotfix uint16
+	FitBuild  uint16
+}
+
+// BPDTEntry is an entry of a BPDT. The offset is relative to the start of
+// the boot partition, also for the entries of the sub-tables.
+type BPDTEntry struct {
+	Type   BPDTEntryType
+	Flags  uint16
+	Offset uint32
+	Size   uint32
+}
+
+// Present returns whether the subpartition has data
+func (e BPDTEntry) Present() bool {
+	return e.Size != 0
+}
+
+func (e BPDTEntry) String() string {
+	return fmt.Sprintf("BPDTEntry{Type=%v, Offset=0x%x, Size=0x%x}", e.Type, e.Offset, e.Size)
+}
+
+// BPDT is a boot partition descriptor table, which lists the subpartitions
+// of a boot partition of an IFWI: the CSE firmware, microcode, and the
+// initial boot blocks
+type BPDT struct {
+	// Offset is the position of the table in its boot partition
+	Offset  uint32
+	Header  BPDTHeader
+	Entries []BPDTEntry
+	// SubBPDT is the table pointed to by the S_BPDT entry, if any
+	SubBPDT *BPDT
+	// Directories are the $CPD directories of the subpartitions, named
+	// after the type of their entry
+	Directories []*MeCPD
+}
+
+// AllEntries returns the entries of the table followed by the ones of the
+// sub-table
+func (b BPDT) AllEntries() []BPDTEntry {
+	entries := append([]BPDTEntry{}, b.Entries...)
+	if b.SubBPDT != nil {
+		entries = append(entries, b.SubBPDT.AllEntries()...)
+	}
+	return entries
+}
+
+// Version returns the version of the CSE firmware from the manifest of the
+// FTPR subpartition, and whether it was found
+func (b BPDT) Version() (MeVersion, bool) {
+	for _, c := range b.Directories {
+		if c.Partition != BPDTTypeFTPR.String() {
+			continue
+		}
+		for _, e := range c.Entries {
+			if e.Kind() != "manifest" {
+				continue
+			}
+			data, err := c.ModuleData(e)
+			if err != nil {
+				continue
+			}
+			if offset := FindMeManifest(data); offset >= 0 {
+				if h, err := NewMeManifestHeader(data[offset:]); err == nil {
+					return h.Version, true
+				}
+			}
+		}
+	}
+	return MeVersion{}, false
+}
+
+// Summary prints a multi-line description of the table
+func (b BPDT) Summary() string {
+	var entries, directories []string
+	for _, e := range b.Entries {
+		entries = append(entries, e.String())
+	}
+	for _, c := range b.Directories {
+		directories = append(directories, c.Summary())
+	}
+	sub := "<none>"
+	if b.SubBPDT != nil {
+		sub = b.SubBPDT.Summary()
+	}
+	return fmt.Sprintf("BPDT{\n"+
+		"    Offset=0x%x\n"+
+		"    Version=%v\n"+
+		"    DescriptorCount=%v\n"+
+		"    FitVersion=%d.%d.%d.%d\n"+
+		"    Entries=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    SubBPDT=%v\n"+
+		"    Directories=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		b.Offset,
+		b.Header.Version,
+		b.Header.DescriptorCount,
+		b.Header.FitMajor, b.Header.FitMinor, b.Header.FitHotfix, b.Header.FitBuild,
+		Indent(strings.Join(entries, "\n"), 8),
+		Indent(sub, 4),
+		Indent(strings.Join(directories, "\n"), 8),
+	)
+}
+
+// Validate checks that the subpartitions fit in a boot partition of the
+// given size
+func (b BPDT) Validate(size uint32) []error {
+	errors := make([]error, 0)
+	for _, e := range b.Entries {
+		if !e.Present() {
+			continue
+		}
+		if end := uint64(e.Offset) + uint64(e.Size); end > uint64(size) {
+			errors = append(errors, fmt.Errorf("BPDT subpartition %v [0x%x-0x%x] exceeds the boot partition size 0x%x",
+				e.Type, e.Offset, end, size))
+		}
+	}
+	if b.SubBPDT != nil {
+		errors = append(errors, b.SubBPDT.Validate(size)...)
+	}
+	return errors
+}
+
+// IsBPDT returns whether buf starts with a BPDT signature
+func IsBPDT(buf []byte) bool {
+	return len(buf) >= BPDTHeaderSize && binary.LittleEndian.Uint32(buf) == BPDTSignature
+}
+
+// NewBPDT parses the BPDT at the given offset of a boot partition, and its
+// sub-table and $CPD directories
+func NewBPDT(bp []byte, offset uint32) (*BPDT, error) {
+	return newBPDT(bp, offset, false)
+}
+
+// newBPDT parses a BPDT, sub tells whether it is a sub-table, which cannot
+// have sub-tables of its own
+func newBPDT(bp []byte, offset uint32, sub bool) (*BPDT, error) {
+	if uint64(offset)+BPDTHeaderSize > uint64(len(bp)) || !IsBPDT(bp[offset:]) {
+		return nil, fmt.Errorf("No BPDT found at offset 0x%x", offset)
+	}
+	b := BPDT{Offset: offset}
+	if err := binary.Read(bytes.NewReader(bp[offset:]), binary.LittleEndian, &b.Header); err != nil {
+		return nil, err
+	}
+	if b.Header.DescriptorCount > bpdtEntriesMax {
+		return nil, fmt.Errorf("Too many BPDT entries: %v", b.Header.DescriptorCount)
+	}
+	entriesStart := uint64(offset) + BPDTHeaderSize
+	entriesEnd := entriesStart + uint64(b.Header.DescriptorCount)*BPDTEntrySize
+	if entriesEnd > uint64(len(bp)) {
+		return nil, fmt.Errorf("BPDT entries [0x%x-0x%x] exceed the boot partition size 0x%x",
+			entriesStart, entriesEnd, len(bp))
+	}
+	b.Entries = make([]BPDTEntry, b.Header.DescriptorCount)
+	if err := binary.Read(bytes.NewReader(bp[entriesStart:entriesEnd]), binary.LittleEndian, b.Entries); err != nil {
+		return nil, err
+	}
+	for _, e := range b.Entries {
+		if !e.Present() || uint64(e.Offset)+uint64(e.Size) > uint64(len(bp)) {
+			continue
+		}
+		data := bp[e.Offset : e.Offset+e.Size]
+		switch {
+		case e.Type == BPDTTypeSBPDT:
+			if sub {
+				return nil, fmt.Errorf("S_BPDT entry in a sub-table")
+			}
+			if b.SubBPDT != nil {
+				return nil, fmt.Errorf("More than one S_BPDT entry")
+			}
+			s, err := newBPDT(bp, e.Offset, true)
+			if err != nil {
+				return nil, fmt.Errorf("S_BPDT: %v", err)
+			}
+			b.SubBPDT = s
+		case bytes.HasPrefix(data, MeCPDSignature):
+			c, err := NewMeCPD(data, e.Type.String())
+			if err != nil {
+				return nil, err
+			}
+			b.Directories = append(b.Directories, c)
+		}
+	}
+	return &b, nil
+}
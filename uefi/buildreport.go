@@ -0,0 +1,399 @@
+package uefi
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// BuildReportModule is a file of a volume, as listed in an EDK2 build report
+// or FV map file
+type BuildReportModule struct {
+	Name string `json:",omitempty"`
+	// INF is the path of the module description, if known
+	INF  string `json:",omitempty"`
+	GUID string `json:",omitempty"`
+	// Offset is the position of the file from the start of its volume, -1
+	// if it is not known
+	Offset int64
+}
+
+func (m BuildReportModule) String() string {
+	switch {
+	case m.Name != "" && m.GUID != "":
+		return m.GUID + " (" + m.Name + ")"
+	case m.Name != "":
+		return m.Name
+	}
+	return m.GUID
+}
+
+// BuildReportVolume is a firmware volume, as listed in an EDK2 build report
+// or FV map file
+type BuildReportVolume struct {
+	Name string `json:",omitempty"`
+	// Offset is the position of the volume from the start of the FD, -1 for
+	// the nested volumes and the ones of the FV map files
+	Offset  int64
+	Size    uint64
+	Modules []BuildReportModule
+}
+
+// BuildReport is the layout of an image as described by the EDK2 build
+// tools: either the FD section of a build report, written by build -y, or
+// the .Fv.txt or .Fv.map file written by GenFv for a volume
+type BuildReport struct {
+	// FDSize is the size of the flash device, 0 for the FV map files
+	FDSize  uint64
+	Volumes []BuildReportVolume
+}
+
+var (
+	// buildReportModuleLine matches the modules of the FV regions of a build
+	// report, and the files of the .Fv.txt files: an offset, a name or GUID
+	// and the optional path of the module description
+	buildReportModuleLine = regexp.MustCompile(`^0x([0-9A-Fa-f]+)\s+(\S+)(?:\s+\((.*)\))?$`)
+	// buildReportMapGUID matches the GUID lines of the .Fv.map files
+	buildReportMapGUID = regexp.MustCompile(`^\(GUID=([0-9A-Fa-f-]{36})`)
+)
+
+// buildReportNumber parses the hexadecimal number starting the value of a
+// build report field, e.g. 0x00200000 (2048K)
+func buildReportNumber(value string) (uint64, error) {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("Missing value")
+	}
+	return strconv.ParseUint(strings.TrimPrefix(strings.ToLower(fields[0]), "0x"), 16, 64)
+}
+
+// buildReportGUID returns the lowercase form of s if it is a GUID, or an
+// empty string
+func buildReportGUID(s string) string {
+	if _, err := uuid.Parse(s); err != nil {
+		return ""
+	}
+	return strings.ToLower(s)
+}
+
+// parseBuildReportFD parses the FD and module summary sections of a build
+// report
+func parseBuildReportFD(data []byte) (*BuildReport, error) {
+	var r BuildReport
+	var (
+		fdBase, regionOffset uint64
+		regionSize           uint64
+		hasRegion, inFD      bool
+		volume               *BuildReportVolume
+		moduleINF            string
+		moduleName           string
+	)
+	guids := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "Firmware Device (FD)":
+			inFD = true
+			continue
+		case strings.HasPrefix(line, ">====") || line == "Module Summary":
+			inFD = false
+			continue
+		}
+		name, value := line, ""
+		if i := strings.Index(line, ":"); i != -1 {
+			name, value = strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		}
+		if !inFD {
+			switch name {
+			case "Module Name":
+				moduleName = value
+			case "Module INF Path":
+				moduleINF = strings.Replace(value, "\\", "/", -1)
+			case "File GUID":
+				if g := buildReportGUID(value); g != "" {
+					guids[moduleINF] = g
+					guids[moduleName] = g
+				}
+			}
+			continue
+		}
+		switch name {
+		case "Base Address":
+			n, err := buildReportNumber(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid build report line %q: %v", line, err)
+			}
+			if r.Volumes == nil && !hasRegion && volume == nil && r.FDSize == 0 {
+				fdBase = n
+				continue
+			}
+			if fdBase != 0 && n >= fdBase {
+				n -= fdBase
+			}
+			regionOffset, hasRegion = n, true
+		case "Size":
+			n, err := buildReportNumber(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid build report line %q: %v", line, err)
+			}
+			if r.FDSize == 0 {
+				r.FDSize = n
+			} else {
+				regionSize = n
+			}
+		case "Fv Size":
+			if volume != nil {
+				if n, err := buildReportNumber(value); err == nil {
+					volume.Size = n
+				}
+			}
+		case "Fv Name":
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("Invalid build report line %q", line)
+			}
+			r.Volumes = append(r.Volumes, BuildReportVolume{Name: fields[0], Offset: -1})
+			volume = &r.Volumes[len(r.Volumes)-1]
+			// the region offset and size are only the ones of its top volume
+			if hasRegion {
+				volume.Offset, volume.Size, hasRegion = int64(regionOffset), regionSize, false
+			}
+		default:
+			m := buildReportModuleLine.FindStringSubmatch(line)
+			// skip the Offsets lines, e.g. 0xFFC84000 (Boot)
+			if m == nil || volume == nil || strings.HasPrefix(m[2], "(") {
+				continue
+			}
+			// the nested volumes are listed with their own modules
+			if strings.HasSuffix(strings.ToLower(m[3]), ".fv") {
+				continue
+			}
+			offset, _ := strconv.ParseInt(m[1], 16, 64)
+			volume.Modules = append(volume.Modules, BuildReportModule{
+				Name:   m[2],
+				INF:    strings.Replace(m[3], "\\", "/", -1),
+				GUID:   buildReportGUID(m[2]),
+				Offset: offset,
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i := range r.Volumes {
+		for j := range r.Volumes[i].Modules {
+			m := &r.Volumes[i].Modules[j]
+			if m.GUID != "" {
+				continue
+			}
+			if g, ok := guids[m.INF]; ok && m.INF != "" {
+				m.GUID = g
+			} else if g, ok := guids[m.Name]; ok {
+				m.GUID = g
+			}
+		}
+	}
+	return &r, nil
+}
+
+// parseBuildReportFV parses the .Fv.txt and .Fv.map files written by GenFv
+func parseBuildReportFV(data []byte) (*BuildReport, error) {
+	v := BuildReportVolume{Offset: -1}
+	var name string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "EFI_FV_TOTAL_SIZE") {
+			if i := strings.Index(line, "="); i != -1 {
+				if n, err := buildReportNumber(line[i+1:]); err == nil {
+					v.Size = n
+				}
+			}
+			continue
+		}
+		if m := buildReportModuleLine.FindStringSubmatch(line); m != nil {
+			offset, _ := strconv.ParseInt(m[1], 16, 64)
+			v.Modules = append(v.Modules, BuildReportModule{GUID: buildReportGUID(m[2]), Offset: offset})
+			continue
+		}
+		if m := buildReportMapGUID.FindStringSubmatch(line); m != nil {
+			v.Modules = append(v.Modules, BuildReportModule{Name: name, GUID: strings.ToLower(m[1]), Offset: -1})
+			continue
+		}
+		// the module lines of the .Fv.map files start with the name
+		if i := strings.Index(line, " ("); i > 0 && !strings.HasPrefix(line, "(") {
+			name = line[:i]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(v.Modules) == 0 {
+		return nil, fmt.Errorf("No module found in FV map file")
+	}
+	return &BuildReport{Volumes: []BuildReportVolume{v}}, nil
+}
+
+// ParseBuildReport parses an EDK2 build report, keeping the volumes of its
+// FD section, or an FV map file
+func ParseBuildReport(data []byte) (*BuildReport, error) {
+	if bytes.Contains(data, []byte("Firmware Device (FD)")) {
+		r, err := parseBuildReportFD(data)
+		if err != nil {
+			return nil, err
+		}
+		if len(r.Volumes) == 0 {
+			return nil, fmt.Errorf("No firmware volume found in build report")
+		}
+		return r, nil
+	}
+	return parseBuildReportFV(data)
+}
+
+// BuildReportMismatch is a difference between an image and a build report,
+// as returned by VerifyBuildReport
+type BuildReportMismatch struct {
+	// Problem is "missing volume", "volume size", "missing module", "moved
+	// module" or "unexpected module"
+	Problem string
+	Volume  string
+	Module  string `json:",omitempty"`
+	// Expected and Found are the values from the report and the image
+	Expected, Found string
+}
+
+func (m BuildReportMismatch) String() string {
+	s := fmt.Sprintf("%s: FV %s", m.Problem, m.Volume)
+	if m.Module != "" {
+		s += " Module " + m.Module
+	}
+	return s + fmt.Sprintf(": expected %s, found %s", m.Expected, m.Found)
+}
+
+// reportVolumeMatches returns the number of modules of the report volume
+// found in the image volume
+func reportVolumeMatches(v BuildReportVolume, fv *FirmwareVolume) int {
+	n := 0
+	for _, m := range v.Modules {
+		if reportModuleFile(m, fv) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// reportModuleFile returns the file of the volume matching a module, by GUID
+// or else by module name, see File.ModuleName
+func reportModuleFile(m BuildReportModule, fv *FirmwareVolume) *File {
+	for _, f := range fv.Files {
+		if m.GUID != "" && f.GUID() == m.GUID {
+			return f
+		}
+		if m.GUID == "" && m.Name != "" && f.ModuleName() == m.Name {
+			return f
+		}
+	}
+	return nil
+}
+
+// VerifyBuildReport compares the volumes of the region with the ones of a
+// build report, and returns the volumes and modules that are missing, that
+// are not at the expected offset or that are not in the report. The volumes
+// with an FD offset are found by their offset from the end of the region,
+// which is the end of the FD, the others by their modules, among the nested
+// volumes too.
+func (br BiosRegion) VerifyBuildReport(r *BuildReport) []BuildReportMismatch {
+	mismatches := make([]BuildReportMismatch, 0)
+	var volumes []*FirmwareVolume
+	for i := range br.FirmwareVolumes {
+		volumes = append(volumes, &br.FirmwareVolumes[i])
+	}
+	for _, fv := range br.FirmwareVolumes {
+		for _, f := range fv.Files {
+			for _, s := range volumeImageSections(nil, f.Sections) {
+				if nested, err := NewFirmwareVolume(s.Data()); err == nil {
+					volumes = append(volumes, nested)
+				}
+			}
+		}
+	}
+	top := uint64(len(br.buf))
+	for _, v := range r.Volumes {
+		name := v.Name
+		if name == "" {
+			name = "<unnamed>"
+		}
+		var fv *FirmwareVolume
+		if v.Offset >= 0 && r.FDSize != 0 {
+			for _, candidate := range volumes[:len(br.FirmwareVolumes)] {
+				if top-candidate.Offset == r.FDSize-uint64(v.Offset) {
+					fv = candidate
+				}
+			}
+			if fv == nil {
+				mismatches = append(mismatches, BuildReportMismatch{Problem: "missing volume", Volume: name,
+					Expected: fmt.Sprintf("0x%x bytes from the end", r.FDSize-uint64(v.Offset)), Found: "<none>"})
+				continue
+			}
+		} else {
+			best := 0
+			for _, candidate := range volumes {
+				if n := reportVolumeMatches(v, candidate); n > best {
+					fv, best = candidate, n
+				}
+			}
+			if fv == nil {
+				mismatches = append(mismatches, BuildReportMismatch{Problem: "missing volume", Volume: name,
+					Expected: fmt.Sprintf("%d modules", len(v.Modules)), Found: "<none>"})
+				continue
+			}
+		}
+		if v.Size != 0 && v.Size != fv.Length {
+			mismatches = append(mismatches, BuildReportMismatch{Problem: "volume size", Volume: name,
+				Expected: fmt.Sprintf("0x%x", v.Size), Found: fmt.Sprintf("0x%x", fv.Length)})
+		}
+		listed := make(map[*File]bool)
+		for _, m := range v.Modules {
+			f := reportModuleFile(m, fv)
+			switch {
+			case f == nil:
+				mismatches = append(mismatches, BuildReportMismatch{Problem: "missing module", Volume: name, Module: m.String(),
+					Expected: "present", Found: "<none>"})
+			case m.Offset >= 0 && uint64(m.Offset) != f.Offset:
+				mismatches = append(mismatches, BuildReportMismatch{Problem: "moved module", Volume: name, Module: m.String(),
+					Expected: fmt.Sprintf("0x%x", m.Offset), Found: fmt.Sprintf("0x%x", f.Offset)})
+			}
+			if f != nil {
+				listed[f] = true
+			}
+		}
+		for _, f := range fv.Files {
+			if f.Type == FileTypePad || listed[f] {
+				continue
+			}
+			// the nested volumes are listed as volumes, not modules
+			if f.Type == FileTypeFirmwareVolumeImage {
+				continue
+			}
+			module := BuildReportModule{Name: f.ModuleName(), GUID: f.GUID()}
+			mismatches = append(mismatches, BuildReportMismatch{Problem: "unexpected module", Volume: name, Module: module.String(),
+				Expected: "<none>", Found: fmt.Sprintf("0x%x", f.Offset)})
+		}
+	}
+	return mismatches
+}
+
+// VerifyBuildReport compares the volumes of the BIOS region of the image
+// with the ones of a build report, see BiosRegion.VerifyBuildReport
+func (f FlashImage) VerifyBuildReport(r *BuildReport) ([]BuildReportMismatch, error) {
+	if f.BiosRegion == nil {
+		return nil, fmt.Errorf("The image has no BIOS region")
+	}
+	return f.BiosRegion.VerifyBuildReport(r), nil
+}
@@ -0,0 +1,518 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// Capsule GUIDs
+const (
+	// FMPCapsuleGUID identifies the capsules holding Firmware Management
+	// Protocol payloads, the format of most UEFI firmware updates
+	FMPCapsuleGUID = "6dcbd5ed-e82d-4c44-bda1-7194199ad92a"
+	// CapsuleOnDiskNameGUID identifies the capsule listing the file names of
+	// the capsules relocated by the EDK2 capsule-on-disk support
+	CapsuleOnDiskNameGUID = "98c80a4f-e16b-4d11-939a-abe561260330"
+	// AptioSignedCapsuleGUID and AptioUnsignedCapsuleGUID identify the AMI
+	// Aptio capsules, the .CAP files of many vendor BIOS downloads, whose
+	// body is a flash image
+	AptioSignedCapsuleGUID   = "4a3ca68b-7723-48fb-803d-578cc1fec44d"
+	AptioUnsignedCapsuleGUID = "14eebb90-890a-43db-aed1-5d3c4588a418"
+	// LenovoCapsuleGUID and Lenovo2CapsuleGUID identify the capsules of
+	// the Lenovo FL1 and FL2 update files, whose body is the flash image or
+	// the EC firmware
+	LenovoCapsuleGUID  = "e20bafd3-9914-4f4f-9537-3129e090eb3c"
+	Lenovo2CapsuleGUID = "25b5fe76-8243-4a5c-a9bd-7ee3246198b5"
+	// EFICapsuleGUID identifies the EDK capsules of a firmware image, the
+	// format of the Apple .scap updates, whose body is the flash image
+	EFICapsuleGUID = "3b6686bd-0d76-4030-b70e-b5519e2fc5a0"
+)
+
+// CapsuleGUIDs maps the capsule GUIDs recognized by IsCapsule to their names
+var CapsuleGUIDs = map[string]string{
+	FMPCapsuleGUID:           "FMP",
+	CapsuleOnDiskNameGUID:    "CapsuleOnDiskName",
+	AptioSignedCapsuleGUID:   "AptioSigned",
+	AptioUnsignedCapsuleGUID: "AptioUnsigned",
+	LenovoCapsuleGUID:        "Lenovo",
+	Lenovo2CapsuleGUID:       "Lenovo2",
+	EFICapsuleGUID:           "EFI",
+}
+
+// Capsule header flags
+const (
+	CapsuleFlagPersistAcrossReset  = 0x00010000
+	CapsuleFlagPopulateSystemTable = 0x00020000
+	CapsuleFlagInitiateReset       = 0x00040000
+)
+
+const (
+	// CapsuleHeaderSize is the size of an EFI_CAPSULE_HEADER
+	CapsuleHeaderSize = 28
+	// FMPCapsuleHeaderSize is the size of the fixed part of an
+	// EFI_FIRMWARE_MANAGEMENT_CAPSULE_HEADER
+	FMPCapsuleHeaderSize = 8
+	// fmpImageAuthenticationSize is the size of the monotonic count and of
+	// the WIN_CERTIFICATE_UEFI_GUID header authenticating the FMP payloads
+	fmpImageAuthenticationSize = 8 + winCertificateHeaderSize + 16
+	// winCertTypeEFIGUID is the type of the WIN_CERTIFICATE_UEFI_GUID
+	winCertTypeEFIGUID = 0x0ef1
+	// fmpCapsuleSupportAuthentication is set in ImageCapsuleSupport if the
+	// payload is authenticated
+	fmpCapsuleSupportAuthentication = 0x1
+)
+
+// fmpImageHeaderSizes are the sizes of the versions of the
+// EFI_FIRMWARE_MANAGEMENT_CAPSULE_IMAGE_HEADER
+var fmpImageHeaderSizes = map[uint32]uint64{1: 32, 2: 40, 3: 48}
+
+// CapsuleHeader is an EFI_CAPSULE_HEADER
+type CapsuleHeader struct {
+	CapsuleGUID      [16]uint8
+	HeaderSize       uint32
+	Flags            uint32
+	CapsuleImageSize uint32
+}
+
+// GUID returns the capsule GUID as a string
+func (h CapsuleHeader) GUID() string {
+	guid, err := uuid.FromBytes(h.CapsuleGUID[:])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return guid.String()
+}
+
+// AptioCapsuleHeader follows the EFI_CAPSULE_HEADER of the AMI Aptio
+// capsules. The offsets are from the start of the capsule.
+type AptioCapsuleHeader struct {
+	// RomImageOffset is the position of the flash image
+	RomImageOffset uint16
+	// RomLayoutOffset is the position of the table of the areas of the
+	// image covered by the signature of signed capsules
+	RomLayoutOffset uint16
+}
+
+// FMPCapsuleHeader is the fixed part of an
+// EFI_FIRMWARE_MANAGEMENT_CAPSULE_HEADER, followed by the offsets of the
+// embedded drivers and of the payloads
+type FMPCapsuleHeader struct {
+	Version             uint32
+	EmbeddedDriverCount uint16
+	PayloadItemCount    uint16
+}
+
+// FMPImageHeader is an EFI_FIRMWARE_MANAGEMENT_CAPSULE_IMAGE_HEADER. The
+// fields after UpdateVendorCodeSize only exist in the later versions.
+type FMPImageHeader struct {
+	Version                uint32
+	UpdateImageTypeID      [16]uint8
+	UpdateImageIndex       uint8
+	Reserved               [3]uint8
+	UpdateImageSize        uint32
+	UpdateVendorCodeSize   uint32
+	UpdateHardwareInstance uint64
+	ImageCapsuleSupport    uint64
+}
+
+// FMPPayload is a payload of an FMP capsule: the image for the device
+// identified by UpdateImageTypeID
+type FMPPayload struct {
+	Header FMPImageHeader
+	// Authenticated is set if the image is preceded by a signature
+	Authenticated bool
+	Image         []byte
+	VendorCode    []byte
+	// Firmware is the parsed image, nil if it is not a known firmware type
+	Firmware Firmware
+}
+
+// ImageTypeID returns the GUID of the device the payload updates
+func (p FMPPayload) ImageTypeID() string {
+	guid, err := uuid.FromBytes(p.Header.UpdateImageTypeID[:])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return guid.String()
+}
+
+// Summary prints a multi-line description of the payload
+func (p FMPPayload) Summary() string {
+	firmware := "<unknown>"
+	if p.Firmware != nil {
+		firmware = p.Firmware.Summary()
+	}
+	return fmt.Sprintf("FMPPayload{\n"+
+		"    Version=%d\n"+
+		"    ImageTypeID=%s\n"+
+		"    ImageIndex=%d\n"+
+		"    HardwareInstance=0x%x\n"+
+		"    Authenticated=%v\n"+
+		"    ImageSize=%v\n"+
+		"    VendorCodeSize=%v\n"+
+		"    Firmware=%v\n"+
+		"}",
+		p.Header.Version, p.ImageTypeID(), p.Header.UpdateImageIndex, p.Header.UpdateHardwareInstance,
+		p.Authenticated, len(p.Image), len(p.VendorCode), Indent(firmware, 4))
+}
+
+// Capsule is a UEFI capsule, the container of the firmware updates passed
+// to UpdateCapsule or staged on the ESP
+type Capsule struct {
+	Header CapsuleHeader
+	// Body is the content of the capsule after its header
+	Body []byte
+	// FMP, Drivers and Payloads are only set on FMP capsules
+	FMP      *FMPCapsuleHeader
+	Drivers  [][]byte
+	Payloads []*FMPPayload
+	// Aptio is only set on AMI Aptio capsules
+	Aptio *AptioCapsuleHeader
+	// Image is only set on the vendor capsules wrapping a firmware image,
+	// the Aptio and Lenovo ones. Firmware is the parsed Image, nil if it is
+	// not a known firmware type, and EcFirmware the EC firmware recognized
+	// in Image otherwise, e.g. in Lenovo FL2 files.
+	Image      []byte
+	Firmware   Firmware
+	EcFirmware *EcFirmware
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the capsule
+func (c Capsule) Buf() []byte {
+	return c.buf
+}
+
+// Summary prints a multi-line description of the capsule
+func (c Capsule) Summary() string {
+	var b bytes.Buffer
+	name, ok := CapsuleGUIDs[c.Header.GUID()]
+	if !ok {
+		name = "Unknown"
+	}
+	fmt.Fprintf(&b, "Capsule{\n")
+	fmt.Fprintf(&b, "    GUID=%s (%s)\n", c.Header.GUID(), name)
+	fmt.Fprintf(&b, "    HeaderSize=0x%x\n", c.Header.HeaderSize)
+	fmt.Fprintf(&b, "    Flags=0x%08x\n", c.Header.Flags)
+	fmt.Fprintf(&b, "    ImageSize=0x%x\n", c.Header.CapsuleImageSize)
+	if c.FMP != nil {
+		var payloads []string
+		for _, p := range c.Payloads {
+			payloads = append(payloads, p.Summary())
+		}
+		fmt.Fprintf(&b, "    EmbeddedDrivers=%d\n", len(c.Drivers))
+		fmt.Fprintf(&b, "    Payloads=[\n")
+		fmt.Fprintf(&b, "        %v\n", Indent(strings.Join(payloads, "\n"), 8))
+		fmt.Fprintf(&b, "    ]\n")
+	}
+	if c.Aptio != nil {
+		fmt.Fprintf(&b, "    RomImageOffset=0x%x\n", c.Aptio.RomImageOffset)
+		fmt.Fprintf(&b, "    RomLayoutOffset=0x%x\n", c.Aptio.RomLayoutOffset)
+	}
+	if c.Image != nil {
+		firmware := "<unknown>"
+		if c.Firmware != nil {
+			firmware = c.Firmware.Summary()
+		} else if c.EcFirmware != nil {
+			firmware = c.EcFirmware.String()
+		}
+		fmt.Fprintf(&b, "    Firmware=%v\n", Indent(firmware, 4))
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// Validate checks the payloads, or the flash image, of the capsule
+func (c Capsule) Validate() []error {
+	errors := make([]error, 0)
+	if c.Firmware != nil {
+		errors = append(errors, c.Firmware.Validate()...)
+	}
+	for i, p := range c.Payloads {
+		if p.Firmware == nil {
+			continue
+		}
+		for _, err := range p.Firmware.Validate() {
+			errors = append(errors, fmt.Errorf("Capsule payload %d: %v", i+1, err))
+		}
+	}
+	return errors
+}
+
+// MarshalBinary serializes the capsule
+func (c Capsule) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, c.buf...), nil
+}
+
+// isCapsuleHeader returns whether buf starts with a capsule header of a
+// known GUID that fits in buf
+func isCapsuleHeader(buf []byte) bool {
+	if len(buf) < CapsuleHeaderSize {
+		return false
+	}
+	var h CapsuleHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+		return false
+	}
+	if _, ok := CapsuleGUIDs[h.GUID()]; !ok {
+		return false
+	}
+	return h.HeaderSize >= CapsuleHeaderSize && h.HeaderSize <= h.CapsuleImageSize && uint64(h.CapsuleImageSize) <= uint64(len(buf))
+}
+
+// IsCapsule returns whether buf is a capsule of a known GUID, see
+// CapsuleGUIDs
+func IsCapsule(buf []byte) bool {
+	if !isCapsuleHeader(buf) {
+		return false
+	}
+	return uint64(binary.LittleEndian.Uint32(buf[24:])) == uint64(len(buf))
+}
+
+// parseFMPPayload parses an FMP capsule payload item
+func parseFMPPayload(buf []byte) (*FMPPayload, error) {
+	if len(buf) < 4 {
+		return nil, fmt.Errorf("FMP payload too small: %v bytes", len(buf))
+	}
+	var p FMPPayload
+	version := binary.LittleEndian.Uint32(buf)
+	hdrSize, ok := fmpImageHeaderSizes[version]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported FMP payload header version %d", version)
+	}
+	if uint64(len(buf)) < hdrSize {
+		return nil, fmt.Errorf("FMP payload header too small: %v bytes", len(buf))
+	}
+	// the older headers are shorter, the missing fields stay zero
+	hdr := make([]byte, fmpImageHeaderSizes[3])
+	copy(hdr, buf[:hdrSize])
+	if err := binary.Read(bytes.NewReader(hdr), binary.LittleEndian, &p.Header); err != nil {
+		return nil, err
+	}
+	imageEnd := hdrSize + uint64(p.Header.UpdateImageSize)
+	vendorEnd := imageEnd + uint64(p.Header.UpdateVendorCodeSize)
+	if vendorEnd > uint64(len(buf)) {
+		return nil, fmt.Errorf("FMP payload of 0x%x bytes exceeds the capsule", vendorEnd)
+	}
+	image := buf[hdrSize:imageEnd]
+	p.VendorCode = buf[imageEnd:vendorEnd]
+
+	// authenticated images start with an EFI_FIRMWARE_IMAGE_AUTHENTICATION
+	p.Authenticated = p.Header.ImageCapsuleSupport&fmpCapsuleSupportAuthentication != 0
+	if !p.Authenticated && len(image) >= fmpImageAuthenticationSize {
+		p.Authenticated = binary.LittleEndian.Uint16(image[14:]) == winCertTypeEFIGUID
+	}
+	if p.Authenticated {
+		if len(image) < fmpImageAuthenticationSize {
+			return nil, fmt.Errorf("FMP payload too small for its authentication: %v bytes", len(image))
+		}
+		authEnd := 8 + uint64(binary.LittleEndian.Uint32(image[8:]))
+		if authEnd < fmpImageAuthenticationSize || authEnd > uint64(len(image)) {
+			return nil, fmt.Errorf("Invalid FMP payload authentication length 0x%x", authEnd-8)
+		}
+		image = image[authEnd:]
+	}
+	p.Image = image
+	if fw, err := Parse(image); err == nil {
+		p.Firmware = fw
+	} else {
+		debugf("FMP payload %s: %v", p.ImageTypeID(), err)
+	}
+	return &p, nil
+}
+
+// newAptioCapsule parses the header following the capsule header of an AMI
+// Aptio capsule, and the flash image it holds
+func newAptioCapsule(c *Capsule) (*Capsule, error) {
+	if len(c.buf) < CapsuleHeaderSize+4 {
+		return nil, fmt.Errorf("Aptio capsule header too small: %v bytes", len(c.buf))
+	}
+	var h AptioCapsuleHeader
+	if err := binary.Read(bytes.NewReader(c.buf[CapsuleHeaderSize:]), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if uint64(h.RomImageOffset) < CapsuleHeaderSize+4 || uint64(h.RomImageOffset) >= uint64(len(c.buf)) {
+		return nil, fmt.Errorf("Invalid Aptio capsule image offset 0x%x", h.RomImageOffset)
+	}
+	c.Aptio = &h
+	c.parseImage(c.buf[h.RomImageOffset:])
+	return c, nil
+}
+
+// parseImage sets the firmware image wrapped by a vendor capsule, and parses
+// it as a firmware or as an EC firmware
+func (c *Capsule) parseImage(image []byte) {
+	c.Image = image
+	fw, err := Parse(image)
+	if err == nil {
+		c.Firmware = fw
+		return
+	}
+	debugf("Capsule %s image: %v", c.Header.GUID(), err)
+	if er, err := NewEcRegion(image); err == nil {
+		c.EcFirmware = er.Firmware
+	}
+}
+
+// NewCapsule parses a capsule, and the FMP payloads or the vendor firmware
+// image it holds
+func NewCapsule(buf []byte) (*Capsule, error) {
+	if !isCapsuleHeader(buf) {
+		return nil, fmt.Errorf("No capsule header found")
+	}
+	var c Capsule
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &c.Header); err != nil {
+		return nil, err
+	}
+	c.buf = buf[:c.Header.CapsuleImageSize]
+	c.Body = c.buf[c.Header.HeaderSize:]
+	switch c.Header.GUID() {
+	case AptioSignedCapsuleGUID, AptioUnsignedCapsuleGUID:
+		return newAptioCapsule(&c)
+	case LenovoCapsuleGUID, Lenovo2CapsuleGUID, EFICapsuleGUID:
+		c.parseImage(c.Body)
+		return &c, nil
+	case FMPCapsuleGUID:
+	default:
+		return &c, nil
+	}
+
+	if len(c.Body) < FMPCapsuleHeaderSize {
+		return nil, fmt.Errorf("FMP capsule header too small: %v bytes", len(c.Body))
+	}
+	var fmp FMPCapsuleHeader
+	if err := binary.Read(bytes.NewReader(c.Body), binary.LittleEndian, &fmp); err != nil {
+		return nil, err
+	}
+	c.FMP = &fmp
+	count := uint64(fmp.EmbeddedDriverCount) + uint64(fmp.PayloadItemCount)
+	if FMPCapsuleHeaderSize+count*8 > uint64(len(c.Body)) {
+		return nil, fmt.Errorf("FMP capsule item list of %d items exceeds the capsule", count)
+	}
+	offsets := make([]uint64, count)
+	if err := binary.Read(bytes.NewReader(c.Body[FMPCapsuleHeaderSize:]), binary.LittleEndian, offsets); err != nil {
+		return nil, err
+	}
+	// each item ends where the next one starts
+	for i, offset := range offsets {
+		end := uint64(len(c.Body))
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		if offset > end || end > uint64(len(c.Body)) {
+			return nil, fmt.Errorf("FMP capsule item %d at 0x%x exceeds the capsule", i+1, offset)
+		}
+		item := c.Body[offset:end]
+		if uint64(i) < uint64(fmp.EmbeddedDriverCount) {
+			c.Drivers = append(c.Drivers, item)
+			continue
+		}
+		p, err := parseFMPPayload(item)
+		if err != nil {
+			return nil, fmt.Errorf("FMP capsule item %d: %v", i+1, err)
+		}
+		c.Payloads = append(c.Payloads, p)
+	}
+	return &c, nil
+}
+
+// CapsuleOnDisk is a capsule file staged on the ESP for the capsule-on-disk
+// delivery, holding one capsule or, once relocated by EDK2, the size of the
+// capsules followed by the capsules and by a capsule with their file names
+type CapsuleOnDisk struct {
+	Capsules []*Capsule
+	// Names are the file names of the capsules, if the file holds a name
+	// capsule
+	Names []string
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Summary prints a multi-line description of the capsules
+func (d CapsuleOnDisk) Summary() string {
+	var capsules []string
+	for _, c := range d.Capsules {
+		capsules = append(capsules, c.Summary())
+	}
+	return fmt.Sprintf("CapsuleOnDisk{\n"+
+		"    Size=%v\n"+
+		"    Names=%v\n"+
+		"    Capsules=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}", len(d.buf), d.Names, Indent(strings.Join(capsules, "\n"), 8))
+}
+
+// Validate checks the capsules
+func (d CapsuleOnDisk) Validate() []error {
+	errors := make([]error, 0)
+	for _, c := range d.Capsules {
+		errors = append(errors, c.Validate()...)
+	}
+	return errors
+}
+
+// MarshalBinary serializes the capsules
+func (d CapsuleOnDisk) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, d.buf...), nil
+}
+
+// capsuleOnDiskStart returns the position of the first capsule of a
+// capsule-on-disk file, after the optional size of the capsules
+func capsuleOnDiskStart(buf []byte) uint64 {
+	if len(buf) >= 8 && binary.LittleEndian.Uint64(buf) == uint64(len(buf))-8 {
+		return 8
+	}
+	return 0
+}
+
+// IsCapsuleOnDisk returns whether buf is a sequence of capsules, optionally
+// preceded by their total size, as staged on the ESP. A single capsule is
+// reported by IsCapsule instead.
+func IsCapsuleOnDisk(buf []byte) bool {
+	offset := capsuleOnDiskStart(buf)
+	count := 0
+	for offset < uint64(len(buf)) {
+		if !isCapsuleHeader(buf[offset:]) {
+			return false
+		}
+		offset += uint64(binary.LittleEndian.Uint32(buf[offset+24:]))
+		count++
+	}
+	return count > 1 || count == 1 && capsuleOnDiskStart(buf) == 8
+}
+
+// NewCapsuleOnDisk unwraps the capsules of a capsule-on-disk file
+func NewCapsuleOnDisk(buf []byte) (*CapsuleOnDisk, error) {
+	if !IsCapsuleOnDisk(buf) {
+		return nil, fmt.Errorf("No capsule-on-disk capsules found")
+	}
+	d := CapsuleOnDisk{buf: buf}
+	for offset := capsuleOnDiskStart(buf); offset < uint64(len(buf)); {
+		c, err := NewCapsule(buf[offset:])
+		if err != nil {
+			return nil, fmt.Errorf("Capsule at 0x%x: %v", offset, err)
+		}
+		offset += uint64(len(c.buf))
+		if c.Header.GUID() == CapsuleOnDiskNameGUID {
+			// the body is a list of null-terminated UCS-2 names
+			for start, i := 0, 0; i+1 < len(c.Body); i += 2 {
+				if c.Body[i] != 0 || c.Body[i+1] != 0 {
+					continue
+				}
+				if i > start {
+					d.Names = append(d.Names, decodeUCS2(c.Body[start:i]))
+				}
+				start = i + 2
+			}
+			continue
+		}
+		d.Capsules = append(d.Capsules, c)
+	}
+	return &d, nil
+}
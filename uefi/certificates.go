@@ -0,0 +1,144 @@
+package uefi
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CertificateInfo is an X.509 certificate found in the image by
+// FlashImage.Certificates
+type CertificateInfo struct {
+	Subject   string
+	Issuer    string
+	Serial    string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// SHA256 is the fingerprint of the certificate
+	SHA256 string
+	// Offset is the absolute position of the certificate in the image, or
+	// of the file holding it for the certificates in compressed sections
+	Offset uint64
+	// Location is the path of the parsed elements holding the certificate
+	Location    string
+	Certificate *x509.Certificate `json:"-"`
+}
+
+func (c CertificateInfo) String() string {
+	return fmt.Sprintf("0x%x %s: Subject=%q Issuer=%q Serial=%s Validity=%s..%s SHA256=%s",
+		c.Offset, c.Location, c.Subject, c.Issuer, c.Serial,
+		c.NotBefore.Format("2006-01-02"), c.NotAfter.Format("2006-01-02"), c.SHA256)
+}
+
+// formatName returns the main attributes of a distinguished name, most
+// specific first
+func formatName(n pkix.Name) string {
+	var parts []string
+	add := func(key string, values ...string) {
+		for _, v := range values {
+			if v != "" {
+				parts = append(parts, key+"="+v)
+			}
+		}
+	}
+	add("CN", n.CommonName)
+	add("OU", n.OrganizationalUnit...)
+	add("O", n.Organization...)
+	add("L", n.Locality...)
+	add("ST", n.Province...)
+	add("C", n.Country...)
+	return strings.Join(parts, ", ")
+}
+
+// foundCertificate is a certificate found by findCertificates
+type foundCertificate struct {
+	offset uint64
+	cert   *x509.Certificate
+}
+
+// findCertificates returns the DER encoded X.509 certificates in buf, with
+// their offsets
+func findCertificates(buf []byte) []foundCertificate {
+	var found []foundCertificate
+	// a certificate and its TBSCertificate are sequences with 2-byte
+	// lengths
+	for i := 0; i+8 <= len(buf); i++ {
+		if buf[i] != 0x30 || buf[i+1] != 0x82 || buf[i+4] != 0x30 || buf[i+5] != 0x82 {
+			continue
+		}
+		end := i + 4 + (int(buf[i+2])<<8 | int(buf[i+3]))
+		if end > len(buf) {
+			continue
+		}
+		cert, err := x509.ParseCertificate(buf[i:end])
+		if err != nil {
+			continue
+		}
+		found = append(found, foundCertificate{offset: uint64(i), cert: cert})
+		i = end - 1
+	}
+	return found
+}
+
+// newCertificateInfo returns the description of a found certificate
+func newCertificateInfo(c *x509.Certificate, offset uint64, location string) CertificateInfo {
+	sum := sha256.Sum256(c.Raw)
+	return CertificateInfo{
+		Subject:     formatName(c.Subject),
+		Issuer:      formatName(c.Issuer),
+		Serial:      fmt.Sprintf("%x", c.SerialNumber),
+		NotBefore:   c.NotBefore,
+		NotAfter:    c.NotAfter,
+		SHA256:      hex.EncodeToString(sum[:]),
+		Offset:      offset,
+		Location:    location,
+		Certificate: c,
+	}
+}
+
+// compressedCertificates appends the certificates in the decompressed
+// contents of the compressed sections to certs. offset is the absolute
+// position of the file holding the sections, and location its path.
+func compressedCertificates(certs []CertificateInfo, sections []*Section, offset uint64, location string) []CertificateInfo {
+	for _, s := range sections {
+		if !s.IsCompressed() {
+			certs = compressedCertificates(certs, s.Sections, offset, location)
+			continue
+		}
+		loc := fmt.Sprintf("%s > Section %v (decompressed)", location, s.Type)
+		for _, c := range findCertificates(s.Decompressed()) {
+			certs = append(certs, newCertificateInfo(c.cert, offset, fmt.Sprintf("%s +0x%x", loc, c.offset)))
+		}
+		certs = compressedCertificates(certs, s.Sections, offset, loc)
+	}
+	return certs
+}
+
+// Certificates returns the X.509 certificates found in the image, sorted by
+// offset: in the Secure Boot variables, in the Authenticode signatures of
+// the PE images, in capsules and in any other file, including the contents
+// of the compressed sections. The location tells where each certificate
+// was found. The Boot Guard manifests hold bare public keys, which are not
+// listed.
+func (f FlashImage) Certificates() []CertificateInfo {
+	var certs []CertificateInfo
+	for _, c := range findCertificates(f.buf) {
+		certs = append(certs, newCertificateInfo(c.cert, c.offset, f.nodePath(c.offset)))
+	}
+	if f.BiosRegion != nil {
+		start, _ := f.Region.BiosOffset()
+		for _, fv := range f.BiosRegion.FirmwareVolumes {
+			for _, file := range fv.Files {
+				offset := uint64(start) + fv.Offset + file.Offset
+				certs = compressedCertificates(certs, file.Sections, offset, f.nodePath(offset))
+			}
+		}
+	}
+	sort.SliceStable(certs, func(i, j int) bool { return certs[i].Offset < certs[j].Offset })
+	return certs
+}
@@ -0,0 +1,76 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// checksum8 returns the value that, added to the 8-bit sum of all the bytes
+// in buf, makes it zero.
+func checksum8(buf []byte) uint8 {
+	var sum uint8
+	for _, b := range buf {
+		sum += b
+	}
+	return -sum
+}
+
+// checksum16 returns the value that, added to the 16-bit sum of all the
+// little-endian words in buf, makes it zero. A trailing odd byte is ignored.
+func checksum16(buf []byte) uint16 {
+	var sum uint16
+	for i := 0; i+1 < len(buf); i += 2 {
+		sum += uint16(buf[i]) | uint16(buf[i+1])<<8
+	}
+	return -sum
+}
+
+// peChecksumOffset returns the offset of the CheckSum field of the optional
+// header of a PE image, or -1 if img is not a PE image.
+func peChecksumOffset(img []byte) int {
+	if len(img) < 0x40 || img[0] != 'M' || img[1] != 'Z' {
+		return -1
+	}
+	peOffset := int(binary.LittleEndian.Uint32(img[0x3c:]))
+	// PE signature, COFF header, then the CheckSum at offset 64 of the
+	// optional header, for both PE32 and PE32+
+	offset := peOffset + 4 + 20 + 64
+	if peOffset < 0 || offset+4 > len(img) || !bytes.Equal(img[peOffset:peOffset+4], []byte("PE\x00\x00")) {
+		return -1
+	}
+	return offset
+}
+
+// peChecksum computes the checksum of a PE image the way the Windows loader
+// does, skipping the CheckSum field at csOffset.
+func peChecksum(img []byte, csOffset int) uint32 {
+	var sum uint32
+	for i := 0; i < len(img); i += 2 {
+		if i == csOffset || i == csOffset+2 {
+			continue
+		}
+		word := uint32(img[i])
+		if i+1 < len(img) {
+			word |= uint32(img[i+1]) << 8
+		}
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return sum + uint32(len(img))
+}
+
+// fixPEChecksum updates the checksum of the PE image in out if the one of
+// the original image orig was set and valid. Unset or wrong checksums are
+// preserved.
+func fixPEChecksum(orig, out []byte) {
+	offset := peChecksumOffset(orig)
+	if offset == -1 || peChecksumOffset(out) != offset {
+		return
+	}
+	stored := binary.LittleEndian.Uint32(orig[offset:])
+	if stored == 0 || stored != peChecksum(orig, offset) {
+		return
+	}
+	binary.LittleEndian.PutUint32(out[offset:], peChecksum(out, offset))
+}
@@ -0,0 +1,94 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// ChipsetFamily is the family of the chipset an image is built for, as
+// guessed from its descriptor
+type ChipsetFamily int
+
+// Chipset families
+const (
+	ChipsetUnknown ChipsetFamily = iota
+	ChipsetICH8
+	ChipsetICH9
+	ChipsetICH10
+	Chipset5Series
+	Chipset6Series
+	Chipset8Series
+	Chipset9Series
+	Chipset100Series
+)
+
+var chipsetFamilyNames = map[ChipsetFamily]string{
+	ChipsetUnknown:   "Unknown",
+	ChipsetICH8:      "ICH8",
+	ChipsetICH9:      "ICH9",
+	ChipsetICH10:     "ICH10",
+	Chipset5Series:   "5 series (Ibex Peak)",
+	Chipset6Series:   "6/7 series (Cougar Point, Panther Point)",
+	Chipset8Series:   "8 series (Lynx Point)",
+	Chipset9Series:   "9 series (Wildcat Point)",
+	Chipset100Series: "100 series and later PCH",
+}
+
+func (c ChipsetFamily) String() string {
+	if name, ok := chipsetFamilyNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("ChipsetFamily(%d)", int(c))
+}
+
+// DescriptorVersion returns the version of the descriptors of the family
+func (c ChipsetFamily) DescriptorVersion() DescriptorVersion {
+	if c == Chipset100Series {
+		return DescriptorV2
+	}
+	return DescriptorV1
+}
+
+// DetectChipset guesses the chipset family of an image from its descriptor,
+// with the same heuristics as ifdtool: the descriptors of version 2 use a
+// 17MHz read clock, the ICH8 has the signature at the start of the image and
+// no processor straps, and the other families are told apart by the
+// location of the ICC table and the number and contents of the straps.
+func DetectChipset(buf []byte, d FlashDescriptorMap) ChipsetFamily {
+	if descriptorVersion(buf, d) == DescriptorV2 {
+		return Chipset100Series
+	}
+	pchStraps := d.NumberOfPchStraps
+	procStraps := d.NumberOfProcStraps
+	if d.IccTableBase == 0 {
+		switch {
+		case procStraps == 0 && pchStraps <= 2 && !hasSignatureAt(buf, 16):
+			return ChipsetICH8
+		case pchStraps <= 2:
+			return ChipsetICH9
+		case pchStraps <= 10:
+			return ChipsetICH10
+		case pchStraps <= 16:
+			return Chipset5Series
+		}
+		// peculiar descriptor, assume Ibex Peak compatibility
+		return Chipset5Series
+	}
+	strapsStart := int(d.PchStrapsBase) * 0x10
+	if d.IccTableBase < 0x31 && strapsStart+4 <= len(buf) && binary.LittleEndian.Uint32(buf[strapsStart:])&0xff < 0x30 {
+		switch {
+		case procStraps <= 1 && pchStraps <= 18:
+			return Chipset6Series
+		case procStraps <= 1 && pchStraps <= 21:
+			return Chipset8Series
+		}
+		return Chipset9Series
+	}
+	return ChipsetUnknown
+}
+
+// hasSignatureAt returns whether the flash signature is at offset off of buf
+func hasSignatureAt(buf []byte, off int) bool {
+	return off+len(FlashSignature) <= len(buf) && bytes.Equal(buf[off:off+len(FlashSignature)], FlashSignature)
+}
@@ -0,0 +1,350 @@
+package uefi
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+var (
+	// DellPFSHeaderTag starts the PFS containers of the Dell firmware updates
+	DellPFSHeaderTag = []byte("PFS.HDR.")
+	// DellPFSFooterTag ends the PFS containers
+	DellPFSFooterTag = []byte("PFS.FTR.")
+	// dellPFSSectionMarker precedes the zlib compressed PFS containers in
+	// the Dell update executables. It is followed by a variable byte and by
+	// the zlib stream.
+	dellPFSSectionMarker = []byte{0xaa, 0xee, 0xaa, 0x76, 0x1b, 0xec, 0xbb, 0x20, 0xf1, 0xe6, 0x51}
+)
+
+const (
+	// DellPFSHeaderSize is the size of the header of a PFS container
+	DellPFSHeaderSize = 16
+	// DellPFSFooterSize is the size of the footer of a PFS container
+	DellPFSFooterSize = 16
+)
+
+// dellPFSEntryHeaderSizes are the sizes of the versions of the PFS entry
+// headers
+var dellPFSEntryHeaderSizes = map[uint32]uint64{1: 0x48, 2: 0x58}
+
+// DellPFSHeader is the header of a PFS container
+type DellPFSHeader struct {
+	Tag           [8]byte
+	HeaderVersion uint32
+	PayloadSize   uint32
+}
+
+// DellPFSFooter is the footer of a PFS container
+type DellPFSFooter struct {
+	PayloadSize uint32
+	Checksum    uint32
+	Tag         [8]byte
+}
+
+// DellPFSEntryHeader is the header of a PFS entry. The version 2 headers
+// have 4 more unknown fields, which are ignored.
+type DellPFSEntryHeader struct {
+	GUID          [16]uint8
+	HeaderVersion uint32
+	// VersionType tells how each field of Version is printed: 'A' in
+	// hexadecimal, 'N' in decimal, while 0 and ' ' end the version
+	VersionType    [4]uint8
+	Version        [4]uint16
+	Reserved       uint64
+	DataSize       uint32
+	DataSigSize    uint32
+	DataMetSize    uint32
+	DataMetSigSize uint32
+	Unknown        [4]uint32
+}
+
+// DellPFSEntry is an entry of a PFS container: a payload, e.g. the BIOS or
+// the firmware of a device, with its signature and metadata
+type DellPFSEntry struct {
+	Header            DellPFSEntryHeader
+	Data              []byte
+	Signature         []byte
+	Metadata          []byte
+	MetadataSignature []byte
+	// Payload is Data, decompressed if it is a zlib compressed section
+	Payload []byte
+	// PFS is set if the payload is itself a PFS container
+	PFS *DellPFS
+	// Firmware is the parsed payload, nil if it is not a known firmware type
+	Firmware Firmware
+}
+
+// GUID returns the GUID of the entry as a string
+func (e DellPFSEntry) GUID() string {
+	guid, err := uuid.FromBytes(e.Header.GUID[:])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return guid.String()
+}
+
+// Version returns the version of the entry as a string
+func (e DellPFSEntry) Version() string {
+	var fields []string
+	for i, v := range e.Header.Version {
+		switch e.Header.VersionType[i] {
+		case 0, ' ':
+			return strings.Join(fields, ".")
+		case 'A':
+			fields = append(fields, fmt.Sprintf("%X", v))
+		default:
+			fields = append(fields, fmt.Sprintf("%d", v))
+		}
+	}
+	return strings.Join(fields, ".")
+}
+
+// Summary prints a multi-line description of the entry
+func (e DellPFSEntry) Summary() string {
+	payload := "<unknown>"
+	if e.PFS != nil {
+		payload = e.PFS.Summary()
+	} else if e.Firmware != nil {
+		payload = e.Firmware.Summary()
+	}
+	return fmt.Sprintf("DellPFSEntry{\n"+
+		"    GUID=%s\n"+
+		"    Version=%s\n"+
+		"    DataSize=%v\n"+
+		"    PayloadSize=%v\n"+
+		"    SignatureSize=%v\n"+
+		"    MetadataSize=%v\n"+
+		"    MetadataSignatureSize=%v\n"+
+		"    Payload=%v\n"+
+		"}",
+		e.GUID(), e.Version(), len(e.Data), len(e.Payload), len(e.Signature), len(e.Metadata), len(e.MetadataSignature),
+		Indent(payload, 4))
+}
+
+// DellPFS is a Dell PFS container, the package of the payloads of the Dell
+// firmware updates
+type DellPFS struct {
+	Header  DellPFSHeader
+	Footer  DellPFSFooter
+	Entries []*DellPFSEntry
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the container
+func (p DellPFS) Buf() []byte {
+	return p.buf
+}
+
+// Summary prints a multi-line description of the container
+func (p DellPFS) Summary() string {
+	var entries []string
+	for _, e := range p.Entries {
+		entries = append(entries, e.Summary())
+	}
+	return fmt.Sprintf("DellPFS{\n"+
+		"    HeaderVersion=%d\n"+
+		"    PayloadSize=0x%x\n"+
+		"    Checksum=0x%08x\n"+
+		"    Entries=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		p.Header.HeaderVersion, p.Header.PayloadSize, p.Footer.Checksum, Indent(strings.Join(entries, "\n"), 8))
+}
+
+// Validate checks the container and the payloads of its entries
+func (p DellPFS) Validate() []error {
+	errors := make([]error, 0)
+	if p.Footer.PayloadSize != p.Header.PayloadSize {
+		errors = append(errors, fmt.Errorf("PFS footer payload size 0x%x does not match the header payload size 0x%x",
+			p.Footer.PayloadSize, p.Header.PayloadSize))
+	}
+	for _, e := range p.Entries {
+		var errs []error
+		if e.PFS != nil {
+			errs = e.PFS.Validate()
+		} else if e.Firmware != nil {
+			errs = e.Firmware.Validate()
+		}
+		for _, err := range errs {
+			errors = append(errors, fmt.Errorf("PFS entry %s: %v", e.GUID(), err))
+		}
+	}
+	return errors
+}
+
+// MarshalBinary serializes the container
+func (p DellPFS) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, p.buf...), nil
+}
+
+// IsDellPFS returns whether buf starts with a PFS container
+func IsDellPFS(buf []byte) bool {
+	return len(buf) >= DellPFSHeaderSize+DellPFSFooterSize && bytes.Equal(buf[:len(DellPFSHeaderTag)], DellPFSHeaderTag)
+}
+
+// inflateDellPFSSection decompresses the zlib stream of a PFS section,
+// buf starting with dellPFSSectionMarker
+func inflateDellPFSSection(buf []byte) ([]byte, error) {
+	start := len(dellPFSSectionMarker) + 1
+	if len(buf) < start {
+		return nil, fmt.Errorf("PFS section too small: %v bytes", len(buf))
+	}
+	r, err := zlib.NewReader(bytes.NewReader(buf[start:]))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// parseDellPFSEntry parses the entry at the start of buf, and returns it
+// with its size
+func parseDellPFSEntry(buf []byte) (*DellPFSEntry, uint64, error) {
+	if len(buf) < 0x14 {
+		return nil, 0, fmt.Errorf("PFS entry too small: %v bytes", len(buf))
+	}
+	hdrSize, ok := dellPFSEntryHeaderSizes[binary.LittleEndian.Uint32(buf[0x10:])]
+	if !ok {
+		return nil, 0, fmt.Errorf("Unsupported PFS entry header version %d", binary.LittleEndian.Uint32(buf[0x10:]))
+	}
+	if uint64(len(buf)) < hdrSize {
+		return nil, 0, fmt.Errorf("PFS entry header too small: %v bytes", len(buf))
+	}
+	var e DellPFSEntry
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &e.Header); err != nil {
+		return nil, 0, err
+	}
+	offset := hdrSize
+	for _, f := range []struct {
+		data *[]byte
+		size uint32
+	}{
+		{&e.Data, e.Header.DataSize},
+		{&e.Signature, e.Header.DataSigSize},
+		{&e.Metadata, e.Header.DataMetSize},
+		{&e.MetadataSignature, e.Header.DataMetSigSize},
+	} {
+		if offset+uint64(f.size) > uint64(len(buf)) {
+			return nil, 0, fmt.Errorf("PFS entry %s of 0x%x bytes exceeds the container", e.GUID(), offset+uint64(f.size))
+		}
+		*f.data = buf[offset : offset+uint64(f.size)]
+		offset += uint64(f.size)
+	}
+
+	e.Payload = e.Data
+	if bytes.HasPrefix(e.Data, dellPFSSectionMarker) {
+		if inflated, err := inflateDellPFSSection(e.Data); err == nil {
+			e.Payload = inflated
+		} else {
+			debugf("PFS entry %s: %v", e.GUID(), err)
+		}
+	}
+	if IsDellPFS(e.Payload) {
+		pfs, err := NewDellPFS(e.Payload)
+		if err != nil {
+			return nil, 0, fmt.Errorf("PFS entry %s: %v", e.GUID(), err)
+		}
+		e.PFS = pfs
+	} else if fw, err := Parse(e.Payload); err == nil {
+		e.Firmware = fw
+	}
+	return &e, offset, nil
+}
+
+// NewDellPFS parses a PFS container, and its nested containers
+func NewDellPFS(buf []byte) (*DellPFS, error) {
+	if !IsDellPFS(buf) {
+		return nil, fmt.Errorf("No PFS header found")
+	}
+	var p DellPFS
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &p.Header); err != nil {
+		return nil, err
+	}
+	end := DellPFSHeaderSize + uint64(p.Header.PayloadSize)
+	if end+DellPFSFooterSize > uint64(len(buf)) {
+		return nil, fmt.Errorf("PFS payload of 0x%x bytes exceeds the buffer", p.Header.PayloadSize)
+	}
+	if err := binary.Read(bytes.NewReader(buf[end:]), binary.LittleEndian, &p.Footer); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p.Footer.Tag[:], DellPFSFooterTag) {
+		return nil, fmt.Errorf("No PFS footer found at 0x%x", end)
+	}
+	p.buf = buf[:end+DellPFSFooterSize]
+	payload := buf[DellPFSHeaderSize:end]
+	for offset := uint64(0); offset < uint64(len(payload)); {
+		e, size, err := parseDellPFSEntry(payload[offset:])
+		if err != nil {
+			return nil, err
+		}
+		p.Entries = append(p.Entries, e)
+		offset += size
+	}
+	return &p, nil
+}
+
+// FindDellPFS returns the PFS containers of a Dell firmware update, either
+// a bare container or the executable embedding the zlib compressed ones
+func FindDellPFS(buf []byte) ([]*DellPFS, error) {
+	if IsDellPFS(buf) {
+		p, err := NewDellPFS(buf)
+		if err != nil {
+			return nil, err
+		}
+		return []*DellPFS{p}, nil
+	}
+	var packages []*DellPFS
+	for offset := 0; offset < len(buf); {
+		idx := bytes.Index(buf[offset:], dellPFSSectionMarker)
+		if idx == -1 {
+			break
+		}
+		offset += idx
+		data, err := inflateDellPFSSection(buf[offset:])
+		offset += len(dellPFSSectionMarker)
+		if err != nil || !IsDellPFS(data) {
+			continue
+		}
+		p, err := NewDellPFS(data)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+	if len(packages) == 0 {
+		return nil, fmt.Errorf("No PFS container found")
+	}
+	return packages, nil
+}
+
+// Extract writes the payloads of the entries to a directory, one file per
+// entry named after its position, GUID and version. The nested containers
+// are extracted to subdirectories.
+func (p DellPFS) Extract(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, e := range p.Entries {
+		name := fmt.Sprintf("%02d_%s_%s", i, e.GUID(), e.Version())
+		if e.PFS != nil {
+			if err := e.PFS.Extract(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".bin"), e.Payload, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package uefi
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DescriptorChange is a field of the descriptor, or of another configuration
+// table like the VBT, that differs between two images
+type DescriptorChange struct {
+	// Field is the name of the field, e.g. "Region.ME", "Master.BIOS.Write"
+	// or "PchStrap[10]"
+	Field string
+	// Old and New are the formatted values, "<none>" if the field is
+	// missing in one of the images
+	Old, New string
+}
+
+func (c DescriptorChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, c.Old, c.New)
+}
+
+// descriptorFields returns the fields compared by DiffDescriptors, in order,
+// and their formatted values
+func (f FlashImage) descriptorFields() ([]string, map[string]string) {
+	var names []string
+	values := make(map[string]string)
+	set := func(name, format string, args ...interface{}) {
+		names = append(names, name)
+		values[name] = fmt.Sprintf(format, args...)
+	}
+	set("Chipset", "%v", f.Chipset)
+	set("DescriptorVersion", "%v", f.DescriptorVersion())
+	set("Component.Densities", "%v", f.Component.Densities())
+	for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+		r := f.Region.Region(t)
+		if r.Valid() {
+			set("Region."+t.String(), "[0x%x-0x%x]", r.Offset(), r.Offset()+r.Size())
+		} else {
+			set("Region."+t.String(), "unused")
+		}
+	}
+	for _, m := range f.Master.Masters() {
+		set("Master."+m.Type.String()+".Read", "[%s]", regionNames(m.Read))
+		set("Master."+m.Type.String()+".Write", "[%s]", regionNames(m.Write))
+	}
+	for _, v := range f.StrapValues() {
+		set("Strap."+v.Name, "%v", v.Value)
+	}
+	for i, s := range f.PchStraps {
+		set(fmt.Sprintf("PchStrap[%d]", i), "0x%08x", s)
+	}
+	for i, s := range f.ProcStraps {
+		set(fmt.Sprintf("ProcStrap[%d]", i), "0x%08x", s)
+	}
+	// the clock configuration ships with the board like the descriptor
+	if f.MeRegion != nil {
+		for _, p := range f.MeRegion.IccProfiles() {
+			keys := make([]string, 0, len(p.Fields))
+			for k := range p.Fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				set("ICC."+p.Name+"."+k, "%s", p.Fields[k])
+			}
+		}
+	}
+	return names, values
+}
+
+// DiffDescriptors compares the descriptors of two images, e.g. two versions
+// of a vendor update, field by field: chipset, component densities, region
+// layout, master permissions, straps and the decoded ICC profiles of the ME
+// region. It returns the fields that differ.
+func DiffDescriptors(from, to *FlashImage) []DescriptorChange {
+	oldNames, oldValues := from.descriptorFields()
+	newNames, newValues := to.descriptorFields()
+	return diffFields(oldNames, oldValues, newNames, newValues)
+}
+
+// diffFields returns the changes between two sets of formatted fields, in
+// the order of the old fields followed by the new ones
+func diffFields(oldNames []string, oldValues map[string]string, newNames []string, newValues map[string]string) []DescriptorChange {
+	var changes []DescriptorChange
+	seen := make(map[string]bool)
+	for _, names := range [][]string{oldNames, newNames} {
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			o, ok := oldValues[name]
+			if !ok {
+				o = "<none>"
+			}
+			n, ok := newValues[name]
+			if !ok {
+				n = "<none>"
+			}
+			if o != n {
+				changes = append(changes, DescriptorChange{Field: name, Old: o, New: n})
+			}
+		}
+	}
+	return changes
+}
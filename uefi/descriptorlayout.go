@@ -0,0 +1,286 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Positions of the sections in the descriptors built by BuildDescriptor
+const (
+	layoutComponentBase = 0x30
+	layoutRegionBase    = 0x40
+	layoutMasterBase    = 0x80
+	layoutPchStrapsBase = 0x100
+)
+
+// LayoutRegion is a region of a DescriptorLayout. Base and Size are in bytes
+// and must be multiples of 4KB.
+type LayoutRegion struct {
+	Name string `json:"name"`
+	Base uint64 `json:"base"`
+	Size uint64 `json:"size"`
+}
+
+// LayoutMaster is a master of a DescriptorLayout, with the names of the
+// regions it can read and write
+type LayoutMaster struct {
+	Name  string   `json:"name"`
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+	// RequesterID is only used by version 1 descriptors
+	RequesterID uint16 `json:"requester_id,omitempty"`
+}
+
+// DescriptorLayout is the declarative description of a flash descriptor,
+// from which BuildDescriptor synthesizes the descriptor region. The
+// descriptor region itself is always the first 4KB and needs not be listed.
+type DescriptorLayout struct {
+	// Version is 1 or 2, see DescriptorVersion
+	Version DescriptorVersion `json:"version"`
+	// PCH puts the signature at offset 16, as all the descriptors since the
+	// ICH8 do
+	PCH bool `json:"pch"`
+	// Components are the sizes of the flash chips in bytes
+	Components []uint64       `json:"components"`
+	Regions    []LayoutRegion `json:"regions"`
+	Masters    []LayoutMaster `json:"masters"`
+	PchStraps  []uint32       `json:"pch_straps"`
+	ProcStraps []uint32       `json:"proc_straps"`
+}
+
+// ParseDescriptorLayout reads a DescriptorLayout from its JSON form
+func ParseDescriptorLayout(data []byte) (*DescriptorLayout, error) {
+	var l DescriptorLayout
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("Invalid descriptor layout: %v", err)
+	}
+	return &l, nil
+}
+
+// regionTypeByName returns the type of the region with the given name
+func regionTypeByName(name string) (FlashRegionType, error) {
+	for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown region %q", name)
+}
+
+// masterTypeByName returns the type of the master with the given name
+func masterTypeByName(name string) (FlashMasterType, error) {
+	for t := MasterTypeBIOS; t < FlashMastersMax; t++ {
+		if strings.EqualFold(t.String(), name) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown master %q", name)
+}
+
+// densityCode returns the density encoding of a component of the given size
+func densityCode(size uint64) (uint8, error) {
+	for code, s := range FlashDensitySizes {
+		if s == size {
+			return code, nil
+		}
+	}
+	return 0, fmt.Errorf("Unsupported component size 0x%x", size)
+}
+
+// accessBits returns the access bitmap of a list of region names, for
+// regions up to max
+func accessBits(names []string, max FlashRegionType) (uint32, error) {
+	var bits uint32
+	for _, name := range names {
+		t, err := regionTypeByName(name)
+		if err != nil {
+			return 0, err
+		}
+		if t >= max {
+			return 0, fmt.Errorf("Region %v cannot be assigned to masters in this descriptor version", t)
+		}
+		bits |= 1 << uint(t)
+	}
+	return bits, nil
+}
+
+// componentSection returns the FLCOMP register of the layout, with the
+// frequencies at 20MHz, or 17MHz for the read clock of version 2 descriptors
+func (l DescriptorLayout) componentSection() (uint32, error) {
+	if len(l.Components) < 1 || len(l.Components) > FlashComponentsMax {
+		return 0, fmt.Errorf("A descriptor has 1 or %d components, got %d", FlashComponentsMax, len(l.Components))
+	}
+	var flcomp uint32
+	shift := uint(3)
+	if l.Version == DescriptorV2 {
+		shift = 4
+		// the second component is marked as not present
+		flcomp = flashDensityNotPresent << shift
+		flcomp |= uint32(Freq17MHz) << 17
+	}
+	for i, size := range l.Components {
+		code, err := densityCode(size)
+		if err != nil {
+			return 0, err
+		}
+		if l.Version != DescriptorV2 && code > 7 {
+			return 0, fmt.Errorf("Unsupported component size 0x%x for version 1 descriptors", size)
+		}
+		mask := uint32(1)<<shift - 1
+		flcomp = flcomp&^(mask<<(shift*uint(i))) | uint32(code)<<(shift*uint(i))
+	}
+	return flcomp, nil
+}
+
+// regionSection returns the region entries of the layout, and checks that
+// the regions fit in the components without overlapping
+func (l DescriptorLayout) regionSection() ([FlashRegionsMax]uint32, error) {
+	var entries [FlashRegionsMax]uint32
+	for i := range entries {
+		entries[i] = 0x7fff
+	}
+	// the descriptor is the first block
+	entries[RegionTypeDescriptor] = 0
+	var flashSize uint64
+	for _, size := range l.Components {
+		flashSize += size
+	}
+	regions := []LayoutRegion{{Name: RegionTypeDescriptor.String(), Base: 0, Size: FlashDescriptorMapSize}}
+	for _, r := range l.Regions {
+		t, err := regionTypeByName(r.Name)
+		if err != nil {
+			return entries, err
+		}
+		if t == RegionTypeDescriptor {
+			return entries, fmt.Errorf("The descriptor region is implicit and cannot be listed")
+		}
+		if r.Base%0x1000 != 0 || r.Size%0x1000 != 0 || r.Size == 0 {
+			return entries, fmt.Errorf("Region %v: base and size must be non-zero multiples of 4KB", t)
+		}
+		if r.Base+r.Size > flashSize {
+			return entries, fmt.Errorf("Region %v [0x%x-0x%x] exceeds the flash size 0x%x", t, r.Base, r.Base+r.Size, flashSize)
+		}
+		if entries[t] != 0x7fff {
+			return entries, fmt.Errorf("Region %v listed twice", t)
+		}
+		entries[t] = uint32(r.Base>>12) | uint32((r.Base+r.Size-1)>>12)<<16
+		regions = append(regions, r)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].Base < regions[j].Base })
+	for i := 1; i < len(regions); i++ {
+		prev, r := regions[i-1], regions[i]
+		if r.Base < prev.Base+prev.Size {
+			return entries, fmt.Errorf("Region %s [0x%x-0x%x] overlaps region %s [0x%x-0x%x]",
+				r.Name, r.Base, r.Base+r.Size, prev.Name, prev.Base, prev.Base+prev.Size)
+		}
+	}
+	return entries, nil
+}
+
+// masterSection returns the master entries of the layout
+func (l DescriptorLayout) masterSection() ([]uint32, error) {
+	count, maxRegion := int(MasterTypeGbE)+1, FlashRegionType(8)
+	if l.Version == DescriptorV2 {
+		count, maxRegion = FlashMastersMax, 12
+	}
+	entries := make([]uint32, count)
+	seen := make(map[FlashMasterType]bool)
+	for _, m := range l.Masters {
+		t, err := masterTypeByName(m.Name)
+		if err != nil {
+			return nil, err
+		}
+		if int(t) >= count {
+			return nil, fmt.Errorf("Master %v is not supported by version %v descriptors", t, l.Version)
+		}
+		if seen[t] {
+			return nil, fmt.Errorf("Master %v listed twice", t)
+		}
+		seen[t] = true
+		read, err := accessBits(m.Read, maxRegion)
+		if err != nil {
+			return nil, fmt.Errorf("Master %v: %v", t, err)
+		}
+		write, err := accessBits(m.Write, maxRegion)
+		if err != nil {
+			return nil, fmt.Errorf("Master %v: %v", t, err)
+		}
+		if l.Version == DescriptorV2 {
+			entries[t] = read<<8 | write<<20
+		} else {
+			entries[t] = uint32(m.RequesterID) | read<<16 | write<<24
+		}
+	}
+	return entries, nil
+}
+
+// BuildDescriptor synthesizes a 4KB descriptor region from a layout, e.g. to
+// create images for emulators or to provision blank chips. The component,
+// region and master sections and the straps are placed at fixed offsets,
+// and the rest of the region is erased.
+func BuildDescriptor(l DescriptorLayout) ([]byte, error) {
+	if l.Version != DescriptorV1 && l.Version != DescriptorV2 {
+		return nil, fmt.Errorf("Unsupported descriptor version %v", l.Version)
+	}
+	flcomp, err := l.componentSection()
+	if err != nil {
+		return nil, err
+	}
+	regions, err := l.regionSection()
+	if err != nil {
+		return nil, err
+	}
+	masters, err := l.masterSection()
+	if err != nil {
+		return nil, err
+	}
+	if len(l.PchStraps) > 0xff || len(l.ProcStraps) > 0xff {
+		return nil, fmt.Errorf("Too many straps: at most 255 of each kind")
+	}
+	procStrapsBase := layoutPchStrapsBase + (len(l.PchStraps)*4+0xf)&^0xf
+	if procStrapsBase+len(l.ProcStraps)*4 > FlashUpperMapOffset {
+		return nil, fmt.Errorf("The straps do not fit in the descriptor")
+	}
+
+	desc := bytes.Repeat([]byte{0xff}, FlashDescriptorMapSize)
+	mapStart := 4
+	if l.PCH {
+		mapStart = 20
+	}
+	copy(desc[mapStart-4:], FlashSignature)
+	descMap := FlashDescriptorMap{
+		ComponentBase:      layoutComponentBase >> 4,
+		NumberOfFlashChips: uint8(len(l.Components) - 1),
+		RegionBase:         layoutRegionBase >> 4,
+		NumberOfRegions:    uint8(flashRegionsBasic - 1),
+		MasterBase:         layoutMasterBase >> 4,
+		NumberOfMasters:    uint8(len(masters) - 1),
+		PchStrapsBase:      layoutPchStrapsBase >> 4,
+		NumberOfPchStraps:  uint8(len(l.PchStraps)),
+		ProcStrapsBase:     uint8(procStrapsBase >> 4),
+		NumberOfProcStraps: uint8(len(l.ProcStraps)),
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, descMap); err != nil {
+		return nil, err
+	}
+	copy(desc[mapStart:], buf.Bytes())
+	binary.LittleEndian.PutUint32(desc[layoutComponentBase:], flcomp)
+	for i, e := range regions {
+		binary.LittleEndian.PutUint32(desc[layoutRegionBase+4*i:], e)
+	}
+	for i, e := range masters {
+		binary.LittleEndian.PutUint32(desc[layoutMasterBase+4*i:], e)
+	}
+	for i, s := range l.PchStraps {
+		binary.LittleEndian.PutUint32(desc[layoutPchStrapsBase+4*i:], s)
+	}
+	for i, s := range l.ProcStraps {
+		binary.LittleEndian.PutUint32(desc[procStrapsBase+4*i:], s)
+	}
+	return desc, nil
+}
@@ -0,0 +1,326 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// Device path node types
+const (
+	DevicePathTypeHardware  = 0x01
+	DevicePathTypeACPI      = 0x02
+	DevicePathTypeMessaging = 0x03
+	DevicePathTypeMedia     = 0x04
+	DevicePathTypeBBS       = 0x05
+	DevicePathTypeEnd       = 0x7f
+)
+
+// Device path end node subtypes
+const (
+	DevicePathEndInstance = 0x01
+	DevicePathEndEntire   = 0xff
+)
+
+// DevicePathNodeHeaderSize is the size of the header of a device path node
+const DevicePathNodeHeaderSize = 4
+
+// Vendor GUIDs of the messaging nodes with a text form of their own
+var devicePathVendorMessagingNames = map[string]string{
+	"e0c14753-f9be-11d2-9a0c-0090273fc14d": "VenPcAnsi()",
+	"dfa66065-b419-11d3-9a2d-0090273fc14d": "VenVt100()",
+	"7baec70b-57e0-4c76-8e87-2f9e28088343": "VenVt100Plus()",
+	"ad15a0d6-8bec-4acf-a073-d01de77e2d88": "VenUtf8()",
+}
+
+// DevicePathNode is a node of an EFI device path, e.g. a PCI device or a
+// partition
+type DevicePathNode struct {
+	Type    uint8
+	SubType uint8
+	// Data holds the node without its header
+	Data []byte
+}
+
+// IsEnd returns whether the node ends a device path or one of its instances
+func (n DevicePathNode) IsEnd() bool {
+	return n.Type == DevicePathTypeEnd
+}
+
+// devicePathGUID formats the GUID at the start of buf
+func devicePathGUID(buf []byte) string {
+	guid, err := uuid.FromBytes(buf[:16])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return strings.ToUpper(guid.String())
+}
+
+// eisaID formats a compressed EISA identifier, e.g. PNP0A03
+func eisaID(id uint32) string {
+	return fmt.Sprintf("%c%c%c%04X",
+		'A'-1+byte(id>>10&0x1f), 'A'-1+byte(id>>5&0x1f), 'A'-1+byte(id&0x1f), id>>16)
+}
+
+// genericText returns the text form of the nodes without a specific one
+func (n DevicePathNode) genericText() string {
+	names := map[uint8]string{
+		DevicePathTypeHardware:  "HardwarePath",
+		DevicePathTypeACPI:      "AcpiPath",
+		DevicePathTypeMessaging: "Msg",
+		DevicePathTypeMedia:     "MediaPath",
+		DevicePathTypeBBS:       "BbsPath",
+	}
+	if name, ok := names[n.Type]; ok {
+		return fmt.Sprintf("%s(%d,%X)", name, n.SubType, n.Data)
+	}
+	return fmt.Sprintf("Path(%d,%d,%X)", n.Type, n.SubType, n.Data)
+}
+
+// String returns the text form of the node defined by the UEFI
+// specification, e.g. Pci(0x1f,0x2)
+func (n DevicePathNode) String() string {
+	d := n.Data
+	u16 := func(off int) uint16 { return binary.LittleEndian.Uint16(d[off:]) }
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(d[off:]) }
+	u64 := func(off int) uint64 { return binary.LittleEndian.Uint64(d[off:]) }
+	// minSizes holds the size of the fixed part of the known nodes
+	minSizes := map[[2]uint8]int{
+		{DevicePathTypeHardware, 0x01}:  2,
+		{DevicePathTypeHardware, 0x02}:  1,
+		{DevicePathTypeHardware, 0x03}:  20,
+		{DevicePathTypeHardware, 0x04}:  16,
+		{DevicePathTypeHardware, 0x05}:  4,
+		{DevicePathTypeACPI, 0x01}:      8,
+		{DevicePathTypeACPI, 0x03}:      4,
+		{DevicePathTypeMessaging, 0x01}: 4,
+		{DevicePathTypeMessaging, 0x02}: 4,
+		{DevicePathTypeMessaging, 0x05}: 2,
+		{DevicePathTypeMessaging, 0x0a}: 16,
+		{DevicePathTypeMessaging, 0x0b}: 33,
+		{DevicePathTypeMessaging, 0x0c}: 15,
+		{DevicePathTypeMessaging, 0x0e}: 15,
+		{DevicePathTypeMessaging, 0x0f}: 7,
+		{DevicePathTypeMessaging, 0x11}: 1,
+		{DevicePathTypeMessaging, 0x12}: 6,
+		{DevicePathTypeMessaging, 0x14}: 2,
+		{DevicePathTypeMessaging, 0x17}: 12,
+		{DevicePathTypeMessaging, 0x18}: 0,
+		{DevicePathTypeMessaging, 0x1a}: 1,
+		{DevicePathTypeMessaging, 0x1d}: 1,
+		{DevicePathTypeMedia, 0x01}:     38,
+		{DevicePathTypeMedia, 0x02}:     20,
+		{DevicePathTypeMedia, 0x03}:     16,
+		{DevicePathTypeMedia, 0x04}:     0,
+		{DevicePathTypeMedia, 0x05}:     16,
+		{DevicePathTypeMedia, 0x06}:     16,
+		{DevicePathTypeMedia, 0x07}:     16,
+		{DevicePathTypeMedia, 0x08}:     20,
+		{DevicePathTypeBBS, 0x01}:       4,
+		{DevicePathTypeEnd, 0x01}:       0,
+		{DevicePathTypeEnd, 0xff}:       0,
+	}
+	minSize, ok := minSizes[[2]uint8{n.Type, n.SubType}]
+	if !ok || len(d) < minSize {
+		return n.genericText()
+	}
+	switch n.Type {
+	case DevicePathTypeHardware:
+		switch n.SubType {
+		case 0x01:
+			return fmt.Sprintf("Pci(0x%x,0x%x)", d[1], d[0])
+		case 0x02:
+			return fmt.Sprintf("PcCard(0x%x)", d[0])
+		case 0x03:
+			return fmt.Sprintf("MemoryMapped(0x%x,0x%x,0x%x)", u32(0), u64(4), u64(12))
+		case 0x04:
+			return vendorText("VenHw", d)
+		case 0x05:
+			return fmt.Sprintf("Ctrl(0x%x)", u32(0))
+		}
+	case DevicePathTypeACPI:
+		switch n.SubType {
+		case 0x01:
+			hid, uid := u32(0), u32(4)
+			if hid&0xffff == 0x41d0 {
+				names := map[uint32]string{
+					0x0a03: "PciRoot",
+					0x0a08: "PcieRoot",
+					0x0604: "Floppy",
+					0x0301: "Keyboard",
+					0x0501: "Serial",
+					0x0401: "ParallelPort",
+				}
+				if name, ok := names[hid>>16]; ok {
+					return fmt.Sprintf("%s(0x%x)", name, uid)
+				}
+			}
+			return fmt.Sprintf("Acpi(%s,0x%x)", eisaID(hid), uid)
+		case 0x03:
+			var adrs []string
+			for off := 0; off+4 <= len(d); off += 4 {
+				adrs = append(adrs, fmt.Sprintf("0x%x", u32(off)))
+			}
+			return "AcpiAdr(" + strings.Join(adrs, ",") + ")"
+		}
+	case DevicePathTypeMessaging:
+		switch n.SubType {
+		case 0x01:
+			channel, drive := "Primary", "Master"
+			if d[0] != 0 {
+				channel = "Secondary"
+			}
+			if d[1] != 0 {
+				drive = "Slave"
+			}
+			return fmt.Sprintf("Ata(%s,%s,0x%x)", channel, drive, u16(2))
+		case 0x02:
+			return fmt.Sprintf("Scsi(0x%x,0x%x)", u16(0), u16(2))
+		case 0x05:
+			return fmt.Sprintf("USB(0x%x,0x%x)", d[0], d[1])
+		case 0x0a:
+			if name, ok := devicePathVendorMessagingNames[strings.ToLower(devicePathGUID(d))]; ok {
+				return name
+			}
+			return vendorText("VenMsg", d)
+		case 0x0b:
+			size := 32
+			if d[32] == 0 || d[32] == 1 {
+				size = 6
+			}
+			return fmt.Sprintf("MAC(%x,0x%x)", d[:size], d[32])
+		case 0x0c:
+			mode := "DHCP"
+			if d[14] != 0 {
+				mode = "Static"
+			}
+			protocols := map[uint16]string{6: "TCP", 17: "UDP"}
+			protocol, ok := protocols[u16(12)]
+			if !ok {
+				protocol = fmt.Sprintf("0x%x", u16(12))
+			}
+			return fmt.Sprintf("IPv4(%v,%s,%s,%v)", net.IP(d[4:8]), protocol, mode, net.IP(d[0:4]))
+		case 0x0e:
+			parities := map[uint8]string{0: "D", 1: "N", 2: "E", 3: "O", 4: "M", 5: "S"}
+			stopBits := map[uint8]string{0: "D", 1: "1", 2: "1.5", 3: "2"}
+			return fmt.Sprintf("Uart(%d,%d,%s,%s)", u64(4), d[12], parities[d[13]], stopBits[d[14]])
+		case 0x0f:
+			return fmt.Sprintf("UsbClass(0x%x,0x%x,0x%x,0x%x,0x%x)", u16(0), u16(2), d[4], d[5], d[6])
+		case 0x11:
+			return fmt.Sprintf("Unit(0x%x)", d[0])
+		case 0x12:
+			return fmt.Sprintf("Sata(0x%x,0x%x,0x%x)", u16(0), u16(2), u16(4))
+		case 0x14:
+			return fmt.Sprintf("Vlan(%d)", u16(0))
+		case 0x17:
+			var eui []string
+			for _, b := range d[4:12] {
+				eui = append(eui, fmt.Sprintf("%02X", b))
+			}
+			return fmt.Sprintf("NVMe(0x%x,%s)", u32(0), strings.Join(eui, "-"))
+		case 0x18:
+			return fmt.Sprintf("Uri(%s)", d)
+		case 0x1a:
+			return fmt.Sprintf("SD(0x%x)", d[0])
+		case 0x1d:
+			return fmt.Sprintf("eMMC(0x%x)", d[0])
+		}
+	case DevicePathTypeMedia:
+		switch n.SubType {
+		case 0x01:
+			part, start, size := u32(0), u64(4), u64(12)
+			switch d[37] {
+			case 1:
+				return fmt.Sprintf("HD(%d,MBR,0x%08x,0x%x,0x%x)", part, binary.LittleEndian.Uint32(d[20:]), start, size)
+			case 2:
+				return fmt.Sprintf("HD(%d,GPT,%s,0x%x,0x%x)", part, devicePathGUID(d[20:36]), start, size)
+			}
+			return fmt.Sprintf("HD(%d,%d,0,0x%x,0x%x)", part, d[36], start, size)
+		case 0x02:
+			return fmt.Sprintf("CDROM(0x%x,0x%x,0x%x)", u32(0), u64(4), u64(12))
+		case 0x03:
+			return vendorText("VenMedia", d)
+		case 0x04:
+			return decodeUCS2(d)
+		case 0x05:
+			return fmt.Sprintf("Media(%s)", devicePathGUID(d))
+		case 0x06:
+			return fmt.Sprintf("FvFile(%s)", devicePathGUID(d))
+		case 0x07:
+			return fmt.Sprintf("Fv(%s)", devicePathGUID(d))
+		case 0x08:
+			return fmt.Sprintf("Offset(0x%x,0x%x)", u64(4), u64(12))
+		}
+	case DevicePathTypeBBS:
+		types := map[uint16]string{1: "Floppy", 2: "HD", 3: "CDROM", 4: "PCMCIA", 5: "USB", 6: "Network"}
+		typ, ok := types[u16(0)]
+		if !ok {
+			typ = fmt.Sprintf("0x%x", u16(0))
+		}
+		desc := strings.TrimRight(string(d[4:]), "\x00")
+		return fmt.Sprintf("BBS(%s,%s,0x%x)", typ, desc, u16(2))
+	case DevicePathTypeEnd:
+		return ""
+	}
+	return n.genericText()
+}
+
+// vendorText returns the text form of the vendor nodes, a GUID followed by
+// optional data
+func vendorText(name string, d []byte) string {
+	if len(d) > 16 {
+		return fmt.Sprintf("%s(%s,%X)", name, devicePathGUID(d), d[16:])
+	}
+	return fmt.Sprintf("%s(%s)", name, devicePathGUID(d))
+}
+
+// DevicePath is an EFI device path: the nodes locating a device or a file,
+// e.g. in the Boot#### variables. It can hold several instances, separated
+// by end instance nodes. The final end node is not included.
+type DevicePath []DevicePathNode
+
+// String returns the text form of the device path defined by the UEFI
+// specification, e.g. PciRoot(0x0)/Pci(0x1f,0x2)/Sata(0x0,0xffff,0x0), with
+// the instances separated by commas
+func (p DevicePath) String() string {
+	var instances []string
+	var nodes []string
+	for _, n := range p {
+		if n.IsEnd() {
+			instances = append(instances, strings.Join(nodes, "/"))
+			nodes = nil
+			continue
+		}
+		nodes = append(nodes, n.String())
+	}
+	instances = append(instances, strings.Join(nodes, "/"))
+	return strings.Join(instances, ",")
+}
+
+// ParseDevicePath parses the device path at the start of buf, up to its end
+// node. It returns the device path and its size, end node included.
+func ParseDevicePath(buf []byte) (DevicePath, uint64, error) {
+	var path DevicePath
+	for offset := uint64(0); ; {
+		if uint64(len(buf))-offset < DevicePathNodeHeaderSize {
+			return nil, 0, fmt.Errorf("Device path node at 0x%x: header exceeds the buffer", offset)
+		}
+		size := uint64(binary.LittleEndian.Uint16(buf[offset+2:]))
+		if size < DevicePathNodeHeaderSize || offset+size > uint64(len(buf)) {
+			return nil, 0, fmt.Errorf("Device path node at 0x%x: invalid size 0x%x", offset, size)
+		}
+		n := DevicePathNode{
+			Type:    buf[offset],
+			SubType: buf[offset+1],
+			Data:    buf[offset+DevicePathNodeHeaderSize : offset+size],
+		}
+		offset += size
+		if n.Type == DevicePathTypeEnd && n.SubType == DevicePathEndEntire {
+			return path, offset, nil
+		}
+		path = append(path, n)
+	}
+}
@@ -0,0 +1,137 @@
+package uefi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/insomniacslk/uefi/compression"
+)
+
+// DiffMagic is the signature at the start of the patches created by Diff
+var DiffMagic = []byte("UEFIDIFF")
+
+// DiffVersion is the version of the patch format
+const DiffVersion = 1
+
+// diffMaxGap is the largest number of unchanged bytes merged into a run of
+// changed ones, as a new run costs 12 bytes
+const diffMaxGap = 12
+
+// diffMaxTargetSize bounds the size of the target image of a patch, which is
+// allocated before the patch can be checked, well above the largest flash
+// chips
+const diffMaxTargetSize = 1 << 28
+
+// diffHeader is the uncompressed header of a patch. It is followed by the
+// LZMA-compressed list of runs, each made of a uint64 offset in the target,
+// a uint32 length and the bytes to write.
+type diffHeader struct {
+	Magic      [8]uint8
+	Version    uint32
+	SourceSize uint64
+	TargetSize uint64
+	SourceHash [32]uint8
+	TargetHash [32]uint8
+}
+
+// Diff returns a patch that turns the source image into the target one, to
+// be applied with ApplyPatch. The patch holds the runs of bytes that differ
+// and the SHA256 of both images, and is compressed with LZMA, so that the
+// deltas between two versions of a firmware are much smaller than a full
+// image.
+func Diff(source, target []byte) ([]byte, error) {
+	if uint64(len(target)) > diffMaxTargetSize {
+		return nil, fmt.Errorf("Target image too big: %v bytes, the maximum is %v", len(target), diffMaxTargetSize)
+	}
+	hdr := diffHeader{
+		Version:    DiffVersion,
+		SourceSize: uint64(len(source)),
+		TargetSize: uint64(len(target)),
+		SourceHash: sha256.Sum256(source),
+		TargetHash: sha256.Sum256(target),
+	}
+	copy(hdr.Magic[:], DiffMagic)
+	// bytes past the end of the source are compared with the erased value
+	at := func(i int) byte {
+		if i < len(source) {
+			return source[i]
+		}
+		return 0xff
+	}
+	var runs bytes.Buffer
+	for i := 0; i < len(target); {
+		if target[i] == at(i) {
+			i++
+			continue
+		}
+		start, end := i, i+1
+		for j := end; j < len(target) && j-end <= diffMaxGap; j++ {
+			if target[j] != at(j) {
+				end = j + 1
+			}
+		}
+		binary.Write(&runs, binary.LittleEndian, uint64(start))
+		binary.Write(&runs, binary.LittleEndian, uint32(end-start))
+		runs.Write(target[start:end])
+		i = end
+	}
+	compressed, err := compression.LZMA.Encode(runs.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	if err := binary.Write(&out, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	out.Write(compressed)
+	debugf("Diff: %v bytes of runs, %v compressed", runs.Len(), len(compressed))
+	return out.Bytes(), nil
+}
+
+// ApplyPatch applies a patch created by Diff to the source image and returns
+// the target image. The SHA256 of the source and of the result are checked
+// against the ones recorded in the patch.
+func ApplyPatch(source, patch []byte) ([]byte, error) {
+	var hdr diffHeader
+	if err := binary.Read(bytes.NewReader(patch), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("Invalid patch: %v", err)
+	}
+	if !bytes.Equal(hdr.Magic[:], DiffMagic) {
+		return nil, fmt.Errorf("Invalid patch: signature not found")
+	}
+	if hdr.Version != DiffVersion {
+		return nil, fmt.Errorf("Unsupported patch version %v", hdr.Version)
+	}
+	if uint64(len(source)) != hdr.SourceSize || sha256.Sum256(source) != hdr.SourceHash {
+		return nil, fmt.Errorf("The patch does not apply to this image")
+	}
+	if hdr.TargetSize > diffMaxTargetSize {
+		return nil, fmt.Errorf("Invalid patch: target size %v bigger than the maximum %v", hdr.TargetSize, diffMaxTargetSize)
+	}
+	runs, err := compression.LZMA.Decode(patch[binary.Size(hdr):])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid patch: %v", err)
+	}
+	target := make([]byte, hdr.TargetSize)
+	n := copy(target, source)
+	fill(target[n:], 0xff)
+	for len(runs) > 0 {
+		if len(runs) < 12 {
+			return nil, fmt.Errorf("Invalid patch: truncated run")
+		}
+		offset := binary.LittleEndian.Uint64(runs)
+		length := uint64(binary.LittleEndian.Uint32(runs[8:]))
+		runs = runs[12:]
+		if length > uint64(len(runs)) || offset > hdr.TargetSize || length > hdr.TargetSize-offset {
+			return nil, fmt.Errorf("Invalid patch: run at 0x%x of %v bytes out of bounds", offset, length)
+		}
+		copy(target[offset:], runs[:length])
+		runs = runs[length:]
+	}
+	if sha256.Sum256(target) != hdr.TargetHash {
+		return nil, fmt.Errorf("Patched image does not match the expected hash")
+	}
+	return target, nil
+}
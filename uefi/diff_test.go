@@ -0,0 +1,25 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestApplyPatchTargetSize(t *testing.T) {
+	source := bytes.Repeat([]byte{0xff}, 0x1000)
+	target := append([]byte{}, source...)
+	target[0x10] = 0
+	patch, err := Diff(source, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ApplyPatch(source, patch); err != nil || !bytes.Equal(got, target) {
+		t.Fatalf("valid patch: %v", err)
+	}
+	// TargetSize follows the magic, the version and SourceSize
+	binary.LittleEndian.PutUint64(patch[20:], 1<<62)
+	if _, err := ApplyPatch(source, patch); err == nil {
+		t.Error("expected an error for a huge target size")
+	}
+}
@@ -0,0 +1,116 @@
+package uefi
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ParseHashAlgorithm returns the hash algorithm with the given name, e.g.
+// sha256. The name is not case sensitive.
+func ParseHashAlgorithm(name string) (HashAlgorithm, error) {
+	for a, n := range hashAlgorithmNames {
+		if strings.EqualFold(n, name) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown hash algorithm %q", name)
+}
+
+// Sum returns the digest of buf with the algorithm
+func (a HashAlgorithm) Sum(buf []byte) ([]byte, error) {
+	h, err := a.newHash()
+	if err != nil {
+		return nil, err
+	}
+	h.Write(buf)
+	return h.Sum(nil), nil
+}
+
+// RegionDigest returns the digest of the raw bytes of a region
+func RegionDigest(r Region, a HashAlgorithm) ([]byte, error) {
+	return a.Sum(r.Buf())
+}
+
+// Digest returns the digest of the firmware volume, header included
+func (fv FirmwareVolume) Digest(a HashAlgorithm) ([]byte, error) {
+	return a.Sum(fv.buf)
+}
+
+// Digest returns the digest of the file, header included
+func (f File) Digest(a HashAlgorithm) ([]byte, error) {
+	return a.Sum(f.buf)
+}
+
+// Digest returns the digest of the section, header included
+func (s Section) Digest(a HashAlgorithm) ([]byte, error) {
+	return a.Sum(s.buf)
+}
+
+// NodeDigest is the digest of a parsed element, as returned by Digests
+type NodeDigest struct {
+	// Path is the list of the types and names of the element and its
+	// parents, which does not depend on the offsets and can be compared
+	// across builds
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Name   string `json:"name,omitempty"`
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+	Digest string `json:"digest"`
+}
+
+func (d NodeDigest) String() string {
+	return fmt.Sprintf("%s 0x%08x 0x%08x %s", d.Digest, d.Offset, d.Size, d.Path)
+}
+
+// nodeDigests returns the digests of the node and its children, in depth
+// first order. buf holds the bytes the offsets of the nodes refer to.
+func nodeDigests(root *Node, buf []byte, a HashAlgorithm) ([]NodeDigest, error) {
+	if _, err := a.newHash(); err != nil {
+		return nil, err
+	}
+	var digests []NodeDigest
+	var walk func(n *Node, parent string)
+	walk = func(n *Node, parent string) {
+		path := n.Type
+		if n.Name != "" {
+			path += " " + n.Name
+		}
+		if parent != "" {
+			path = parent + " > " + path
+		}
+		if n.Offset+n.Size <= uint64(len(buf)) {
+			sum, _ := a.Sum(buf[n.Offset : n.Offset+n.Size])
+			digests = append(digests, NodeDigest{
+				Path:   path,
+				Type:   n.Type,
+				Name:   n.Name,
+				Offset: n.Offset,
+				Size:   n.Size,
+				Digest: hex.EncodeToString(sum),
+			})
+		} else {
+			debugf("%v exceeds the image, not hashed", n)
+		}
+		for _, child := range n.Children {
+			walk(child, path)
+		}
+	}
+	walk(root, "")
+	return digests, nil
+}
+
+// Digests returns the digests of all the parsed elements of the image
+// (regions, firmware volumes, files, sections, variables and ME
+// partitions) in the order of the tree returned by Tree. The contents of
+// the compressed sections are not hashed separately.
+func (f FlashImage) Digests(a HashAlgorithm) ([]NodeDigest, error) {
+	return nodeDigests(f.Tree(), f.buf, a)
+}
+
+// Digests returns the digests of all the parsed elements of a BIOS region
+// parsed on its own, in the order of the tree returned by Tree.
+func (br BiosRegion) Digests(a HashAlgorithm) ([]NodeDigest, error) {
+	return nodeDigests(br.Tree(), br.buf, a)
+}
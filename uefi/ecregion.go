@@ -0,0 +1,157 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// EcFirmware is the header of the firmware in the EC region
+type EcFirmware struct {
+	// Format is the name of the parser that recognized the firmware
+	Format    string
+	Signature string
+	Version   string
+	// PayloadOffset and PayloadSize locate the firmware image in the
+	// region
+	PayloadOffset uint32
+	PayloadSize   uint32
+}
+
+func (e EcFirmware) String() string {
+	return fmt.Sprintf("EcFirmware{Format=%s, Signature=%q, Version=%q, Payload=[0x%x-0x%x]}",
+		e.Format, e.Signature, e.Version, e.PayloadOffset, uint64(e.PayloadOffset)+uint64(e.PayloadSize))
+}
+
+// EcFirmwareParser finds the header of the firmware of a vendor in the EC
+// region. It returns false if the region does not hold such a firmware.
+type EcFirmwareParser func(buf []byte) (*EcFirmware, bool)
+
+type namedEcFirmwareParser struct {
+	name  string
+	parse EcFirmwareParser
+}
+
+var ecFirmwareParsers = []namedEcFirmwareParser{
+	{"cros_ec", parseCrosEC},
+}
+
+// RegisterEcFirmwareParser registers a parser for the EC firmware. The
+// parsers are tried in registration order by NewEcRegion, and the first one
+// that recognizes the firmware is used. Registering a parser with the name of
+// an existing one replaces it.
+func RegisterEcFirmwareParser(name string, p EcFirmwareParser) {
+	for i, ep := range ecFirmwareParsers {
+		if ep.name == name {
+			ecFirmwareParsers[i].parse = p
+			return
+		}
+	}
+	ecFirmwareParsers = append(ecFirmwareParsers, namedEcFirmwareParser{name, p})
+}
+
+// Cookies around the image_data structure of the Chromium EC firmware, which
+// holds its version
+const (
+	crosECCookie1 = 0xce778899
+	crosECCookie2 = 0xceaabbdd
+	// crosECImageDataSize is the size of image_data: the cookies, a 32
+	// bytes version string, the size and the rollback version
+	crosECImageDataSize = 48
+)
+
+// parseCrosEC finds the image_data structure of a Chromium EC firmware
+func parseCrosEC(buf []byte) (*EcFirmware, bool) {
+	for offset := 0; offset+crosECImageDataSize <= len(buf); offset += 4 {
+		if binary.LittleEndian.Uint32(buf[offset:]) != crosECCookie1 ||
+			binary.LittleEndian.Uint32(buf[offset+44:]) != crosECCookie2 {
+			continue
+		}
+		version := buf[offset+4 : offset+36]
+		if i := bytes.IndexByte(version, 0); i >= 0 {
+			version = version[:i]
+		}
+		size := binary.LittleEndian.Uint32(buf[offset+36:])
+		if uint64(size) > uint64(len(buf)) {
+			size = uint32(len(buf))
+		}
+		return &EcFirmware{
+			Signature:   "image_data",
+			Version:     string(version),
+			PayloadSize: size,
+		}, true
+	}
+	return nil, false
+}
+
+// EcRegion represents the Embedded Controller region of the flash image, on
+// recent descriptors. It holds the EC firmware, whose format is defined by the
+// EC vendor and recognized by the parsers registered with
+// RegisterEcFirmwareParser.
+type EcRegion struct {
+	// Firmware is the header of the firmware, nil if no parser recognized
+	// it
+	Firmware *EcFirmware
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the region
+func (er EcRegion) Buf() []byte {
+	return er.buf
+}
+
+// Type returns RegionTypeEC
+func (er EcRegion) Type() FlashRegionType {
+	return RegionTypeEC
+}
+
+// Payload returns the firmware image, or the whole region if the firmware
+// was not recognized
+func (er EcRegion) Payload() []byte {
+	if er.Firmware == nil {
+		return er.buf
+	}
+	end := uint64(er.Firmware.PayloadOffset) + uint64(er.Firmware.PayloadSize)
+	if end > uint64(len(er.buf)) {
+		end = uint64(len(er.buf))
+	}
+	return er.buf[er.Firmware.PayloadOffset:end]
+}
+
+// Summary prints a multi-line description of the region
+func (er EcRegion) Summary() string {
+	firmware := "<unknown>"
+	if er.Firmware != nil {
+		firmware = er.Firmware.String()
+	}
+	return fmt.Sprintf("EcRegion{\n"+
+		"    Size=%v\n"+
+		"    Firmware=%v\n"+
+		"}", len(er.buf), firmware)
+}
+
+// MarshalBinary serializes the region
+func (er EcRegion) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, er.buf...), nil
+}
+
+// NewEcRegion parses a sequence of bytes and returns an EcRegion object, if a valid
+// one is passed, or an error
+func NewEcRegion(data []byte) (*EcRegion, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Embedded Controller region is empty")
+	}
+	er := EcRegion{buf: data}
+	for _, p := range ecFirmwareParsers {
+		if fw, ok := p.parse(data); ok {
+			if uint64(fw.PayloadOffset) > uint64(len(data)) {
+				return nil, fmt.Errorf("EC firmware payload offset 0x%x exceeds the region size 0x%x", fw.PayloadOffset, len(data))
+			}
+			fw.Format = p.name
+			er.Firmware = fw
+			break
+		}
+	}
+	return &er, nil
+}
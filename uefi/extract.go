@@ -0,0 +1,384 @@
+package uefi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Extracted directory layout, distinct from the unpacked one so that both
+// can share a directory
+const (
+	ExtractManifestName = "extract.json"
+	ExtractImageName    = "extract.bin"
+	// ExtractFormat identifies the manifests written by Extract
+	ExtractFormat = "extract"
+)
+
+// ExtractNode describes an element of the hierarchy written by Extract. The
+// leaves have their contents in a data file, the other elements are
+// directories holding their children.
+type ExtractNode struct {
+	// Type is FlashImage, Region, FirmwareVolume, File or Section
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+	// Index is the position of the element in the list of its container,
+	// used to find it again when assembling
+	Index int `json:"index"`
+	// Path is the directory of the element, or its data file for leaves,
+	// relative to the extracted directory
+	Path string `json:"path"`
+	// Offset is the position of the element from the start of its
+	// container. The children of compressed sections are relative to the
+	// decompressed data.
+	Offset uint64 `json:"offset"`
+	Size   uint64 `json:"size"`
+	// Compression is the algorithm of compressed sections
+	Compression string `json:"compression,omitempty"`
+	// SHA256 is the hash of the data file of leaves, used to detect changes
+	SHA256   string         `json:"sha256,omitempty"`
+	Children []*ExtractNode `json:"children,omitempty"`
+}
+
+// ExtractManifest is the description of a directory written by Extract
+type ExtractManifest struct {
+	// Format is ExtractFormat
+	Format string       `json:"format"`
+	Image  string       `json:"image"`
+	Root   *ExtractNode `json:"root"`
+}
+
+// sectionDirName returns a name for the directory of a section of the given
+// type
+func sectionDirName(t SectionType) string {
+	if name, ok := SectionTypeNames[t]; ok {
+		return strings.TrimPrefix(name, "EFI_SECTION_")
+	}
+	return fmt.Sprintf("0x%02x", uint8(t))
+}
+
+// extractor writes the elements of an image to a directory
+type extractor struct {
+	dir string
+}
+
+// leaf writes the data of a leaf element and completes its node
+func (e extractor) leaf(n *ExtractNode, data []byte) (*ExtractNode, error) {
+	n.Path += ".bin"
+	p := filepath.Join(e.dir, filepath.FromSlash(n.Path))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		return nil, err
+	}
+	n.SHA256 = sha256Hex(data)
+	return n, nil
+}
+
+func (e extractor) section(s *Section, idx int, parent string) (*ExtractNode, error) {
+	n := &ExtractNode{
+		Type:        "Section",
+		Name:        s.Type.String(),
+		Index:       idx,
+		Path:        path.Join(parent, fmt.Sprintf("%02d-%s", idx, sectionDirName(s.Type))),
+		Offset:      s.Offset,
+		Size:        s.SectionSize(),
+		Compression: s.CompressionName(),
+	}
+	if len(s.Sections) == 0 {
+		return e.leaf(n, s.Data())
+	}
+	for i, child := range s.Sections {
+		c, err := e.section(child, i, n.Path)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = append(n.Children, c)
+	}
+	return n, nil
+}
+
+func (e extractor) file(f *File, idx int, parent string) (*ExtractNode, error) {
+	n := &ExtractNode{
+		Type:   "File",
+		Name:   f.GUID(),
+		Index:  idx,
+		Path:   path.Join(parent, fileBaseName(idx, f)),
+		Offset: f.Offset,
+		Size:   f.FileSize(),
+	}
+	if len(f.Sections) == 0 {
+		return e.leaf(n, f.Data())
+	}
+	for i, s := range f.Sections {
+		c, err := e.section(s, i, n.Path)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = append(n.Children, c)
+	}
+	return n, nil
+}
+
+func (e extractor) firmwareVolume(fv *FirmwareVolume, idx int, parent string) (*ExtractNode, error) {
+	n := &ExtractNode{
+		Type:   "FirmwareVolume",
+		Name:   fv.guidString(),
+		Index:  idx,
+		Path:   path.Join(parent, fmt.Sprintf("%02d-%s", idx, fv.guidString())),
+		Offset: fv.Offset,
+		Size:   fv.Length,
+	}
+	for i, f := range fv.Files {
+		if f.Type == FileTypePad {
+			continue
+		}
+		c, err := e.file(f, i, n.Path)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = append(n.Children, c)
+	}
+	if len(n.Children) == 0 {
+		// e.g. NVRAM volumes
+		return e.leaf(n, fv.buf)
+	}
+	return n, nil
+}
+
+// Extract writes the whole image to dir as a hierarchy of directories:
+// regions, firmware volumes, files and sections, including the decompressed
+// contents of compressed sections. Each leaf is written to a data file, and
+// the hierarchy is described in a JSON manifest. Pad files are skipped.
+// Assemble rebuilds an image from the directory.
+func (f FlashImage) Extract(dir string) error {
+	e := extractor{dir: dir}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ExtractImageName), f.buf, 0644); err != nil {
+		return err
+	}
+	root := &ExtractNode{Type: "FlashImage", Path: ".", Size: uint64(len(f.buf))}
+	for i, r := range f.Tree().Children {
+		if r.Type != "Region" {
+			continue
+		}
+		n := &ExtractNode{
+			Type:   "Region",
+			Name:   r.Name,
+			Index:  i,
+			Path:   "regions/" + r.Name,
+			Offset: r.Offset,
+			Size:   r.Size,
+		}
+		if r.Name == "BIOS" && f.BiosRegion != nil {
+			for j := range f.BiosRegion.FirmwareVolumes {
+				c, err := e.firmwareVolume(&f.BiosRegion.FirmwareVolumes[j], j, n.Path)
+				if err != nil {
+					return err
+				}
+				n.Children = append(n.Children, c)
+			}
+		} else {
+			data, err := f.RegionData(r.Name)
+			if err != nil {
+				return err
+			}
+			if n, err = e.leaf(n, data); err != nil {
+				return err
+			}
+		}
+		root.Children = append(root.Children, n)
+	}
+	out, err := json.MarshalIndent(ExtractManifest{Format: ExtractFormat, Image: ExtractImageName, Root: root}, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, ExtractManifestName), out, 0644)
+}
+
+// assembler applies the modified leaves of an extracted directory
+type assembler struct {
+	dir string
+}
+
+// modified returns the contents of the data file of a leaf if it changed
+// since the extraction, or nil
+func (a assembler) modified(n *ExtractNode) ([]byte, error) {
+	if len(n.Children) != 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(a.dir, filepath.FromSlash(n.Path)))
+	if err != nil {
+		return nil, err
+	}
+	if sha256Hex(data) == n.SHA256 {
+		return nil, nil
+	}
+	debugf("%s was modified", n.Path)
+	return data, nil
+}
+
+func (a assembler) sections(sections []*Section, nodes []*ExtractNode) error {
+	for _, n := range nodes {
+		if n.Index < 0 || n.Index >= len(sections) {
+			return fmt.Errorf("%s: section not found", n.Path)
+		}
+		s := sections[n.Index]
+		data, err := a.modified(n)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			if err := s.SetData(data); err != nil {
+				return fmt.Errorf("%s: %v", n.Path, err)
+			}
+		}
+		if err := a.sections(s.Sections, n.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a assembler) firmwareVolume(fv *FirmwareVolume, n *ExtractNode) error {
+	data, err := a.modified(n)
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		if uint64(len(data)) != uint64(len(fv.buf)) {
+			return fmt.Errorf("%s: firmware volume must be %v bytes, got %v", n.Path, len(fv.buf), len(data))
+		}
+		return fv.rebuild(data)
+	}
+	// sections are edited in place, while files without sections are
+	// replaced afterwards, in the volume rebuilt with the edited sections
+	replaced := make(map[string][]byte)
+	var order []string
+	for _, fn := range n.Children {
+		if fn.Index < 0 || fn.Index >= len(fv.Files) {
+			return fmt.Errorf("%s: file not found", fn.Path)
+		}
+		f := fv.Files[fn.Index]
+		data, err := a.modified(fn)
+		if err != nil {
+			return err
+		}
+		if data != nil {
+			replaced[f.GUID()] = data
+			order = append(order, f.GUID())
+		}
+		if err := a.sections(f.Sections, fn.Children); err != nil {
+			return err
+		}
+	}
+	if len(order) == 0 {
+		return nil
+	}
+	buf, err := fv.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := fv.rebuild(buf); err != nil {
+		return err
+	}
+	for _, guid := range order {
+		if err := fv.ReplaceFile(guid, replaced[guid]); err != nil {
+			return fmt.Errorf("File %s: %v", guid, err)
+		}
+	}
+	return nil
+}
+
+// Assemble rebuilds an image from a directory created by Extract. The
+// modified sections are resized and recompressed as needed, the modified
+// files without sections are replaced with FirmwareVolume.ReplaceFile, and
+// the modified regions are replaced with FlashImage.ReplaceRegion. The FIT
+// is updated if the files it points to moved. Whatever was not modified is
+// left as it is.
+func Assemble(dir string) (*FlashImage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ExtractManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest ExtractManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest: %v", err)
+	}
+	if manifest.Format != ExtractFormat {
+		return nil, fmt.Errorf("Invalid manifest: format %q, expected %q", manifest.Format, ExtractFormat)
+	}
+	if manifest.Root == nil {
+		return nil, fmt.Errorf("Invalid manifest: no root element")
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(manifest.Image)))
+	if err != nil {
+		return nil, err
+	}
+	image, err := NewFlashImage(buf)
+	if err != nil {
+		return nil, err
+	}
+	// make sure that only the modified elements will change
+	if err := image.CheckRoundTrip(); err != nil {
+		return nil, err
+	}
+	// the volumes are edited in place, keep the original layout to update
+	// the FIT
+	var original *BiosRegion
+	if image.BiosRegion != nil {
+		original = image.BiosRegion.clone()
+		// the table moves with its file until it is updated
+		image.BiosRegion.FIT = nil
+	}
+	a := assembler{dir: dir}
+	regions := make(map[string][]byte)
+	var order []string
+	for _, r := range manifest.Root.Children {
+		if len(r.Children) == 0 {
+			data, err := a.modified(r)
+			if err != nil {
+				return nil, err
+			}
+			if data != nil {
+				regions[r.Name] = data
+				order = append(order, r.Name)
+			}
+			continue
+		}
+		if image.BiosRegion == nil {
+			return nil, fmt.Errorf("%s: BIOS region not parsed", r.Path)
+		}
+		for _, n := range r.Children {
+			if n.Index < 0 || n.Index >= len(image.BiosRegion.FirmwareVolumes) {
+				return nil, fmt.Errorf("%s: firmware volume not found", n.Path)
+			}
+			if err := a.firmwareVolume(&image.BiosRegion.FirmwareVolumes[n.Index], n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	out, err := image.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if image, err = NewFlashImage(out); err != nil {
+		return nil, err
+	}
+	if err := image.updateFIT(original); err != nil {
+		return nil, err
+	}
+	for _, name := range order {
+		if err := image.ReplaceRegion(name, regions[name]); err != nil {
+			return nil, err
+		}
+	}
+	return image, nil
+}
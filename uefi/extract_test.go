@@ -0,0 +1,43 @@
+package uefi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractUnpackSameDirectory(t *testing.T) {
+	f := syntheticFlashImage(t)
+	dir, err := ioutil.TempDir("", "extract")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := f.Unpack(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Assemble(dir); err == nil {
+		t.Error("Assemble: expected an error for an unpacked directory")
+	}
+	if err := f.Extract(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Repack(dir); err != nil {
+		t.Errorf("Repack: %v", err)
+	}
+	if _, err := Assemble(dir); err != nil {
+		t.Errorf("Assemble: %v", err)
+	}
+	// a manifest of the wrong format is refused
+	data, err := ioutil.ReadFile(filepath.Join(dir, ExtractManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, UnpackManifestName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Repack(dir); err == nil {
+		t.Error("Repack: expected an error for a manifest written by Extract")
+	}
+}
@@ -0,0 +1,307 @@
+package uefi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// FDFName is the name of the flash description written by ExportFDF
+const FDFName = "image.fdf"
+
+// fdfFileTypes maps the file types to their names in the FILE statements
+var fdfFileTypes = map[FileType]string{
+	FileTypeRaw:                 "RAW",
+	FileTypeFreeform:            "FREEFORM",
+	FileTypeSecurityCore:        "SEC",
+	FileTypePEICore:             "PEI_CORE",
+	FileTypeDXECore:             "DXE_CORE",
+	FileTypePEIM:                "PEIM",
+	FileTypeDriver:              "DRIVER",
+	FileTypeCombinedPEIMDriver:  "COMBINED_PEIM_DRIVER",
+	FileTypeApplication:         "APPLICATION",
+	FileTypeSMM:                 "SMM",
+	FileTypeFirmwareVolumeImage: "FV_IMAGE",
+	FileTypeCombinedSMMDXE:      "COMBINED_SMM_DXE",
+	FileTypeSMMCore:             "SMM_CORE",
+}
+
+// fdfSectionTypes maps the section types to their names in the SECTION
+// statements
+var fdfSectionTypes = map[SectionType]string{
+	SectionTypeCompression:         "COMPRESS",
+	SectionTypeGUIDDefined:         "GUIDED",
+	SectionTypeDisposable:          "DISPOSABLE",
+	SectionTypePE32:                "PE32",
+	SectionTypePIC:                 "PIC",
+	SectionTypeTE:                  "TE",
+	SectionTypeDXEDepex:            "DXE_DEPEX",
+	SectionTypeVersion:             "VERSION",
+	SectionTypeUserInterface:       "UI",
+	SectionTypeCompatibility16:     "COMPAT16",
+	SectionTypeFirmwareVolumeImage: "FV_IMAGE",
+	SectionTypeFreeformSubtypeGUID: "SUBTYPE_GUID",
+	SectionTypeRaw:                 "RAW",
+	SectionTypePEIDepex:            "PEI_DEPEX",
+	SectionTypeMMDepex:             "SMM_DEPEX",
+}
+
+// fdfVolumeAttributes are the EFI_FVB2 attributes of the volumes, in the
+// order of the FV sections written by GenFds
+var fdfVolumeAttributes = []struct {
+	Name string
+	Mask uint32
+}{
+	{"MEMORY_MAPPED", 0x00000400},
+	{"STICKY_WRITE", 0x00000200},
+	{"LOCK_CAP", 0x00000040},
+	{"LOCK_STATUS", 0x00000080},
+	{"WRITE_DISABLED_CAP", 0x00000008},
+	{"WRITE_ENABLED_CAP", 0x00000010},
+	{"WRITE_STATUS", 0x00000020},
+	{"WRITE_LOCK_CAP", 0x00004000},
+	{"WRITE_LOCK_STATUS", 0x00008000},
+	{"READ_DISABLED_CAP", 0x00000001},
+	{"READ_ENABLED_CAP", 0x00000002},
+	{"READ_STATUS", 0x00000004},
+	{"READ_LOCK_CAP", 0x00001000},
+	{"READ_LOCK_STATUS", 0x00002000},
+}
+
+const (
+	// fdfAlignmentMask selects the alignment of the volumes, a power of two,
+	// in the attributes
+	fdfAlignmentMask  = 0x001f0000
+	fdfAlignmentShift = 16
+	// fdfBlockSize is the block size of the flash device, when the BIOS
+	// region has no volume to take it from
+	fdfBlockSize = 0x1000
+)
+
+// fdfSize formats an alignment as in the FvAlignment and Align options
+func fdfSize(n uint64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return fmt.Sprintf("%dG", n>>30)
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dM", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dK", n>>10)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// fdfVolumeName returns the name of the FV section of a volume of the BIOS
+// region
+func fdfVolumeName(index int) string {
+	return fmt.Sprintf("FV%02d", index)
+}
+
+// fdfVolumePath returns the path of the volumes of the BIOS region that do
+// not hold files, e.g. the NVRAM stores, which are copied as they are
+func fdfVolumePath(index int, fv FirmwareVolume) string {
+	return fmt.Sprintf("volumes/%02d-%s.fv", index, fv.guidString())
+}
+
+// fdfRegionPath returns the path of a flash region outside the BIOS region
+func fdfRegionPath(name string) string {
+	return "regions/" + name + ".bin"
+}
+
+// fdfSections describes the section tree of a file on one line, e.g.
+// GUIDED ee4e5898-...(PE32 DXE_DEPEX UI VERSION)
+func fdfSections(sections []*Section) string {
+	var names []string
+	for _, s := range sections {
+		name, ok := fdfSectionTypes[s.Type]
+		if !ok {
+			name = fmt.Sprintf("0x%02x", uint8(s.Type))
+		}
+		if g := s.GUIDDefinedGUID(); g != "" {
+			name += " " + g
+		}
+		if len(s.Sections) > 0 {
+			name += "(" + fdfSections(s.Sections) + ")"
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, " ")
+}
+
+// volumeNameGUID returns the name GUID of the volume from its extended
+// header, or an empty string if it has none
+func (fv FirmwareVolume) volumeNameGUID() string {
+	if fv.ExtHeaderOffset == 0 || uint64(fv.ExtHeaderOffset)+FirmwareVolumeExtHeaderMinSize > uint64(len(fv.buf)) {
+		return ""
+	}
+	guid, err := uuid.FromBytes(fv.buf[fv.ExtHeaderOffset : fv.ExtHeaderOffset+16])
+	if err != nil {
+		return ""
+	}
+	return guid.String()
+}
+
+// writeFDFVolume writes the FV section of a volume of the BIOS region, with
+// one FILE statement per file. The files refer to their contents in the
+// directory written by Unpack, and their section tree is described in a
+// comment, as the modules they were built from are not known.
+func writeFDFVolume(b *bytes.Buffer, index int, fv FirmwareVolume) {
+	fmt.Fprintf(b, "[FV.%s]\n", fdfVolumeName(index))
+	fmt.Fprintf(b, "# %s, %s\n", fv.guidString(), FirmwareVolumeGUIDs[fv.guidString()])
+	if g := fv.volumeNameGUID(); g != "" {
+		fmt.Fprintf(b, "FvNameGuid         = %s\n", g)
+	}
+	if len(fv.Blocks) > 0 && fv.Blocks[0].Size != 0 {
+		fmt.Fprintf(b, "BlockSize          = 0x%x\n", fv.Blocks[0].Size)
+		fmt.Fprintf(b, "NumBlocks          = 0x%x\n", fv.Length/uint64(fv.Blocks[0].Size))
+	}
+	fmt.Fprintf(b, "FvAlignment        = %s\n", fdfSize(1<<((fv.Attributes&fdfAlignmentMask)>>fdfAlignmentShift)))
+	fmt.Fprintf(b, "%-18s = %d\n", "ERASE_POLARITY", fv.ErasePolarity())
+	for _, a := range fdfVolumeAttributes {
+		value := "FALSE"
+		if fv.Attributes&a.Mask != 0 {
+			value = "TRUE"
+		}
+		fmt.Fprintf(b, "%-18s = %s\n", a.Name, value)
+	}
+	for i, f := range fv.Files {
+		if f.Type == FileTypePad {
+			continue
+		}
+		typ, ok := fdfFileTypes[f.Type]
+		if !ok {
+			typ = fmt.Sprintf("0x%02X", uint8(f.Type))
+		}
+		options := ""
+		if f.Attributes&FileAttribFixed != 0 {
+			options += " Fixed"
+		}
+		if f.Attributes&FileAttribChecksum != 0 {
+			options += " Checksum"
+		}
+		if a := f.Alignment(); a > 1 {
+			options += " Align = " + fdfSize(a)
+		}
+		b.WriteString("\n")
+		comment := strings.TrimSpace(f.ModuleName() + " " + f.Version())
+		if f.HasSections() {
+			comment = strings.TrimSpace(comment + " " + fdfSections(f.Sections))
+		}
+		if comment != "" {
+			fmt.Fprintf(b, "# %s\n", comment)
+		}
+		fmt.Fprintf(b, "FILE %s = %s%s %s\n", typ, f.GUID(), options, unpackFilePath(index, fv, i, f))
+	}
+	b.WriteString("\n")
+}
+
+// WriteFDF writes an approximate EDK2 flash description of the image: an FD
+// section mapping the flash right below 4GB, with one region per volume of
+// the BIOS region and per flash region outside of it, and one FV section
+// per volume holding files. The paths are relative to a directory written
+// by ExportFDF. The gaps between the volumes and the pad files are left to
+// GenFds, so a rebuilt image matches the layout but not necessarily the
+// bytes of the original one.
+func (f FlashImage) WriteFDF(w io.Writer, name string) error {
+	size := uint64(len(f.buf))
+	type fdRegion struct {
+		offset, size uint64
+		statement    string
+	}
+	var regions []fdRegion
+	for _, n := range f.Tree().Children {
+		if n.Type != "Region" || (n.Name == RegionTypeBIOS.String() && f.BiosRegion != nil) {
+			continue
+		}
+		regions = append(regions, fdRegion{n.Offset, n.Size, "FILE = " + fdfRegionPath(n.Name)})
+	}
+	blockSize := uint64(fdfBlockSize)
+	if f.BiosRegion != nil {
+		start, _ := f.Region.RegionOffset(RegionTypeBIOS)
+		for i, fv := range f.BiosRegion.FirmwareVolumes {
+			statement := "FV = " + fdfVolumeName(i)
+			if !fv.IsFFS() {
+				statement = "FILE = " + fdfVolumePath(i, fv)
+			}
+			regions = append(regions, fdRegion{uint64(start) + fv.Offset, fv.Length, statement})
+		}
+		if fvs := f.BiosRegion.FirmwareVolumes; len(fvs) > 0 && len(fvs[0].Blocks) > 0 && fvs[0].Blocks[0].Size != 0 {
+			blockSize = uint64(fvs[0].Blocks[0].Size)
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].offset < regions[j].offset })
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "## @file\n"+
+		"#  Flash description generated from %s. The layout matches the\n"+
+		"#  original image, the modules are included as binaries.\n"+
+		"##\n\n", name)
+	b.WriteString("[FD.IMAGE]\n")
+	fmt.Fprintf(&b, "BaseAddress   = 0x%08x\n", (1<<32)-size)
+	fmt.Fprintf(&b, "Size          = 0x%08x\n", size)
+	erasePolarity := 1
+	if f.BiosRegion != nil && len(f.BiosRegion.FirmwareVolumes) > 0 {
+		erasePolarity = int(f.BiosRegion.FirmwareVolumes[0].ErasePolarity())
+	}
+	fmt.Fprintf(&b, "ErasePolarity = %d\n", erasePolarity)
+	fmt.Fprintf(&b, "BlockSize     = 0x%x\n", blockSize)
+	fmt.Fprintf(&b, "NumBlocks     = 0x%x\n", size/blockSize)
+	for _, r := range regions {
+		fmt.Fprintf(&b, "\n0x%08x|0x%08x\n%s\n", r.offset, r.size, r.statement)
+	}
+	b.WriteString("\n")
+	if f.BiosRegion != nil {
+		for i, fv := range f.BiosRegion.FirmwareVolumes {
+			if fv.IsFFS() {
+				writeFDFVolume(&b, i, fv)
+			}
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// ExportFDF unpacks the image into dir with Unpack, adds the descriptor and
+// the volumes that do not hold files, and writes the flash description
+// referring to them, as returned by WriteFDF
+func (f FlashImage) ExportFDF(dir, name string) error {
+	if err := f.Unpack(dir); err != nil {
+		return err
+	}
+	write := func(path string, data []byte) error {
+		path = filepath.Join(dir, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, data, 0644)
+	}
+	// Unpack skips the descriptor, which can not be edited
+	if data, err := f.RegionData("Descriptor"); err == nil {
+		if err := write(fdfRegionPath("Descriptor"), data); err != nil {
+			return err
+		}
+	}
+	if f.BiosRegion != nil {
+		for i, fv := range f.BiosRegion.FirmwareVolumes {
+			if fv.IsFFS() {
+				continue
+			}
+			if err := write(fdfVolumePath(i, fv), fv.buf); err != nil {
+				return err
+			}
+		}
+	}
+	out, err := os.Create(filepath.Join(dir, FDFName))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return f.WriteFDF(out, name)
+}
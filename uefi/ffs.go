@@ -0,0 +1,100 @@
+package uefi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fileStateReserved is a state bit that is never set by the firmware, and is
+// therefore only set in the files of volumes with erase polarity 1
+const fileStateReserved = 0x80
+
+// NewFFS parses a standalone firmware file, as exported by UEFITool or
+// MMTool in .ffs files: the file header followed by the file contents. The
+// erase polarity of the volume the file was exported from is guessed from
+// its state byte. Up to 7 bytes of alignment padding may follow the file.
+func NewFFS(data []byte) (*File, error) {
+	if len(data) < FileHeaderMinSize {
+		return nil, fmt.Errorf("FFS file too small: %v bytes", len(data))
+	}
+	var erasePolarity uint8
+	if data[23]&fileStateReserved != 0 {
+		erasePolarity = 1
+	}
+	f, err := NewFile(data, erasePolarity)
+	if err != nil {
+		return nil, err
+	}
+	if extra := uint64(len(data)) - f.FileSize(); extra >= FileAlignment {
+		return nil, fmt.Errorf("FFS file %s: %v bytes after the end of the file", f.GUID(), extra)
+	}
+	if errs := f.Validate(); len(errs) > 0 {
+		return nil, fmt.Errorf("FFS file %s: %v", f.GUID(), errs[0])
+	}
+	return f, nil
+}
+
+// ExportFFS returns the file at the given path, in the format described for
+// Patch without the sections, e.g. "1/5a5e7c1f-0001-4e3a-9f6b-0a1b2c3d4e01",
+// as a standalone .ffs file: its header and contents, as stored in its
+// volume, which is what UEFITool extracts "as is"
+func (f FlashImage) ExportFFS(path string) ([]byte, error) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid file path %q: expected volume/file", path)
+	}
+	i, idx, err := f.resolveFile(path, parts)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{}, f.BiosRegion.FirmwareVolumes[i].Files[idx].Buf()...), nil
+}
+
+// ImportFFS adds a standalone .ffs file, as parsed by NewFFS, to the volume
+// with the given index in the BIOS region. A file with the same GUID is
+// replaced by it, header included, like UEFITool's "replace as is", in
+// place if it fits as described for FirmwareVolume.ReplaceFile, and the
+// file is inserted with FirmwareVolume.InsertFile otherwise. The image
+// is then serialized and parsed again, and the FIT is updated if the files
+// it points to moved, see BiosRegion.UpdateFIT.
+func (f *FlashImage) ImportFFS(volume int, data []byte) error {
+	if f.BiosRegion == nil {
+		return fmt.Errorf("The image has no BIOS region")
+	}
+	if volume < 0 || volume >= len(f.BiosRegion.FirmwareVolumes) {
+		return fmt.Errorf("Firmware volume %d not found", volume)
+	}
+	file, err := NewFFS(data)
+	if err != nil {
+		return err
+	}
+	old := f.BiosRegion.clone()
+	// the table moves with its file until it is updated
+	f.BiosRegion.FIT = nil
+	fv := &f.BiosRegion.FirmwareVolumes[volume]
+	if err := fv.checkEditable(); err != nil {
+		f.BiosRegion = old
+		return err
+	}
+	if idx := fv.findFile(file.GUID()); idx != -1 {
+		err = fv.replaceFileAt(idx, file)
+	} else {
+		err = fv.InsertFile(file)
+	}
+	if err != nil {
+		f.BiosRegion = old
+		return err
+	}
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		f.BiosRegion = old
+		return err
+	}
+	image, err := NewFlashImage(buf)
+	if err != nil {
+		f.BiosRegion = old
+		return err
+	}
+	*f = *image
+	return f.updateFIT(old)
+}
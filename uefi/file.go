@@ -0,0 +1,419 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// File constants
+const (
+	FileHeaderMinSize    = 24
+	FileHeaderLargeSize  = 32
+	FileAlignment        = 8
+	FileFixedChecksum    = 0xaa
+	FileMaxSmallFileSize = 0xffffff
+)
+
+// File attributes
+const (
+	FileAttribLargeFile     = 0x01
+	FileAttribDataAlignment = 0x38
+	FileAttribFixed         = 0x04
+	FileAttribChecksum      = 0x40
+)
+
+// File states. When the erase polarity of the volume is 1 the bits are
+// stored inverted.
+const (
+	FileStateHeaderConstruction = 0x01
+	FileStateHeaderValid        = 0x02
+	FileStateDataValid          = 0x04
+	FileStateMarkedForUpdate    = 0x08
+	FileStateDeleted            = 0x10
+	FileStateHeaderInvalid      = 0x20
+)
+
+// FileType is the type of a firmware file
+type FileType uint8
+
+// Firmware file types, as defined in the PI specification
+const (
+	FileTypeAll                 FileType = 0x00
+	FileTypeRaw                 FileType = 0x01
+	FileTypeFreeform            FileType = 0x02
+	FileTypeSecurityCore        FileType = 0x03
+	FileTypePEICore             FileType = 0x04
+	FileTypeDXECore             FileType = 0x05
+	FileTypePEIM                FileType = 0x06
+	FileTypeDriver              FileType = 0x07
+	FileTypeCombinedPEIMDriver  FileType = 0x08
+	FileTypeApplication         FileType = 0x09
+	FileTypeSMM                 FileType = 0x0a
+	FileTypeFirmwareVolumeImage FileType = 0x0b
+	FileTypeCombinedSMMDXE      FileType = 0x0c
+	FileTypeSMMCore             FileType = 0x0d
+	FileTypePad                 FileType = 0xf0
+)
+
+// FileTypeNames maps the file types to their names
+var FileTypeNames = map[FileType]string{
+	FileTypeAll:                 "EFI_FV_FILETYPE_ALL",
+	FileTypeRaw:                 "EFI_FV_FILETYPE_RAW",
+	FileTypeFreeform:            "EFI_FV_FILETYPE_FREEFORM",
+	FileTypeSecurityCore:        "EFI_FV_FILETYPE_SECURITY_CORE",
+	FileTypePEICore:             "EFI_FV_FILETYPE_PEI_CORE",
+	FileTypeDXECore:             "EFI_FV_FILETYPE_DXE_CORE",
+	FileTypePEIM:                "EFI_FV_FILETYPE_PEIM",
+	FileTypeDriver:              "EFI_FV_FILETYPE_DRIVER",
+	FileTypeCombinedPEIMDriver:  "EFI_FV_FILETYPE_COMBINED_PEIM_DRIVER",
+	FileTypeApplication:         "EFI_FV_FILETYPE_APPLICATION",
+	FileTypeSMM:                 "EFI_FV_FILETYPE_SMM",
+	FileTypeFirmwareVolumeImage: "EFI_FV_FILETYPE_FIRMWARE_VOLUME_IMAGE",
+	FileTypeCombinedSMMDXE:      "EFI_FV_FILETYPE_COMBINED_SMM_DXE",
+	FileTypeSMMCore:             "EFI_FV_FILETYPE_SMM_CORE",
+	FileTypePad:                 "EFI_FV_FILETYPE_FFS_PAD",
+}
+
+func (t FileType) String() string {
+	if name, ok := FileTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (0x%02x)", uint8(t))
+}
+
+// FileHeader contains the fixed fields of a firmware file header
+type FileHeader struct {
+	Name           [16]uint8
+	HeaderChecksum uint8
+	DataChecksum   uint8
+	Type           FileType
+	Attributes     uint8
+	Size           [3]uint8
+	State          uint8
+}
+
+// File represents a firmware file (FFS) inside a firmware volume
+type File struct {
+	FileHeader
+	// ExtendedSize is only used for large files
+	ExtendedSize uint64
+	// ErasePolarity is the erase polarity of the containing volume
+	ErasePolarity uint8
+	// Offset is the position of the file from the start of the containing
+	// volume
+	Offset uint64
+	// Sections contained in the file, for file types that have sections
+	Sections []*Section
+	// Broken holds the elements that could not be parsed in permissive mode
+	Broken []BrokenNode
+	// Holds the raw buffer, including the header
+	buf []byte
+}
+
+// IsLarge returns whether the file uses the large file header format
+func (f File) IsLarge() bool {
+	return f.Attributes&FileAttribLargeFile != 0
+}
+
+// HeaderLen returns the size of the file header
+func (f File) HeaderLen() uint64 {
+	if f.IsLarge() {
+		return FileHeaderLargeSize
+	}
+	return FileHeaderMinSize
+}
+
+// FileSize returns the size of the whole file, including its header
+func (f File) FileSize() uint64 {
+	if f.IsLarge() {
+		return f.ExtendedSize
+	}
+	return uint64(f.Size[0]) | uint64(f.Size[1])<<8 | uint64(f.Size[2])<<16
+}
+
+// Alignment returns the data alignment in bytes required by the file
+func (f File) Alignment() uint64 {
+	// the 3-bit field encodes 1, 16, 128, 512, 1K, 4K, 32K, 64K
+	alignments := []uint64{1, 16, 128, 512, 1024, 4 * 1024, 32 * 1024, 64 * 1024}
+	return alignments[(f.Attributes&FileAttribDataAlignment)>>3]
+}
+
+// HasSections returns whether the file type is made of sections
+func (f File) HasSections() bool {
+	return f.Type >= FileTypeFreeform && f.Type <= FileTypeSMMCore
+}
+
+// GUID returns the name of the file as a GUID string
+func (f File) GUID() string {
+	guid, err := uuid.FromBytes(f.Name[:])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return guid.String()
+}
+
+// Buf returns the raw bytes of the file, including its header
+func (f File) Buf() []byte {
+	return f.buf
+}
+
+// Data returns the contents of the file, excluding the header
+func (f File) Data() []byte {
+	return f.buf[f.HeaderLen():]
+}
+
+// findSection returns the first section of the given type, searching the
+// sections recursively, including the decompressed ones
+func findSection(sections []*Section, typ SectionType) *Section {
+	for _, s := range sections {
+		if s.Type == typ {
+			return s
+		}
+		if found := findSection(s.Sections, typ); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// UIName returns the name of the file from its user interface section, or an
+// empty string if it has none
+func (f File) UIName() string {
+	s := findSection(f.Sections, SectionTypeUserInterface)
+	if s == nil {
+		return ""
+	}
+	return decodeUCS2(s.Data())
+}
+
+// Version returns the version string of the file from its version section,
+// or the build number if the string is empty. It returns an empty string if
+// the file has no version section.
+func (f File) Version() string {
+	s := findSection(f.Sections, SectionTypeVersion)
+	if s == nil || len(s.Data()) < 2 {
+		return ""
+	}
+	if v := decodeUCS2(s.Data()[2:]); v != "" {
+		return v
+	}
+	return fmt.Sprintf("%d", binary.LittleEndian.Uint16(s.Data()))
+}
+
+// RealState returns the file state, taking the erase polarity into account
+func (f File) RealState() uint8 {
+	if f.ErasePolarity != 0 {
+		return ^f.State
+	}
+	return f.State
+}
+
+func (f File) String() string {
+	return fmt.Sprintf("File{Name=%s, Type=%v, Size=%v}", f.GUID(), f.Type, f.FileSize())
+}
+
+// Summary prints a multi-line description of the File
+func (f File) Summary() string {
+	var sections []string
+	for _, s := range f.Sections {
+		sections = append(sections, s.Summary())
+	}
+	return fmt.Sprintf("File{\n"+
+		"    Name=%s\n"+
+		"    Type=%v\n"+
+		"    Attributes=0x%02x\n"+
+		"    Size=%v\n"+
+		"    State=0x%02x\n"+
+		"    HeaderChecksum=0x%02x\n"+
+		"    DataChecksum=0x%02x\n"+
+		"    Sections=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		f.GUID(), f.Type, f.Attributes, f.FileSize(), f.State,
+		f.HeaderChecksum, f.DataChecksum,
+		Indent(strings.Join(sections, "\n"), 8),
+	)
+}
+
+// headerChecksum computes the header checksum, assuming the data checksum
+// and state fields to be zero.
+func (f File) headerChecksum() uint8 {
+	hdr := make([]byte, f.HeaderLen())
+	copy(hdr, f.buf)
+	// IntegrityCheck.Checksum.Header, IntegrityCheck.Checksum.File and State
+	hdr[16], hdr[17], hdr[23] = 0, 0, 0
+	return checksum8(hdr)
+}
+
+// dataChecksum computes the data checksum, or returns the fixed value if the
+// file does not require one.
+func (f File) dataChecksum() uint8 {
+	return fileDataChecksum(f.Attributes, f.Data())
+}
+
+// fileDataChecksum computes the data checksum of a file with the given
+// attributes and data
+func fileDataChecksum(attributes uint8, data []byte) uint8 {
+	if attributes&FileAttribChecksum == 0 {
+		return FileFixedChecksum
+	}
+	return checksum8(data)
+}
+
+// Validate runs a set of checks on the file and returns a list of errors
+// specifying what is wrong.
+func (f File) Validate() []error {
+	errors := make([]error, 0)
+	if sum := f.headerChecksum(); sum != f.HeaderChecksum {
+		errors = append(errors, fmt.Errorf("File %s: invalid header checksum: expected 0x%02x, got 0x%02x",
+			f.GUID(), sum, f.HeaderChecksum,
+		))
+	}
+	if sum := f.dataChecksum(); sum != f.DataChecksum {
+		errors = append(errors, fmt.Errorf("File %s: invalid data checksum: expected 0x%02x, got 0x%02x",
+			f.GUID(), sum, f.DataChecksum,
+		))
+	}
+	return errors
+}
+
+// MarshalBinary serializes the file. The header is rebuilt from the fields
+// and the sections are serialized at their offsets. Anything else is copied
+// from the parsed buffer. If the sections change size, the file size is
+// updated. The header and data checksums are recomputed if
+// they were valid in the parsed file, so that edits do not invalidate them,
+// while invalid ones are preserved.
+func (f File) MarshalBinary() ([]byte, error) {
+	out, err := marshalSections(f.buf, f.Sections)
+	if err != nil {
+		return nil, err
+	}
+	if size := uint64(len(out)); size != uint64(len(f.buf)) {
+		if f.IsLarge() {
+			f.ExtendedSize = size
+		} else if size < FileMaxSmallFileSize {
+			f.Size = [3]uint8{uint8(size), uint8(size >> 8), uint8(size >> 16)}
+		} else {
+			return nil, fmt.Errorf("File %v too large for a standard header: %v bytes", f.GUID(), size)
+		}
+	}
+	var hdr bytes.Buffer
+	if err := binary.Write(&hdr, binary.LittleEndian, f.FileHeader); err != nil {
+		return nil, err
+	}
+	if f.IsLarge() {
+		binary.Write(&hdr, binary.LittleEndian, f.ExtendedSize)
+	}
+	if err := splice(out, 0, hdr.Bytes(), "file header"); err != nil {
+		return nil, err
+	}
+	// keep the checksums valid, if they were in the parsed file
+	if f.buf[17] == fileDataChecksum(f.buf[19], f.Data()) {
+		out[17] = fileDataChecksum(f.Attributes, out[f.HeaderLen():])
+	}
+	if f.buf[16] == f.headerChecksum() {
+		parsed := File{FileHeader: f.FileHeader, buf: out}
+		out[16] = parsed.headerChecksum()
+	}
+	return out, nil
+}
+
+// NewFile parses a sequence of bytes and returns a File object, if a valid
+// one is passed, or an error
+func NewFile(data []byte, erasePolarity uint8) (*File, error) {
+	if len(data) < FileHeaderMinSize {
+		return nil, fmt.Errorf("File size too small: expected at least %v bytes, got %v",
+			FileHeaderMinSize,
+			len(data),
+		)
+	}
+	f := File{ErasePolarity: erasePolarity}
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, &f.FileHeader); err != nil {
+		return nil, err
+	}
+	if f.IsLarge() {
+		if err := binary.Read(reader, binary.LittleEndian, &f.ExtendedSize); err != nil {
+			return nil, err
+		}
+	}
+	size := f.FileSize()
+	if size < f.HeaderLen() || size > uint64(len(data)) {
+		return nil, fmt.Errorf("File %s: invalid size %v, %v bytes available",
+			f.GUID(), size, len(data),
+		)
+	}
+	f.buf = data[:size]
+	if f.HasSections() {
+		sections, err := parseSections(f.buf, f.HeaderLen(), &f.Broken)
+		if err != nil {
+			return nil, fmt.Errorf("File %s: %v", f.GUID(), err)
+		}
+		f.Sections = sections
+	}
+	return &f, nil
+}
+
+// CreatePadFile returns a pad file of the given total size, which must be at
+// least FileHeaderMinSize. The contents of the pad file are erased.
+func CreatePadFile(size uint64, erasePolarity uint8) (*File, error) {
+	if size < FileHeaderMinSize {
+		return nil, fmt.Errorf("Pad file size too small: expected at least %v bytes, got %v",
+			FileHeaderMinSize, size,
+		)
+	}
+	erased := byte(0)
+	if erasePolarity != 0 {
+		erased = 0xff
+	}
+	// the name of pad files is left erased
+	var name [16]uint8
+	copy(name[:], bytes.Repeat([]byte{erased}, len(name)))
+	dataLen := size - FileHeaderMinSize
+	if size > FileMaxSmallFileSize {
+		dataLen = size - FileHeaderLargeSize
+	}
+	return CreateFile(name, FileTypePad, 0, bytes.Repeat([]byte{erased}, int(dataLen)), erasePolarity)
+}
+
+// CreateFile builds a new firmware file with the given name, type,
+// attributes and contents, computing the size and the checksums. The
+// erasePolarity is the one of the volume the file is meant for.
+func CreateFile(name [16]uint8, typ FileType, attributes uint8, data []byte, erasePolarity uint8) (*File, error) {
+	f := File{ErasePolarity: erasePolarity}
+	f.Name = name
+	f.Type = typ
+	f.Attributes = attributes &^ FileAttribLargeFile
+	size := uint64(FileHeaderMinSize + len(data))
+	if size > FileMaxSmallFileSize {
+		f.Attributes |= FileAttribLargeFile
+		f.ExtendedSize = uint64(FileHeaderLargeSize + len(data))
+	} else {
+		f.Size = [3]uint8{uint8(size), uint8(size >> 8), uint8(size >> 16)}
+	}
+	state := uint8(FileStateHeaderConstruction | FileStateHeaderValid | FileStateDataValid)
+	if erasePolarity != 0 {
+		state = ^state
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, f.FileHeader); err != nil {
+		return nil, err
+	}
+	if f.IsLarge() {
+		if err := binary.Write(&buf, binary.LittleEndian, f.ExtendedSize); err != nil {
+			return nil, err
+		}
+	}
+	buf.Write(data)
+	f.buf = buf.Bytes()
+	f.HeaderChecksum = f.headerChecksum()
+	f.DataChecksum = f.dataChecksum()
+	f.State = state
+	f.buf[16], f.buf[17], f.buf[23] = f.HeaderChecksum, f.DataChecksum, f.State
+	return &f, nil
+}
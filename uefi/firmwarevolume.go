@@ -4,14 +4,21 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 
 	uuid "github.com/insomniacslk/uefi/uuid"
 )
 
 // FirmwareVolume constants
 const (
-	FirmwareVolumeFixedHeaderSize = 56
-	FirmwareVolumeMinSize         = FirmwareVolumeFixedHeaderSize + 8 // +8 for the null block that terminates the block list
+	FirmwareVolumeFixedHeaderSize  = 56
+	FirmwareVolumeMinSize          = FirmwareVolumeFixedHeaderSize + 8 // +8 for the null block that terminates the block list
+	FirmwareVolumeExtHeaderMinSize = 20
+)
+
+// FirmwareVolume attributes
+const (
+	FirmwareVolumeAttribErasePolarity = 0x00000800
 )
 
 // FirmwareVolumeGUIDs maps the known FV GUIDs. These values come from
@@ -24,6 +31,8 @@ var FirmwareVolumeGUIDs = map[string]string{
 	"cef5b9a3-476d-497f-9fdc-e98143e0422c": "NVRAM_NVAR",
 	"00504624-8a59-4eeb-bd0f-6b36e96128e0": "NVRAM_EVSA2",
 	"04adeead-61ff-4d31-b6ba-64f8bf901f5a": "APPLE_BOOT",
+	"bd001b8c-6a71-487b-a14f-0c2a2dcf7a5d": "APPLE_AUTHENTICATION",
+	"153d2197-29bd-44dc-ac59-887f70e41a6b": "APPLE_MICROCODE",
 	"16b45da2-7d70-4aea-a58d-760e9ecb841d": "PFH1",
 	"e360bdba-c3ce-46be-8f37-b231e5cb9f35": "PFH2",
 }
@@ -37,16 +46,16 @@ type Block struct {
 // FirmwareVolumeFixedHeader contains the fixed fields of a firmware volume
 // header
 type FirmwareVolumeFixedHeader struct {
-	Zeros          [16]uint8
-	FileSystemGUID [16]uint8
-	Length         uint64
-	Signature      uint32
-	AttrMask       uint8
-	HeaderLen      uint16
-	Checksum       uint16
-	Reserved       [3]uint8
-	Revision       uint8
-	Unused         [3]uint8
+	Zeros           [16]uint8
+	FileSystemGUID  [16]uint8
+	Length          uint64
+	Signature       uint32
+	Attributes      uint32
+	HeaderLen       uint16
+	Checksum        uint16
+	ExtHeaderOffset uint16
+	Reserved        uint8
+	Revision        uint8
 }
 
 // FirmwareVolume represents a firmware volume. It combines the fixed header and
@@ -56,53 +65,226 @@ type FirmwareVolume struct {
 	// there must be at least one that is zeroed and indicates the end of the
 	// block list
 	Blocks []Block
+	// Files contained in the volume
+	Files []*File
+	// VariableStore is the NVRAM variable store, for volumes holding one
+	VariableStore *VariableStore
+	// EVSAStore is the Phoenix SCT variable store, for volumes holding one
+	EVSAStore *EVSAStore
+	// NVARStore is the AMI Aptio variable store, for volumes holding one
+	NVARStore *NVARStore
+	// Offset is the position of the volume from the start of the containing
+	// region
+	Offset uint64
+	// Broken holds the elements that could not be parsed in permissive mode
+	Broken []BrokenNode
+	// Holds the raw buffer
+	buf []byte
+}
+
+// ErasePolarity returns the value of the erased bits in the volume, either
+// 0 or 1.
+func (fv FirmwareVolume) ErasePolarity() uint8 {
+	if fv.Attributes&FirmwareVolumeAttribErasePolarity != 0 {
+		return 1
+	}
+	return 0
+}
+
+// IsFFS returns whether the volume uses one of the firmware file system
+// formats, and therefore contains files. The Apple boot and authentication
+// volumes use the FFS2 format under their own GUIDs.
+func (fv FirmwareVolume) IsFFS() bool {
+	switch FirmwareVolumeGUIDs[fv.guidString()] {
+	case "FFS1", "FFS2", "FFS3", "APPLE_BOOT", "APPLE_AUTHENTICATION":
+		return true
+	}
+	return false
+}
+
+// erasedByte returns the value of an erased byte in the volume
+func (fv FirmwareVolume) erasedByte() byte {
+	if fv.ErasePolarity() != 0 {
+		return 0xff
+	}
+	return 0
+}
+
+// Buf returns the raw bytes of the firmware volume
+func (fv FirmwareVolume) Buf() []byte {
+	return fv.buf
+}
+
+// DataOffset returns the offset of the first file from the start of the
+// volume, skipping the header and the extended header if present.
+func (fv FirmwareVolume) DataOffset() uint64 {
+	offset := uint64(fv.HeaderLen)
+	if fv.ExtHeaderOffset != 0 && uint64(fv.ExtHeaderOffset)+FirmwareVolumeExtHeaderMinSize <= uint64(len(fv.buf)) {
+		extSize := binary.LittleEndian.Uint32(fv.buf[fv.ExtHeaderOffset+16:])
+		offset = uint64(fv.ExtHeaderOffset) + uint64(extSize)
+	}
+	return align8(offset)
+}
+
+func align8(v uint64) uint64 {
+	return (v + 7) &^ 7
+}
+
+// guidString returns the file system GUID of the volume as a string
+func (fv FirmwareVolume) guidString() string {
+	guid, err := uuid.FromBytes(fv.FileSystemGUID[:])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return guid.String()
 }
 
 // Summary prints a multi-line representation of a FirmwareVolume object
 func (fv FirmwareVolume) Summary() string {
-	var (
-		guidName, guidString string
-		ok                   bool
-	)
-	if guid, err := uuid.FromBytes(fv.FileSystemGUID[:]); err == nil {
-		guidString = guid.String()
-		guidName, ok = FirmwareVolumeGUIDs[guidString]
-		if !ok {
-			guidName = "Unknown"
-		}
-	} else {
-		guidString = "<invalid GUID>"
+	guidString := fv.guidString()
+	guidName, ok := FirmwareVolumeGUIDs[guidString]
+	if !ok {
 		guidName = "Unknown"
 	}
+	var files []string
+	for _, f := range fv.Files {
+		files = append(files, f.Summary())
+	}
+	storeSummary := "<none>"
+	if fv.VariableStore != nil {
+		storeSummary = fv.VariableStore.Summary()
+	} else if fv.EVSAStore != nil {
+		storeSummary = fv.EVSAStore.Summary()
+	} else if fv.NVARStore != nil {
+		storeSummary = fv.NVARStore.Summary()
+	}
 	return fmt.Sprintf("FirmwareVolume{\n"+
 		"    FileSystemGUID=%s (%v)\n"+
 		"    Length=%v\n"+
 		"    Signature=0x%08x\n"+
-		"    AttrMask=0x%02x\n"+
+		"    Attributes=0x%08x\n"+
 		"    HeaderLen=%v\n"+
 		"    Checksum=0x%04x\n"+
 		"    Revision=%v\n"+
 		"    Blocks=%v\n"+
+		"    Files=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    VariableStore=%v\n"+
 		"}",
 		guidString, guidName,
-		fv.Length, fv.Signature, fv.AttrMask,
+		fv.Length, fv.Signature, fv.Attributes,
 		fv.HeaderLen, fv.Checksum, fv.Revision,
 		fv.Blocks,
+		Indent(strings.Join(files, "\n"), 8),
+		Indent(storeSummary, 4),
 	)
 }
 
+// Validate runs a set of checks on the firmware volume and its files and
+// returns a list of errors specifying what is wrong.
+func (fv FirmwareVolume) Validate() []error {
+	errors := make([]error, 0)
+	if hdrLen := uint64(fv.HeaderLen); hdrLen > uint64(len(fv.buf)) {
+		errors = append(errors, fmt.Errorf("Firmware volume %s: header length 0x%x larger than the volume", fv.guidString(), hdrLen))
+	} else if sum := checksum16(fv.buf[:hdrLen]); sum != 0 {
+		errors = append(errors, fmt.Errorf("Firmware volume %s: invalid header checksum 0x%04x", fv.guidString(), fv.Checksum))
+	}
+	if fv.Length != uint64(len(fv.buf)) {
+		errors = append(errors, fmt.Errorf("Firmware volume %s: length 0x%x, but 0x%x bytes were parsed", fv.guidString(), fv.Length, len(fv.buf)))
+	}
+	for _, f := range fv.Files {
+		errors = append(errors, f.Validate()...)
+	}
+	if fv.EVSAStore != nil {
+		for _, err := range fv.EVSAStore.Validate() {
+			errors = append(errors, fmt.Errorf("Firmware volume %s: %v", fv.guidString(), err))
+		}
+	}
+	if fv.NVARStore != nil {
+		for _, err := range fv.NVARStore.Validate() {
+			errors = append(errors, fmt.Errorf("Firmware volume %s: %v", fv.guidString(), err))
+		}
+	}
+	return errors
+}
+
+// MarshalBinary serializes the firmware volume. The header and the block map
+// are rebuilt from the fields and the files are serialized at their offsets.
+// Anything else is copied from the parsed buffer. Files that changed size
+// are then replaced as FirmwareVolume.ReplaceFile does. The header checksum
+// is recomputed if it was valid in the parsed volume.
+func (fv FirmwareVolume) MarshalBinary() ([]byte, error) {
+	out := append([]byte{}, fv.buf...)
+	var hdr bytes.Buffer
+	if err := binary.Write(&hdr, binary.LittleEndian, fv.FirmwareVolumeFixedHeader); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&hdr, binary.LittleEndian, append(fv.Blocks, Block{})); err != nil {
+		return nil, err
+	}
+	if err := splice(out, 0, hdr.Bytes(), "firmware volume header"); err != nil {
+		return nil, err
+	}
+	// files that changed size, e.g. because their sections were
+	// recompressed, are replaced after the rest of the volume is rebuilt
+	resized := make(map[string][]byte)
+	var order []string
+	for _, f := range fv.Files {
+		fb, err := f.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if uint64(len(fb)) != uint64(len(f.buf)) {
+			resized[f.GUID()] = fb[f.HeaderLen():]
+			order = append(order, f.GUID())
+			continue
+		}
+		if err := splice(out, f.Offset, fb, f.String()); err != nil {
+			return nil, err
+		}
+	}
+	if fv.VariableStore != nil {
+		sb, err := fv.VariableStore.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if err := splice(out, fv.DataOffset(), sb, "variable store"); err != nil {
+			return nil, err
+		}
+	}
+	// keep the header checksum valid, if it was in the parsed volume
+	if hdrLen := uint64(fv.HeaderLen); hdrLen <= uint64(len(out)) && checksum16(fv.buf[:hdrLen]) == 0 {
+		binary.LittleEndian.PutUint16(out[50:], 0)
+		binary.LittleEndian.PutUint16(out[50:], checksum16(out[:hdrLen]))
+	}
+	if len(order) == 0 {
+		return out, nil
+	}
+	rebuilt, err := NewFirmwareVolume(out)
+	if err != nil {
+		return nil, err
+	}
+	for _, guid := range order {
+		if err := rebuilt.ReplaceFile(guid, resized[guid]); err != nil {
+			return nil, err
+		}
+	}
+	return rebuilt.buf, nil
+}
+
 // FindFirmwareVolumeOffset searches for a firmware volume signature, "_FVH"
 // using 8-byte alignment. If found, returns the offset from the start of the
 // firmware volume, otherwise returns -1.
 func FindFirmwareVolumeOffset(data []byte) int64 {
-	if len(data) < 32 {
+	if len(data) < 44 {
 		return -1
 	}
 	var (
 		offset int64
 		fvSig  = []byte("_FVH")
 	)
-	for offset = 32; offset < int64(len(data)); offset += 8 {
+	for offset = 40; offset+4 <= int64(len(data)); offset += 8 {
 		if bytes.Equal(data[offset:offset+4], fvSig) {
 			return offset - 40 // the actual volume starts 40 bytes before the signature
 		}
@@ -133,10 +315,202 @@ func NewFirmwareVolume(data []byte) (*FirmwareVolume, error) {
 		}
 		if block.Count == 0 && block.Size == 0 {
 			// found the terminating block
+			debugf("Terminating block: %+v", block)
 			break
 		}
+		debugf("Block: %+v", block)
 		blocks = append(blocks, block)
 	}
 	fv.Blocks = blocks
+	// a volume must at least hold its headers, or the volumes that follow it
+	// could not be found
+	headerSize := uint64(len(data) - reader.Len())
+	if uint64(fv.HeaderLen) > headerSize {
+		headerSize = uint64(fv.HeaderLen)
+	}
+	if fv.Length < headerSize {
+		return nil, fmt.Errorf("Firmware Volume length too small: %v bytes, the headers take %v",
+			fv.Length,
+			headerSize,
+		)
+	}
+	if fv.Length > uint64(len(data)) {
+		return nil, fmt.Errorf("Firmware Volume length too large: %v bytes, but only %v available",
+			fv.Length,
+			len(data),
+		)
+	}
+	fv.buf = data[:fv.Length]
+	if fv.IsFFS() {
+		if err := fv.parseFiles(); err != nil {
+			return nil, err
+		}
+	} else if offset := fv.DataOffset(); offset < fv.Length && IsVariableStore(fv.buf[offset:]) {
+		store, err := NewVariableStore(fv.buf[offset:])
+		if err != nil {
+			if err := tolerate(&fv.Broken, offset, fv.buf[offset:], err); err != nil {
+				return nil, err
+			}
+		}
+		fv.VariableStore = store
+	} else if offset < fv.Length && IsEVSAStore(fv.buf[offset:]) {
+		store, err := NewEVSAStore(fv.buf[offset:])
+		if err != nil {
+			if err := tolerate(&fv.Broken, offset, fv.buf[offset:], err); err != nil {
+				return nil, err
+			}
+		}
+		fv.EVSAStore = store
+	} else if offset < fv.Length && IsNVARStore(fv.buf[offset:]) {
+		store, err := NewNVARStore(fv.buf[offset:])
+		if err != nil {
+			if err := tolerate(&fv.Broken, offset, fv.buf[offset:], err); err != nil {
+				return nil, err
+			}
+		}
+		fv.NVARStore = store
+	}
 	return &fv, nil
 }
+
+// buildFirmwareVolume returns the bytes of a firmware volume with the given
+// file system GUID, block map and attributes, with contents placed right
+// after the header and the rest of the volume erased.
+func buildFirmwareVolume(guid [16]uint8, blocks []Block, attributes uint32, contents []byte) ([]byte, error) {
+	length := blockMapLength(blocks)
+	hdr := FirmwareVolumeFixedHeader{
+		FileSystemGUID: guid,
+		Length:         length,
+		Signature:      binary.LittleEndian.Uint32([]byte("_FVH")),
+		Attributes:     attributes,
+		HeaderLen:      uint16(FirmwareVolumeFixedHeaderSize + 8*(len(blocks)+1)),
+		Revision:       2,
+	}
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, append(blocks, Block{})); err != nil {
+		return nil, err
+	}
+	fv := buf.Bytes()
+	binary.LittleEndian.PutUint16(fv[50:], checksum16(fv))
+	if align8(uint64(len(fv)))+uint64(len(contents)) > length {
+		return nil, fmt.Errorf("Firmware Volume contents too large: %v bytes do not fit in %v",
+			len(contents), length,
+		)
+	}
+	erased := byte(0)
+	if attributes&FirmwareVolumeAttribErasePolarity != 0 {
+		erased = 0xff
+	}
+	out := bytes.Repeat([]byte{erased}, int(length))
+	copy(out, fv)
+	copy(out[align8(uint64(len(fv))):], contents)
+	return out, nil
+}
+
+// fileBytes serializes a file for a volume with the given erase polarity
+func fileBytes(f *File, erasePolarity uint8) ([]byte, error) {
+	fb, err := f.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if f.ErasePolarity != erasePolarity {
+		// the state bits are stored inverted in volumes with erase polarity 1
+		fb[23] = ^fb[23]
+	}
+	return fb, nil
+}
+
+// layoutFiles places the files one after the other starting at offset,
+// honoring their data alignment by inserting pad files where needed. It
+// returns the bytes to be placed at offset.
+func layoutFiles(files []*File, offset uint64, erasePolarity uint8) ([]byte, error) {
+	erased := byte(0)
+	if erasePolarity != 0 {
+		erased = 0xff
+	}
+	var out []byte
+	cur := offset
+	for _, f := range files {
+		fb, err := fileBytes(f, erasePolarity)
+		if err != nil {
+			return nil, err
+		}
+		if pad := padSizeFor(cur, f.HeaderLen(), f.Alignment()); pad != 0 {
+			padFile, err := CreatePadFile(pad, erasePolarity)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, padFile.Buf()...)
+			cur += pad
+		}
+		out = append(out, fb...)
+		cur += uint64(len(fb))
+		for cur%FileAlignment != 0 {
+			out = append(out, erased)
+			cur++
+		}
+	}
+	return out, nil
+}
+
+// padSizeFor returns the size of the pad file to insert at offset so that
+// the data of a file with the given header length starts at the required
+// alignment, or 0 if no pad file is needed. offset must be 8-byte aligned.
+func padSizeFor(offset, headerLen, alignment uint64) uint64 {
+	if (offset+headerLen)%alignment == 0 {
+		return 0
+	}
+	next := offset + FileHeaderMinSize
+	for (next+headerLen)%alignment != 0 {
+		next += FileAlignment
+	}
+	return next - offset
+}
+
+// CreateFirmwareVolume builds a new firmware volume with the given file
+// system GUID, block map and attributes, containing the given files. The
+// files are aligned as required by their attributes, using pad files, and the
+// rest of the volume is left as free space. The volume length is computed
+// from the block map.
+func CreateFirmwareVolume(guid [16]uint8, blocks []Block, attributes uint32, files []*File) (*FirmwareVolume, error) {
+	headerLen := align8(uint64(FirmwareVolumeFixedHeaderSize + 8*(len(blocks)+1)))
+	var erasePolarity uint8
+	if attributes&FirmwareVolumeAttribErasePolarity != 0 {
+		erasePolarity = 1
+	}
+	contents, err := layoutFiles(files, headerLen, erasePolarity)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := buildFirmwareVolume(guid, blocks, attributes, contents)
+	if err != nil {
+		return nil, err
+	}
+	return NewFirmwareVolume(buf)
+}
+
+// parseFiles reads the files contained in the volume, stopping at the first
+// header that is entirely erased, which marks the beginning of the free
+// space.
+func (fv *FirmwareVolume) parseFiles() error {
+	erased := bytes.Repeat([]byte{fv.erasedByte()}, FileHeaderMinSize)
+	for offset := fv.DataOffset(); offset+FileHeaderMinSize <= fv.Length; {
+		if bytes.Equal(fv.buf[offset:offset+FileHeaderMinSize], erased) {
+			break
+		}
+		f, err := NewFile(fv.buf[offset:], fv.ErasePolarity())
+		if err != nil {
+			err = fmt.Errorf("File at offset 0x%x: %v", offset, err)
+			// the size of a broken file is unknown, keep the rest of the volume
+			return tolerate(&fv.Broken, offset, fv.buf[offset:], err)
+		}
+		debugf("File %s found at offset 0x%x", f.GUID(), offset)
+		f.Offset = offset
+		fv.Files = append(fv.Files, f)
+		offset = align8(offset + f.FileSize())
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// checkEditable returns an error if the volume cannot be safely modified
+func (fv FirmwareVolume) checkEditable() error {
+	if !fv.IsFFS() {
+		return fmt.Errorf("Firmware volume %s does not contain files", fv.guidString())
+	}
+	if len(fv.Broken) != 0 {
+		return fmt.Errorf("Firmware volume %s has broken elements, refusing to modify it", fv.guidString())
+	}
+	return nil
+}
+
+// freeSpaceOffset returns the offset of the free space after the last file
+func (fv FirmwareVolume) freeSpaceOffset() uint64 {
+	offset := fv.DataOffset()
+	for _, f := range fv.Files {
+		if end := align8(f.Offset + f.FileSize()); end > offset {
+			offset = end
+		}
+	}
+	return offset
+}
+
+// fitFile returns the offset at which a file of the given size, header
+// length and alignment can be placed in the [start, end) range, and whether
+// it fits. If padTail is true the space left after the file must be big
+// enough to hold a pad file.
+func fitFile(start, end, headerLen, alignment, size uint64, padTail bool) (uint64, bool) {
+	offset := start + padSizeFor(start, headerLen, alignment)
+	tail := align8(offset + size)
+	if tail > end {
+		return 0, false
+	}
+	if padTail && end != tail && end-tail < FileHeaderMinSize {
+		return 0, false
+	}
+	return offset, true
+}
+
+// rebuild replaces the volume with the one parsed from buf, keeping its
+// position in the containing region.
+func (fv *FirmwareVolume) rebuild(buf []byte) error {
+	nfv, err := NewFirmwareVolume(buf)
+	if err != nil {
+		return err
+	}
+	nfv.Offset = fv.Offset
+	*fv = *nfv
+	return nil
+}
+
+// writePad writes a pad file covering [start, end) in buf
+func (fv FirmwareVolume) writePad(buf []byte, start, end uint64) error {
+	pad, err := CreatePadFile(end-start, fv.ErasePolarity())
+	if err != nil {
+		return err
+	}
+	copy(buf[start:], pad.Buf())
+	return nil
+}
+
+// InsertFile places a new file in the volume. Pad files large enough to
+// hold it are used first, otherwise the file is placed in the free space
+// after the last file. The file data alignment is honored by inserting a pad
+// file before it when needed. An error is returned if there is not enough
+// room.
+func (fv *FirmwareVolume) InsertFile(f *File) error {
+	if err := fv.checkEditable(); err != nil {
+		return err
+	}
+	fb, err := fileBytes(f, fv.ErasePolarity())
+	if err != nil {
+		return err
+	}
+	size := uint64(len(fb))
+	buf := append([]byte{}, fv.buf...)
+	erased := []byte{fv.erasedByte()}
+
+	place := func(start, end uint64, inPad bool) (bool, error) {
+		offset, ok := fitFile(start, end, f.HeaderLen(), f.Alignment(), size, inPad)
+		if !ok {
+			return false, nil
+		}
+		copy(buf[start:end], bytes.Repeat(erased, int(end-start)))
+		if offset != start {
+			if err := fv.writePad(buf, start, offset); err != nil {
+				return false, err
+			}
+		}
+		copy(buf[offset:], fb)
+		if tail := align8(offset + size); inPad && tail != end {
+			if err := fv.writePad(buf, tail, end); err != nil {
+				return false, err
+			}
+		}
+		debugf("Inserting file %s at offset 0x%x of volume %s", f.GUID(), offset, fv.guidString())
+		return true, nil
+	}
+
+	for _, pad := range fv.Files {
+		if pad.Type != FileTypePad {
+			continue
+		}
+		ok, err := place(pad.Offset, align8(pad.Offset+pad.FileSize()), true)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return fv.rebuild(buf)
+		}
+	}
+	ok, err := place(fv.freeSpaceOffset(), fv.Length, false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("Not enough space in firmware volume %s for file %s: %v bytes needed, %v free",
+			fv.guidString(), f.GUID(), size, fv.Length-fv.freeSpaceOffset(),
+		)
+	}
+	return fv.rebuild(buf)
+}
+
+// findFile returns the index of the first file with the given GUID, or -1
+func (fv FirmwareVolume) findFile(guid string) int {
+	guid = strings.ToLower(guid)
+	for idx, f := range fv.Files {
+		if f.GUID() == guid {
+			return idx
+		}
+	}
+	return -1
+}
+
+// slotEnd returns the end of the space that the file at index idx can use
+// without moving other files: the file itself and the pad files that follow
+// it. If only free space follows, the end of the volume is returned and
+// the second value is true.
+func (fv FirmwareVolume) slotEnd(idx int) (uint64, bool) {
+	for _, f := range fv.Files[idx+1:] {
+		if f.Type != FileTypePad {
+			return f.Offset, false
+		}
+	}
+	return fv.Length, true
+}
+
+// ReplaceFile replaces the contents of the file with the given GUID, keeping
+// its name, type and attributes and recomputing the checksums. If the new
+// file fits in the space taken by the old one and by the pad files that
+// follow it, it is written in place and the space left is turned into a pad
+// file. Otherwise the old file is replaced by a pad file and the new one is
+// inserted like InsertFile does.
+func (fv *FirmwareVolume) ReplaceFile(guid string, newContents []byte) error {
+	if err := fv.checkEditable(); err != nil {
+		return err
+	}
+	idx := fv.findFile(guid)
+	if idx == -1 {
+		return fmt.Errorf("File %s not found in firmware volume %s", guid, fv.guidString())
+	}
+	old := fv.Files[idx]
+	nf, err := CreateFile(old.Name, old.Type, old.Attributes, newContents, fv.ErasePolarity())
+	if err != nil {
+		return err
+	}
+	return fv.replaceFileAt(idx, nf)
+}
+
+// replaceFileAt replaces the file at index idx with nf, in place if it fits
+// as described for ReplaceFile
+func (fv *FirmwareVolume) replaceFileAt(idx int, nf *File) error {
+	fb, err := fileBytes(nf, fv.ErasePolarity())
+	if err != nil {
+		return err
+	}
+	buf := append([]byte{}, fv.buf...)
+	start := fv.Files[idx].Offset
+	end, atFreeSpace := fv.slotEnd(idx)
+	if offset, ok := fitFile(start, end, nf.HeaderLen(), nf.Alignment(), nf.FileSize(), !atFreeSpace); ok && offset == start {
+		fill(buf[start:end], fv.erasedByte())
+		copy(buf[start:], fb)
+		if tail := align8(start + nf.FileSize()); !atFreeSpace && tail != end {
+			if err := fv.writePad(buf, tail, end); err != nil {
+				return err
+			}
+		}
+		debugf("Replacing file %s in place at offset 0x%x", nf.GUID(), start)
+		return fv.rebuild(buf)
+	}
+	// the new file does not fit, free the old slot and insert it elsewhere
+	saved := *fv
+	if err := fv.removeFile(idx); err != nil {
+		return err
+	}
+	if err := fv.InsertFile(nf); err != nil {
+		*fv = saved
+		return err
+	}
+	return nil
+}
+
+// removeFile replaces the file at index idx with a pad file covering its
+// footprint and the adjacent pad files, or with erased bytes if it is
+// followed only by free space.
+func (fv *FirmwareVolume) removeFile(idx int) error {
+	buf := append([]byte{}, fv.buf...)
+	f := fv.Files[idx]
+	start, end := f.Offset, align8(f.Offset+f.FileSize())
+	// merge with the adjacent pad files
+	for i := idx - 1; i >= 0 && fv.Files[i].Type == FileTypePad && align8(fv.Files[i].Offset+fv.Files[i].FileSize()) == start; i-- {
+		start = fv.Files[i].Offset
+	}
+	for i := idx + 1; i < len(fv.Files) && fv.Files[i].Type == FileTypePad && fv.Files[i].Offset == end; i++ {
+		end = align8(fv.Files[i].Offset + fv.Files[i].FileSize())
+	}
+	if _, atFreeSpace := fv.slotEnd(idx); atFreeSpace {
+		end = fv.Length
+		fill(buf[start:end], fv.erasedByte())
+	} else if err := fv.writePad(buf, start, end); err != nil {
+		return err
+	}
+	return fv.rebuild(buf)
+}
+
+// DeleteFile removes the file with the given GUID from the volume. The other
+// files are not moved, so they keep their alignment: the footprint of the
+// deleted file becomes a pad file, merged with the adjacent ones, or free
+// space if no file follows it.
+func (fv *FirmwareVolume) DeleteFile(guid string) error {
+	if err := fv.checkEditable(); err != nil {
+		return err
+	}
+	idx := fv.findFile(guid)
+	if idx == -1 {
+		return fmt.Errorf("File %s not found in firmware volume %s", guid, fv.guidString())
+	}
+	debugf("Deleting file %s at offset 0x%x", guid, fv.Files[idx].Offset)
+	return fv.removeFile(idx)
+}
+
+// blockMapLength returns the number of bytes described by a block map
+func blockMapLength(blocks []Block) uint64 {
+	var length uint64
+	for _, b := range blocks {
+		length += uint64(b.Count) * uint64(b.Size)
+	}
+	return length
+}
+
+// usedLength returns the offset of the end of the data in the volume, i.e.
+// the position after the last byte that is not erased, or the end of the
+// variable store, whose size covers its free space too.
+func (fv FirmwareVolume) usedLength() uint64 {
+	erased := fv.erasedByte()
+	end := uint64(len(fv.buf))
+	for end > 0 && fv.buf[end-1] == erased {
+		end--
+	}
+	if fv.VariableStore != nil {
+		if storeEnd := fv.DataOffset() + uint64(fv.VariableStore.Size); storeEnd > end {
+			end = storeEnd
+		}
+	}
+	return end
+}
+
+// Resize changes the length of the volume to hold at least length bytes. The
+// length is rounded up to the erase block size, and the block map and the
+// header checksum are updated accordingly: the count of the last block map
+// entry is adjusted, so the header length does not change. Growing the volume
+// adds free space, shrinking it fails if data would be lost. The position of
+// the volume in its region is not changed: BiosRegion.MarshalBinary fails if
+// it grew over the next volume.
+func (fv *FirmwareVolume) Resize(length uint64) error {
+	if len(fv.Blocks) == 0 || fv.Blocks[len(fv.Blocks)-1].Size == 0 {
+		return fmt.Errorf("Firmware volume %s has an invalid block map: %v", fv.guidString(), fv.Blocks)
+	}
+	last := len(fv.Blocks) - 1
+	fixed := blockMapLength(fv.Blocks[:last])
+	size := uint64(fv.Blocks[last].Size)
+	count := uint64(1)
+	if length > fixed+size {
+		count = (length - fixed + size - 1) / size
+	}
+	if count > 0xffffffff {
+		return fmt.Errorf("Firmware volume length %v too large for block size 0x%x", length, size)
+	}
+	newLength := fixed + count*size
+	if used := fv.usedLength(); newLength < used {
+		return fmt.Errorf("Cannot resize firmware volume %s to %v bytes: its data takes %v bytes",
+			fv.guidString(), newLength, used,
+		)
+	}
+	buf := bytes.Repeat([]byte{fv.erasedByte()}, int(newLength))
+	copy(buf, fv.buf)
+	binary.LittleEndian.PutUint64(buf[32:], newLength)
+	binary.LittleEndian.PutUint32(buf[FirmwareVolumeFixedHeaderSize+8*last:], uint32(count))
+	binary.LittleEndian.PutUint16(buf[50:], 0)
+	binary.LittleEndian.PutUint16(buf[50:], checksum16(buf[:fv.HeaderLen]))
+	debugf("Resizing firmware volume %s from %v to %v bytes", fv.guidString(), fv.Length, newLength)
+	return fv.rebuild(buf)
+}
+
+// ShrinkToFit resizes the volume to the smallest length, in erase blocks,
+// that holds its data.
+func (fv *FirmwareVolume) ShrinkToFit() error {
+	return fv.Resize(fv.usedLength())
+}
@@ -0,0 +1,146 @@
+package uefi
+
+import (
+	"bytes"
+	"testing"
+)
+
+// syntheticFlashImage returns the default synthetic image, whose second
+// volume holds the files
+func syntheticFlashImage(t *testing.T) *FlashImage {
+	buf, err := NewSyntheticImage(DefaultSyntheticConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFlashImage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// roundTrip serializes the image and parses it again, failing the test if
+// the result is not valid
+func roundTrip(t *testing.T, f *FlashImage) *FlashImage {
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	image, err := NewFlashImage(buf)
+	if err != nil {
+		t.Fatalf("NewFlashImage: %v", err)
+	}
+	for _, err := range image.Validate() {
+		t.Errorf("Validate: %v", err)
+	}
+	return image
+}
+
+// rawSection returns a raw section holding n bytes of the given value
+func rawSection(n int, b byte) []byte {
+	size := SectionHeaderMinSize + n
+	return append([]byte{byte(size), byte(size >> 8), byte(size >> 16), byte(SectionTypeRaw)}, bytes.Repeat([]byte{b}, n)...)
+}
+
+// fileData returns the contents of the file with the given GUID in the
+// files volume, or nil if it is not found
+func fileData(f *FlashImage, guid string) []byte {
+	fv := f.BiosRegion.FirmwareVolumes[1]
+	if idx := fv.findFile(guid); idx != -1 {
+		return fv.Files[idx].Data()
+	}
+	return nil
+}
+
+func TestInsertFileRoundTrip(t *testing.T) {
+	f := syntheticFlashImage(t)
+	const guid = "5a5e7c1f-0005-4e3a-9f6b-0a1b2c3d4e05"
+	name, err := parseGUID(guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fv := &f.BiosRegion.FirmwareVolumes[1]
+	file, err := CreateFile(name, FileTypeFreeform, 0, rawSection(0x321, 0xa5), fv.ErasePolarity())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fv.InsertFile(file); err != nil {
+		t.Fatal(err)
+	}
+	image := roundTrip(t, f)
+	if got := fileData(image, guid); !bytes.Equal(got, rawSection(0x321, 0xa5)) {
+		t.Errorf("inserted file: got %d bytes of data", len(got))
+	}
+	if got := len(image.BiosRegion.FirmwareVolumes[1].Files); got != 5 {
+		t.Errorf("got %d files, want 5", got)
+	}
+}
+
+func TestReplaceFileRoundTrip(t *testing.T) {
+	for _, n := range []int{0x10, 0x2000} {
+		f := syntheticFlashImage(t)
+		const guid = "5a5e7c1f-0002-4e3a-9f6b-0a1b2c3d4e02"
+		if err := f.BiosRegion.FirmwareVolumes[1].ReplaceFile(guid, rawSection(n, 0x5a)); err != nil {
+			t.Fatal(err)
+		}
+		image := roundTrip(t, f)
+		if got := fileData(image, guid); !bytes.Equal(got, rawSection(n, 0x5a)) {
+			t.Errorf("%d bytes: replaced file has %d bytes of data", n, len(got))
+		}
+		if fileData(image, "5a5e7c1f-0003-4e3a-9f6b-0a1b2c3d4e03") == nil {
+			t.Errorf("%d bytes: the following file is gone", n)
+		}
+	}
+}
+
+func TestDeleteFileRoundTrip(t *testing.T) {
+	f := syntheticFlashImage(t)
+	want := fileData(f, "5a5e7c1f-0003-4e3a-9f6b-0a1b2c3d4e03")
+	if err := f.BiosRegion.FirmwareVolumes[1].DeleteFile("5a5e7c1f-0002-4e3a-9f6b-0a1b2c3d4e02"); err != nil {
+		t.Fatal(err)
+	}
+	image := roundTrip(t, f)
+	if fileData(image, "5a5e7c1f-0002-4e3a-9f6b-0a1b2c3d4e02") != nil {
+		t.Error("the deleted file is still there")
+	}
+	if got := fileData(image, "5a5e7c1f-0003-4e3a-9f6b-0a1b2c3d4e03"); !bytes.Equal(got, want) {
+		t.Error("the following file changed")
+	}
+}
+
+func TestResizeRoundTrip(t *testing.T) {
+	f := syntheticFlashImage(t)
+	fv := &f.BiosRegion.FirmwareVolumes[1]
+	length := fv.Length
+	if err := fv.ShrinkToFit(); err != nil {
+		t.Fatal(err)
+	}
+	if fv.Length >= length {
+		t.Fatalf("ShrinkToFit kept %v bytes of %v", fv.Length, length)
+	}
+	image := roundTrip(t, f)
+	if got := image.BiosRegion.FirmwareVolumes[1].Length; got != fv.Length {
+		t.Errorf("shrunk volume: got %v bytes, want %v", got, fv.Length)
+	}
+	if err := image.BiosRegion.FirmwareVolumes[1].Resize(length); err != nil {
+		t.Fatal(err)
+	}
+	image = roundTrip(t, image)
+	if got := image.BiosRegion.FirmwareVolumes[1].Length; got != length {
+		t.Errorf("grown volume: got %v bytes, want %v", got, length)
+	}
+	if got := len(image.BiosRegion.FirmwareVolumes[1].Files); got != 4 {
+		t.Errorf("got %d files, want 4", got)
+	}
+}
+
+func TestResizeOverlap(t *testing.T) {
+	f := syntheticFlashImage(t)
+	fv := &f.BiosRegion.FirmwareVolumes[0]
+	if err := fv.Resize(fv.Length + 0x1000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.MarshalBinary(); err == nil {
+		t.Error("expected an error for a volume grown over the next one")
+	}
+}
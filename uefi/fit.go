@@ -0,0 +1,272 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// FITPointerAddress is the physical address of the pointer to the
+	// Firmware Interface Table, 0x40 bytes below 4GB
+	FITPointerAddress = 0xffffffc0
+	// FITEntrySize is the size of an entry of the FIT, including the header
+	FITEntrySize = 16
+	// fitEntriesMax bounds the number of entries, to reject garbage
+	fitEntriesMax = 1024
+	// fitChecksumValid is the C_V bit of the TypeChecksumValid field
+	fitChecksumValid = 0x80
+)
+
+// FITSignature is the address field of the header entry of the FIT
+var FITSignature = []byte("_FIT_   ")
+
+// FITEntryType is the type of an entry of the FIT
+type FITEntryType uint8
+
+// FIT entry types
+const (
+	FITTypeHeader             FITEntryType = 0x00
+	FITTypeMicrocode          FITEntryType = 0x01
+	FITTypeStartupACM         FITEntryType = 0x02
+	FITTypeDiagnosticACM      FITEntryType = 0x03
+	FITTypeBIOSStartupModule  FITEntryType = 0x07
+	FITTypeTPMPolicy          FITEntryType = 0x08
+	FITTypeBIOSPolicy         FITEntryType = 0x09
+	FITTypeTXTPolicy          FITEntryType = 0x0a
+	FITTypeKeyManifest        FITEntryType = 0x0b
+	FITTypeBootPolicyManifest FITEntryType = 0x0c
+	FITTypeCSESecureBoot      FITEntryType = 0x10
+	FITTypeTXTSXPolicy        FITEntryType = 0x2d
+	FITTypeJMPDebugPolicy     FITEntryType = 0x2f
+	FITTypeUnused             FITEntryType = 0x7f
+)
+
+var fitEntryTypeNames = map[FITEntryType]string{
+	FITTypeHeader:             "Header",
+	FITTypeMicrocode:          "Microcode",
+	FITTypeStartupACM:         "StartupACM",
+	FITTypeDiagnosticACM:      "DiagnosticACM",
+	FITTypeBIOSStartupModule:  "BIOSStartupModule",
+	FITTypeTPMPolicy:          "TPMPolicy",
+	FITTypeBIOSPolicy:         "BIOSPolicy",
+	FITTypeTXTPolicy:          "TXTPolicy",
+	FITTypeKeyManifest:        "KeyManifest",
+	FITTypeBootPolicyManifest: "BootPolicyManifest",
+	FITTypeCSESecureBoot:      "CSESecureBoot",
+	FITTypeTXTSXPolicy:        "TXTSXPolicy",
+	FITTypeJMPDebugPolicy:     "JMPDebugPolicy",
+	FITTypeUnused:             "Unused",
+}
+
+func (t FITEntryType) String() string {
+	if name, ok := fitEntryTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("FITEntryType(0x%02x)", uint8(t))
+}
+
+// FITEntry is an entry of the Firmware Interface Table. Address is the
+// physical address of the component, except for the header, where it holds
+// the signature, and for the policy entries, where it may be an index.
+type FITEntry struct {
+	Address  uint64
+	Size     [3]uint8
+	Reserved uint8
+	Version  uint16
+	// TypeChecksumValid holds the type in bits 6:0, and whether Checksum
+	// is valid in bit 7
+	TypeChecksumValid uint8
+	Checksum          uint8
+}
+
+// Type returns the type of the entry
+func (e FITEntry) Type() FITEntryType {
+	return FITEntryType(e.TypeChecksumValid &^ fitChecksumValid)
+}
+
+// ChecksumValid returns whether the Checksum field is in use
+func (e FITEntry) ChecksumValid() bool {
+	return e.TypeChecksumValid&fitChecksumValid != 0
+}
+
+// RawSize returns the 24-bit size field. It is the number of entries for
+// the header, and a number of 16-byte units for most of the other types.
+func (e FITEntry) RawSize() uint32 {
+	return uint32(e.Size[0]) | uint32(e.Size[1])<<8 | uint32(e.Size[2])<<16
+}
+
+// HasComponent returns whether the address of the entry is the physical
+// address of a component in the BIOS region
+func (e FITEntry) HasComponent() bool {
+	switch e.Type() {
+	case FITTypeMicrocode, FITTypeStartupACM, FITTypeDiagnosticACM, FITTypeBIOSStartupModule,
+		FITTypeKeyManifest, FITTypeBootPolicyManifest:
+		return true
+	}
+	return false
+}
+
+func (e FITEntry) String() string {
+	return fmt.Sprintf("FITEntry{Type=%v, Address=0x%x, Size=0x%x, Version=0x%04x}",
+		e.Type(), e.Address, e.RawSize(), e.Version)
+}
+
+// FIT is the Firmware Interface Table, which lists the components the CPU
+// processes before executing the firmware: microcode updates, the startup
+// ACM, and the Boot Guard manifests and policies.
+type FIT struct {
+	// Offset is the position of the table from the start of the BIOS region
+	Offset uint64
+	// Header is the first entry of the table
+	Header  FITEntry
+	Entries []FITEntry
+}
+
+// EntriesOfType returns the entries with the given type
+func (t FIT) EntriesOfType(typ FITEntryType) []FITEntry {
+	var entries []FITEntry
+	for _, e := range t.Entries {
+		if e.Type() == typ {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// checksum returns the 8-bit sum of the table, which is 0 when the header
+// checksum is valid
+func (t FIT) checksum() uint8 {
+	buf, err := t.MarshalBinary()
+	if err != nil {
+		return 0
+	}
+	var sum uint8
+	for _, b := range buf {
+		sum += b
+	}
+	return sum
+}
+
+// FixChecksum updates the number of entries in the header and, if the
+// header checksum is in use, the checksum
+func (t *FIT) FixChecksum() {
+	count := uint32(len(t.Entries) + 1)
+	t.Header.Size = [3]uint8{uint8(count), uint8(count >> 8), uint8(count >> 16)}
+	if t.Header.ChecksumValid() {
+		t.Header.Checksum = 0
+		t.Header.Checksum = -t.checksum()
+	}
+}
+
+// MarshalBinary serializes the table, header included
+func (t FIT) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, t.Header); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, t.Entries); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Summary prints a multi-line description of the table
+func (t FIT) Summary() string {
+	var entries []string
+	for _, e := range t.Entries {
+		entries = append(entries, e.String())
+	}
+	return fmt.Sprintf("FIT{\n"+
+		"    Offset=0x%x\n"+
+		"    Version=0x%04x\n"+
+		"    Entries=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		t.Offset,
+		t.Header.Version,
+		Indent(strings.Join(entries, "\n"), 8),
+	)
+}
+
+// Validate checks the checksum of the table, the order of the entries and
+// that the components are inside a BIOS region of the given size
+func (t FIT) Validate(regionSize uint64) []error {
+	errors := make([]error, 0)
+	if t.Header.ChecksumValid() && t.checksum() != 0 {
+		errors = append(errors, fmt.Errorf("FIT checksum mismatch: the table sums to 0x%02x", t.checksum()))
+	}
+	for i, e := range t.Entries {
+		if i > 0 && e.Type() < t.Entries[i-1].Type() {
+			errors = append(errors, fmt.Errorf("FIT entry %d of type %v follows an entry of type %v", i+1, e.Type(), t.Entries[i-1].Type()))
+		}
+		if e.HasComponent() {
+			if _, err := addressToOffset(e.Address, regionSize); err != nil {
+				errors = append(errors, fmt.Errorf("FIT entry %d of type %v: %v", i+1, e.Type(), err))
+			}
+		}
+	}
+	return errors
+}
+
+// addressToOffset converts a physical address below 4GB to an offset in a
+// BIOS region of the given size, whose end is mapped at 4GB
+func addressToOffset(addr, regionSize uint64) (uint64, error) {
+	const top = 1 << 32
+	if addr >= top || addr < top-regionSize {
+		return 0, fmt.Errorf("Address 0x%x is outside of the BIOS region [0x%x-0x%x]", addr, top-regionSize, uint64(top))
+	}
+	return addr - (top - regionSize), nil
+}
+
+// AddressToOffset converts a physical address below 4GB to an offset in the
+// region, whose end is mapped at 4GB
+func (br BiosRegion) AddressToOffset(addr uint64) (uint64, error) {
+	return addressToOffset(addr, uint64(len(br.buf)))
+}
+
+// FindFIT returns the offset of the FIT in a BIOS region, from the pointer
+// at FITPointerAddress
+func FindFIT(region []byte) (uint64, error) {
+	size := uint64(len(region))
+	pointer, err := addressToOffset(FITPointerAddress, size)
+	if err != nil {
+		return 0, err
+	}
+	addr := binary.LittleEndian.Uint64(region[pointer:])
+	offset, err := addressToOffset(addr, size)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid FIT pointer: %v", err)
+	}
+	return offset, nil
+}
+
+// NewFIT parses the FIT pointed to by the FIT pointer of a BIOS region
+func NewFIT(region []byte) (*FIT, error) {
+	offset, err := FindFIT(region)
+	if err != nil {
+		return nil, err
+	}
+	if offset+FITEntrySize > uint64(len(region)) || !bytes.Equal(region[offset:offset+uint64(len(FITSignature))], FITSignature) {
+		return nil, fmt.Errorf("FIT signature %q not found at offset 0x%x", FITSignature, offset)
+	}
+	t := FIT{Offset: offset}
+	if err := binary.Read(bytes.NewReader(region[offset:]), binary.LittleEndian, &t.Header); err != nil {
+		return nil, err
+	}
+	count := uint64(t.Header.RawSize())
+	if count == 0 || count > fitEntriesMax {
+		return nil, fmt.Errorf("Invalid number of FIT entries: %v", count)
+	}
+	end := offset + count*FITEntrySize
+	if end > uint64(len(region)) {
+		return nil, fmt.Errorf("FIT [0x%x-0x%x] exceeds the region size 0x%x", offset, end, len(region))
+	}
+	t.Entries = make([]FITEntry, count-1)
+	if err := binary.Read(bytes.NewReader(region[offset+FITEntrySize:end]), binary.LittleEndian, t.Entries); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,143 @@
+package uefi
+
+import (
+	"fmt"
+)
+
+// offsetToAddress converts an offset in the region to its physical address
+// below 4GB
+func (br BiosRegion) offsetToAddress(offset uint64) uint64 {
+	return 1<<32 - uint64(len(br.buf)) + offset
+}
+
+// fileAt returns the file of the region containing the given offset, and
+// the position of the offset from the start of the file. Pad files are not
+// returned, as their GUIDs are not unique.
+func (br BiosRegion) fileAt(offset uint64) (*File, uint64, bool) {
+	for _, fv := range br.FirmwareVolumes {
+		if offset < fv.Offset || offset >= fv.Offset+fv.Length {
+			continue
+		}
+		for _, f := range fv.Files {
+			start := fv.Offset + f.Offset
+			if f.Type != FileTypePad && offset >= start && offset < start+f.FileSize() {
+				return f, offset - start, true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// fileOffset returns the offset in the region of the first file with the
+// given GUID
+func (br BiosRegion) fileOffset(guid string) (*File, uint64, bool) {
+	for _, fv := range br.FirmwareVolumes {
+		if idx := fv.findFile(guid); idx != -1 {
+			return fv.Files[idx], fv.Offset + fv.Files[idx].Offset, true
+		}
+	}
+	return nil, 0, false
+}
+
+// relocate returns where the element at the given offset of the old region
+// is in this region, following the file that contains it. The second value
+// is false if the element is not in a file, and it is left where it was.
+func (br BiosRegion) relocate(old BiosRegion, offset uint64) (uint64, bool, error) {
+	f, delta, ok := old.fileAt(offset)
+	if !ok {
+		return offset, false, nil
+	}
+	nf, start, ok := br.fileOffset(f.GUID())
+	if !ok {
+		return 0, false, fmt.Errorf("File %s was removed", f.GUID())
+	}
+	if delta >= nf.FileSize() {
+		return 0, false, fmt.Errorf("File %s is now 0x%x bytes, smaller than the offset 0x%x", f.GUID(), nf.FileSize(), delta)
+	}
+	return start + delta, true, nil
+}
+
+// clone returns a copy of the region whose volumes can be edited without
+// changing the ones of br
+func (br BiosRegion) clone() *BiosRegion {
+	br.FirmwareVolumes = append([]FirmwareVolume{}, br.FirmwareVolumes...)
+	return &br
+}
+
+// UpdateFIT updates the FIT after the files of the region were moved or
+// replaced: the addresses of the components, and the position of the table
+// itself, are computed again from the files that contained them in the old
+// region, and the checksum is recomputed. The region must have the FIT of
+// old, and the same size.
+func (br *BiosRegion) UpdateFIT(old BiosRegion) error {
+	return br.updateFIT(old, nil)
+}
+
+// updateFIT is UpdateFIT, with the new offsets of the components that moved
+// inside their file given by moved, indexed by their old offset
+func (br *BiosRegion) updateFIT(old BiosRegion, moved map[uint64]uint64) error {
+	if old.FIT == nil {
+		return nil
+	}
+	if len(br.buf) != len(old.buf) {
+		return fmt.Errorf("Cannot update the FIT: the region size changed from 0x%x to 0x%x", len(old.buf), len(br.buf))
+	}
+	fit := *old.FIT
+	fit.Entries = append([]FITEntry{}, old.FIT.Entries...)
+	for i, e := range fit.Entries {
+		if !e.HasComponent() {
+			continue
+		}
+		offset, err := old.AddressToOffset(e.Address)
+		if err != nil {
+			continue
+		}
+		newOffset, ok := moved[offset]
+		if !ok {
+			newOffset, ok, err = br.relocate(old, offset)
+			if err != nil {
+				return fmt.Errorf("FIT entry %d of type %v: %v", i+1, e.Type(), err)
+			}
+		}
+		if ok && newOffset != offset {
+			debugf("FIT entry %d of type %v moved from 0x%x to 0x%x", i+1, e.Type(), offset, newOffset)
+			fit.Entries[i].Address = br.offsetToAddress(newOffset)
+		}
+	}
+	offset, _, err := br.relocate(old, old.FIT.Offset)
+	if err != nil {
+		return fmt.Errorf("FIT table: %v", err)
+	}
+	fit.Offset = offset
+	fit.FixChecksum()
+	br.FIT = &fit
+	return nil
+}
+
+// updateFIT updates the FIT of the BIOS region after its volumes were
+// edited, see BiosRegion.UpdateFIT, and parses the image again so the
+// volumes hold the new table
+func (f *FlashImage) updateFIT(old *BiosRegion) error {
+	if old == nil || old.FIT == nil || f.BiosRegion == nil {
+		return nil
+	}
+	if err := f.BiosRegion.UpdateFIT(*old); err != nil {
+		return err
+	}
+	return f.reparse()
+}
+
+// reparse serializes the image and parses it again, so every field reflects
+// the pending edits
+func (f *FlashImage) reparse() error {
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	image, err := NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	*f = *image
+	return nil
+}
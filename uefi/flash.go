@@ -2,7 +2,11 @@ package uefi
 
 import (
 	"bytes"
+	"encoding"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 )
 
 // FlashSignature is the sequence of bytes that a Flash image is expected to
@@ -19,11 +23,41 @@ type FlashImage struct {
 	DescriptorMapStart uint
 	RegionStart        uint
 	MasterStart        uint
+	ComponentStart     uint
 	DescriptorMap      FlashDescriptorMap
-	Region             FlashRegionSection
-	Master             FlashMasterSection
+	// Chipset is guessed from the descriptor, and selects the layout of the
+	// version specific sections
+	Chipset         ChipsetFamily
+	Component       FlashComponentSection
+	Region          FlashRegionSection
+	Master          FlashMasterSection
+	PchStrapsStart  uint
+	ProcStrapsStart uint
+	PchStraps       FlashStraps
+	ProcStraps      FlashStraps
+	// UpperMap is nil if the descriptor has no upper map
+	UpperMap       *FlashUpperMap
+	VSCCTableStart uint
+	VSCCTable      VSCCTable
+	// OEM is nil if the image is smaller than the descriptor region
+	OEM *FlashOEMSection
 	// Actual regions
 	BiosRegion *BiosRegion
+	MeRegion   *MeRegion
+	GbeRegion  *GbeRegion
+	PdrRegion  *PdrRegion
+	EcRegion   *EcRegion
+	// TenGbeRegions are the 10GbE regions, in the order of their types
+	TenGbeRegions []*TenGbeRegion
+	// Broken holds the elements that could not be parsed in permissive mode
+	Broken []BrokenNode
+	// durations is the time spent parsing each part of the image
+	durations map[string]time.Duration
+}
+
+// DescriptorVersion returns the version of the flash descriptor
+func (f FlashImage) DescriptorVersion() DescriptorVersion {
+	return f.Master.Version
 }
 
 // IsPCH returns whether the flash image has the more recent PCH format, or not.
@@ -58,7 +92,101 @@ func (f FlashImage) Validate() []error {
 		errors = append(errors, err)
 	}
 	errors = append(errors, f.DescriptorMap.Validate()...)
-	// TODO also validate regions, masters, etc
+	errors = append(errors, f.Component.Validate()...)
+	errors = append(errors, f.Region.Validate()...)
+	errors = append(errors, f.Master.Validate()...)
+	errors = append(errors, f.ValidateLayout(false)...)
+	if f.BiosRegion != nil {
+		for _, fv := range f.BiosRegion.FirmwareVolumes {
+			errors = append(errors, fv.Validate()...)
+		}
+		errors = append(errors, f.BiosRegion.vulnerabilityErrors()...)
+	}
+	if f.MeRegion != nil {
+		errors = append(errors, f.MeRegion.Validate()...)
+	}
+	if f.GbeRegion != nil {
+		errors = append(errors, f.GbeRegion.Validate()...)
+	}
+	for _, r := range f.TenGbeRegions {
+		errors = append(errors, r.Validate()...)
+	}
+	return errors
+}
+
+// layoutRegion is a region in use, as checked by ValidateLayout
+type layoutRegion struct {
+	t            FlashRegionType
+	offset, size uint64
+}
+
+// ValidateLayout checks that the regions in use do not overlap, and that
+// they fit in the flash chips described by the component section and in the
+// image. If requireCoverage is set, it also checks that the regions cover the
+// whole flash, with no gaps.
+func (f FlashImage) ValidateLayout(requireCoverage bool) []error {
+	var (
+		errors  []error
+		regions []layoutRegion
+	)
+	for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+		if start, end := f.Region.RegionOffset(t); end != 0 {
+			regions = append(regions, layoutRegion{t, uint64(start), uint64(end - start)})
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].offset < regions[j].offset })
+	flashSize := f.Component.TotalSize()
+	if flashSize == 0 {
+		flashSize = uint64(len(f.buf))
+	}
+	var (
+		end  uint64
+		last layoutRegion
+	)
+	for i, r := range regions {
+		if i > 0 && r.offset < end {
+			prev := last
+			errors = append(errors, fmt.Errorf("Region %v [0x%x-0x%x] overlaps region %v [0x%x-0x%x]",
+				r.t, r.offset, r.offset+r.size, prev.t, prev.offset, prev.offset+prev.size))
+		} else if requireCoverage && r.offset > end {
+			errors = append(errors, fmt.Errorf("Gap not covered by any region at [0x%x-0x%x]", end, r.offset))
+		}
+		if r.offset+r.size > flashSize {
+			errors = append(errors, fmt.Errorf("Region %v [0x%x-0x%x] exceeds the flash size 0x%x",
+				r.t, r.offset, r.offset+r.size, flashSize))
+		} else if r.offset+r.size > uint64(len(f.buf)) {
+			errors = append(errors, fmt.Errorf("Region %v [0x%x-0x%x] exceeds the image size 0x%x",
+				r.t, r.offset, r.offset+r.size, len(f.buf)))
+		}
+		if r.offset+r.size > end {
+			end, last = r.offset+r.size, r
+		}
+	}
+	if requireCoverage && end < flashSize {
+		errors = append(errors, fmt.Errorf("Gap not covered by any region at [0x%x-0x%x]", end, flashSize))
+	}
+	return errors
+}
+
+// RegionContaining returns the type of the region in use that contains the
+// given absolute offset
+func (f FlashImage) RegionContaining(offset uint64) (FlashRegionType, error) {
+	for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+		if start, end := f.Region.RegionOffset(t); offset >= uint64(start) && offset < uint64(end) {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("Offset 0x%x is not in any region", offset)
+}
+
+// ParseErrors returns the errors tolerated while parsing the image in
+// permissive mode. They are not reported by Validate, as the image was
+// parsed nonetheless.
+func (f FlashImage) ParseErrors() []error {
+	errors := brokenErrors("Flash image", f.Broken)
+	if f.BiosRegion != nil {
+		errors = append(errors, f.BiosRegion.ParseErrors()...)
+	}
 	return errors
 }
 
@@ -73,32 +201,124 @@ func (f FlashImage) String() string {
 
 // Summary prints a multi-line description of the flash image
 func (f FlashImage) Summary() string {
+	var straps []string
+	for _, v := range f.StrapValues() {
+		straps = append(straps, v.String())
+	}
+	biosSummary, meSummary, gbeSummary, pdrSummary, ecSummary := "<none>", "<none>", "<none>", "<none>", "<none>"
+	if f.BiosRegion != nil {
+		biosSummary = f.BiosRegion.Summary()
+	}
+	if f.MeRegion != nil {
+		meSummary = f.MeRegion.Summary()
+	}
+	if f.GbeRegion != nil {
+		gbeSummary = f.GbeRegion.Summary()
+	}
+	if f.PdrRegion != nil {
+		pdrSummary = f.PdrRegion.Summary()
+	}
+	if f.EcRegion != nil {
+		ecSummary = f.EcRegion.Summary()
+	}
+	var tenGbeSummaries []string
+	for _, r := range f.TenGbeRegions {
+		tenGbeSummaries = append(tenGbeSummaries, r.Summary())
+	}
 	return fmt.Sprintf("FlashImage{\n"+
 		"    Size=%v\n"+
 		"    DescriptorMapStart=%v\n"+
 		"    RegionStart=%v\n"+
 		"    MasterStart=%v\n"+
+		"    Chipset=%v\n"+
 		"    Descriptor=%v\n"+
+		"    Component=%v\n"+
 		"    Region=%v\n"+
 		"    Master=%v\n"+
+		"    Straps=[%v]\n"+
+		"    VSCCTable=%v\n"+
+		"    OEM=%v\n"+
 		"    BiosRegion=%v\n"+
+		"    MeRegion=%v\n"+
+		"    GbeRegion=%v\n"+
+		"    PdrRegion=%v\n"+
+		"    EcRegion=%v\n"+
+		"    TenGbeRegions=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    Broken=%v\n"+
 		"}",
 		len(f.buf),
 		f.DescriptorMapStart,
 		f.RegionStart,
 		f.MasterStart,
+		f.Chipset,
 		Indent(f.DescriptorMap.Summary(), 4),
+		Indent(f.Component.Summary(), 4),
 		Indent(f.Region.Summary(), 4),
 		Indent(f.Master.Summary(), 4),
-		Indent(f.BiosRegion.Summary(), 4),
+		strings.Join(straps, ", "),
+		Indent(f.VSCCTable.Summary(), 4),
+		f.OEM,
+		Indent(biosSummary, 4),
+		Indent(meSummary, 4),
+		Indent(gbeSummary, 4),
+		Indent(pdrSummary, 4),
+		Indent(ecSummary, 4),
+		Indent(strings.Join(tenGbeSummaries, "\n"), 8),
+		f.Broken,
 	)
 }
 
-func computeRegionSize(base, limit uint16) uint32 {
-	if limit == 0 {
-		return 0
+// descriptorPart is a section of the descriptor, or a region, serialized at
+// its offset by MarshalBinary
+type descriptorPart struct {
+	name   string
+	offset uint
+	m      encoding.BinaryMarshaler
+}
+
+// descriptorParts returns the parsed sections of the descriptor with their
+// offsets
+func (f FlashImage) descriptorParts() []descriptorPart {
+	parts := []descriptorPart{
+		{"descriptor map", f.DescriptorMapStart, f.DescriptorMap},
+		{"component section", f.ComponentStart, f.Component},
+		{"region section", f.RegionStart, f.Region},
+		{"master section", f.MasterStart, f.Master},
+		{"PCH straps", f.PchStrapsStart, f.PchStraps},
+		{"processor straps", f.ProcStrapsStart, f.ProcStraps},
+		{"VSCC table", f.VSCCTableStart, f.VSCCTable},
+	}
+	if f.UpperMap != nil {
+		parts = append(parts, descriptorPart{"upper map", FlashUpperMapOffset, f.UpperMap})
+	}
+	if f.OEM != nil {
+		parts = append(parts, descriptorPart{"OEM section", FlashOEMSectionOffset, f.OEM})
+	}
+	return parts
+}
+
+// MarshalBinary serializes the flash image. The descriptor sections and the
+// parsed regions are serialized at their offsets, the rest of the image is
+// copied from the parsed buffer.
+func (f FlashImage) MarshalBinary() ([]byte, error) {
+	out := append([]byte{}, f.buf...)
+	parts := f.descriptorParts()
+	for _, r := range f.Regions() {
+		start, _ := f.Region.RegionOffset(r.Type())
+		parts = append(parts, descriptorPart{r.Type().String() + " region", uint(start), r})
 	}
-	return (uint32(limit) + 1 - uint32(base)) * 0x1000
+	for _, p := range parts {
+		b, err := p.m.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if err := splice(out, uint64(p.offset), b, p.name); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
 }
 
 // NewFlashImage tries to create a FlashImage structure, and returns a FlashImage
@@ -111,7 +331,8 @@ func NewFlashImage(buf []byte) (*FlashImage, error) {
 			len(buf),
 		)
 	}
-	flash := FlashImage{buf: buf}
+	start := time.Now()
+	flash := FlashImage{buf: buf, durations: make(map[string]time.Duration)}
 	descriptorMapStart, err := flash.FindSignature()
 	if err != nil {
 		return nil, err
@@ -124,10 +345,23 @@ func NewFlashImage(buf []byte) (*FlashImage, error) {
 		return nil, err
 	}
 	flash.DescriptorMap = *desc
+	flash.Chipset = DetectChipset(buf, flash.DescriptorMap)
+	debugf("Detected chipset: %v", flash.Chipset)
 
 	// Region
 	flash.RegionStart = uint(flash.DescriptorMap.RegionBase) * 0x10
-	region, err := NewFlashRegionSection(buf[flash.RegionStart : flash.RegionStart+uint(FlashRegionSectionSize)])
+	// the region section extends up to the master section, which follows it
+	regionEnd := flash.RegionStart + uint(FlashRegionSectionSize)
+	if masterStart := uint(flash.DescriptorMap.MasterBase) * 0x10; masterStart > flash.RegionStart {
+		regionEnd = masterStart
+		if max := flash.RegionStart + FlashRegionsMax*4; regionEnd > max {
+			regionEnd = max
+		}
+	}
+	if regionEnd > uint(len(buf)) {
+		regionEnd = uint(len(buf))
+	}
+	region, err := NewFlashRegionSection(buf[flash.RegionStart:regionEnd])
 	if err != nil {
 		return nil, err
 	}
@@ -135,20 +369,158 @@ func NewFlashImage(buf []byte) (*FlashImage, error) {
 
 	// Master
 	flash.MasterStart = uint(flash.DescriptorMap.MasterBase) * 0x10
-	master, err := NewFlashMasterSection(buf[flash.MasterStart : flash.MasterStart+uint(FlashMasterSectionSize)])
+	// the master section extends up to the PCH straps, which follow it
+	masterEnd := flash.MasterStart + uint(FlashMasterSectionSize)
+	if strapsStart := uint(flash.DescriptorMap.PchStrapsBase) * 0x10; strapsStart > masterEnd {
+		masterEnd = strapsStart
+		if max := flash.MasterStart + FlashMastersMax*4; masterEnd > max {
+			masterEnd = max
+		}
+	}
+	if masterEnd > uint(len(buf)) {
+		masterEnd = uint(len(buf))
+	}
+	master, err := NewFlashMasterSection(buf[flash.MasterStart:masterEnd])
 	if err != nil {
 		return nil, err
 	}
 	flash.Master = *master
+	flash.Master.Version = flash.Chipset.DescriptorVersion()
 
-	// BIOS region
-	biosBase := uint32(uint32(flash.Region.BiosBase) * 0x1000)
-	biosSize := uint32(computeRegionSize(flash.Region.BiosBase, flash.Region.BiosLimit))
-	br, err := NewBiosRegion(buf[biosBase : biosBase+biosSize])
+	// Component
+	flash.ComponentStart = uint(flash.DescriptorMap.ComponentBase) * 0x10
+	if flash.ComponentStart > uint(len(buf)) {
+		return nil, fmt.Errorf("Component section out of bounds at 0x%x", flash.ComponentStart)
+	}
+	// FLMAP0.NC holds the number of components minus one
+	components := int(flash.DescriptorMap.NumberOfFlashChips&0x3) + 1
+	component, err := NewFlashComponentSection(buf[flash.ComponentStart:], components, flash.DescriptorVersion())
 	if err != nil {
 		return nil, err
 	}
-	flash.BiosRegion = br
+	flash.Component = *component
+
+	// Soft straps
+	straps := []struct {
+		name   string
+		start  *uint
+		count  uint8
+		straps *FlashStraps
+	}{
+		{"PCH", &flash.PchStrapsStart, flash.DescriptorMap.NumberOfPchStraps, &flash.PchStraps},
+		{"Processor", &flash.ProcStrapsStart, flash.DescriptorMap.NumberOfProcStraps, &flash.ProcStraps},
+	}
+	flash.PchStrapsStart = uint(flash.DescriptorMap.PchStrapsBase) * 0x10
+	flash.ProcStrapsStart = uint(flash.DescriptorMap.ProcStrapsBase) * 0x10
+	for _, st := range straps {
+		if st.count == 0 {
+			continue
+		}
+		if *st.start > uint(len(buf)) {
+			warnf("%s straps out of bounds at 0x%x", st.name, *st.start)
+			continue
+		}
+		s, err := NewFlashStraps(buf[*st.start:], int(st.count))
+		if err != nil {
+			warnf("%s straps: %v", st.name, err)
+			continue
+		}
+		*st.straps = s
+	}
+
+	// Upper map and VSCC table, within the 4KiB descriptor
+	if len(buf) >= FlashUpperMapOffset+FlashUpperMapSize {
+		descriptor := buf
+		if len(descriptor) > 0x1000 {
+			descriptor = descriptor[:0x1000]
+		}
+		upper, table, tableStart, err := NewVSCCTable(descriptor)
+		if err != nil {
+			warnf("VSCC table: %v", err)
+		} else {
+			flash.UpperMap = upper
+			flash.VSCCTable = table
+			flash.VSCCTableStart = tableStart
+		}
+	}
+	if len(buf) >= FlashOEMSectionOffset+FlashOEMSectionSize {
+		oem, err := NewFlashOEMSection(buf[FlashOEMSectionOffset:])
+		if err != nil {
+			return nil, err
+		}
+		flash.OEM = oem
+	}
+	flash.durations["Descriptor"] = time.Since(start)
+
+	// Regions
+	tenGbe := func(t FlashRegionType) func([]byte) error {
+		return func(data []byte) error {
+			r, err := NewTenGbeRegion(data, t)
+			if err != nil {
+				return err
+			}
+			flash.TenGbeRegions = append(flash.TenGbeRegions, r)
+			return nil
+		}
+	}
+	regions := []struct {
+		name  string
+		t     FlashRegionType
+		parse func([]byte) error
+	}{
+		{"BIOS", RegionTypeBIOS, func(data []byte) (err error) {
+			flash.BiosRegion, err = NewBiosRegion(data)
+			return err
+		}},
+		{"ME", RegionTypeME, func(data []byte) (err error) {
+			flash.MeRegion, err = NewMeRegion(data)
+			return err
+		}},
+		{"GbE", RegionTypeGbE, func(data []byte) (err error) {
+			flash.GbeRegion, err = NewGbeRegion(data)
+			return err
+		}},
+		{"PDR", RegionTypePDR, func(data []byte) (err error) {
+			flash.PdrRegion, err = NewPdrRegion(data)
+			return err
+		}},
+		{"EC", RegionTypeEC, func(data []byte) (err error) {
+			flash.EcRegion, err = NewEcRegion(data)
+			return err
+		}},
+		{"10GbE0", RegionType10GbE0, tenGbe(RegionType10GbE0)},
+		{"10GbE1", RegionType10GbE1, tenGbe(RegionType10GbE1)},
+	}
+	for _, r := range regions {
+		start, end := flash.Region.RegionOffset(r.t)
+		base, size := uint64(start), uint64(end-start)
+		if size == 0 {
+			continue
+		}
+		if base+size > uint64(len(buf)) {
+			err := fmt.Errorf("%s region out of bounds: 0x%x-0x%x, image size 0x%x",
+				r.name, base, base+size, len(buf),
+			)
+			var data []byte
+			if base < uint64(len(buf)) {
+				data = buf[base:]
+			}
+			if err := tolerate(&flash.Broken, base, data, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		regionStart := time.Now()
+		err := r.parse(buf[base : base+size])
+		flash.durations[r.name] = time.Since(regionStart)
+		if err != nil {
+			err = fmt.Errorf("%s region: %v", r.name, err)
+			if err := tolerate(&flash.Broken, base, buf[base:base+size], err); err != nil {
+				return nil, err
+			}
+		}
+	}
+	flash.durations["Total"] = time.Since(start)
 
 	return &flash, nil
 }
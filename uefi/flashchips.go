@@ -0,0 +1,92 @@
+package uefi
+
+import (
+	"fmt"
+)
+
+// FlashChip describes a SPI flash part
+type FlashChip struct {
+	Vendor string
+	Name   string
+	// Size is the capacity of the part in bytes
+	Size uint64
+}
+
+func (c FlashChip) String() string {
+	if c.Size == 0 {
+		return fmt.Sprintf("%s %s", c.Vendor, c.Name)
+	}
+	return fmt.Sprintf("%s %s (%dMB)", c.Vendor, c.Name, c.Size>>20)
+}
+
+// JEDECVendors maps the JEDEC manufacturer IDs to the names of the vendors
+var JEDECVendors = map[uint8]string{
+	0x01: "Spansion",
+	0x1c: "Eon",
+	0x1f: "Atmel",
+	0x20: "Micron",
+	0x9d: "ISSI",
+	0xbf: "SST",
+	0xc2: "Macronix",
+	0xc8: "GigaDevice",
+	0xef: "Winbond",
+}
+
+// KnownFlashChips maps the JEDEC IDs of common SPI flash parts, as returned
+// by VSCCEntry.JEDECID, to their description. Users can add their own.
+var KnownFlashChips = map[uint32]FlashChip{
+	0x012018: {"Spansion", "S25FL128S", 16 << 20},
+	0x010219: {"Spansion", "S25FL256S", 32 << 20},
+	0x1c3017: {"Eon", "EN25Q64", 8 << 20},
+	0x1c3018: {"Eon", "EN25Q128", 16 << 20},
+	0x1f4700: {"Atmel", "AT25DF321", 4 << 20},
+	0x1f4800: {"Atmel", "AT25DF641", 8 << 20},
+	0x20ba17: {"Micron", "N25Q064", 8 << 20},
+	0x20ba18: {"Micron", "N25Q128", 16 << 20},
+	0x20ba19: {"Micron", "N25Q256", 32 << 20},
+	0x20ba20: {"Micron", "MT25QL512", 64 << 20},
+	0x20bb18: {"Micron", "N25Q128 (1.8V)", 16 << 20},
+	0x9d6018: {"ISSI", "IS25LP128", 16 << 20},
+	0xbf2541: {"SST", "SST25VF016B", 2 << 20},
+	0xbf254a: {"SST", "SST25VF032B", 4 << 20},
+	0xc22015: {"Macronix", "MX25L1605", 2 << 20},
+	0xc22016: {"Macronix", "MX25L3205", 4 << 20},
+	0xc22017: {"Macronix", "MX25L6405", 8 << 20},
+	0xc22018: {"Macronix", "MX25L12805", 16 << 20},
+	0xc22019: {"Macronix", "MX25L25635", 32 << 20},
+	0xc2201a: {"Macronix", "MX66L51235", 64 << 20},
+	0xc22537: {"Macronix", "MX25U6435", 8 << 20},
+	0xc22538: {"Macronix", "MX25U12835", 16 << 20},
+	0xc22539: {"Macronix", "MX25U25635", 32 << 20},
+	0xc84017: {"GigaDevice", "GD25Q64", 8 << 20},
+	0xc84018: {"GigaDevice", "GD25Q128", 16 << 20},
+	0xc84019: {"GigaDevice", "GD25Q256", 32 << 20},
+	0xc86018: {"GigaDevice", "GD25LQ128", 16 << 20},
+	0xef4015: {"Winbond", "W25Q16", 2 << 20},
+	0xef4016: {"Winbond", "W25Q32", 4 << 20},
+	0xef4017: {"Winbond", "W25Q64", 8 << 20},
+	0xef4018: {"Winbond", "W25Q128", 16 << 20},
+	0xef4019: {"Winbond", "W25Q256", 32 << 20},
+	0xef4020: {"Winbond", "W25Q512", 64 << 20},
+	0xef6017: {"Winbond", "W25Q64FW", 8 << 20},
+	0xef6018: {"Winbond", "W25Q128FW", 16 << 20},
+	0xef6019: {"Winbond", "W25Q256FW", 32 << 20},
+}
+
+// LookupFlashChip returns the description of the part with the given JEDEC
+// ID, and whether it is known. Parts of known vendors that are not in
+// KnownFlashChips are described by vendor only, with a zero size.
+func LookupFlashChip(jedecID uint32) (FlashChip, bool) {
+	if chip, ok := KnownFlashChips[jedecID]; ok {
+		return chip, true
+	}
+	if vendor, ok := JEDECVendors[uint8(jedecID>>16)]; ok {
+		return FlashChip{Vendor: vendor, Name: fmt.Sprintf("unknown part 0x%04x", jedecID&0xffff)}, false
+	}
+	return FlashChip{}, false
+}
+
+// Chip returns the description of the part of the entry, see LookupFlashChip
+func (e VSCCEntry) Chip() (FlashChip, bool) {
+	return LookupFlashChip(e.JEDECID())
+}
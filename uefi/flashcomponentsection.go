@@ -0,0 +1,163 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// FlashComponentSectionSize is the size of the component section: the
+	// FLCOMP, FLILL and FLPB registers
+	FlashComponentSectionSize = 12
+	// FlashComponentsMax is the maximum number of flash components
+	FlashComponentsMax = 2
+	// flashDensityNotPresent is the density of a missing component in
+	// descriptors of version 2
+	flashDensityNotPresent = 0xf
+)
+
+// FlashDensitySizes maps the density encodings of the component section to
+// the size of the components in bytes. The 32MB and 64MB encodings are only
+// used by the newer chipsets.
+var FlashDensitySizes = map[uint8]uint64{
+	0: 512 * 1024,
+	1: 1024 * 1024,
+	2: 2 * 1024 * 1024,
+	3: 4 * 1024 * 1024,
+	4: 8 * 1024 * 1024,
+	5: 16 * 1024 * 1024,
+	6: 32 * 1024 * 1024,
+	7: 64 * 1024 * 1024,
+}
+
+// FlashComponentSection is the component section of the descriptor, which
+// describes the SPI flash parts
+type FlashComponentSection struct {
+	// Params holds the FLCOMP register, with the densities and frequencies
+	Params FlashParams
+	// InvalidInstructions are the opcodes the controller refuses to send
+	InvalidInstructions [4]uint8
+	// PartitionBoundary is FLPB on version 1, and FLILL1 on version 2
+	PartitionBoundary uint32
+	// NumberOfComponents comes from the descriptor map
+	NumberOfComponents int
+	Version            DescriptorVersion
+}
+
+// DensityCode returns the raw density encoding of component i: 3 bits per
+// component on version 1, and 4 bits on version 2
+func (c FlashComponentSection) DensityCode(i int) uint8 {
+	if c.Version == DescriptorV2 {
+		return (c.Params.Densities >> (4 * uint(i))) & 0x0f
+	}
+	return (c.Params.Densities >> (3 * uint(i))) & 0x07
+}
+
+// Density returns the size in bytes of component i
+func (c FlashComponentSection) Density(i int) (uint64, error) {
+	if i < 0 || i >= c.NumberOfComponents || i >= FlashComponentsMax {
+		return 0, fmt.Errorf("Component %d not present: the descriptor has %d", i, c.NumberOfComponents)
+	}
+	code := c.DensityCode(i)
+	if c.Version == DescriptorV2 && code == flashDensityNotPresent {
+		return 0, fmt.Errorf("Component %d not present", i)
+	}
+	size, ok := FlashDensitySizes[code]
+	if !ok {
+		return 0, fmt.Errorf("Unknown density 0x%x for component %d", code, i)
+	}
+	return size, nil
+}
+
+// Densities returns the sizes in bytes of the components that are present
+func (c FlashComponentSection) Densities() []uint64 {
+	var sizes []uint64
+	for i := 0; i < c.NumberOfComponents && i < FlashComponentsMax; i++ {
+		if size, err := c.Density(i); err == nil {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes
+}
+
+// TotalSize returns the sum of the sizes of the components
+func (c FlashComponentSection) TotalSize() uint64 {
+	var total uint64
+	for _, size := range c.Densities() {
+		total += size
+	}
+	return total
+}
+
+// MarshalBinary serializes the component section
+func (c FlashComponentSection) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, FlashComponentSectionSize)
+	params, err := c.Params.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	copy(buf, params)
+	copy(buf[4:], c.InvalidInstructions[:])
+	binary.LittleEndian.PutUint32(buf[8:], c.PartitionBoundary)
+	return buf, nil
+}
+
+func (c FlashComponentSection) String() string {
+	return fmt.Sprintf("FlashComponentSection{Densities=%v}", c.Densities())
+}
+
+// Summary prints a multi-line description of the component section
+func (c FlashComponentSection) Summary() string {
+	return fmt.Sprintf("FlashComponentSection{\n"+
+		"    NumberOfComponents=%v\n"+
+		"    Densities=%v\n"+
+		"    InvalidInstructions=% x\n"+
+		"    PartitionBoundary=0x%08x\n"+
+		"    Params=%v\n"+
+		"}",
+		c.NumberOfComponents,
+		c.Densities(),
+		c.InvalidInstructions,
+		c.PartitionBoundary,
+		Indent(c.Params.Summary(), 4),
+	)
+}
+
+// Validate checks that the densities of the components can be decoded, and
+// the flash parameters
+func (c FlashComponentSection) Validate() []error {
+	errors := c.Params.Validate()
+	for i := 0; i < c.NumberOfComponents && i < FlashComponentsMax; i++ {
+		code := c.DensityCode(i)
+		if c.Version == DescriptorV2 && code == flashDensityNotPresent {
+			continue
+		}
+		if _, ok := FlashDensitySizes[code]; !ok {
+			errors = append(errors, fmt.Errorf("Unknown density 0x%x for component %d", code, i))
+		}
+	}
+	return errors
+}
+
+// NewFlashComponentSection initializes a FlashComponentSection from a slice
+// of bytes, for the given number of components and descriptor version
+func NewFlashComponentSection(buf []byte, components int, version DescriptorVersion) (*FlashComponentSection, error) {
+	if len(buf) < FlashComponentSectionSize {
+		return nil, fmt.Errorf("Flash Component Section size too small: expected %v bytes, got %v",
+			FlashComponentSectionSize,
+			len(buf),
+		)
+	}
+	params, err := NewFlashParams(buf)
+	if err != nil {
+		return nil, err
+	}
+	c := FlashComponentSection{
+		Params:             *params,
+		PartitionBoundary:  binary.LittleEndian.Uint32(buf[8:]),
+		NumberOfComponents: components,
+		Version:            version,
+	}
+	copy(c.InvalidInstructions[:], buf[4:8])
+	return &c, nil
+}
@@ -14,6 +14,31 @@ const (
 	FlashDescriptorMapMaxBase = 0xe0
 )
 
+// DescriptorVersion is the version of the flash descriptor format, which
+// defines the layout of some of its sections
+type DescriptorVersion int
+
+// Descriptor versions: version 1 is used up to the 100 series PCHs
+// (Skylake), version 2 by the later ones.
+const (
+	DescriptorV1 DescriptorVersion = 1
+	DescriptorV2 DescriptorVersion = 2
+)
+
+// descriptorVersion detects the version of the descriptor from the read
+// clock frequency of the component section, like ifdtool does: only
+// descriptors of version 2 use 17MHz
+func descriptorVersion(buf []byte, d FlashDescriptorMap) DescriptorVersion {
+	start := int(d.ComponentBase) * 0x10
+	if start > len(buf) {
+		return DescriptorV1
+	}
+	if p, err := NewFlashParams(buf[start:]); err == nil && p.ReadClockFrequency == Freq17MHz {
+		return DescriptorV2
+	}
+	return DescriptorV1
+}
+
 // FlashDescriptorMap represent an Intel flash descriptor. This object provides
 // accessors to the various descriptor fields.
 type FlashDescriptorMap struct {
@@ -55,6 +80,15 @@ func NewFlashDescriptorMap(buf []byte) (*FlashDescriptorMap, error) {
 	return &descriptor, nil
 }
 
+// MarshalBinary serializes the FlashDescriptorMap fields
+func (d FlashDescriptorMap) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, d); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (d FlashDescriptorMap) String() string {
 	return fmt.Sprintf("FlashDescriptorMap{NumberOfRegions=%v, NumberOfFlashChips=%v, NumberOfMasters=%v, NumberOfPCHStraps=%v, NumberOfProcessorStraps=%v, NumberOfICCTableEntries=%v, DMITableEntries=%v}",
 		d.NumberOfRegions,
@@ -0,0 +1,192 @@
+package uefi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ReplaceRegion replaces the contents of the region with the given name
+// (BIOS, ME, GbE or PDR, case insensitive) with data. data must not be larger
+// than the region as defined by the base and limit in the descriptor, and it
+// is padded with 0xff, the erased flash value, up to the region size. The
+// image, including any pending edit to the other regions, is serialized and
+// parsed again, so every field reflects the new region.
+func (f *FlashImage) ReplaceRegion(name string, data []byte) error {
+	if strings.EqualFold(name, "Descriptor") {
+		return fmt.Errorf("Cannot replace the descriptor region, edit its fields instead")
+	}
+	n := f.regionNode(name)
+	if n == nil {
+		return fmt.Errorf("Cannot replace region %s: region not found", name)
+	}
+	if n.Offset+n.Size > uint64(len(f.buf)) {
+		return fmt.Errorf("Cannot replace region %s: region 0x%x-0x%x out of the image boundaries (size 0x%x)",
+			n.Name, n.Offset, n.Offset+n.Size, len(f.buf),
+		)
+	}
+	if uint64(len(data)) > n.Size {
+		return fmt.Errorf("Region %s too small: %v bytes available, got %v", n.Name, n.Size, len(data))
+	}
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	region := buf[n.Offset : n.Offset+n.Size]
+	copy(region, data)
+	fill(region[len(data):], 0xff)
+	debugf("Replacing region %s at 0x%x with %v bytes", n.Name, n.Offset, len(data))
+	image, err := NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	*f = *image
+	return nil
+}
+
+// RegionData returns the contents of the region with the given name
+// (Descriptor, BIOS, ME, GbE or PDR, case insensitive) as parsed, using the
+// base and limit from the descriptor. The method is not called Region
+// because that is the name of the region section field.
+func (f FlashImage) RegionData(name string) ([]byte, error) {
+	n := f.regionNode(name)
+	if n == nil {
+		return nil, fmt.Errorf("Region %s not found", name)
+	}
+	if n.Offset+n.Size > uint64(len(f.buf)) {
+		return nil, fmt.Errorf("Region %s 0x%x-0x%x out of the image boundaries (size 0x%x)",
+			n.Name, n.Offset, n.Offset+n.Size, len(f.buf),
+		)
+	}
+	return f.buf[n.Offset : n.Offset+n.Size], nil
+}
+
+// ExtractRegions writes each region present in the image to dir, in a file
+// named after the region in lower case, e.g. bios.bin and me.bin, like
+// ifdtool does.
+func (f FlashImage) ExtractRegions(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, n := range f.Tree().Children {
+		if n.Type != "Region" {
+			continue
+		}
+		data, err := f.RegionData(n.Name)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, strings.ToLower(n.Name)+".bin")
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pathIndex parses an index of a path in the format described for Patch
+func pathIndex(p, s string, n int) (int, error) {
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 || i >= n {
+		return 0, fmt.Errorf("Path %q: invalid index %q", p, s)
+	}
+	return i, nil
+}
+
+// resolveFile returns the indexes of the volume and of the file identified
+// by the first two elements of a path in the format described for Patch
+func (f FlashImage) resolveFile(p string, parts []string) (int, int, error) {
+	if f.BiosRegion == nil {
+		return 0, 0, fmt.Errorf("Path %q: BIOS region not parsed", p)
+	}
+	i, err := pathIndex(p, parts[0], len(f.BiosRegion.FirmwareVolumes))
+	if err != nil {
+		return 0, 0, err
+	}
+	fv := f.BiosRegion.FirmwareVolumes[i]
+	idx := fv.findFile(parts[1])
+	if idx == -1 {
+		if idx, err = pathIndex(p, parts[1], len(fv.Files)); err != nil {
+			return 0, 0, err
+		}
+	}
+	return i, idx, nil
+}
+
+// resolveSection returns the section at the given path in the BIOS region,
+// in the format described for Patch
+func (f FlashImage) resolveSection(p string) (*Section, error) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) < 3 {
+		return nil, fmt.Errorf("Invalid section path %q: expected volume/file/section[/section...]", p)
+	}
+	i, idx, err := f.resolveFile(p, parts)
+	if err != nil {
+		return nil, err
+	}
+	sections := f.BiosRegion.FirmwareVolumes[i].Files[idx].Sections
+	var s *Section
+	for _, part := range parts[2:] {
+		i, err := pathIndex(p, part, len(sections))
+		if err != nil {
+			return nil, err
+		}
+		s = sections[i]
+		sections = s.Sections
+	}
+	return s, nil
+}
+
+// Patch overwrites the contents of a section at the given offset, from the
+// start of its data, with patch. The section is identified by the index of
+// its firmware volume in the BIOS region, the GUID or the index of its file
+// and the indexes of the sections leading to it, separated by slashes, e.g.
+// "1/5a5e7c1f-0001-4e3a-9f6b-0a1b2c3d4e01/0/0". It must not contain other
+// sections. The image is then serialized and parsed again, which
+// recompresses the enclosing compressed sections, updates the sizes of the
+// sections, files and volumes containing the patched section, and
+// recomputes their checksums. The FIT is updated if the files it points to
+// moved, see BiosRegion.UpdateFIT. The image is left unchanged on error.
+func (f *FlashImage) Patch(path string, offset uint64, patch []byte) error {
+	s, err := f.resolveSection(path)
+	if err != nil {
+		return err
+	}
+	data := s.Data()
+	if offset > uint64(len(data)) || uint64(len(patch)) > uint64(len(data))-offset {
+		return fmt.Errorf("Patch at 0x%x of %v bytes out of the section data (%v bytes)", offset, len(patch), len(data))
+	}
+	orig := *f
+	old := f.BiosRegion.clone()
+	// the sections are shared with the clone, so the data is put back too
+	restore := func(err error) error {
+		// the size is unchanged, so this cannot fail
+		s.SetData(data)
+		*f = orig
+		f.BiosRegion = old
+		return err
+	}
+	// the table moves with its file until it is updated
+	f.BiosRegion.FIT = nil
+	patched := append([]byte{}, data...)
+	copy(patched[offset:], patch)
+	if err := s.SetData(patched); err != nil {
+		return restore(err)
+	}
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		return restore(err)
+	}
+	image, err := NewFlashImage(buf)
+	if err != nil {
+		return restore(err)
+	}
+	*f = *image
+	if err := f.updateFIT(old); err != nil {
+		return restore(err)
+	}
+	return nil
+}
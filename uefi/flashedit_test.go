@@ -0,0 +1,31 @@
+package uefi
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	const path = "1/5a5e7c1f-0001-4e3a-9f6b-0a1b2c3d4e01/0"
+	f := syntheticFlashImage(t)
+	if err := f.Patch(path, 2, []byte{0xde, 0xad}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := roundTrip(t, f).resolveSection(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Data()[2:4]; !bytes.Equal(got, []byte{0xde, 0xad}) {
+		t.Errorf("got % x at offset 2, want de ad", got)
+	}
+}
+
+func TestPatchOutOfBounds(t *testing.T) {
+	const path = "1/5a5e7c1f-0001-4e3a-9f6b-0a1b2c3d4e01/0"
+	for _, offset := range []uint64{0x1000, ^uint64(0)} {
+		f := syntheticFlashImage(t)
+		if err := f.Patch(path, offset, []byte{0xde, 0xad}); err == nil {
+			t.Errorf("offset 0x%x: expected an error", offset)
+		}
+	}
+}
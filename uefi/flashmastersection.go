@@ -4,13 +4,98 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"strings"
 )
 
 // FlashMasterSectionSize is the size in bytes of the FlashMaster section
 const FlashMasterSectionSize = 12
 
+// FlashMastersMax is the maximum number of masters in the master section of
+// recent descriptors
+const FlashMastersMax = 5
+
+// FlashMasterType is the index of a master in the master section
+type FlashMasterType int
+
+// Flash master types. The reserved and EC masters are only defined on
+// recent descriptors.
+const (
+	MasterTypeBIOS FlashMasterType = iota
+	MasterTypeME
+	MasterTypeGbE
+	MasterTypeReserved
+	MasterTypeEC
+)
+
+var flashMasterTypeNames = [FlashMastersMax]string{"BIOS", "ME", "GbE", "Reserved", "EC"}
+
+func (t FlashMasterType) String() string {
+	if t >= 0 && t < FlashMastersMax {
+		return flashMasterTypeNames[t]
+	}
+	return fmt.Sprintf("Master%d", int(t))
+}
+
+// FlashMaster is a decoded entry of the master section
+type FlashMaster struct {
+	Type FlashMasterType
+	// RequesterID is only defined on version 1 descriptors
+	RequesterID uint16
+	// Read and Write have bit i set if the master can access the region of
+	// type i
+	Read, Write uint16
+}
+
+// CanRead returns whether the master can read the region of the given type
+func (m FlashMaster) CanRead(t FlashRegionType) bool {
+	return t >= 0 && t < 16 && m.Read&(1<<uint(t)) != 0
+}
+
+// CanWrite returns whether the master can write the region of the given type
+func (m FlashMaster) CanWrite(t FlashRegionType) bool {
+	return t >= 0 && t < 16 && m.Write&(1<<uint(t)) != 0
+}
+
+// regionNames returns the names of the regions set in an access bitmap
+func regionNames(access uint16) string {
+	var names []string
+	for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+		if access&(1<<uint(t)) != 0 {
+			names = append(names, t.String())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (m FlashMaster) String() string {
+	return fmt.Sprintf("FlashMaster{Type=%v, Read=[%s], Write=[%s]}", m.Type, regionNames(m.Read), regionNames(m.Write))
+}
+
+// FlashAccess is the access of a master to a region
+type FlashAccess struct {
+	Master      FlashMasterType
+	Region      FlashRegionType
+	Read, Write bool
+}
+
+func (a FlashAccess) String() string {
+	mode := ""
+	if a.Read {
+		mode += "r"
+	}
+	if a.Write {
+		mode += "w"
+	}
+	if mode == "" {
+		mode = "-"
+	}
+	return fmt.Sprintf("%v: %v %s", a.Master, a.Region, mode)
+}
+
 // FlashMasterSection holds all the IDs and read/write permissions for other regions
 // This controls whether the bios region can read/write to the ME for example.
+// The fields describe the first three masters with the layout of version 1
+// descriptors; use Masters to decode them according to the version.
 type FlashMasterSection struct {
 	BiosID    uint16
 	BiosRead  uint8
@@ -21,6 +106,54 @@ type FlashMasterSection struct {
 	GbeID     uint16
 	GbeRead   uint8
 	GbeWrite  uint8
+	// Extended holds the raw entries following the GbE master, e.g. the EC
+	// master on recent descriptors
+	Extended []uint32
+	// Version is the version of the descriptor
+	Version DescriptorVersion
+}
+
+// entries returns the raw entries of the master section
+func (m FlashMasterSection) entries() []uint32 {
+	entry := func(id uint16, read, write uint8) uint32 {
+		return uint32(id) | uint32(read)<<16 | uint32(write)<<24
+	}
+	return append([]uint32{
+		entry(m.BiosID, m.BiosRead, m.BiosWrite),
+		entry(m.MeID, m.MeRead, m.MeWrite),
+		entry(m.GbeID, m.GbeRead, m.GbeWrite),
+	}, m.Extended...)
+}
+
+// Masters decodes the entries of the master section according to the
+// descriptor version. Version 1 entries have 8-bit read and write access
+// fields, version 2 entries have 12-bit ones and up to five masters.
+func (m FlashMasterSection) Masters() []FlashMaster {
+	var masters []FlashMaster
+	for i, e := range m.entries() {
+		t := FlashMasterType(i)
+		if m.Version == DescriptorV2 {
+			if i >= FlashMastersMax {
+				break
+			}
+			masters = append(masters, FlashMaster{
+				Type:  t,
+				Read:  uint16(e>>8) & 0xfff,
+				Write: uint16(e>>20) & 0xfff,
+			})
+			continue
+		}
+		if t > MasterTypeGbE {
+			break
+		}
+		masters = append(masters, FlashMaster{
+			Type:        t,
+			RequesterID: uint16(e),
+			Read:        uint16(e>>16) & 0xff,
+			Write:       uint16(e >> 24),
+		})
+	}
+	return masters
 }
 
 func (m FlashMasterSection) String() string {
@@ -30,6 +163,10 @@ func (m FlashMasterSection) String() string {
 
 // Summary prints a multi-line description of the FlashMasterSection
 func (m FlashMasterSection) Summary() string {
+	var masters []string
+	for _, master := range m.Masters() {
+		masters = append(masters, master.String())
+	}
 	return fmt.Sprintf("FlashMasterSection{\n"+
 		"    BiosID=%v\n"+
 		"    BiosRead=%v\n"+
@@ -40,15 +177,212 @@ func (m FlashMasterSection) Summary() string {
 		"    GbeID=%v\n"+
 		"    GbeRead=%v\n"+
 		"    GbeWrite=%v\n"+
+		"    Version=%v\n"+
+		"    Masters=[\n"+
+		"        %v\n"+
+		"    ]\n"+
 		"}",
 		m.BiosID, m.BiosRead, m.BiosWrite,
 		m.MeID, m.MeRead, m.MeWrite,
 		m.GbeID, m.GbeRead, m.GbeWrite,
+		m.Version,
+		Indent(strings.Join(masters, "\n"), 8),
 	)
 }
 
+// Master returns the decoded entry of the master of the given type, and
+// whether the section has it
+func (m FlashMasterSection) Master(t FlashMasterType) (FlashMaster, bool) {
+	for _, master := range m.Masters() {
+		if master.Type == t {
+			return master, true
+		}
+	}
+	return FlashMaster{}, false
+}
+
+// LockedAccess are the permissions set by Lock, those of shipping images:
+// every master can access its own region only, the host and the ME can also
+// read the descriptor, and share the GbE region with the GbE master. Users
+// can change them to match their platform.
+var LockedAccess = map[FlashMasterType]FlashMaster{
+	MasterTypeBIOS: {
+		Read:  regionBits(RegionTypeDescriptor, RegionTypeBIOS, RegionTypeGbE),
+		Write: regionBits(RegionTypeBIOS, RegionTypeGbE),
+	},
+	MasterTypeME: {
+		Read:  regionBits(RegionTypeDescriptor, RegionTypeME, RegionTypeGbE),
+		Write: regionBits(RegionTypeME, RegionTypeGbE),
+	},
+	MasterTypeGbE: {Read: regionBits(RegionTypeGbE), Write: regionBits(RegionTypeGbE)},
+	MasterTypeEC:  {Read: regionBits(RegionTypeEC), Write: regionBits(RegionTypeEC)},
+}
+
+// regionBits returns the access bitmap of the given regions
+func regionBits(types ...FlashRegionType) uint16 {
+	var bits uint16
+	for _, t := range types {
+		bits |= 1 << uint(t)
+	}
+	return bits
+}
+
+// accessMask returns the regions the access fields can describe in this
+// descriptor version
+func (m FlashMasterSection) accessMask() uint16 {
+	if m.Version == DescriptorV2 {
+		return 0xfff
+	}
+	return 0xff
+}
+
+// setEntry replaces the raw entry of master i
+func (m *FlashMasterSection) setEntry(i int, e uint32) {
+	id, read, write := uint16(e), uint8(e>>16), uint8(e>>24)
+	switch FlashMasterType(i) {
+	case MasterTypeBIOS:
+		m.BiosID, m.BiosRead, m.BiosWrite = id, read, write
+	case MasterTypeME:
+		m.MeID, m.MeRead, m.MeWrite = id, read, write
+	case MasterTypeGbE:
+		m.GbeID, m.GbeRead, m.GbeWrite = id, read, write
+	default:
+		m.Extended[i-int(MasterTypeGbE)-1] = e
+	}
+}
+
+// SetMaster encodes a master into its entry according to the descriptor
+// version. The requester ID is only stored on version 1 descriptors, the
+// reserved bits of version 2 entries are kept.
+func (m *FlashMasterSection) SetMaster(master FlashMaster) error {
+	if _, ok := m.Master(master.Type); !ok {
+		return fmt.Errorf("Master %v not present in the descriptor", master.Type)
+	}
+	mask := m.accessMask()
+	if master.Read&^mask != 0 || master.Write&^mask != 0 {
+		return fmt.Errorf("Master %v: regions [%s] cannot be assigned to masters in this descriptor version",
+			master.Type, regionNames((master.Read|master.Write)&^mask))
+	}
+	i := int(master.Type)
+	e := m.entries()[i]
+	if m.Version == DescriptorV2 {
+		e = e&0xff | uint32(master.Read)<<8 | uint32(master.Write)<<20
+	} else {
+		e = uint32(master.RequesterID) | uint32(master.Read)<<16 | uint32(master.Write)<<24
+	}
+	m.setEntry(i, e)
+	return nil
+}
+
+// SetAccess grants or revokes the read and write access of a master to a
+// region, e.g. to let the host rewrite the ME region while flashing
+func (m *FlashMasterSection) SetAccess(t FlashMasterType, r FlashRegionType, read, write bool) error {
+	master, ok := m.Master(t)
+	if !ok {
+		return fmt.Errorf("Master %v not present in the descriptor", t)
+	}
+	if r < 0 || r >= 16 || m.accessMask()&(1<<uint(r)) == 0 {
+		return fmt.Errorf("Region %v cannot be assigned to masters in this descriptor version", r)
+	}
+	bit := uint16(1) << uint(r)
+	master.Read &^= bit
+	master.Write &^= bit
+	if read {
+		master.Read |= bit
+	}
+	if write {
+		master.Write |= bit
+	}
+	return m.SetMaster(master)
+}
+
+// Unlock grants every master read and write access to every region, as
+// needed to reflash the whole chip from the host
+func (m *FlashMasterSection) Unlock() error {
+	for _, master := range m.Masters() {
+		master.Read, master.Write = m.accessMask(), m.accessMask()
+		if err := m.SetMaster(master); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lock sets the permissions of every master to the ones in LockedAccess.
+// Masters that are not listed lose every access.
+func (m *FlashMasterSection) Lock() error {
+	for _, master := range m.Masters() {
+		locked := LockedAccess[master.Type]
+		mask := m.accessMask()
+		master.Read, master.Write = locked.Read&mask, locked.Write&mask
+		if err := m.SetMaster(master); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AccessMatrix returns the access of every master to every region in use,
+// as described by the region and master sections of the image
+func (f FlashImage) AccessMatrix() []FlashAccess {
+	var matrix []FlashAccess
+	for _, master := range f.Master.Masters() {
+		for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+			r := f.Region.Region(t)
+			if t != RegionTypeDescriptor && !r.Valid() {
+				continue
+			}
+			matrix = append(matrix, FlashAccess{
+				Master: master.Type,
+				Region: t,
+				Read:   master.CanRead(t),
+				Write:  master.CanWrite(t),
+			})
+		}
+	}
+	return matrix
+}
+
+// Validate runs a set of checks on the master section and returns a list of
+// errors specifying what is wrong.
+func (m FlashMasterSection) Validate() []error {
+	errors := make([]error, 0)
+	bios, ok := m.Master(MasterTypeBIOS)
+	if !ok {
+		return append(errors, fmt.Errorf("No BIOS master"))
+	}
+	// the host could not boot
+	if !bios.CanRead(RegionTypeBIOS) {
+		errors = append(errors, fmt.Errorf("The BIOS master cannot read the BIOS region"))
+	}
+	if m.Version == DescriptorV1 {
+		ids := make(map[uint16]FlashMasterType)
+		for _, master := range m.Masters() {
+			if master.RequesterID == 0 {
+				continue
+			}
+			if other, ok := ids[master.RequesterID]; ok {
+				errors = append(errors, fmt.Errorf("Masters %v and %v have the same requester ID 0x%04x", other, master.Type, master.RequesterID))
+			}
+			ids[master.RequesterID] = master.Type
+		}
+	}
+	return errors
+}
+
+// MarshalBinary serializes the FlashMasterSection
+func (m FlashMasterSection) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, m.entries()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // NewFlashMasterSection parses a sequence of bytes and returns a FlashMasterSection
-// object, if a valid one is passed, or an error
+// object, if a valid one is passed, or an error. The entries following the
+// GbE master, up to FlashMastersMax, are read into Extended, as many as buf
+// holds. The version is set to DescriptorV1, the caller sets the actual one.
 func NewFlashMasterSection(buf []byte) (*FlashMasterSection, error) {
 	if len(buf) < FlashMasterSectionSize {
 		return nil, fmt.Errorf("Flash Master Section size too small: expected %v bytes, got %v",
@@ -56,10 +390,28 @@ func NewFlashMasterSection(buf []byte) (*FlashMasterSection, error) {
 			len(buf),
 		)
 	}
-	var master FlashMasterSection
+	var (
+		master  FlashMasterSection
+		entries [3]struct {
+			ID          uint16
+			Read, Write uint8
+		}
+	)
 	reader := bytes.NewReader(buf)
-	if err := binary.Read(reader, binary.LittleEndian, &master); err != nil {
+	if err := binary.Read(reader, binary.LittleEndian, &entries); err != nil {
+		return nil, err
+	}
+	master.BiosID, master.BiosRead, master.BiosWrite = entries[0].ID, entries[0].Read, entries[0].Write
+	master.MeID, master.MeRead, master.MeWrite = entries[1].ID, entries[1].Read, entries[1].Write
+	master.GbeID, master.GbeRead, master.GbeWrite = entries[2].ID, entries[2].Read, entries[2].Write
+	extended := len(buf)/4 - len(entries)
+	if extended > FlashMastersMax-len(entries) {
+		extended = FlashMastersMax - len(entries)
+	}
+	master.Extended = make([]uint32, extended)
+	if err := binary.Read(reader, binary.LittleEndian, master.Extended); err != nil {
 		return nil, err
 	}
+	master.Version = DescriptorV1
 	return &master, nil
 }
@@ -0,0 +1,112 @@
+package uefi
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// FlashOEMSectionOffset is the position of the OEM section from the
+	// start of the descriptor region
+	FlashOEMSectionOffset = 0xf00
+	// FlashOEMSectionSize is the size of the OEM section
+	FlashOEMSectionSize = 0x100
+)
+
+// FlashOEMSection is the section at the end of the descriptor region that
+// is reserved to the OEM. Its layout is vendor specific, and it is decoded by
+// the decoders registered with RegisterOEMDecoder.
+type FlashOEMSection [FlashOEMSectionSize]byte
+
+// OEMDecoder decodes the OEM section of a vendor. It returns the decoded
+// fields, e.g. serial numbers or platform IDs, and false if the section does
+// not have the layout of the vendor.
+type OEMDecoder func(s FlashOEMSection) (map[string]string, bool)
+
+type namedOEMDecoder struct {
+	name   string
+	decode OEMDecoder
+}
+
+var oemDecoders []namedOEMDecoder
+
+// RegisterOEMDecoder registers a decoder for the OEM section. The decoders
+// are tried in registration order by FlashOEMSection.Decode. Registering a
+// decoder with the name of an existing one replaces it.
+func RegisterOEMDecoder(name string, d OEMDecoder) {
+	for i, od := range oemDecoders {
+		if od.name == name {
+			oemDecoders[i].decode = d
+			return
+		}
+	}
+	oemDecoders = append(oemDecoders, namedOEMDecoder{name, d})
+}
+
+// OEMInfo holds the fields decoded from the OEM section or from the Platform
+// Data region by a decoder
+type OEMInfo struct {
+	Decoder string
+	Fields  map[string]string
+}
+
+func (i OEMInfo) String() string {
+	keys := make([]string, 0, len(i.Fields))
+	for k := range i.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%q", k, i.Fields[k]))
+	}
+	return fmt.Sprintf("%s{%s}", i.Decoder, strings.Join(fields, ", "))
+}
+
+// NewFlashOEMSection copies the OEM section from the start of buf
+func NewFlashOEMSection(buf []byte) (*FlashOEMSection, error) {
+	if len(buf) < FlashOEMSectionSize {
+		return nil, fmt.Errorf("OEM section size too small: expected %v bytes, got %v", FlashOEMSectionSize, len(buf))
+	}
+	var s FlashOEMSection
+	copy(s[:], buf)
+	return &s, nil
+}
+
+// MarshalBinary serializes the OEM section
+func (s FlashOEMSection) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, s[:]...), nil
+}
+
+// IsErased returns true if the section is unused
+func (s FlashOEMSection) IsErased() bool {
+	return bytes.Count(s[:], []byte{0xff}) == len(s) || bytes.Count(s[:], []byte{0}) == len(s)
+}
+
+// Decode runs the registered decoders on the section, and returns the
+// results of the ones that recognized it
+func (s FlashOEMSection) Decode() []OEMInfo {
+	var infos []OEMInfo
+	for _, d := range oemDecoders {
+		if fields, ok := d.decode(s); ok {
+			infos = append(infos, OEMInfo{Decoder: d.name, Fields: fields})
+		}
+	}
+	return infos
+}
+
+func (s FlashOEMSection) String() string {
+	if s.IsErased() {
+		return "FlashOEMSection{erased}"
+	}
+	var infos []string
+	for _, i := range s.Decode() {
+		infos = append(infos, i.String())
+	}
+	if len(infos) == 0 {
+		return "FlashOEMSection{unknown}"
+	}
+	return fmt.Sprintf("FlashOEMSection{%s}", strings.Join(infos, ", "))
+}
@@ -1,6 +1,7 @@
 package uefi
 
 import (
+	"encoding/binary"
 	"fmt"
 )
 
@@ -30,98 +31,114 @@ var FlashFrequencyStringMap = map[FlashFrequency]string{
 	Freq17MHz:      "17MHz",
 }
 
-// FlashParams is a 4-byte object that holds the flash parameters information.
-type FlashParams []byte
-
-// FirstChipDensity returns the size of the first chip.
-func (p FlashParams) FirstChipDensity() uint {
-	return uint(p[0] & 0x0f)
-}
-
-// SecondChipDensity returns the size of the second chip.
-func (p FlashParams) SecondChipDensity() uint {
-	return uint((p[0] >> 4) & 0x0f)
-}
-
-// ReadClockFrequency returns the chip frequency while reading from the flash.
-func (p FlashParams) ReadClockFrequency() FlashFrequency {
-	return FlashFrequency((p[2] >> 1) & 0x07)
-}
-
-// FastReadEnabled returns if FastRead is enabled.
-func (p FlashParams) FastReadEnabled() uint {
-	return uint((p[2] >> 4) & 0x01)
-}
-
-// FastReadFrequency returns the frequency under FastRead.
-func (p FlashParams) FastReadFrequency() FlashFrequency {
-	return FlashFrequency((p[2] >> 5) & 0x07)
-}
-
-// FlashWriteFrequency returns the chip frequency for writing.
-func (p FlashParams) FlashWriteFrequency() FlashFrequency {
-	return FlashFrequency(p[3] & 0x07)
+func (f FlashFrequency) String() string {
+	if s, ok := FlashFrequencyStringMap[f]; ok {
+		return s
+	}
+	return fmt.Sprintf("Unknown (%d)", uint(f))
 }
 
-// FlashReadStatusFrequency returns the chip frequency while reading the flash status.
-func (p FlashParams) FlashReadStatusFrequency() FlashFrequency {
-	return FlashFrequency((p[3] >> 3) & 0x07)
+// FlashParams holds the flash parameters of the FLCOMP register of the
+// component section. The densities of the components depend on the
+// descriptor version, and are decoded by FlashComponentSection.
+type FlashParams struct {
+	// Densities holds the density encodings of the components, bits 7:0
+	Densities                   uint8
+	ReadClockFrequency          FlashFrequency
+	FastReadEnabled             bool
+	FastReadFrequency           FlashFrequency
+	FlashWriteFrequency         FlashFrequency
+	FlashReadStatusFrequency    FlashFrequency
+	DualOutputFastReadSupported bool
+	// Reserved holds the bits that are not decoded, so that they are
+	// serialized back as they were
+	Reserved uint32
 }
 
-// DualOutputFastReadSupported returns if Dual Output Fast Read is supported.
-func (p FlashParams) DualOutputFastReadSupported() uint {
-	return uint(p[3] >> 7)
-}
+// flashParamsReservedMask is the mask of the bits of FLCOMP that are not
+// decoded into FlashParams fields
+const flashParamsReservedMask = 0x8001ff00
 
 func (p FlashParams) String() string {
-	return fmt.Sprintf("FlashParams{...}")
+	return fmt.Sprintf("FlashParams{ReadClockFrequency=%v, FastReadEnabled=%v, FastReadFrequency=%v}",
+		p.ReadClockFrequency, p.FastReadEnabled, p.FastReadFrequency)
 }
 
 // Summary prints a multi-line description of the FlashParams
 func (p FlashParams) Summary() string {
-	rcf, ok := FlashFrequencyStringMap[p.ReadClockFrequency()]
-	if !ok {
-		rcf = fmt.Sprintf("Unknown (%v)", p.ReadClockFrequency())
-	}
-	frf, ok := FlashFrequencyStringMap[p.FastReadFrequency()]
-	if !ok {
-		frf = fmt.Sprintf("Unknown (%v)", p.FastReadFrequency())
-	}
-	fwf, ok := FlashFrequencyStringMap[p.FlashWriteFrequency()]
-	if !ok {
-		fwf = fmt.Sprintf("Unknown (%v)", p.FlashWriteFrequency())
-	}
-	frsf, ok := FlashFrequencyStringMap[p.FlashReadStatusFrequency()]
-	if !ok {
-		frsf = fmt.Sprintf("Unknown (%v)", p.FlashReadStatusFrequency())
-	}
 	return fmt.Sprintf("FlashParams{\n"+
-		"    FirstChipDensity=%v\n"+
-		"    SecondChipDensity=%v\n"+
 		"    ReadClockFrequency=%v\n"+
 		"    FastReadEnabled=%v\n"+
 		"    FastReadFrequency=%v\n"+
 		"    FlashWriteFrequency=%v\n"+
 		"    FlashReadStatusFrequency=%v\n"+
+		"    DualOutputFastReadSupported=%v\n"+
 		"}",
-		p.FirstChipDensity(),
-		p.SecondChipDensity(),
-		rcf,
-		p.FastReadEnabled(),
-		frf,
-		fwf,
-		frsf,
+		p.ReadClockFrequency,
+		p.FastReadEnabled,
+		p.FastReadFrequency,
+		p.FlashWriteFrequency,
+		p.FlashReadStatusFrequency,
+		p.DualOutputFastReadSupported,
 	)
 }
 
+// Validate checks that the frequencies are known ones
+func (p FlashParams) Validate() []error {
+	errors := make([]error, 0)
+	freqs := []struct {
+		name string
+		f    FlashFrequency
+	}{
+		{"read clock", p.ReadClockFrequency},
+		{"fast read", p.FastReadFrequency},
+		{"write and erase", p.FlashWriteFrequency},
+		{"read status", p.FlashReadStatusFrequency},
+	}
+	for _, f := range freqs {
+		if _, ok := FlashFrequencyStringMap[f.f]; !ok {
+			errors = append(errors, fmt.Errorf("Unknown %s frequency %d", f.name, uint(f.f)))
+		}
+	}
+	return errors
+}
+
+// MarshalBinary serializes the FlashParams
+func (p FlashParams) MarshalBinary() ([]byte, error) {
+	v := uint32(p.Densities) |
+		uint32(p.ReadClockFrequency&7)<<17 |
+		uint32(p.FastReadFrequency&7)<<21 |
+		uint32(p.FlashWriteFrequency&7)<<24 |
+		uint32(p.FlashReadStatusFrequency&7)<<27 |
+		p.Reserved&flashParamsReservedMask
+	if p.FastReadEnabled {
+		v |= 1 << 20
+	}
+	if p.DualOutputFastReadSupported {
+		v |= 1 << 30
+	}
+	buf := make([]byte, FlashParamsSize)
+	binary.LittleEndian.PutUint32(buf, v)
+	return buf, nil
+}
+
 // NewFlashParams initalizes a FlashParam struct from a slice of bytes
 func NewFlashParams(buf []byte) (*FlashParams, error) {
-	if len(buf) != FlashParamsSize {
+	if len(buf) < FlashParamsSize {
 		return nil, fmt.Errorf("Invalid image size: expected %v bytes, got %v",
 			FlashParamsSize,
 			len(buf),
 		)
 	}
-	p := FlashParams(buf)
-	return &p, nil
+	v := binary.LittleEndian.Uint32(buf)
+	return &FlashParams{
+		Densities:                   uint8(v),
+		ReadClockFrequency:          FlashFrequency(v>>17) & 7,
+		FastReadEnabled:             v&(1<<20) != 0,
+		FastReadFrequency:           FlashFrequency(v>>21) & 7,
+		FlashWriteFrequency:         FlashFrequency(v>>24) & 7,
+		FlashReadStatusFrequency:    FlashFrequency(v>>27) & 7,
+		DualOutputFastReadSupported: v&(1<<30) != 0,
+		Reserved:                    v & flashParamsReservedMask,
+	}, nil
 }
@@ -10,6 +10,80 @@ import (
 // FlashRegionSectionSize is the size of the Region descriptor. It is made up by 18 fields, each 16-bits large.
 const FlashRegionSectionSize = 36
 
+// FlashRegionSectionMinSize is the size of the region section of the
+// ICH-era descriptors, which describe the descriptor, BIOS, ME, GbE and PDR
+// regions
+const FlashRegionSectionMinSize = 20
+
+// FlashRegionsMax is the maximum number of regions in the region section of
+// recent descriptors
+const FlashRegionsMax = 16
+
+// flashRegionsBasic is the number of regions of the ICH-era descriptors
+const flashRegionsBasic = FlashRegionSectionMinSize / 4
+
+// FlashRegionType is the index of a region in the region section
+type FlashRegionType int
+
+// Flash region types. The regions after the PDR are only defined on recent
+// PCH descriptors.
+const (
+	RegionTypeDescriptor FlashRegionType = iota
+	RegionTypeBIOS
+	RegionTypeME
+	RegionTypeGbE
+	RegionTypePDR
+	RegionTypeDevExp
+	RegionTypeBIOS2
+	RegionTypeMicrocode
+	RegionTypeEC
+	RegionTypeDevExp2
+	RegionTypeIE
+	RegionType10GbE0
+	RegionType10GbE1
+	RegionTypeReserved13
+	RegionTypeReserved14
+	RegionTypePTT
+)
+
+var flashRegionTypeNames = [FlashRegionsMax]string{
+	"Descriptor", "BIOS", "ME", "GbE", "PDR", "DevExp", "BIOS2", "Microcode",
+	"EC", "DevExp2", "IE", "10GbE0", "10GbE1", "Reserved13", "Reserved14", "PTT",
+}
+
+func (t FlashRegionType) String() string {
+	if t >= 0 && t < FlashRegionsMax {
+		return flashRegionTypeNames[t]
+	}
+	return fmt.Sprintf("Region%d", int(t))
+}
+
+// FlashRegion is an entry of the region section. Base and Limit are in
+// units of 4KB, the limit being the last block of the region.
+type FlashRegion struct {
+	Base, Limit uint16
+}
+
+// Valid returns whether the region is in use. Unused regions have a limit
+// lower than the base, usually 0x7fff and 0, or are all ones.
+func (r FlashRegion) Valid() bool {
+	base, limit := r.Base&0x7fff, r.Limit&0x7fff
+	return limit != 0 && limit >= base && base != 0x7fff
+}
+
+// Offset returns the position of the region in the image
+func (r FlashRegion) Offset() uint64 {
+	return uint64(r.Base&0x7fff) * 0x1000
+}
+
+// Size returns the size of the region in bytes, or 0 if it is not in use
+func (r FlashRegion) Size() uint64 {
+	if !r.Valid() {
+		return 0
+	}
+	return uint64(r.Limit&0x7fff-r.Base&0x7fff+1) * 0x1000
+}
+
 // FlashRegionSection holds the metadata of all the different flash regions like PDR, Gbe and the Bios region.
 type FlashRegionSection struct {
 	Reserved            uint16
@@ -18,6 +92,84 @@ type FlashRegionSection struct {
 	MeBase, MeLimit     uint16
 	GbeBase, GbeLimit   uint16
 	PdrBase, PdrLimit   uint16
+	// Extended holds the regions following the PDR, starting with
+	// RegionTypeDevExp, on descriptors that have them
+	Extended []FlashRegion
+}
+
+// Region returns the entry of the region of the given type. Regions that
+// are not described by the section are returned empty.
+func (f FlashRegionSection) Region(t FlashRegionType) FlashRegion {
+	switch t {
+	case RegionTypeDescriptor:
+		return FlashRegion{f.Reserved, f.FlashBlockEraseSize}
+	case RegionTypeBIOS:
+		return FlashRegion{f.BiosBase, f.BiosLimit}
+	case RegionTypeME:
+		return FlashRegion{f.MeBase, f.MeLimit}
+	case RegionTypeGbE:
+		return FlashRegion{f.GbeBase, f.GbeLimit}
+	case RegionTypePDR:
+		return FlashRegion{f.PdrBase, f.PdrLimit}
+	}
+	if i := int(t) - flashRegionsBasic; i >= 0 && i < len(f.Extended) {
+		return f.Extended[i]
+	}
+	return FlashRegion{}
+}
+
+// RegionOffset returns the absolute byte range [start, end) of the region of
+// the given type, or 0, 0 if it is not in use. The descriptor region always
+// starts at 0, and its entry is often zeroed, i.e. it is only the first block.
+func (f FlashRegionSection) RegionOffset(t FlashRegionType) (start, end uint32) {
+	r := f.Region(t)
+	if t == RegionTypeDescriptor {
+		return 0, uint32(r.Limit&0x7fff+1) * 0x1000
+	}
+	if !r.Valid() {
+		return 0, 0
+	}
+	return uint32(r.Offset()), uint32(r.Offset() + r.Size())
+}
+
+// BiosOffset returns the absolute byte range of the BIOS region
+func (f FlashRegionSection) BiosOffset() (start, end uint32) {
+	return f.RegionOffset(RegionTypeBIOS)
+}
+
+// MeOffset returns the absolute byte range of the ME region
+func (f FlashRegionSection) MeOffset() (start, end uint32) {
+	return f.RegionOffset(RegionTypeME)
+}
+
+// GbeOffset returns the absolute byte range of the GbE region
+func (f FlashRegionSection) GbeOffset() (start, end uint32) {
+	return f.RegionOffset(RegionTypeGbE)
+}
+
+// PdrOffset returns the absolute byte range of the PDR region
+func (f FlashRegionSection) PdrOffset() (start, end uint32) {
+	return f.RegionOffset(RegionTypePDR)
+}
+
+// Validate runs a set of checks on the region section and returns a list of
+// errors specifying what is wrong.
+func (f FlashRegionSection) Validate() []error {
+	errors := make([]error, 0)
+	if !f.Region(RegionTypeBIOS).Valid() {
+		errors = append(errors, fmt.Errorf("No BIOS region"))
+	}
+	for t := RegionTypeBIOS; t < FlashRegionsMax; t++ {
+		r := f.Region(t)
+		base, limit := r.Base&0x7fff, r.Limit&0x7fff
+		// unused regions have a limit lower than the base, or are all zeros
+		// or all ones
+		if r.Valid() || limit < base || r == (FlashRegion{}) || r == (FlashRegion{0xffff, 0xffff}) {
+			continue
+		}
+		errors = append(errors, fmt.Errorf("Region %v has an invalid base 0x%x and limit 0x%x", t, r.Base, r.Limit))
+	}
+	return errors
 }
 
 // AvailableRegions returns a list of names of the regions with non-zero size.
@@ -35,6 +187,11 @@ func (f FlashRegionSection) AvailableRegions() []string {
 	if f.PdrLimit > 0 {
 		regions = append(regions, "PDR")
 	}
+	for i, r := range f.Extended {
+		if r.Valid() {
+			regions = append(regions, FlashRegionType(i+flashRegionsBasic).String())
+		}
+	}
 	return regions
 }
 
@@ -46,32 +203,72 @@ func (f FlashRegionSection) String() string {
 
 // Summary prints a multi-line description of the FlashRegionSection
 func (f FlashRegionSection) Summary() string {
+	var extended string
+	for i, r := range f.Extended {
+		if r.Valid() {
+			extended += fmt.Sprintf("    %vBase=%v (size: %v)\n", FlashRegionType(i+flashRegionsBasic), r.Base, r.Limit)
+		}
+	}
 	return fmt.Sprintf("FlashRegionSection{\n"+
 		"    Regions=%v\n"+
 		"    BiosBase=%v (size: %v)\n"+
 		"    MeBase=%v (size: %v)\n"+
 		"    GbeBase=%v (size: %v)\n"+
 		"    PdrBase=%v (size: %v)\n"+
+		"%s"+
 		"}",
 		strings.Join(f.AvailableRegions(), ","),
 		f.BiosBase, f.BiosLimit,
 		f.MeBase, f.MeLimit,
 		f.GbeBase, f.GbeLimit,
 		f.PdrBase, f.PdrLimit,
+		extended,
 	)
 }
 
-// NewFlashRegionSection initializes a FlashRegionSection from a slice of bytes
+// MarshalBinary serializes the FlashRegionSection
+func (f FlashRegionSection) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	for t := RegionTypeDescriptor; t < flashRegionsBasic; t++ {
+		if err := binary.Write(&buf, binary.LittleEndian, f.Region(t)); err != nil {
+			return nil, err
+		}
+	}
+	if err := binary.Write(&buf, binary.LittleEndian, f.Extended); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewFlashRegionSection initializes a FlashRegionSection from a slice of bytes.
+// The entries following the PDR, up to FlashRegionsMax, are read into
+// Extended, as many as data holds.
 func NewFlashRegionSection(data []byte) (*FlashRegionSection, error) {
-	if len(data) < FlashRegionSectionSize {
-		return nil, fmt.Errorf("Flash Region Section size too small: expected %v bytes, got %v",
-			FlashRegionSectionSize,
+	if len(data) < FlashRegionSectionMinSize {
+		return nil, fmt.Errorf("Flash Region Section size too small: expected at least %v bytes, got %v",
+			FlashRegionSectionMinSize,
 			len(data),
 		)
 	}
-	var region FlashRegionSection
+	var (
+		region  FlashRegionSection
+		entries [flashRegionsBasic]FlashRegion
+	)
 	reader := bytes.NewReader(data)
-	if err := binary.Read(reader, binary.LittleEndian, &region); err != nil {
+	if err := binary.Read(reader, binary.LittleEndian, &entries); err != nil {
+		return nil, err
+	}
+	region.Reserved, region.FlashBlockEraseSize = entries[0].Base, entries[0].Limit
+	region.BiosBase, region.BiosLimit = entries[1].Base, entries[1].Limit
+	region.MeBase, region.MeLimit = entries[2].Base, entries[2].Limit
+	region.GbeBase, region.GbeLimit = entries[3].Base, entries[3].Limit
+	region.PdrBase, region.PdrLimit = entries[4].Base, entries[4].Limit
+	extended := len(data)/4 - flashRegionsBasic
+	if extended > FlashRegionsMax-flashRegionsBasic {
+		extended = FlashRegionsMax - flashRegionsBasic
+	}
+	region.Extended = make([]FlashRegion, extended)
+	if err := binary.Read(reader, binary.LittleEndian, region.Extended); err != nil {
 		return nil, err
 	}
 	return &region, nil
@@ -0,0 +1,165 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// FlashStraps holds the soft straps of a strap section of the descriptor,
+// one dword per strap register
+type FlashStraps []uint32
+
+// MarshalBinary serializes the straps
+func (s FlashStraps) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, []uint32(s)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewFlashStraps reads count strap dwords from buf
+func NewFlashStraps(buf []byte, count int) (FlashStraps, error) {
+	if len(buf) < count*4 {
+		return nil, fmt.Errorf("Flash straps size too small: expected %v bytes, got %v", count*4, len(buf))
+	}
+	straps := make(FlashStraps, count)
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, []uint32(straps)); err != nil {
+		return nil, err
+	}
+	return straps, nil
+}
+
+// StrapField describes a known field of the soft straps
+type StrapField struct {
+	Name        string
+	Description string
+	// Processor is set for the processor straps, otherwise the field is in
+	// the PCH straps
+	Processor bool
+	// Index is the number of the strap dword
+	Index        int
+	Shift, Width uint
+}
+
+// KnownStrapFields lists the strap fields decoded by StrapValues, by
+// descriptor version. The meaning of most straps depends on the chipset, so
+// only the fields that are stable across chipsets are listed; users can add
+// their own.
+var KnownStrapFields = map[DescriptorVersion][]StrapField{
+	DescriptorV1: {
+		{Name: "AltMeDisable", Description: "Disable the ME after bring up (ME 6 to 10)", Index: 10, Shift: 7, Width: 1},
+	},
+	DescriptorV2: {
+		{Name: "HAP", Description: "High Assurance Platform, disables the ME after bring up (ME 11 and later)", Index: 0, Shift: 16, Width: 1},
+	},
+}
+
+// StrapValue is the value of a strap field in an image
+type StrapValue struct {
+	StrapField
+	Value uint32
+}
+
+func (v StrapValue) String() string {
+	kind := "PCH"
+	if v.Processor {
+		kind = "Processor"
+	}
+	return fmt.Sprintf("%s=%v (%s strap %d, bits %d:%d)", v.Name, v.Value, kind, v.Index, v.Shift+v.Width-1, v.Shift)
+}
+
+// strapDword returns a pointer to the strap dword of a field, or nil if the
+// image does not have it
+func (f *FlashImage) strapDword(field StrapField) *uint32 {
+	straps := f.PchStraps
+	if field.Processor {
+		straps = f.ProcStraps
+	}
+	if field.Index < 0 || field.Index >= len(straps) {
+		return nil
+	}
+	return &straps[field.Index]
+}
+
+// StrapValues decodes the known strap fields for the descriptor version of
+// the image
+func (f FlashImage) StrapValues() []StrapValue {
+	var values []StrapValue
+	for _, field := range KnownStrapFields[f.DescriptorVersion()] {
+		d := f.strapDword(field)
+		if d == nil {
+			continue
+		}
+		mask := uint32(1)<<field.Width - 1
+		values = append(values, StrapValue{field, (*d >> field.Shift) & mask})
+	}
+	return values
+}
+
+// SetStrap sets the value of a known strap field, by name. The change is
+// written by MarshalBinary.
+func (f *FlashImage) SetStrap(name string, value uint32) error {
+	for _, field := range KnownStrapFields[f.DescriptorVersion()] {
+		if !strings.EqualFold(field.Name, name) {
+			continue
+		}
+		d := f.strapDword(field)
+		if d == nil {
+			return fmt.Errorf("Strap %s not present in the image", field.Name)
+		}
+		mask := uint32(1)<<field.Width - 1
+		if value > mask {
+			return fmt.Errorf("Value %v too large for strap %s of %d bits", value, field.Name, field.Width)
+		}
+		*d = *d&^(mask<<field.Shift) | value<<field.Shift
+		return nil
+	}
+	return fmt.Errorf("Unknown strap %s for descriptor version %v", name, f.DescriptorVersion())
+}
+
+// meDisableStraps are the names of the strap fields that disable the ME after
+// bring up, by descriptor version
+var meDisableStraps = map[DescriptorVersion]string{
+	DescriptorV1: "AltMeDisable",
+	DescriptorV2: "HAP",
+}
+
+// meDisableStrap returns the ME disable strap field of the image and its
+// value
+func (f FlashImage) meDisableStrap() (StrapValue, error) {
+	name := meDisableStraps[f.DescriptorVersion()]
+	for _, v := range f.StrapValues() {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return StrapValue{}, fmt.Errorf("No ME disable strap for descriptor version %v", f.DescriptorVersion())
+}
+
+// MEDisabled returns whether the strap that disables the ME after bring up is
+// set: HAP on descriptors of version 2, AltMeDisable on version 1.
+func (f FlashImage) MEDisabled() (bool, error) {
+	v, err := f.meDisableStrap()
+	if err != nil {
+		return false, err
+	}
+	return v.Value != 0, nil
+}
+
+// SetMEDisabled sets or clears the strap that disables the ME after bring up,
+// HAP or AltMeDisable depending on the descriptor version. The change is
+// written by MarshalBinary.
+func (f *FlashImage) SetMEDisabled(disabled bool) error {
+	v, err := f.meDisableStrap()
+	if err != nil {
+		return err
+	}
+	var value uint32
+	if disabled {
+		value = 1
+	}
+	return f.SetStrap(v.Name, value)
+}
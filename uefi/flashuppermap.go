@@ -0,0 +1,164 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// FlashUpperMapOffset is the position of the upper map (FLUMAP1) from
+	// the start of the descriptor region
+	FlashUpperMapOffset = 0xefc
+	// FlashUpperMapSize is the size of the upper map
+	FlashUpperMapSize = 4
+	// VSCCEntrySize is the size of an entry of the VSCC table
+	VSCCEntrySize = 8
+)
+
+// FlashUpperMap is the upper map of the descriptor, which locates the VSCC
+// table
+type FlashUpperMap struct {
+	VSCCTableBase uint8
+	// VSCCTableLength is the length of the table in dwords, two per entry
+	VSCCTableLength uint8
+	Reserved        uint16
+}
+
+// MarshalBinary serializes the upper map
+func (m FlashUpperMap) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// VSCCEraseBlockSizes maps the block erase size field of the VSCC registers
+// to the size in bytes
+var VSCCEraseBlockSizes = [4]uint{256, 4 * 1024, 8 * 1024, 64 * 1024}
+
+// VSCC is a decoded Vendor Specific Component Capabilities register
+type VSCC struct {
+	EraseBlockSize uint
+	// WriteGranularity is 1 or 64 bytes
+	WriteGranularity         uint
+	WriteStatusRequired      bool
+	WriteEnableOnWriteStatus bool
+	EraseOpcode              uint8
+}
+
+func newVSCC(v uint16) VSCC {
+	granularity := uint(1)
+	if v&(1<<2) != 0 {
+		granularity = 64
+	}
+	return VSCC{
+		EraseBlockSize:           VSCCEraseBlockSizes[v&3],
+		WriteGranularity:         granularity,
+		WriteStatusRequired:      v&(1<<3) != 0,
+		WriteEnableOnWriteStatus: v&(1<<4) != 0,
+		EraseOpcode:              uint8(v >> 8),
+	}
+}
+
+func (v VSCC) String() string {
+	return fmt.Sprintf("VSCC{EraseBlockSize=%v, WriteGranularity=%v, WriteStatusRequired=%v, WriteEnableOnWriteStatus=%v, EraseOpcode=0x%02x}",
+		v.EraseBlockSize, v.WriteGranularity, v.WriteStatusRequired, v.WriteEnableOnWriteStatus, v.EraseOpcode)
+}
+
+// VSCCEntry is an entry of the VSCC table, describing a supported SPI flash
+// part
+type VSCCEntry struct {
+	// JID holds the vendor ID in bits 7:0 and the device ID in bits 23:8
+	JID  uint32
+	VSCC uint32
+}
+
+// JEDECID returns the JEDEC ID of the part, as returned by the RDID command:
+// the vendor ID followed by the two bytes of the device ID
+func (e VSCCEntry) JEDECID() uint32 {
+	return (e.JID&0xff)<<16 | (e.JID>>8&0xff)<<8 | e.JID>>16&0xff
+}
+
+// Upper returns the capabilities used for the upper flash partition
+func (e VSCCEntry) Upper() VSCC {
+	return newVSCC(uint16(e.VSCC))
+}
+
+// Lower returns the capabilities used for the lower flash partition
+func (e VSCCEntry) Lower() VSCC {
+	return newVSCC(uint16(e.VSCC >> 16))
+}
+
+func (e VSCCEntry) String() string {
+	chip := "unknown"
+	if c, _ := e.Chip(); c.Vendor != "" {
+		chip = c.String()
+	}
+	return fmt.Sprintf("VSCCEntry{JEDECID=0x%06x, Chip=%s, Upper=%v, Lower=%v}", e.JEDECID(), chip, e.Upper(), e.Lower())
+}
+
+// VSCCTable is the table of the SPI flash parts supported by the image
+type VSCCTable []VSCCEntry
+
+// MarshalBinary serializes the VSCC table
+func (t VSCCTable) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, []VSCCEntry(t)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Find returns the entry of the part with the given JEDEC ID, as returned by
+// VSCCEntry.JEDECID, and whether it was found
+func (t VSCCTable) Find(jedecID uint32) (VSCCEntry, bool) {
+	for _, e := range t {
+		if e.JEDECID() == jedecID {
+			return e, true
+		}
+	}
+	return VSCCEntry{}, false
+}
+
+// Summary prints a multi-line description of the VSCC table
+func (t VSCCTable) Summary() string {
+	var entries []string
+	for _, e := range t {
+		entries = append(entries, e.String())
+	}
+	return fmt.Sprintf("VSCCTable[\n"+
+		"    %v\n"+
+		"]", Indent(strings.Join(entries, "\n"), 4))
+}
+
+// NewVSCCTable parses the upper map of the descriptor region, and the VSCC
+// table it points to. It returns the upper map, the table and the position of
+// the table in the descriptor region.
+func NewVSCCTable(descriptor []byte) (*FlashUpperMap, VSCCTable, uint, error) {
+	if len(descriptor) < FlashUpperMapOffset+FlashUpperMapSize {
+		return nil, nil, 0, fmt.Errorf("Upper map out of bounds: descriptor size 0x%x", len(descriptor))
+	}
+	var m FlashUpperMap
+	if err := binary.Read(bytes.NewReader(descriptor[FlashUpperMapOffset:]), binary.LittleEndian, &m); err != nil {
+		return nil, nil, 0, err
+	}
+	start := uint(m.VSCCTableBase) * 0x10
+	count := uint(m.VSCCTableLength) / 2
+	if count == 0 || m == (FlashUpperMap{0xff, 0xff, 0xffff}) {
+		// no table, or erased upper map
+		return &m, nil, start, nil
+	}
+	if start+count*VSCCEntrySize > uint(len(descriptor)) {
+		return nil, nil, 0, fmt.Errorf("VSCC table out of bounds: 0x%x-0x%x, descriptor size 0x%x",
+			start, start+count*VSCCEntrySize, len(descriptor),
+		)
+	}
+	table := make(VSCCTable, count)
+	if err := binary.Read(bytes.NewReader(descriptor[start:]), binary.LittleEndian, []VSCCEntry(table)); err != nil {
+		return nil, nil, 0, err
+	}
+	return &m, table, start, nil
+}
@@ -0,0 +1,298 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FMAPSignature starts the flash maps of the coreboot and Chromium OS images
+var FMAPSignature = []byte("__FMAP__")
+
+// FMAP constants
+const (
+	FMAPHeaderSize = 56
+	FMAPAreaSize   = 42
+	// FMAPNameSize is the size of the names, including the terminating NUL
+	FMAPNameSize = 32
+)
+
+// FMAP area flags
+const (
+	FMAPAreaStatic     = 1 << 0
+	FMAPAreaCompressed = 1 << 1
+	FMAPAreaRO         = 1 << 2
+	FMAPAreaPreserve   = 1 << 3
+)
+
+var fmapAreaFlagNames = []struct {
+	flag uint16
+	name string
+}{
+	{FMAPAreaStatic, "static"},
+	{FMAPAreaCompressed, "compressed"},
+	{FMAPAreaRO, "ro"},
+	{FMAPAreaPreserve, "preserve"},
+}
+
+// fmapHeader is the binary header of an FMAP
+type fmapHeader struct {
+	Signature [8]byte
+	VerMajor  uint8
+	VerMinor  uint8
+	Base      uint64
+	Size      uint32
+	Name      [FMAPNameSize]byte
+	NAreas    uint16
+}
+
+// fmapArea is the binary form of an FMAP area
+type fmapArea struct {
+	Offset uint32
+	Size   uint32
+	Name   [FMAPNameSize]byte
+	Flags  uint16
+}
+
+// FMAPArea is an area of an FMAP. The offset is from the start of the
+// image.
+type FMAPArea struct {
+	Name   string `json:"name"`
+	Offset uint32 `json:"offset"`
+	Size   uint32 `json:"size"`
+	Flags  uint16 `json:"flags"`
+}
+
+func (a FMAPArea) String() string {
+	var flags []string
+	for _, f := range fmapAreaFlagNames {
+		if a.Flags&f.flag != 0 {
+			flags = append(flags, f.name)
+		}
+	}
+	s := fmt.Sprintf("%s [0x%08x-0x%08x]", a.Name, a.Offset, uint64(a.Offset)+uint64(a.Size))
+	if len(flags) > 0 {
+		s += " " + strings.Join(flags, ",")
+	}
+	return s
+}
+
+// FMAP is the flash map of the coreboot and Chromium OS images, naming the
+// areas of the flash
+type FMAP struct {
+	Name     string `json:"name"`
+	VerMajor uint8  `json:"ver_major"`
+	VerMinor uint8  `json:"ver_minor"`
+	// Base is the address of the flash in the memory map
+	Base  uint64     `json:"base"`
+	Size  uint32     `json:"size"`
+	Areas []FMAPArea `json:"areas"`
+}
+
+// Summary prints a multi-line description of the FMAP
+func (m FMAP) Summary() string {
+	var areas []string
+	for _, a := range m.Areas {
+		areas = append(areas, a.String())
+	}
+	return fmt.Sprintf("FMAP{\n"+
+		"    Name=%s\n"+
+		"    Version=%d.%d\n"+
+		"    Base=0x%x\n"+
+		"    Size=0x%x\n"+
+		"    Areas=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		m.Name, m.VerMajor, m.VerMinor, m.Base, m.Size, Indent(strings.Join(areas, "\n"), 8))
+}
+
+// Validate checks that the names fit in the binary form and that the areas
+// are within the flash. Areas may nest, as the Chromium OS sections do.
+func (m FMAP) Validate() []error {
+	errors := make([]error, 0)
+	if len(m.Name) >= FMAPNameSize {
+		errors = append(errors, fmt.Errorf("FMAP name %q longer than %d bytes", m.Name, FMAPNameSize-1))
+	}
+	for _, a := range m.Areas {
+		if len(a.Name) >= FMAPNameSize {
+			errors = append(errors, fmt.Errorf("FMAP area name %q longer than %d bytes", a.Name, FMAPNameSize-1))
+		}
+		if uint64(a.Offset)+uint64(a.Size) > uint64(m.Size) {
+			errors = append(errors, fmt.Errorf("FMAP area %v exceeds the flash size 0x%x", a, m.Size))
+		}
+	}
+	return errors
+}
+
+// fmapName returns the NUL-terminated name of a binary FMAP field
+func fmapName(b [FMAPNameSize]byte) string {
+	if i := bytes.IndexByte(b[:], 0); i >= 0 {
+		return string(b[:i])
+	}
+	return string(b[:])
+}
+
+// MarshalBinary serializes the FMAP in the format read by flashrom and
+// cbfstool
+func (m FMAP) MarshalBinary() ([]byte, error) {
+	if errs := m.Validate(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if len(m.Areas) > 0xffff {
+		return nil, fmt.Errorf("Too many FMAP areas: %d", len(m.Areas))
+	}
+	hdr := fmapHeader{VerMajor: m.VerMajor, VerMinor: m.VerMinor, Base: m.Base, Size: m.Size, NAreas: uint16(len(m.Areas))}
+	copy(hdr.Signature[:], FMAPSignature)
+	copy(hdr.Name[:], m.Name)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, hdr); err != nil {
+		return nil, err
+	}
+	for _, a := range m.Areas {
+		area := fmapArea{Offset: a.Offset, Size: a.Size, Flags: a.Flags}
+		copy(area.Name[:], a.Name)
+		if err := binary.Write(&buf, binary.LittleEndian, area); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// NewFMAP parses the FMAP at the start of buf
+func NewFMAP(buf []byte) (*FMAP, error) {
+	if len(buf) < FMAPHeaderSize || !bytes.Equal(buf[:len(FMAPSignature)], FMAPSignature) {
+		return nil, fmt.Errorf("No FMAP signature found")
+	}
+	var hdr fmapHeader
+	reader := bytes.NewReader(buf)
+	if err := binary.Read(reader, binary.LittleEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if hdr.VerMajor != 1 {
+		return nil, fmt.Errorf("Unsupported FMAP version %d.%d", hdr.VerMajor, hdr.VerMinor)
+	}
+	if FMAPHeaderSize+uint64(hdr.NAreas)*FMAPAreaSize > uint64(len(buf)) {
+		return nil, fmt.Errorf("FMAP with %d areas exceeds the buffer", hdr.NAreas)
+	}
+	m := FMAP{
+		Name:     fmapName(hdr.Name),
+		VerMajor: hdr.VerMajor,
+		VerMinor: hdr.VerMinor,
+		Base:     hdr.Base,
+		Size:     hdr.Size,
+		Areas:    make([]FMAPArea, 0, hdr.NAreas),
+	}
+	for i := 0; i < int(hdr.NAreas); i++ {
+		var a fmapArea
+		if err := binary.Read(reader, binary.LittleEndian, &a); err != nil {
+			return nil, err
+		}
+		m.Areas = append(m.Areas, FMAPArea{Name: fmapName(a.Name), Offset: a.Offset, Size: a.Size, Flags: a.Flags})
+	}
+	return &m, nil
+}
+
+// FindFMAP returns the offset of the first valid FMAP in buf, or -1 if
+// there is none
+func FindFMAP(buf []byte) int {
+	for offset := 0; offset < len(buf); offset += len(FMAPSignature) {
+		idx := bytes.Index(buf[offset:], FMAPSignature)
+		if idx == -1 {
+			break
+		}
+		offset += idx
+		if _, err := NewFMAP(buf[offset:]); err == nil {
+			return offset
+		}
+	}
+	return -1
+}
+
+// embeddedFMAP returns the first valid FMAP in buf, or nil if there is none
+func embeddedFMAP(buf []byte) *FMAP {
+	offset := FindFMAP(buf)
+	if offset == -1 {
+		return nil
+	}
+	m, _ := NewFMAP(buf[offset:])
+	return m
+}
+
+// FMAP returns the FMAP embedded in the image, e.g. by coreboot, or nil if
+// there is none
+func (f FlashImage) FMAP() *FMAP {
+	return embeddedFMAP(f.buf)
+}
+
+// FMAP returns the FMAP embedded in the region, or nil if there is none
+func (br BiosRegion) FMAP() *FMAP {
+	return embeddedFMAP(br.buf)
+}
+
+// fmapRegionName returns the name of the FMAP area of a flash region, as
+// used in the coreboot flash map descriptors
+func fmapRegionName(t FlashRegionType) string {
+	if t == RegionTypeDescriptor {
+		return "SI_DESC"
+	}
+	return "SI_" + strings.ToUpper(t.String())
+}
+
+// newRegionFMAP returns the FMAP of a flash of the given size with one area
+// per region, sorted by offset. The flash is mapped right below 4GB, as on
+// all the platforms with an Intel flash descriptor.
+func newRegionFMAP(size uint64, regions []layoutRegion) (*FMAP, error) {
+	if size > 0xffffffff {
+		return nil, fmt.Errorf("Flash size 0x%x too large for an FMAP", size)
+	}
+	sort.Slice(regions, func(i, j int) bool { return regions[i].offset < regions[j].offset })
+	m := FMAP{Name: "FLASH", VerMajor: 1, VerMinor: 1, Base: 1<<32 - size, Size: uint32(size), Areas: make([]FMAPArea, 0, len(regions))}
+	for _, r := range regions {
+		if r.offset+r.size > size {
+			return nil, fmt.Errorf("Region %v [0x%x-0x%x] exceeds the flash size 0x%x", r.t, r.offset, r.offset+r.size, size)
+		}
+		m.Areas = append(m.Areas, FMAPArea{Name: fmapRegionName(r.t), Offset: uint32(r.offset), Size: uint32(r.size)})
+	}
+	return &m, nil
+}
+
+// GenerateFMAP returns an FMAP describing the regions of the flash
+// descriptor, named like in the coreboot flash map descriptors (SI_DESC,
+// SI_ME, SI_BIOS and so on)
+func (f FlashImage) GenerateFMAP() (*FMAP, error) {
+	var regions []layoutRegion
+	for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+		if start, end := f.Region.RegionOffset(t); end != 0 {
+			regions = append(regions, layoutRegion{t, uint64(start), uint64(end - start)})
+		}
+	}
+	size := f.Component.TotalSize()
+	if size == 0 {
+		size = uint64(len(f.buf))
+	}
+	return newRegionFMAP(size, regions)
+}
+
+// FMAP returns an FMAP describing the regions of the layout, like
+// FlashImage.GenerateFMAP
+func (l DescriptorLayout) FMAP() (*FMAP, error) {
+	regions := []layoutRegion{{RegionTypeDescriptor, 0, 0x1000}}
+	for _, r := range l.Regions {
+		t, err := regionTypeByName(r.Name)
+		if err != nil {
+			return nil, err
+		}
+		if t == RegionTypeDescriptor {
+			continue
+		}
+		regions = append(regions, layoutRegion{t, r.Base, r.Size})
+	}
+	var size uint64
+	for _, c := range l.Components {
+		size += c
+	}
+	return newRegionFMAP(size, regions)
+}
@@ -0,0 +1,180 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	// GbeBankSize is the size of each copy of the NVM in the GbE region
+	GbeBankSize = 0x1000
+	// GbeChecksumTarget is the sum of the words 0x00 to 0x3f of a valid
+	// NVM copy, including the checksum word
+	GbeChecksumTarget = 0xbaba
+	// gbeChecksumWord is the position of the checksum word
+	gbeChecksumWord = 0x3f
+	// gbeSignatureWord is the position of the word whose bits 15:14 are
+	// 10b in a valid NVM copy
+	gbeSignatureWord = 0x13
+)
+
+// MACAddress is a burned-in Ethernet address
+type MACAddress [6]byte
+
+func (m MACAddress) String() string {
+	return net.HardwareAddr(m[:]).String()
+}
+
+// ParseMACAddress parses a MAC address in the form 00:11:22:33:44:55
+func ParseMACAddress(s string) (MACAddress, error) {
+	var m MACAddress
+	hw, err := net.ParseMAC(s)
+	if err != nil {
+		return m, err
+	}
+	if len(hw) != len(m) {
+		return m, fmt.Errorf("Invalid MAC address %q: expected %d bytes, got %d", s, len(m), len(hw))
+	}
+	copy(m[:], hw)
+	return m, nil
+}
+
+// GbeBank is a copy of the NVM of the network controller. The region holds
+// two of them, the controller loads the valid one.
+type GbeBank struct {
+	// Offset is the position of the copy in the region
+	Offset uint32
+	MAC    MACAddress
+	// Checksum is the checksum word, see GbeChecksumTarget
+	Checksum uint16
+	// Valid tells whether the signature of the copy is set
+	Valid bool
+	// ChecksumValid tells whether the words sum to GbeChecksumTarget
+	ChecksumValid bool
+}
+
+func (b GbeBank) String() string {
+	return fmt.Sprintf("GbeBank{Offset=0x%x, MAC=%v, Checksum=0x%04x, Valid=%v, ChecksumValid=%v}",
+		b.Offset, b.MAC, b.Checksum, b.Valid, b.ChecksumValid)
+}
+
+// gbeChecksum returns the checksum word for the NVM copy at the start of
+// buf
+func gbeChecksum(buf []byte) uint16 {
+	var sum uint16
+	for i := 0; i < gbeChecksumWord; i++ {
+		sum += binary.LittleEndian.Uint16(buf[2*i:])
+	}
+	return GbeChecksumTarget - sum
+}
+
+// newGbeBank decodes the NVM copy at the start of buf
+func newGbeBank(buf []byte, offset uint32) GbeBank {
+	b := GbeBank{
+		Offset:   offset,
+		Checksum: binary.LittleEndian.Uint16(buf[2*gbeChecksumWord:]),
+		Valid:    binary.LittleEndian.Uint16(buf[2*gbeSignatureWord:])>>14 == 2,
+	}
+	copy(b.MAC[:], buf)
+	b.ChecksumValid = b.Checksum == gbeChecksum(buf)
+	return b
+}
+
+// GbeRegion represents the Gigabit Ethernet region of the flash image, which
+// holds the NVM of the integrated network controller.
+type GbeRegion struct {
+	// Banks are the copies of the NVM, one per 4KB
+	Banks []GbeBank
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the region
+func (gr GbeRegion) Buf() []byte {
+	return gr.buf
+}
+
+// Type returns RegionTypeGbE
+func (gr GbeRegion) Type() FlashRegionType {
+	return RegionTypeGbE
+}
+
+// MAC returns the MAC address of the first valid NVM copy
+func (gr GbeRegion) MAC() (MACAddress, error) {
+	for _, b := range gr.Banks {
+		if b.Valid {
+			return b.MAC, nil
+		}
+	}
+	return MACAddress{}, fmt.Errorf("No valid NVM copy in the GbE region")
+}
+
+// SetMAC writes the MAC address in the valid NVM copies and fixes their
+// checksums. The raw buffer is copied first, so the image the region was
+// parsed from is not modified.
+func (gr *GbeRegion) SetMAC(mac MACAddress) error {
+	if _, err := gr.MAC(); err != nil {
+		return err
+	}
+	gr.buf = append([]byte{}, gr.buf...)
+	for i, b := range gr.Banks {
+		if !b.Valid {
+			continue
+		}
+		bank := gr.buf[b.Offset:]
+		copy(bank, mac[:])
+		binary.LittleEndian.PutUint16(bank[2*gbeChecksumWord:], gbeChecksum(bank))
+		gr.Banks[i] = newGbeBank(bank, b.Offset)
+	}
+	return nil
+}
+
+// Summary prints a multi-line description of the region
+func (gr GbeRegion) Summary() string {
+	var banks []string
+	for _, b := range gr.Banks {
+		banks = append(banks, b.String())
+	}
+	return fmt.Sprintf("GbeRegion{\n"+
+		"    Size=%v\n"+
+		"    Banks=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}", len(gr.buf), Indent(strings.Join(banks, "\n"), 8))
+}
+
+// Validate checks that the region has a valid NVM copy, unless it is
+// erased, as it is before the network controller is provisioned, and that
+// the checksums of the valid copies are correct
+func (gr GbeRegion) Validate() []error {
+	errors := make([]error, 0)
+	if _, err := gr.MAC(); err != nil && !isErased(gr.buf) {
+		errors = append(errors, err)
+	}
+	for _, b := range gr.Banks {
+		if b.Valid && !b.ChecksumValid {
+			errors = append(errors, fmt.Errorf("Wrong checksum 0x%04x for the GbE NVM copy at 0x%x", b.Checksum, b.Offset))
+		}
+	}
+	return errors
+}
+
+// MarshalBinary serializes the region
+func (gr GbeRegion) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, gr.buf...), nil
+}
+
+// NewGbeRegion parses a sequence of bytes and returns a GbeRegion object, if a valid
+// one is passed, or an error
+func NewGbeRegion(data []byte) (*GbeRegion, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Gigabit Ethernet region is empty")
+	}
+	gr := GbeRegion{buf: data}
+	for offset := 0; offset+2*(gbeChecksumWord+1) <= len(data); offset += GbeBankSize {
+		gr.Banks = append(gr.Banks, newGbeBank(data[offset:], uint32(offset)))
+	}
+	return &gr, nil
+}
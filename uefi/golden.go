@@ -0,0 +1,131 @@
+package uefi
+
+import (
+	"fmt"
+)
+
+// GoldenModule is a file of a known-good image, as recorded in a
+// GoldenManifest
+type GoldenModule struct {
+	// Volume is the file system GUID of the firmware volume holding the file
+	Volume string `json:"volume"`
+	GUID   string `json:"guid"`
+	Name   string `json:"name,omitempty"`
+	// SHA256 is the digest of the file, header included
+	SHA256 string `json:"sha256"`
+}
+
+// GoldenManifest holds the expected digests of the files of a known-good
+// image, to be compared with other images by VerifyGolden. It is meant to
+// be stored as JSON.
+type GoldenManifest struct {
+	Modules []GoldenModule `json:"modules"`
+}
+
+// ModuleChange is a file that differs between a golden manifest and an
+// image, as reported by VerifyGolden
+type ModuleChange struct {
+	// Change is "added", "removed" or "modified"
+	Change string
+	Volume string
+	GUID   string
+	Name   string `json:",omitempty"`
+	// Old and New are the digests of the file, "<none>" if the file is
+	// missing in the manifest or in the image
+	Old, New string
+}
+
+func (c ModuleChange) String() string {
+	name := c.GUID
+	if c.Name != "" {
+		name += " (" + c.Name + ")"
+	}
+	return fmt.Sprintf("%s: FV %s File %s: %s -> %s", c.Change, c.Volume, name, c.Old, c.New)
+}
+
+// GoldenManifest returns the digests of the files of the region, except the
+// pad files, in the order of the volumes, each followed by the files of the
+// volumes nested in it
+func (br BiosRegion) GoldenManifest() *GoldenManifest {
+	m := GoldenManifest{Modules: make([]GoldenModule, 0)}
+	br.walkFiles(func(fv *FirmwareVolume, file, parent *File, offset uint64) {
+		if file.Type == FileTypePad {
+			return
+		}
+		m.Modules = append(m.Modules, GoldenModule{
+			Volume: fv.guidString(),
+			GUID:   file.GUID(),
+			Name:   file.ModuleName(),
+			SHA256: sha256Hex(file.buf),
+		})
+	})
+	return &m
+}
+
+// GoldenManifest returns the digests of the files of the BIOS region of the
+// image, see BiosRegion.GoldenManifest
+func (f FlashImage) GoldenManifest() (*GoldenManifest, error) {
+	if f.BiosRegion == nil {
+		return nil, fmt.Errorf("The image has no BIOS region")
+	}
+	return f.BiosRegion.GoldenManifest(), nil
+}
+
+// goldenKey identifies a file in a manifest by its GUID and by the number of
+// files with the same GUID before it, as the same file is often stored in
+// several volumes, e.g. for recovery
+type goldenKey struct {
+	guid string
+	n    int
+}
+
+// goldenKeys returns the keys of the modules of a manifest, in order
+func goldenKeys(modules []GoldenModule) []goldenKey {
+	seen := make(map[string]int)
+	keys := make([]goldenKey, 0, len(modules))
+	for _, m := range modules {
+		keys = append(keys, goldenKey{m.GUID, seen[m.GUID]})
+		seen[m.GUID]++
+	}
+	return keys
+}
+
+// VerifyGolden compares the files of the region with the ones of a manifest
+// generated from a known-good image, and returns the files that were added,
+// removed or modified. No changes means the files were not tampered with:
+// the contents outside of the files, e.g. the NVRAM, are not compared.
+func (br BiosRegion) VerifyGolden(golden *GoldenManifest) []ModuleChange {
+	current := br.GoldenManifest()
+	expected := make(map[goldenKey]GoldenModule)
+	for i, k := range goldenKeys(golden.Modules) {
+		expected[k] = golden.Modules[i]
+	}
+	changes := make([]ModuleChange, 0)
+	found := make(map[goldenKey]bool)
+	for i, k := range goldenKeys(current.Modules) {
+		m := current.Modules[i]
+		found[k] = true
+		old, ok := expected[k]
+		switch {
+		case !ok:
+			changes = append(changes, ModuleChange{Change: "added", Volume: m.Volume, GUID: m.GUID, Name: m.Name, Old: "<none>", New: m.SHA256})
+		case old.SHA256 != m.SHA256:
+			changes = append(changes, ModuleChange{Change: "modified", Volume: m.Volume, GUID: m.GUID, Name: m.Name, Old: old.SHA256, New: m.SHA256})
+		}
+	}
+	for i, k := range goldenKeys(golden.Modules) {
+		if m := golden.Modules[i]; !found[k] {
+			changes = append(changes, ModuleChange{Change: "removed", Volume: m.Volume, GUID: m.GUID, Name: m.Name, Old: m.SHA256, New: "<none>"})
+		}
+	}
+	return changes
+}
+
+// VerifyGolden compares the files of the BIOS region of the image with the
+// ones of a golden manifest, see BiosRegion.VerifyGolden
+func (f FlashImage) VerifyGolden(golden *GoldenManifest) ([]ModuleChange, error) {
+	if f.BiosRegion == nil {
+		return nil, fmt.Errorf("The image has no BIOS region")
+	}
+	return f.BiosRegion.VerifyGolden(golden), nil
+}
@@ -0,0 +1,153 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// GscLayoutPointersSize is the size of the layout pointers at the
+	// start of a GSC image, including the ROM bypass vector
+	GscLayoutPointersSize = 0x48
+	// gscBootPartitions is the number of boot partitions described by the
+	// layout pointers
+	gscBootPartitions = 5
+)
+
+// GscLayoutPointers is the header of the firmware images of the graphics
+// security controller of the discrete GPUs, which took the place of the
+// descriptor: it locates the boot partitions, each described by a BPDT.
+type GscLayoutPointers struct {
+	ROMBypassVector [16]byte
+	// Size is the size of the structure after the ROM bypass vector
+	Size     uint16
+	Flags    uint8
+	Reserved uint8
+	CRC32    uint32
+	// Boot holds the offset and size of each boot partition
+	Boot [gscBootPartitions]struct {
+		Offset uint32
+		Size   uint32
+	}
+	TempPagesOffset uint32
+	TempPagesSize   uint32
+}
+
+// GscImage is a firmware image of the graphics security controller, the
+// CSME derivative of the 12th generation and later discrete GPUs
+type GscImage struct {
+	Pointers GscLayoutPointers
+	// BootPartitions are the BPDTs of the boot partitions that are present,
+	// nil for the others
+	BootPartitions [gscBootPartitions]*BPDT
+	// Holds the raw buffer
+	buf []byte
+}
+
+// bootPartition returns the bytes of boot partition i, or nil if it is not
+// present
+func (g GscImage) bootPartition(i int) []byte {
+	b := g.Pointers.Boot[i]
+	if b.Size == 0 || uint64(b.Offset)+uint64(b.Size) > uint64(len(g.buf)) {
+		return nil
+	}
+	return g.buf[b.Offset : b.Offset+b.Size]
+}
+
+// Version returns the version of the firmware from the manifest of the FTPR
+// subpartition, and whether it was found
+func (g GscImage) Version() (MeVersion, bool) {
+	for _, bp := range g.BootPartitions {
+		if bp == nil {
+			continue
+		}
+		if v, ok := bp.Version(); ok {
+			return v, true
+		}
+	}
+	return MeVersion{}, false
+}
+
+// Summary prints a multi-line description of the image
+func (g GscImage) Summary() string {
+	var bps []string
+	for i, bp := range g.BootPartitions {
+		if bp == nil {
+			continue
+		}
+		bps = append(bps, fmt.Sprintf("Boot%d@0x%x=%v", i+1, g.Pointers.Boot[i].Offset, bp.Summary()))
+	}
+	version := "<unknown>"
+	if v, ok := g.Version(); ok {
+		version = v.String()
+	}
+	return fmt.Sprintf("GscImage{\n"+
+		"    Size=%v\n"+
+		"    Version=%v\n"+
+		"    BootPartitions=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}", len(g.buf), version, Indent(strings.Join(bps, "\n"), 8))
+}
+
+// Validate checks that the boot partitions fit in the image, and that their
+// subpartitions fit in them
+func (g GscImage) Validate() []error {
+	errors := make([]error, 0)
+	for i, b := range g.Pointers.Boot {
+		if b.Size == 0 {
+			continue
+		}
+		if uint64(b.Offset)+uint64(b.Size) > uint64(len(g.buf)) {
+			errors = append(errors, fmt.Errorf("GSC boot partition %d [0x%x-0x%x] exceeds the image size 0x%x",
+				i+1, b.Offset, uint64(b.Offset)+uint64(b.Size), len(g.buf)))
+			continue
+		}
+		if g.BootPartitions[i] != nil {
+			errors = append(errors, g.BootPartitions[i].Validate(b.Size)...)
+		}
+	}
+	return errors
+}
+
+// MarshalBinary serializes the image
+func (g GscImage) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, g.buf...), nil
+}
+
+// IsGscImage returns whether buf starts with GSC layout pointers, i.e. the
+// first boot partition they point to starts with a BPDT
+func IsGscImage(buf []byte) bool {
+	if len(buf) < GscLayoutPointersSize {
+		return false
+	}
+	offset := binary.LittleEndian.Uint32(buf[0x18:])
+	size := binary.LittleEndian.Uint32(buf[0x1c:])
+	return offset >= GscLayoutPointersSize && size != 0 &&
+		uint64(offset)+uint64(size) <= uint64(len(buf)) && IsBPDT(buf[offset:])
+}
+
+// NewGscImage parses a GSC firmware image
+func NewGscImage(buf []byte) (*GscImage, error) {
+	if !IsGscImage(buf) {
+		return nil, fmt.Errorf("No GSC layout pointers found")
+	}
+	g := GscImage{buf: buf}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &g.Pointers); err != nil {
+		return nil, err
+	}
+	for i := range g.Pointers.Boot {
+		bp := g.bootPartition(i)
+		if !IsBPDT(bp) {
+			continue
+		}
+		b, err := NewBPDT(bp, 0)
+		if err != nil {
+			return nil, fmt.Errorf("GSC boot partition %d: %v", i+1, err)
+		}
+		g.BootPartitions[i] = b
+	}
+	return &g, nil
+}
@@ -0,0 +1,191 @@
+package uefi
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// hiddenDataMergeGap is the number of fill bytes below which two runs of
+// data are reported as one
+const hiddenDataMergeGap = 16
+
+// HiddenData is a run of non-erased bytes found by FlashImage.HiddenData
+// outside of the parsed structures
+type HiddenData struct {
+	// Area describes where the data was found, e.g. "BIOS region gap"
+	Area string
+	// Offset is the absolute position of the data in the image
+	Offset uint64
+	Size   uint64
+	// Entropy is the Shannon entropy of the data in bits per byte, from 0
+	// to 8. Values close to 8 suggest compressed or encrypted data.
+	Entropy float64
+}
+
+func (h HiddenData) String() string {
+	return fmt.Sprintf("%s at 0x%x: 0x%x bytes, entropy %.2f", h.Area, h.Offset, h.Size, h.Entropy)
+}
+
+// Entropy returns the Shannon entropy of buf in bits per byte
+func Entropy(buf []byte) float64 {
+	if len(buf) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range buf {
+		counts[b]++
+	}
+	var e float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(len(buf))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// hiddenArea is a range of the image that is expected to only hold fill
+// bytes
+type hiddenArea struct {
+	name       string
+	start, end uint64
+	fill       []byte
+}
+
+// scan returns the runs of bytes of the area that are not fill bytes
+func (a hiddenArea) scan(buf []byte) []HiddenData {
+	if a.end > uint64(len(buf)) {
+		a.end = uint64(len(buf))
+	}
+	isFill := func(b byte) bool {
+		for _, f := range a.fill {
+			if b == f {
+				return true
+			}
+		}
+		return false
+	}
+	var found []HiddenData
+	for i := a.start; i < a.end; {
+		if isFill(buf[i]) {
+			i++
+			continue
+		}
+		start, end := i, i+1
+		for j := end; j < a.end && j < end+hiddenDataMergeGap; j++ {
+			if !isFill(buf[j]) {
+				end = j + 1
+			}
+		}
+		found = append(found, HiddenData{
+			Area:    a.name,
+			Offset:  start,
+			Size:    end - start,
+			Entropy: Entropy(buf[start:end]),
+		})
+		i = end
+	}
+	return found
+}
+
+// descriptorAreas returns the parts of the descriptor region that are not
+// used by the parsed sections
+func (f FlashImage) descriptorAreas() []hiddenArea {
+	_, end := f.Region.RegionOffset(RegionTypeDescriptor)
+	if end == 0 || uint64(end) > uint64(len(f.buf)) {
+		end = uint32(len(f.buf))
+		if end > 0x1000 {
+			end = 0x1000
+		}
+	}
+	used := []hiddenArea{{start: uint64(f.DescriptorMapStart) - uint64(len(FlashSignature)), end: uint64(f.DescriptorMapStart)}}
+	for _, p := range f.descriptorParts() {
+		b, err := p.m.MarshalBinary()
+		if err != nil || len(b) == 0 {
+			continue
+		}
+		used = append(used, hiddenArea{start: uint64(p.offset), end: uint64(p.offset) + uint64(len(b))})
+	}
+	return unusedAreas("Descriptor reserved area", 0, uint64(end), used, []byte{0x00, 0xff})
+}
+
+// unusedAreas returns the parts of [start, end) not covered by the used
+// ranges
+func unusedAreas(name string, start, end uint64, used []hiddenArea, fill []byte) []hiddenArea {
+	sort.Slice(used, func(i, j int) bool { return used[i].start < used[j].start })
+	var areas []hiddenArea
+	pos := start
+	for _, u := range used {
+		if u.start > pos && u.start <= end {
+			areas = append(areas, hiddenArea{name, pos, u.start, fill})
+		}
+		if u.end > pos {
+			pos = u.end
+		}
+	}
+	if pos < end {
+		areas = append(areas, hiddenArea{name, pos, end, fill})
+	}
+	return areas
+}
+
+// biosAreas returns the parts of the BIOS region outside of the firmware
+// volumes, the free space at the end of the volumes and the content of the
+// pad files
+func (f FlashImage) biosAreas() []hiddenArea {
+	if f.BiosRegion == nil {
+		return nil
+	}
+	start, end := f.Region.BiosOffset()
+	base := uint64(start)
+	var used, areas []hiddenArea
+	for _, fv := range f.BiosRegion.FirmwareVolumes {
+		fvStart := base + fv.Offset
+		used = append(used, hiddenArea{start: fvStart, end: fvStart + fv.Length})
+		if !fv.IsFFS() || fv.VariableStore != nil || len(fv.Broken) != 0 {
+			continue
+		}
+		fill := []byte{fv.erasedByte()}
+		free := fv.DataOffset()
+		for _, file := range fv.Files {
+			fileStart := fvStart + file.Offset
+			if file.Type == FileTypePad {
+				areas = append(areas, hiddenArea{"Pad file", fileStart + file.HeaderLen(), fileStart + file.FileSize(), fill})
+			}
+			if e := align8(file.Offset + file.FileSize()); e > free {
+				free = e
+			}
+		}
+		if free < fv.Length {
+			areas = append(areas, hiddenArea{"Firmware volume free space", fvStart + free, fvStart + fv.Length, fill})
+		}
+	}
+	return append(areas, unusedAreas("BIOS region gap", base, uint64(end), used, []byte{0x00, 0xff})...)
+}
+
+// HiddenData looks for data outside of the parsed structures, where only
+// erased or padding bytes are expected: the flash not covered by any region,
+// the reserved areas of the descriptor, the gaps between the firmware
+// volumes of the BIOS region, their free space and their pad files. Runs of
+// data separated by less than 16 fill bytes are reported together, sorted by
+// offset.
+func (f FlashImage) HiddenData() []HiddenData {
+	var used []hiddenArea
+	for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+		if start, end := f.Region.RegionOffset(t); end != 0 {
+			used = append(used, hiddenArea{start: uint64(start), end: uint64(end)})
+		}
+	}
+	areas := unusedAreas("Flash not covered by any region", 0, uint64(len(f.buf)), used, []byte{0x00, 0xff})
+	areas = append(areas, f.descriptorAreas()...)
+	areas = append(areas, f.biosAreas()...)
+	found := make([]HiddenData, 0)
+	for _, a := range areas {
+		found = append(found, a.scan(f.buf)...)
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Offset < found[j].Offset })
+	return found
+}
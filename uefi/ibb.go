@@ -0,0 +1,150 @@
+package uefi
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// newHash returns a hash.Hash for the algorithm, for the algorithms
+// supported by the standard library
+func (a HashAlgorithm) newHash() (hash.Hash, error) {
+	switch a {
+	case HashAlgorithmSHA1:
+		return sha1.New(), nil
+	case HashAlgorithmSHA256:
+		return sha256.New(), nil
+	case HashAlgorithmSHA384:
+		return sha512.New384(), nil
+	case HashAlgorithmSHA512:
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("Unsupported hash algorithm %v", a)
+}
+
+// IBBSegmentData returns the bytes of the BIOS region described by an IBB
+// segment
+func (br BiosRegion) IBBSegmentData(s IBBSegment) ([]byte, error) {
+	regionSize := uint64(len(br.buf))
+	start, err := addressToOffset(uint64(s.Base), regionSize)
+	if err != nil {
+		return nil, err
+	}
+	end := start + uint64(s.Size)
+	if end > regionSize {
+		return nil, fmt.Errorf("IBB segment [0x%x-0x%x] exceeds the BIOS region", s.Base, uint64(s.Base)+uint64(s.Size))
+	}
+	return br.buf[start:end], nil
+}
+
+// IBBData returns the hashed segments of an IBB element, concatenated in the
+// order of the manifest, which is the data the IBB hash is computed on
+func (br BiosRegion) IBBData(e IBBElement) ([]byte, error) {
+	var data []byte
+	for i, s := range e.Segments {
+		if !s.Hashed() {
+			continue
+		}
+		buf, err := br.IBBSegmentData(s)
+		if err != nil {
+			return nil, fmt.Errorf("Segment %d: %v", i+1, err)
+		}
+		data = append(data, buf...)
+	}
+	return data, nil
+}
+
+// IBBHashCheck is the result of the verification of an IBB hash by
+// BiosRegion.VerifyIBB
+type IBBHashCheck struct {
+	// Element is the index of the IBB element in the manifest, from 1
+	Element  int
+	Expected BootGuardHash
+	// Computed is empty if the algorithm is not supported
+	Computed []byte
+	Match    bool
+}
+
+func (c IBBHashCheck) String() string {
+	result := "mismatch"
+	switch {
+	case c.Computed == nil:
+		result = "unsupported algorithm"
+	case c.Match:
+		result = "match"
+	}
+	return fmt.Sprintf("IBB element %d: %v: %s (computed %x)", c.Element, c.Expected, result, c.Computed)
+}
+
+// VerifyIBB computes the hashes of the IBB of the Boot Policy Manifest and
+// compares them to the ones signed in it
+func (br BiosRegion) VerifyIBB() ([]IBBHashCheck, error) {
+	bpm, err := br.BootPolicyManifest()
+	if err != nil {
+		return nil, err
+	}
+	if bpm == nil {
+		return nil, fmt.Errorf("The BIOS region has no Boot Policy Manifest")
+	}
+	var checks []IBBHashCheck
+	for i, e := range bpm.IBBs {
+		data, err := br.IBBData(e)
+		if err != nil {
+			return nil, fmt.Errorf("IBB element %d: %v", i+1, err)
+		}
+		for _, expected := range e.Hashes {
+			c := IBBHashCheck{Element: i + 1, Expected: expected}
+			if h, err := expected.Algorithm.newHash(); err == nil {
+				h.Write(data)
+				c.Computed = h.Sum(nil)
+				c.Match = bytes.Equal(c.Computed, expected.Digest)
+			} else {
+				debugf("IBB element %d: %v", i+1, err)
+			}
+			checks = append(checks, c)
+		}
+	}
+	return checks, nil
+}
+
+// ExtractIBB writes the segments of the IBB elements of the Boot Policy
+// Manifest to dir, as ibb<element>_segment<n>_<base>.bin, and the hashed
+// segments of each element concatenated as ibb<element>.bin
+func (br BiosRegion) ExtractIBB(dir string) error {
+	bpm, err := br.BootPolicyManifest()
+	if err != nil {
+		return err
+	}
+	if bpm == nil {
+		return fmt.Errorf("The BIOS region has no Boot Policy Manifest")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, e := range bpm.IBBs {
+		for j, s := range e.Segments {
+			buf, err := br.IBBSegmentData(s)
+			if err != nil {
+				return fmt.Errorf("IBB element %d segment %d: %v", i+1, j+1, err)
+			}
+			name := fmt.Sprintf("ibb%d_segment%d_%08x.bin", i+1, j+1, s.Base)
+			if err := ioutil.WriteFile(filepath.Join(dir, name), buf, 0644); err != nil {
+				return err
+			}
+		}
+		data, err := br.IBBData(e)
+		if err != nil {
+			return fmt.Errorf("IBB element %d: %v", i+1, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("ibb%d.bin", i+1)), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
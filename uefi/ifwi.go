@@ -0,0 +1,98 @@
+package uefi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IFWI is an Integrated Firmware Image, the layout of the Apollo Lake and
+// later Atom platforms: one or two boot partitions, each described by a
+// BPDT, holding the CSE firmware and the BIOS. The second boot partition
+// starts at the middle of the image.
+type IFWI struct {
+	BootPartitions []*BPDT
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the image
+func (i IFWI) Buf() []byte {
+	return i.buf
+}
+
+// bootPartition returns the bytes of boot partition n
+func (i IFWI) bootPartition(n int) []byte {
+	if len(i.BootPartitions) == 1 {
+		return i.buf
+	}
+	half := len(i.buf) / 2
+	if n == 0 {
+		return i.buf[:half]
+	}
+	return i.buf[half:]
+}
+
+// Version returns the version of the CSE firmware from the first boot
+// partition, and whether it was found
+func (i IFWI) Version() (MeVersion, bool) {
+	return i.BootPartitions[0].Version()
+}
+
+// Summary prints a multi-line description of the image
+func (i IFWI) Summary() string {
+	var bps []string
+	for _, bp := range i.BootPartitions {
+		bps = append(bps, bp.Summary())
+	}
+	version := "<unknown>"
+	if v, ok := i.Version(); ok {
+		version = v.String()
+	}
+	return fmt.Sprintf("IFWI{\n"+
+		"    Size=%v\n"+
+		"    Version=%v\n"+
+		"    BootPartitions=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}", len(i.buf), version, Indent(strings.Join(bps, "\n"), 8))
+}
+
+// Validate checks that the subpartitions fit in their boot partitions
+func (i IFWI) Validate() []error {
+	errors := make([]error, 0)
+	for n, bp := range i.BootPartitions {
+		errors = append(errors, bp.Validate(uint32(len(i.bootPartition(n))))...)
+	}
+	return errors
+}
+
+// MarshalBinary serializes the image
+func (i IFWI) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, i.buf...), nil
+}
+
+// NewIFWI parses an IFWI, which starts with the BPDT of the first boot
+// partition
+func NewIFWI(buf []byte) (*IFWI, error) {
+	if !IsBPDT(buf) {
+		return nil, fmt.Errorf("No BPDT found at the start of the image")
+	}
+	i := IFWI{buf: buf}
+	half := len(buf) / 2
+	if IsBPDT(buf[half:]) {
+		for _, bp := range [][]byte{buf[:half], buf[half:]} {
+			b, err := NewBPDT(bp, 0)
+			if err != nil {
+				return nil, err
+			}
+			i.BootPartitions = append(i.BootPartitions, b)
+		}
+		return &i, nil
+	}
+	b, err := NewBPDT(buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	i.BootPartitions = []*BPDT{b}
+	return &i, nil
+}
@@ -0,0 +1,143 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"fmt"
+)
+
+// IM4PMagic is the first string of the IM4P containers
+const IM4PMagic = "IM4P"
+
+// IM4PTypeMacEFI is the type of the IM4P containers of the Mac EFI updates
+const IM4PTypeMacEFI = "mefi"
+
+// IM4P compression algorithms
+const (
+	IM4PCompressionNone  = 0
+	IM4PCompressionLZFSE = 1
+)
+
+// im4pCompression is the optional compression description following the
+// payload
+type im4pCompression struct {
+	Algorithm int
+	Size      int
+}
+
+// IM4P is an Apple IMG4 payload, the DER encoded container of the firmware
+// updates of the T2 Macs. The Mac EFI payloads are .scap capsules or flash
+// images.
+type IM4P struct {
+	// Type is the four character code of the payload, e.g. mefi
+	Type        string
+	Description string
+	Payload     []byte
+	// Compression is the algorithm of the compressed payloads, and
+	// UncompressedSize their size once decompressed
+	Compression      int
+	UncompressedSize int
+	// Firmware is the parsed payload, nil if it is compressed or not a
+	// known firmware type
+	Firmware Firmware
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the container
+func (p IM4P) Buf() []byte {
+	return p.buf
+}
+
+// Summary prints a multi-line description of the container
+func (p IM4P) Summary() string {
+	firmware := "<unknown>"
+	if p.Firmware != nil {
+		firmware = p.Firmware.Summary()
+	}
+	return fmt.Sprintf("IM4P{\n"+
+		"    Type=%s\n"+
+		"    Description=%s\n"+
+		"    PayloadSize=%v\n"+
+		"    Compression=%d\n"+
+		"    Firmware=%v\n"+
+		"}",
+		p.Type, p.Description, len(p.Payload), p.Compression, Indent(firmware, 4))
+}
+
+// Validate checks the payload, if it is a known firmware type
+func (p IM4P) Validate() []error {
+	errors := make([]error, 0)
+	if p.Firmware == nil {
+		return errors
+	}
+	for _, err := range p.Firmware.Validate() {
+		errors = append(errors, fmt.Errorf("IM4P payload %s: %v", p.Type, err))
+	}
+	return errors
+}
+
+// MarshalBinary serializes the container
+func (p IM4P) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, p.buf...), nil
+}
+
+// IsIM4P returns whether buf starts with an IM4P container: a DER sequence
+// whose first element is the IM4P string
+func IsIM4P(buf []byte) bool {
+	if len(buf) < 12 || buf[0] != 0x30 {
+		return false
+	}
+	// the magic follows the sequence tag and its length, of up to 5 bytes
+	return bytes.Contains(buf[:12], append([]byte{0x16, byte(len(IM4PMagic))}, IM4PMagic...))
+}
+
+// NewIM4P parses an IM4P container, and its payload if it is uncompressed
+func NewIM4P(buf []byte) (*IM4P, error) {
+	if !IsIM4P(buf) {
+		return nil, fmt.Errorf("No IM4P header found")
+	}
+	var seq asn1.RawValue
+	rest, err := asn1.Unmarshal(buf, &seq)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid IM4P container: %v", err)
+	}
+	p := IM4P{buf: buf[:len(buf)-len(rest)]}
+	var magic string
+	elements := seq.Bytes
+	for _, f := range []*string{&magic, &p.Type, &p.Description} {
+		if elements, err = asn1.UnmarshalWithParams(elements, f, "ia5"); err != nil {
+			return nil, fmt.Errorf("Invalid IM4P header: %v", err)
+		}
+	}
+	if magic != IM4PMagic {
+		return nil, fmt.Errorf("Invalid IM4P magic %q", magic)
+	}
+	if elements, err = asn1.Unmarshal(elements, &p.Payload); err != nil {
+		return nil, fmt.Errorf("Invalid IM4P payload: %v", err)
+	}
+	// the optional keybags and compression description follow
+	for len(elements) > 0 {
+		var c im4pCompression
+		var next []byte
+		if next, err = asn1.Unmarshal(elements, &c); err == nil {
+			p.Compression, p.UncompressedSize = c.Algorithm, c.Size
+			elements = next
+			continue
+		}
+		var raw asn1.RawValue
+		if elements, err = asn1.Unmarshal(elements, &raw); err != nil {
+			return nil, fmt.Errorf("Invalid IM4P element: %v", err)
+		}
+	}
+	if p.Compression != IM4PCompressionNone {
+		debugf("IM4P payload %s: unsupported compression %d", p.Type, p.Compression)
+		return &p, nil
+	}
+	if fw, err := Parse(p.Payload); err == nil {
+		p.Firmware = fw
+	} else {
+		debugf("IM4P payload %s: %v", p.Type, err)
+	}
+	return &p, nil
+}
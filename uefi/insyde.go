@@ -0,0 +1,203 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// InsydeIFlashSignature starts the headers of the sub-images of the Insyde
+// iFlash update files
+var InsydeIFlashSignature = []byte("$_IFLASH")
+
+// InsydeIFlashHeaderSize is the size of the header of an iFlash sub-image
+const InsydeIFlashHeaderSize = 24
+
+// InsydeIFlashImageNames maps the tags of the iFlash sub-images to a
+// description of their content
+var InsydeIFlashImageNames = map[string]string{
+	"BIOSIMG": "BIOS",
+	"DRV_IMG": "iFlash driver",
+	"INI_IMG": "platform.ini",
+	"EC_IMG":  "EC",
+	"ME_IMG":  "ME",
+	"FD_IMG":  "Flash descriptor",
+	"OEM_ID":  "OEM ID",
+	"BIOSCER": "BIOS certificate",
+	"BIOSCR2": "BIOS certificate",
+}
+
+// InsydeIFlashHeader is the header of an iFlash sub-image. The sizes are
+// counted from the end of the header.
+type InsydeIFlashHeader struct {
+	Signature [8]byte
+	ImageTag  [8]byte
+	TotalSize uint32
+	ImageSize uint32
+}
+
+// InsydeIFlashImage is a sub-image of an Insyde iFlash update file
+type InsydeIFlashImage struct {
+	Header InsydeIFlashHeader
+	// Offset is the position of the header in the update file
+	Offset uint64
+	Data   []byte
+	// Firmware is the parsed image, nil if it is not a known firmware type
+	Firmware Firmware
+}
+
+// Tag returns the tag of the sub-image, e.g. BIOSIMG
+func (i InsydeIFlashImage) Tag() string {
+	return strings.Trim(string(i.Header.ImageTag[:]), "_\x00 ")
+}
+
+// Name returns a description of the content of the sub-image
+func (i InsydeIFlashImage) Name() string {
+	if name, ok := InsydeIFlashImageNames[i.Tag()]; ok {
+		return name
+	}
+	return "Unknown"
+}
+
+// Summary prints a multi-line description of the sub-image
+func (i InsydeIFlashImage) Summary() string {
+	firmware := "<unknown>"
+	if i.Firmware != nil {
+		firmware = i.Firmware.Summary()
+	}
+	return fmt.Sprintf("InsydeIFlashImage{\n"+
+		"    Tag=%s (%s)\n"+
+		"    Offset=0x%x\n"+
+		"    TotalSize=0x%x\n"+
+		"    ImageSize=0x%x\n"+
+		"    Firmware=%v\n"+
+		"}",
+		i.Tag(), i.Name(), i.Offset, i.Header.TotalSize, i.Header.ImageSize, Indent(firmware, 4))
+}
+
+// InsydeIFlash is an Insyde iFlash update file, the tool executable or
+// package holding the sub-images to flash: the BIOS, the EC firmware, the
+// flash descriptor and so on
+type InsydeIFlash struct {
+	Images []*InsydeIFlashImage
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the update file
+func (f InsydeIFlash) Buf() []byte {
+	return f.buf
+}
+
+// Summary prints a multi-line description of the update file
+func (f InsydeIFlash) Summary() string {
+	var images []string
+	for _, i := range f.Images {
+		images = append(images, i.Summary())
+	}
+	return fmt.Sprintf("InsydeIFlash{\n"+
+		"    Size=%v\n"+
+		"    Images=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}", len(f.buf), Indent(strings.Join(images, "\n"), 8))
+}
+
+// Validate checks the sub-images that are known firmware types
+func (f InsydeIFlash) Validate() []error {
+	errors := make([]error, 0)
+	for _, i := range f.Images {
+		if i.Firmware == nil {
+			continue
+		}
+		for _, err := range i.Firmware.Validate() {
+			errors = append(errors, fmt.Errorf("iFlash image %s: %v", i.Tag(), err))
+		}
+	}
+	return errors
+}
+
+// MarshalBinary serializes the update file
+func (f InsydeIFlash) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, f.buf...), nil
+}
+
+// IsInsydeIFlash returns whether buf starts with an iFlash sub-image
+func IsInsydeIFlash(buf []byte) bool {
+	return len(buf) >= InsydeIFlashHeaderSize && bytes.Equal(buf[:len(InsydeIFlashSignature)], InsydeIFlashSignature)
+}
+
+// parseInsydeIFlashImage parses the sub-image at the start of buf, or
+// returns nil if the signature is not followed by a valid header, e.g. in
+// the code of the iFlash tool
+func parseInsydeIFlashImage(buf []byte) *InsydeIFlashImage {
+	var i InsydeIFlashImage
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &i.Header); err != nil {
+		return nil
+	}
+	for _, c := range i.Header.ImageTag {
+		if c < 0x20 || c > 0x7e {
+			return nil
+		}
+	}
+	end := InsydeIFlashHeaderSize + uint64(i.Header.ImageSize)
+	if i.Header.ImageSize == 0 || i.Header.TotalSize < i.Header.ImageSize || end > uint64(len(buf)) {
+		return nil
+	}
+	i.Data = buf[InsydeIFlashHeaderSize:end]
+	if fw, err := Parse(i.Data); err == nil {
+		i.Firmware = fw
+	} else {
+		debugf("iFlash image %s: %v", i.Tag(), err)
+	}
+	return &i
+}
+
+// NewInsydeIFlash finds the sub-images of an Insyde iFlash update file
+func NewInsydeIFlash(buf []byte) (*InsydeIFlash, error) {
+	f := InsydeIFlash{buf: buf}
+	for offset := 0; offset < len(buf); {
+		idx := bytes.Index(buf[offset:], InsydeIFlashSignature)
+		if idx == -1 {
+			break
+		}
+		offset += idx
+		i := parseInsydeIFlashImage(buf[offset:])
+		if i == nil {
+			offset += len(InsydeIFlashSignature)
+			continue
+		}
+		i.Offset = uint64(offset)
+		f.Images = append(f.Images, i)
+		offset += InsydeIFlashHeaderSize + len(i.Data)
+	}
+	if len(f.Images) == 0 {
+		return nil, fmt.Errorf("No iFlash image found")
+	}
+	return &f, nil
+}
+
+// Extract writes the sub-images to a directory, one file per image named
+// after its position and tag
+func (f InsydeIFlash) Extract(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for n, i := range f.Images {
+		tag := strings.Map(func(r rune) rune {
+			if r == '/' || r == '\\' {
+				return '_'
+			}
+			return r
+		}, i.Tag())
+		name := fmt.Sprintf("%02d_%s.bin", n, tag)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), i.Data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
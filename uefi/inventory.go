@@ -0,0 +1,211 @@
+package uefi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// InventorySchema is the SQL schema of the firmware inventory database
+// written by WriteInventorySQL. Every row references the image it comes from
+// by the SHA256 of the image, so that many images can be stored in the same
+// database and queried together.
+const InventorySchema = `CREATE TABLE IF NOT EXISTS images (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    size INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS nodes (
+    image_id TEXT NOT NULL REFERENCES images(id),
+    id INTEGER NOT NULL,
+    parent_id INTEGER,
+    type TEXT NOT NULL,
+    name TEXT,
+    image_offset INTEGER NOT NULL,
+    size INTEGER NOT NULL,
+    sha256 TEXT NOT NULL,
+    PRIMARY KEY (image_id, id)
+);
+CREATE TABLE IF NOT EXISTS modules (
+    image_id TEXT NOT NULL REFERENCES images(id),
+    volume TEXT NOT NULL,
+    guid TEXT NOT NULL,
+    type TEXT NOT NULL,
+    name TEXT,
+    version TEXT,
+    image_offset INTEGER NOT NULL,
+    size INTEGER NOT NULL,
+    sha256 TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS findings (
+    image_id TEXT NOT NULL REFERENCES images(id),
+    kind TEXT NOT NULL,
+    rule TEXT,
+    confidence TEXT,
+    image_offset INTEGER,
+    message TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS modules_guid ON modules (guid);
+CREATE INDEX IF NOT EXISTS modules_sha256 ON modules (sha256);
+`
+
+// InventoryModule is a module of an image, as listed by Inventory
+type InventoryModule struct {
+	// Volume is the file system GUID of the volume holding the module, or
+	// the kind of the modules outside of the volumes: Microcode, ACM,
+	// BIOSGuard, ME or EC
+	Volume string
+	// Parent is the GUID of the file holding the nested volume of the
+	// module, for the modules of nested volumes
+	Parent  string `json:",omitempty"`
+	GUID    string `json:",omitempty"`
+	Type    string
+	Name    string `json:",omitempty"`
+	Version string `json:",omitempty"`
+	// Offset is the position of the module in the image, or the one of its
+	// parent file for the modules of nested volumes, which may be compressed
+	Offset uint64
+	Size   int
+	SHA256 string
+}
+
+// Inventory returns the modules of the image: the files of the volumes of
+// the BIOS region, including the nested ones, with their names, versions
+// and hashes, the microcode updates named after their CPUID, the ACMs, the
+// BIOS Guard packages named after their platform, and the ME and EC
+// firmwares with their versions
+func (f FlashImage) Inventory() []InventoryModule {
+	modules := make([]InventoryModule, 0)
+	if f.BiosRegion != nil {
+		start, _ := f.Region.BiosOffset()
+		base := uint64(start)
+		f.BiosRegion.walkFiles(func(fv *FirmwareVolume, file, parent *File, offset uint64) {
+			if file.Type == FileTypePad {
+				return
+			}
+			m := InventoryModule{
+				Volume:  fv.guidString(),
+				GUID:    file.GUID(),
+				Type:    file.Type.String(),
+				Name:    file.ModuleName(),
+				Version: file.Version(),
+				Offset:  base + offset,
+				Size:    len(file.buf),
+				SHA256:  sha256Hex(file.buf),
+			}
+			if parent != nil {
+				m.Parent = parent.GUID()
+			}
+			modules = append(modules, m)
+		})
+		for _, m := range f.BiosRegion.Microcodes() {
+			modules = append(modules, InventoryModule{Volume: "Microcode", Type: "Microcode",
+				Name: fmt.Sprintf("0x%08x", m.Header.ProcessorSignature), Version: fmt.Sprintf("0x%x", m.Header.UpdateRevision),
+				Offset: base + m.Offset, Size: len(m.buf), SHA256: sha256Hex(m.buf)})
+		}
+		for _, a := range f.BiosRegion.ACMs() {
+			modules = append(modules, InventoryModule{Volume: "ACM", Type: "ACM",
+				Name: a.TypeName(), Version: fmt.Sprintf("%s SVN %d", a.Date(), a.Header.TxtSVN),
+				Offset: base + a.Offset, Size: len(a.buf), SHA256: sha256Hex(a.buf)})
+		}
+		for _, p := range f.BiosRegion.BIOSGuardPackages() {
+			modules = append(modules, InventoryModule{Volume: "BIOSGuard", Type: "BIOSGuardPackage",
+				Name: p.PlatformID(), Version: fmt.Sprintf("BIOS SVN %d EC SVN %d", p.Header.BIOSSVN, p.Header.ECSVN),
+				Offset: base + p.Offset, Size: len(p.buf), SHA256: sha256Hex(p.buf)})
+		}
+	}
+	if f.MeRegion != nil {
+		if v, ok := f.MeRegion.Version(); ok {
+			start, _ := f.Region.MeOffset()
+			e, _ := f.MeRegion.FPT.Partition("FTPR")
+			data, _ := f.MeRegion.PartitionData("FTPR")
+			modules = append(modules, InventoryModule{Volume: "ME", Type: "MePartition", Name: "FTPR", Version: v.String(),
+				Offset: uint64(start) + uint64(e.Offset), Size: len(data), SHA256: sha256Hex(data)})
+		}
+	}
+	if f.EcRegion != nil && f.EcRegion.Firmware != nil {
+		start, _ := f.Region.RegionOffset(RegionTypeEC)
+		fw, data := f.EcRegion.Firmware, f.EcRegion.Payload()
+		modules = append(modules, InventoryModule{Volume: "EC", Type: "EcFirmware", Name: fw.Format, Version: fw.Version,
+			Offset: uint64(start) + uint64(fw.PayloadOffset), Size: len(data), SHA256: sha256Hex(data)})
+	}
+	return modules
+}
+
+// sqlValue formats a value as a SQL literal
+func sqlValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case string:
+		return "'" + strings.Replace(v, "'", "''", -1) + "'"
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// sqlInsert returns an INSERT statement for the given table and values
+func sqlInsert(table string, values ...interface{}) string {
+	var literals []string
+	for _, v := range values {
+		literals = append(literals, sqlValue(v))
+	}
+	return fmt.Sprintf("INSERT INTO %s VALUES (%s);\n", table, strings.Join(literals, ", "))
+}
+
+// WriteInventorySQL writes the parse results of the image as SQL statements
+// to w: the schema, then the tree of parsed elements, the modules returned
+// by Inventory except the ones of nested volumes, and the validation and
+// scan findings. The rows of a previous export of the same image are deleted
+// first, so exports can be repeated. The output can be loaded with e.g.
+// `sqlite3 inventory.db < image.sql`.
+func (f FlashImage) WriteInventorySQL(w io.Writer, name string) error {
+	id := sha256Hex(f.buf)
+	var b bytes.Buffer
+	b.WriteString(InventorySchema)
+	b.WriteString("BEGIN TRANSACTION;\n")
+	for _, table := range []string{"findings", "modules", "nodes", "images"} {
+		column := "image_id"
+		if table == "images" {
+			column = "id"
+		}
+		fmt.Fprintf(&b, "DELETE FROM %s WHERE %s = %s;\n", table, column, sqlValue(id))
+	}
+	b.WriteString(sqlInsert("images", id, name, len(f.buf)))
+
+	// nodes are numbered in depth-first order
+	nextID := 0
+	var walk func(n *Node, parent interface{})
+	walk = func(n *Node, parent interface{}) {
+		nodeID := nextID
+		nextID++
+		var hash string
+		if n.Offset+n.Size <= uint64(len(f.buf)) {
+			hash = sha256Hex(f.buf[n.Offset : n.Offset+n.Size])
+		}
+		b.WriteString(sqlInsert("nodes", id, nodeID, parent, n.Type, n.Name, n.Offset, n.Size, hash))
+		for _, child := range n.Children {
+			walk(child, nodeID)
+		}
+	}
+	walk(f.Tree(), nil)
+
+	for _, m := range f.Inventory() {
+		// the table only holds the modules with a position in the image
+		if m.Parent != "" {
+			continue
+		}
+		b.WriteString(sqlInsert("modules", id, m.Volume, m.GUID, m.Type, m.Name, m.Version, m.Offset, m.Size, m.SHA256))
+	}
+
+	for _, err := range f.Validate() {
+		b.WriteString(sqlInsert("findings", id, "validation", nil, nil, nil, err.Error()))
+	}
+	for _, finding := range f.Scan(nil) {
+		b.WriteString(sqlInsert("findings", id, "scan", finding.Rule, finding.Confidence.String(),
+			finding.Offset, fmt.Sprintf("%q (%s)", finding.Match, finding.Path)))
+	}
+	b.WriteString("COMMIT;\n")
+	_, err := b.WriteTo(w)
+	return err
+}
@@ -0,0 +1,91 @@
+package uefi
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// LogLevel is the severity of a log message emitted by the parsers.
+type LogLevel int
+
+// Log levels, from the most to the least verbose.
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogDebug:   "DEBUG",
+	LogInfo:    "INFO",
+	LogWarning: "WARNING",
+	LogError:   "ERROR",
+}
+
+func (l LogLevel) String() string {
+	if name, ok := logLevelNames[l]; ok {
+		return name
+	}
+	return "UNKNOWN"
+}
+
+// Logger is the interface used by this package to report what the parsers
+// are doing. Library consumers can implement it to redirect or structure the
+// output, and install it with SetLogger.
+type Logger interface {
+	Logf(level LogLevel, format string, args ...interface{})
+}
+
+// StdLogger is a Logger that writes to a standard library logger, dropping
+// the messages below MinLevel.
+type StdLogger struct {
+	*log.Logger
+	MinLevel LogLevel
+}
+
+// Logf implements the Logger interface.
+func (l StdLogger) Logf(level LogLevel, format string, args ...interface{}) {
+	if level < l.MinLevel {
+		return
+	}
+	l.Printf(level.String()+": "+format, args...)
+}
+
+// NewStdLogger returns a StdLogger that writes to stderr the messages of
+// level minLevel or higher.
+func NewStdLogger(minLevel LogLevel) *StdLogger {
+	return &StdLogger{
+		Logger:   log.New(os.Stderr, "uefi: ", log.LstdFlags),
+		MinLevel: minLevel,
+	}
+}
+
+// DiscardLogger is a Logger that silences all the messages.
+var DiscardLogger Logger = StdLogger{Logger: log.New(ioutil.Discard, "", 0)}
+
+// logger is the package-level logger. By default only warnings and errors
+// are printed.
+var logger Logger = NewStdLogger(LogWarning)
+
+// SetLogger replaces the package-level logger. Passing nil silences the
+// output.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = DiscardLogger
+	}
+	logger = l
+}
+
+func debugf(format string, args ...interface{}) {
+	logger.Logf(LogDebug, format, args...)
+}
+
+func infof(format string, args ...interface{}) {
+	logger.Logf(LogInfo, format, args...)
+}
+
+func warnf(format string, args ...interface{}) {
+	logger.Logf(LogWarning, format, args...)
+}
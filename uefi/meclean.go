@@ -0,0 +1,162 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// meFPTChecksumVersion is the last FPT header version with the 8-bit
+// checksum, later ones have a CRC32
+const meFPTChecksumVersion = 0x20
+
+// meFPTCRC32Offset is the offset of the CRC32 in a version 2.1 header
+const meFPTCRC32Offset = 0x14
+
+// meFPTCRC32 is a way of computing the CRC32 of a version 2.1 partition
+// table, given the table from the header up to the end of the entries
+type meFPTCRC32 func(table []byte) uint32
+
+// meFPTCRC32s are the known variants of the CRC32 of the version 2.1
+// partition tables, covering the header alone or the entries too, computed
+// with the CRC32 field set to zero
+var meFPTCRC32s = []meFPTCRC32{
+	func(table []byte) uint32 { return crc32.ChecksumIEEE(zeroFPTCRC32(table[:MeFPTHeaderSize])) },
+	func(table []byte) uint32 { return crc32.ChecksumIEEE(zeroFPTCRC32(table)) },
+	// the variants without the final inversion
+	func(table []byte) uint32 { return ^crc32.ChecksumIEEE(zeroFPTCRC32(table[:MeFPTHeaderSize])) },
+	func(table []byte) uint32 { return ^crc32.ChecksumIEEE(zeroFPTCRC32(table)) },
+}
+
+// zeroFPTCRC32 returns a copy of the table with the CRC32 set to zero
+func zeroFPTCRC32(table []byte) []byte {
+	t := append([]byte{}, table...)
+	binary.LittleEndian.PutUint32(t[meFPTCRC32Offset:], 0)
+	return t
+}
+
+// fptCRC32 returns the variant of the CRC32 that matches the one of the
+// partition table of the region, or an error if none does, as the table
+// could not be updated without invalidating it
+func (mr MeRegion) fptCRC32() (meFPTCRC32, error) {
+	crc, err := mr.FPT.Header.CRC32()
+	if err != nil {
+		return nil, err
+	}
+	start := int(mr.FPT.Offset)
+	end := start + MeFPTHeaderSize
+	if mr.FPT.Header.HeaderLength > MeFPTHeaderSize {
+		end = start + int(mr.FPT.Header.HeaderLength)
+	}
+	end += len(mr.FPT.Entries) * MeFPTEntrySize
+	for _, f := range meFPTCRC32s {
+		if f(mr.buf[start:end]) == crc {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("Cannot update the ME partition table: unknown CRC32 0x%08x of the version 0x%02x header",
+		crc, mr.FPT.Header.HeaderVersion)
+}
+
+// MeCleanPartitions are the partitions kept by default by CleanME: the
+// FTPR partition holds the bring-up code that the ME needs to initialize the
+// platform, everything else can be removed
+var MeCleanPartitions = []string{"FTPR"}
+
+// Minimized returns a copy of the region with only the partitions in keep,
+// the way me_cleaner does: the other partitions are erased and removed from
+// the partition table. The checksum of the table is updated, and the CRC32
+// of the version 2.1 tables is computed like the original one, the regions
+// whose CRC32 is computed in an unknown way are refused.
+func (mr MeRegion) Minimized(keep []string) (*MeRegion, error) {
+	if mr.FPT == nil {
+		return nil, fmt.Errorf("The ME region has no partition table")
+	}
+	kept := make(map[string]bool)
+	for _, name := range keep {
+		if _, ok := mr.FPT.Partition(name); !ok {
+			return nil, fmt.Errorf("ME partition %s not present", name)
+		}
+		kept[name] = true
+	}
+	var crc meFPTCRC32
+	if mr.FPT.Header.HeaderVersion > meFPTChecksumVersion {
+		var err error
+		if crc, err = mr.fptCRC32(); err != nil {
+			return nil, err
+		}
+	}
+	buf := append([]byte{}, mr.buf...)
+	var entries []MeFPTEntry
+	for _, e := range mr.FPT.Entries {
+		if kept[e.PartitionName()] {
+			entries = append(entries, e)
+			continue
+		}
+		if e.Present() && uint64(e.Offset)+uint64(e.Length) <= uint64(len(buf)) {
+			copy(buf[e.Offset:e.Offset+e.Length], bytes.Repeat([]byte{0xff}, int(e.Length)))
+		}
+	}
+	// the kept partitions may share bytes with the removed ones
+	for _, e := range entries {
+		if e.Present() && uint64(e.Offset)+uint64(e.Length) <= uint64(len(buf)) {
+			copy(buf[e.Offset:e.Offset+e.Length], mr.buf[e.Offset:e.Offset+e.Length])
+		}
+	}
+
+	header := mr.FPT.Header
+	header.NumEntries = uint32(len(entries))
+	var table bytes.Buffer
+	if err := binary.Write(&table, binary.LittleEndian, header); err != nil {
+		return nil, err
+	}
+	if header.HeaderLength > MeFPTHeaderSize {
+		start := int(mr.FPT.Offset) + MeFPTHeaderSize
+		table.Write(mr.buf[start : start+int(header.HeaderLength)-MeFPTHeaderSize])
+	}
+	if err := binary.Write(&table, binary.LittleEndian, entries); err != nil {
+		return nil, err
+	}
+	if header.HeaderVersion <= meFPTChecksumVersion {
+		t := table.Bytes()
+		t[0xb] = 0
+		var sum uint8
+		for _, b := range t[:MeFPTHeaderSize] {
+			sum += b
+		}
+		t[0xb] = -sum
+	} else {
+		t := table.Bytes()
+		binary.LittleEndian.PutUint32(t[meFPTCRC32Offset:], crc(t))
+	}
+	// the entries of the removed partitions are erased
+	oldEnd := int(mr.FPT.Offset) + table.Len() + (len(mr.FPT.Entries)-len(entries))*MeFPTEntrySize
+	copy(buf[mr.FPT.Offset:oldEnd], bytes.Repeat([]byte{0xff}, oldEnd-int(mr.FPT.Offset)))
+	copy(buf[mr.FPT.Offset:], table.Bytes())
+	return NewMeRegion(buf)
+}
+
+// CleanME minimizes the ME region keeping the partitions in keep, or
+// MeCleanPartitions if keep is empty, see MeRegion.Minimized. If setHAP is
+// set, the ME is also asked to disable itself after bring-up, see
+// SetMEDisabled.
+func (f *FlashImage) CleanME(keep []string, setHAP bool) error {
+	if f.MeRegion == nil {
+		return fmt.Errorf("The image has no ME region")
+	}
+	if len(keep) == 0 {
+		keep = MeCleanPartitions
+	}
+	me, err := f.MeRegion.Minimized(keep)
+	if err != nil {
+		return err
+	}
+	if setHAP {
+		if err := f.SetMEDisabled(true); err != nil {
+			return err
+		}
+	}
+	f.MeRegion = me
+	return nil
+}
@@ -0,0 +1,62 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+)
+
+// fpt21Region returns an ME region with a version 2.1 partition table
+// holding the FTPR and MFS partitions, whose CRC32 covers the header and the
+// entries
+func fpt21Region(t *testing.T) []byte {
+	buf := bytes.Repeat([]byte{0xff}, 0x3000)
+	var table bytes.Buffer
+	header := MeFPTHeader{NumEntries: 2, HeaderVersion: MeFPTVersion21, EntryVersion: 0x10, HeaderLength: MeFPTHeaderSize}
+	copy(header.Signature[:], MeFPTSignature)
+	entries := []MeFPTEntry{
+		{Name: [4]byte{'F', 'T', 'P', 'R'}, Offset: 0x1000, Length: 0x1000},
+		{Name: [4]byte{'M', 'F', 'S'}, Offset: 0x2000, Length: 0x1000, Flags: uint32(MePartitionNVRAM)},
+	}
+	if err := binary.Write(&table, binary.LittleEndian, header); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(&table, binary.LittleEndian, entries); err != nil {
+		t.Fatal(err)
+	}
+	copy(buf, table.Bytes())
+	binary.LittleEndian.PutUint32(buf[meFPTCRC32Offset:], crc32.ChecksumIEEE(table.Bytes()))
+	return buf
+}
+
+func TestMinimizedFPT21(t *testing.T) {
+	mr, err := NewMeRegion(fpt21Region(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	me, err := mr.Minimized(MeCleanPartitions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(me.FPT.Entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(me.FPT.Entries))
+	}
+	table := me.buf[:MeFPTHeaderSize+MeFPTEntrySize]
+	want := crc32.ChecksumIEEE(zeroFPTCRC32(table))
+	if got, _ := me.FPT.Header.CRC32(); got != want {
+		t.Errorf("got CRC32 0x%08x, want 0x%08x", got, want)
+	}
+}
+
+func TestMinimizedFPT21UnknownCRC32(t *testing.T) {
+	buf := fpt21Region(t)
+	buf[meFPTCRC32Offset] ^= 0xff
+	mr, err := NewMeRegion(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mr.Minimized(MeCleanPartitions); err == nil {
+		t.Error("expected an error for an unknown CRC32")
+	}
+}
@@ -0,0 +1,235 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// MeCPDHeaderSize is the size of the $CPD header of version 1, the
+	// header of version 2 has a CRC32 after it and is described by its
+	// HeaderLength
+	MeCPDHeaderSize = 0x10
+	// MeCPDEntrySize is the size of an entry of a $CPD directory
+	MeCPDEntrySize = 0x18
+	// meCPDOffsetMask masks the offset out of the OffsetAttributes field
+	meCPDOffsetMask = 0x1ffffff
+	// meCPDCompressed is set in OffsetAttributes for Huffman compressed
+	// modules
+	meCPDCompressed = 1 << 25
+	// meCPDEntriesMax bounds the number of entries, to reject garbage
+	meCPDEntriesMax = 1024
+)
+
+// MeCPDSignature is the signature of the code partition directories of CSME
+// 11 and later
+var MeCPDSignature = []byte("$CPD")
+
+// MeCPDHeader is the header of a $CPD code partition directory
+type MeCPDHeader struct {
+	Signature     [4]byte
+	NumEntries    uint32
+	HeaderVersion uint8
+	EntryVersion  uint8
+	HeaderLength  uint8
+	Checksum      uint8
+	PartitionName [4]byte
+}
+
+// MeCPDEntry is an entry of a $CPD directory. The offset is relative to the
+// start of the directory.
+type MeCPDEntry struct {
+	Name             [12]byte
+	OffsetAttributes uint32
+	Length           uint32
+	Reserved         uint32
+}
+
+// ModuleName returns the name of the module, e.g. FTPR.man or bup
+func (e MeCPDEntry) ModuleName() string {
+	return strings.TrimRight(string(bytes.SplitN(e.Name[:], []byte{0}, 2)[0]), " ")
+}
+
+// Offset returns the position of the module from the start of the directory
+func (e MeCPDEntry) Offset() uint32 {
+	return e.OffsetAttributes & meCPDOffsetMask
+}
+
+// Compressed returns whether the module is Huffman compressed. Compressed
+// modules are extracted as they are.
+func (e MeCPDEntry) Compressed() bool {
+	return e.OffsetAttributes&meCPDCompressed != 0
+}
+
+// Kind returns "manifest" for the partition manifests, "metadata" for the
+// module metadata and "module" for the code and data modules
+func (e MeCPDEntry) Kind() string {
+	switch {
+	case strings.HasSuffix(e.ModuleName(), ".man"):
+		return "manifest"
+	case strings.HasSuffix(e.ModuleName(), ".met"):
+		return "metadata"
+	}
+	return "module"
+}
+
+func (e MeCPDEntry) String() string {
+	return fmt.Sprintf("MeCPDEntry{Name=%s, Kind=%s, Offset=0x%x, Length=0x%x, Compressed=%v}",
+		e.ModuleName(), e.Kind(), e.Offset(), e.Length, e.Compressed())
+}
+
+// MeCPD is a $CPD code partition directory, which lists the modules of a
+// partition with their manifest and metadata
+type MeCPD struct {
+	// Partition is the name of the FPT partition holding the directory
+	Partition string
+	Header    MeCPDHeader
+	Entries   []MeCPDEntry
+	// Holds the raw buffer, from the start of the directory to the end of
+	// the partition
+	buf []byte
+}
+
+// Name returns the name of the partition in the directory header
+func (c MeCPD) Name() string {
+	return strings.TrimRight(string(c.Header.PartitionName[:]), "\x00 ")
+}
+
+// Module returns the bytes of the module with the given name
+func (c MeCPD) Module(name string) ([]byte, error) {
+	for _, e := range c.Entries {
+		if e.ModuleName() == name {
+			return c.ModuleData(e)
+		}
+	}
+	return nil, fmt.Errorf("Module %s not found in the %s directory", name, c.Partition)
+}
+
+// ModuleData returns the bytes of the module of an entry
+func (c MeCPD) ModuleData(e MeCPDEntry) ([]byte, error) {
+	end := uint64(e.Offset()) + uint64(e.Length)
+	if end > uint64(len(c.buf)) {
+		return nil, fmt.Errorf("Module %s [0x%x-0x%x] exceeds the %s partition",
+			e.ModuleName(), e.Offset(), end, c.Partition)
+	}
+	return c.buf[e.Offset():end], nil
+}
+
+// Summary prints a multi-line description of the directory
+func (c MeCPD) Summary() string {
+	var entries []string
+	for _, e := range c.Entries {
+		entries = append(entries, e.String())
+	}
+	return fmt.Sprintf("MeCPD{\n"+
+		"    Partition=%v\n"+
+		"    Name=%v\n"+
+		"    HeaderVersion=%v\n"+
+		"    NumEntries=%v\n"+
+		"    Entries=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		c.Partition,
+		c.Name(),
+		c.Header.HeaderVersion,
+		c.Header.NumEntries,
+		Indent(strings.Join(entries, "\n"), 8),
+	)
+}
+
+// NewMeCPD parses the $CPD directory at the start of buf, which extends to
+// the end of its partition
+func NewMeCPD(buf []byte, partition string) (*MeCPD, error) {
+	if len(buf) < MeCPDHeaderSize {
+		return nil, fmt.Errorf("ME code partition directory too small: expected %v bytes, got %v",
+			MeCPDHeaderSize, len(buf))
+	}
+	if !bytes.Equal(buf[:len(MeCPDSignature)], MeCPDSignature) {
+		return nil, fmt.Errorf("ME code partition directory signature %q not found", MeCPDSignature)
+	}
+	c := MeCPD{Partition: partition, buf: buf}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &c.Header); err != nil {
+		return nil, err
+	}
+	if c.Header.NumEntries > meCPDEntriesMax {
+		return nil, fmt.Errorf("Too many entries in the %s code partition directory: %v", partition, c.Header.NumEntries)
+	}
+	entriesStart := MeCPDHeaderSize
+	if int(c.Header.HeaderLength) > entriesStart {
+		entriesStart = int(c.Header.HeaderLength)
+	}
+	entriesEnd := entriesStart + int(c.Header.NumEntries)*MeCPDEntrySize
+	if entriesEnd > len(buf) {
+		return nil, fmt.Errorf("The entries of the %s code partition directory [0x%x-0x%x] exceed the partition size 0x%x",
+			partition, entriesStart, entriesEnd, len(buf))
+	}
+	c.Entries = make([]MeCPDEntry, c.Header.NumEntries)
+	if err := binary.Read(bytes.NewReader(buf[entriesStart:entriesEnd]), binary.LittleEndian, c.Entries); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// MeModuleInfo describes a module written by ExtractModules
+type MeModuleInfo struct {
+	Partition  string `json:"partition"`
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	Path       string `json:"path"`
+	Offset     uint32 `json:"offset"`
+	Size       uint32 `json:"size"`
+	Compressed bool   `json:"compressed"`
+	SHA256     string `json:"sha256"`
+}
+
+// ExtractModules writes the modules of the $CPD directories to dir, one
+// directory per partition, with their manifests and metadata, and describes
+// them in modules.json. Offsets are relative to the ME region.
+func (mr MeRegion) ExtractModules(dir string) error {
+	if len(mr.Directories) == 0 {
+		return fmt.Errorf("The ME region has no code partition directories")
+	}
+	modules := make([]MeModuleInfo, 0)
+	for _, c := range mr.Directories {
+		e, _ := mr.FPT.Partition(c.Partition)
+		partDir := filepath.Join(dir, c.Partition)
+		if err := os.MkdirAll(partDir, 0755); err != nil {
+			return err
+		}
+		for _, entry := range c.Entries {
+			data, err := c.ModuleData(entry)
+			if err != nil {
+				return err
+			}
+			name := entry.ModuleName()
+			if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+				return fmt.Errorf("Invalid module name %q in the %s directory", name, c.Partition)
+			}
+			if err := ioutil.WriteFile(filepath.Join(partDir, name), data, 0644); err != nil {
+				return err
+			}
+			modules = append(modules, MeModuleInfo{
+				Partition:  c.Partition,
+				Name:       name,
+				Kind:       entry.Kind(),
+				Path:       c.Partition + "/" + name,
+				Offset:     e.Offset + entry.Offset(),
+				Size:       entry.Length,
+				Compressed: entry.Compressed(),
+				SHA256:     sha256Hex(data),
+			})
+		}
+	}
+	data, err := json.MarshalIndent(modules, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "modules.json"), data, 0644)
+}
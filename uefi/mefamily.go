@@ -0,0 +1,57 @@
+package uefi
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// MeFamily is the kind of engine the ME region is built for. The TXE of the
+// Atom platforms and the SPS of the server platforms use the same region as
+// the ME of the client platforms, with different partitions and versions.
+type MeFamily int
+
+// ME families
+const (
+	MeFamilyUnknown MeFamily = iota
+	MeFamilyME
+	MeFamilyTXE
+	MeFamilySPS
+)
+
+var meFamilyNames = map[MeFamily]string{
+	MeFamilyUnknown: "Unknown",
+	MeFamilyME:      "ME",
+	MeFamilyTXE:     "TXE",
+	MeFamilySPS:     "SPS",
+}
+
+func (f MeFamily) String() string {
+	if name, ok := meFamilyNames[f]; ok {
+		return name
+	}
+	return fmt.Sprintf("MeFamily(%d)", int(f))
+}
+
+// meTXEMaxMajor is the last major version of the TXE. The ME versions
+// with $MN2 manifests start at 6, the older ones have $MAN manifests.
+const meTXEMaxMajor = 4
+
+// DetectMeFamily guesses the family of the engine from the partition table
+// and the FTPR manifest, either of which may be nil: the SPS has operational
+// partitions OPR1 and OPR2, the TXE has versions 1 to 4 with $MN2 manifests.
+func DetectMeFamily(fpt *MeFPT, manifest *MeManifestHeader) MeFamily {
+	if fpt != nil {
+		for _, name := range []string{"OPR1", "OPR2"} {
+			if _, ok := fpt.Partition(name); ok {
+				return MeFamilySPS
+			}
+		}
+	}
+	if manifest == nil {
+		return MeFamilyUnknown
+	}
+	if bytes.Equal(manifest.Signature[:], MeManifestSignatures[0]) && manifest.Version.Major <= meTXEMaxMajor {
+		return MeFamilyTXE
+	}
+	return MeFamilyME
+}
@@ -0,0 +1,250 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// MeFPTHeaderSize is the size of the $FPT header, from the signature
+	MeFPTHeaderSize = 0x20
+	// MeFPTEntrySize is the size of an entry of the partition table
+	MeFPTEntrySize = 0x20
+	// meFPTBypassVectorSize is the size of the ROM bypass vector that
+	// precedes the $FPT header on some ME generations
+	meFPTBypassVectorSize = 0x10
+	// meFPTEntriesMax bounds the number of entries, to reject garbage
+	meFPTEntriesMax = 128
+	// MeFPTVersion21 is the header version of CSME 12 and later, which
+	// replaced the checksum byte with flags and the Flags field with a
+	// CRC32
+	MeFPTVersion21 = 0x21
+)
+
+// MeFPTSignature is the signature of the ME partition table
+var MeFPTSignature = []byte("$FPT")
+
+// MePartitionType is the type of a partition of the ME region, from the
+// flags of its entry
+type MePartitionType uint8
+
+// ME partition types
+const (
+	MePartitionCode MePartitionType = iota
+	MePartitionData
+	MePartitionNVRAM
+	MePartitionGeneric
+	MePartitionEFFS
+	MePartitionROM
+)
+
+var mePartitionTypeNames = map[MePartitionType]string{
+	MePartitionCode:    "Code",
+	MePartitionData:    "Data",
+	MePartitionNVRAM:   "NVRAM",
+	MePartitionGeneric: "Generic",
+	MePartitionEFFS:    "EFFS",
+	MePartitionROM:     "ROM",
+}
+
+func (t MePartitionType) String() string {
+	if name, ok := mePartitionTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("MePartitionType(%d)", uint8(t))
+}
+
+// MeFPTHeader is the header of the ME partition table. The checksum and
+// the tick fields have different meanings across ME generations and are
+// kept raw, see the accessors for the version 2.1 layout.
+type MeFPTHeader struct {
+	Signature      [4]byte
+	NumEntries     uint32
+	HeaderVersion  uint8
+	EntryVersion   uint8
+	HeaderLength   uint8
+	HeaderChecksum uint8
+	TicksToAdd     uint16
+	TokensToAdd    uint16
+	UMASize        uint32
+	Flags          uint32
+	// FitcMajor, FitcMinor, FitcHotfix and FitcBuild are the version of
+	// the tool that built the image
+	FitcMajor  uint16
+	FitcMinor  uint16
+	FitcHotfix uint16
+	FitcBuild  uint16
+}
+
+// IsVersion21 returns whether the header has the layout of CSME 12 and
+// later
+func (h MeFPTHeader) IsVersion21() bool {
+	return h.HeaderVersion >= MeFPTVersion21
+}
+
+// Redundant returns whether the version 2.1 header has the redundancy flag
+// set, i.e. a backup of the partitions is kept
+func (h MeFPTHeader) Redundant() bool {
+	return h.IsVersion21() && h.HeaderChecksum&1 != 0
+}
+
+// CRC32 returns the CRC32 of a version 2.1 header, which takes the place of
+// the Flags field
+func (h MeFPTHeader) CRC32() (uint32, error) {
+	if !h.IsVersion21() {
+		return 0, fmt.Errorf("FPT header version 0x%02x has no CRC32", h.HeaderVersion)
+	}
+	return h.Flags, nil
+}
+
+// MeFPTEntry is an entry of the ME partition table. Offset is relative to
+// the start of the ME region.
+type MeFPTEntry struct {
+	Name           [4]byte
+	Owner          [4]byte
+	Offset         uint32
+	Length         uint32
+	StartTokens    uint32
+	MaxTokens      uint32
+	ScratchSectors uint32
+	Flags          uint32
+}
+
+// PartitionName returns the name of the partition, e.g. FTPR or MFS
+func (e MeFPTEntry) PartitionName() string {
+	return strings.TrimRight(string(e.Name[:]), "\x00 ")
+}
+
+// PartitionType returns the type of the partition, from bits 6:0 of the
+// flags
+func (e MeFPTEntry) PartitionType() MePartitionType {
+	return MePartitionType(e.Flags & 0x7f)
+}
+
+// Valid returns whether the entry is marked as valid, i.e. bits 31:24 of
+// the flags are not all set
+func (e MeFPTEntry) Valid() bool {
+	return e.Flags>>24 != 0xff
+}
+
+// Present returns whether the partition has data in the region. Some
+// partitions, e.g. on the host or in RAM, only have an entry.
+func (e MeFPTEntry) Present() bool {
+	return e.Valid() && e.Length != 0 && e.Offset != 0 && e.Offset != 0xffffffff
+}
+
+func (e MeFPTEntry) String() string {
+	return fmt.Sprintf("MeFPTEntry{Name=%s, Type=%v, Offset=0x%x, Length=0x%x, Valid=%v}",
+		e.PartitionName(), e.PartitionType(), e.Offset, e.Length, e.Valid())
+}
+
+// MeFPT is the $FPT partition table at the start of the ME region
+type MeFPT struct {
+	// Offset is the position of the signature in the region, 0 or after
+	// the ROM bypass vector
+	Offset  uint32
+	Header  MeFPTHeader
+	Entries []MeFPTEntry
+}
+
+// Partition returns the entry of the partition with the given name, and
+// whether the table has it
+func (t MeFPT) Partition(name string) (MeFPTEntry, bool) {
+	for _, e := range t.Entries {
+		if e.PartitionName() == name {
+			return e, true
+		}
+	}
+	return MeFPTEntry{}, false
+}
+
+// Summary prints a multi-line description of the partition table
+func (t MeFPT) Summary() string {
+	var entries []string
+	for _, e := range t.Entries {
+		entries = append(entries, e.String())
+	}
+	return fmt.Sprintf("MeFPT{\n"+
+		"    Offset=0x%x\n"+
+		"    HeaderVersion=0x%02x\n"+
+		"    NumEntries=%v\n"+
+		"    FitcVersion=%d.%d.%d.%d\n"+
+		"    Entries=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		t.Offset,
+		t.Header.HeaderVersion,
+		t.Header.NumEntries,
+		t.Header.FitcMajor, t.Header.FitcMinor, t.Header.FitcHotfix, t.Header.FitcBuild,
+		Indent(strings.Join(entries, "\n"), 8),
+	)
+}
+
+// Validate checks that the partitions with data fit in a region of the
+// given size and do not overlap the partition table
+func (t MeFPT) Validate(regionSize uint32) []error {
+	errors := make([]error, 0)
+	tableEnd := uint64(t.Offset) + MeFPTHeaderSize + uint64(len(t.Entries))*MeFPTEntrySize
+	for _, e := range t.Entries {
+		if !e.Present() {
+			continue
+		}
+		end := uint64(e.Offset) + uint64(e.Length)
+		if end > uint64(regionSize) {
+			errors = append(errors, fmt.Errorf("ME partition %s [0x%x-0x%x] exceeds the region size 0x%x",
+				e.PartitionName(), e.Offset, end, regionSize))
+		}
+		if uint64(e.Offset) < tableEnd {
+			errors = append(errors, fmt.Errorf("ME partition %s at 0x%x overlaps the partition table", e.PartitionName(), e.Offset))
+		}
+	}
+	return errors
+}
+
+// FindMeFPT returns the offset of the $FPT signature in an ME region, or -1
+// if there is none
+func FindMeFPT(buf []byte) int {
+	for _, offset := range []int{0, meFPTBypassVectorSize} {
+		if len(buf) >= offset+len(MeFPTSignature) && bytes.Equal(buf[offset:offset+len(MeFPTSignature)], MeFPTSignature) {
+			return offset
+		}
+	}
+	return -1
+}
+
+// NewMeFPT parses the $FPT partition table of an ME region
+func NewMeFPT(buf []byte) (*MeFPT, error) {
+	offset := FindMeFPT(buf)
+	if offset < 0 {
+		return nil, fmt.Errorf("ME partition table signature %q not found", MeFPTSignature)
+	}
+	if len(buf) < offset+MeFPTHeaderSize {
+		return nil, fmt.Errorf("ME partition table header too small: expected %v bytes, got %v",
+			MeFPTHeaderSize, len(buf)-offset)
+	}
+	t := MeFPT{Offset: uint32(offset)}
+	reader := bytes.NewReader(buf[offset:])
+	if err := binary.Read(reader, binary.LittleEndian, &t.Header); err != nil {
+		return nil, err
+	}
+	if t.Header.NumEntries > meFPTEntriesMax {
+		return nil, fmt.Errorf("Too many ME partition table entries: %v", t.Header.NumEntries)
+	}
+	entriesStart := offset + MeFPTHeaderSize
+	if t.Header.HeaderLength > MeFPTHeaderSize {
+		entriesStart = offset + int(t.Header.HeaderLength)
+	}
+	entriesEnd := entriesStart + int(t.Header.NumEntries)*MeFPTEntrySize
+	if entriesEnd > len(buf) {
+		return nil, fmt.Errorf("ME partition table entries [0x%x-0x%x] exceed the region size 0x%x",
+			entriesStart, entriesEnd, len(buf))
+	}
+	t.Entries = make([]MeFPTEntry, t.Header.NumEntries)
+	if err := binary.Read(bytes.NewReader(buf[entriesStart:entriesEnd]), binary.LittleEndian, t.Entries); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,84 @@
+package uefi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IccPartitionNames are the ME partitions searched for the Integrated Clock
+// Controller data, in order. The layout of the data is not public and
+// changes across ME generations. Users can add their own names.
+var IccPartitionNames = []string{"ICCP"}
+
+// IccProfile is a clock profile decoded from the ICC data, e.g. the
+// frequencies and spread spectrum settings of the clock outputs
+type IccProfile struct {
+	Name   string
+	Fields map[string]string
+}
+
+func (p IccProfile) String() string {
+	keys := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]string, 0, len(keys))
+	for _, k := range keys {
+		fields = append(fields, fmt.Sprintf("%s=%q", k, p.Fields[k]))
+	}
+	return fmt.Sprintf("IccProfile{Name=%s, %s}", p.Name, strings.Join(fields, ", "))
+}
+
+// IccDecoder decodes the ICC data of an ME generation. It returns the
+// profiles, and false if the data does not have the layout it knows.
+type IccDecoder func(data []byte) ([]IccProfile, bool)
+
+type namedIccDecoder struct {
+	name   string
+	decode IccDecoder
+}
+
+var iccDecoders []namedIccDecoder
+
+// RegisterIccDecoder registers a decoder for the ICC data. The decoders are
+// tried in registration order by MeRegion.IccProfiles, and the first one
+// that recognizes the data is used. Registering a decoder with the name of
+// an existing one replaces it.
+func RegisterIccDecoder(name string, d IccDecoder) {
+	for i, id := range iccDecoders {
+		if id.name == name {
+			iccDecoders[i].decode = d
+			return
+		}
+	}
+	iccDecoders = append(iccDecoders, namedIccDecoder{name, d})
+}
+
+// IccData returns the bytes of the first partition in IccPartitionNames
+// that is present, and its name
+func (mr MeRegion) IccData() ([]byte, string, error) {
+	for _, name := range IccPartitionNames {
+		if data, err := mr.PartitionData(name); err == nil {
+			return data, name, nil
+		}
+	}
+	return nil, "", fmt.Errorf("No ICC data partition found, tried %s", strings.Join(IccPartitionNames, ", "))
+}
+
+// IccProfiles decodes the ICC data with the registered decoders. It returns
+// nil if there is no ICC data or no decoder recognizes it.
+func (mr MeRegion) IccProfiles() []IccProfile {
+	data, name, err := mr.IccData()
+	if err != nil {
+		return nil
+	}
+	for _, d := range iccDecoders {
+		if profiles, ok := d.decode(data); ok {
+			return profiles
+		}
+	}
+	debugf("No decoder recognized the ICC data in partition %s", name)
+	return nil
+}
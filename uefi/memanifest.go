@@ -0,0 +1,85 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// MeManifestHeaderSize is the size of the part of the manifest header
+	// decoded by NewMeManifestHeader
+	MeManifestHeaderSize = 0x2c
+	// meManifestSignatureOffset is the position of the signature in the
+	// manifest header
+	meManifestSignatureOffset = 0x1c
+	// meManifestVendorIntel is the vendor of the manifests signed by Intel
+	meManifestVendorIntel = 0x8086
+)
+
+// MeManifestSignatures are the signatures of the code partition manifests:
+// $MAN on old ME generations, $MN2 since ME 6
+var MeManifestSignatures = [][]byte{[]byte("$MN2"), []byte("$MAN")}
+
+// MeVersion is the version of the ME firmware
+type MeVersion struct {
+	Major  uint16
+	Minor  uint16
+	Hotfix uint16
+	Build  uint16
+}
+
+func (v MeVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d.%d", v.Major, v.Minor, v.Hotfix, v.Build)
+}
+
+// MeManifestHeader is the header of the manifest of an ME code partition,
+// up to the firmware version. The RSA key and signature that follow it are
+// not decoded.
+type MeManifestHeader struct {
+	ModuleType    uint16
+	ModuleSubType uint16
+	// HeaderLength and Size are in dwords
+	HeaderLength  uint32
+	HeaderVersion uint32
+	Flags         uint32
+	ModuleVendor  uint32
+	// Date is BCD encoded, e.g. 0x20170801
+	Date       uint32
+	Size       uint32
+	Signature  [4]byte
+	NumModules uint32
+	Version    MeVersion
+}
+
+func (h MeManifestHeader) String() string {
+	return fmt.Sprintf("MeManifestHeader{Version=%v, Date=%08x, Vendor=0x%x}", h.Version, h.Date, h.ModuleVendor)
+}
+
+// FindMeManifest returns the offset of the first manifest header signed by
+// Intel in buf, e.g. the FTPR partition, or -1 if there is none. On CSME 11
+// and later the manifest follows the $CPD directory of the partition.
+func FindMeManifest(buf []byte) int {
+	for offset := 0; offset+MeManifestHeaderSize <= len(buf); offset += 4 {
+		sig := buf[offset+meManifestSignatureOffset : offset+meManifestSignatureOffset+4]
+		for _, s := range MeManifestSignatures {
+			if bytes.Equal(sig, s) && binary.LittleEndian.Uint32(buf[offset+16:]) == meManifestVendorIntel {
+				return offset
+			}
+		}
+	}
+	return -1
+}
+
+// NewMeManifestHeader parses the manifest header at the start of buf
+func NewMeManifestHeader(buf []byte) (*MeManifestHeader, error) {
+	if len(buf) < MeManifestHeaderSize {
+		return nil, fmt.Errorf("ME manifest header too small: expected %v bytes, got %v",
+			MeManifestHeaderSize, len(buf))
+	}
+	var h MeManifestHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
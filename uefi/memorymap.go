@@ -0,0 +1,103 @@
+package uefi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Memory map owners for the ranges that do not belong to a parsed node
+const (
+	MemoryMapPadding = "Padding"
+	MemoryMapUnknown = "Unknown"
+)
+
+// MemoryMapEntry is a range of bytes of the image, [Start, End), with the
+// element that owns it.
+type MemoryMapEntry struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+	// Owner is the type of the owner, e.g. "File" or "FirmwareVolume header"
+	Owner string `json:"owner"`
+	Name  string `json:"name,omitempty"`
+	// Path is the list of names of the containing nodes, separated by "/"
+	Path string `json:"path,omitempty"`
+}
+
+func (e MemoryMapEntry) String() string {
+	s := fmt.Sprintf("0x%08x-0x%08x %-24s %s", e.Start, e.End, e.Owner, e.Name)
+	return strings.TrimRight(s, " ")
+}
+
+// MemoryMap is an ordered, gap-free list of ranges covering a whole image.
+type MemoryMap []MemoryMapEntry
+
+func (m MemoryMap) String() string {
+	var lines []string
+	for _, e := range m {
+		lines = append(lines, e.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isErased returns whether all the bytes in buf are 0xff, or all are 0x00
+func isErased(buf []byte) bool {
+	if len(buf) == 0 {
+		return true
+	}
+	for _, b := range buf {
+		if b != buf[0] {
+			return false
+		}
+	}
+	return buf[0] == 0xff || buf[0] == 0x00
+}
+
+// memoryMap appends to m the ranges of the node and of its children. The
+// range before the first child is attributed to the header of the node,
+// other gaps are padding if erased, unknown otherwise.
+func memoryMap(m MemoryMap, buf []byte, n *Node, path string) MemoryMap {
+	name := n.Name
+	if name == "" {
+		name = n.Type
+	}
+	childPath := strings.TrimPrefix(path+"/"+name, "/")
+	if len(n.Children) == 0 {
+		return append(m, MemoryMapEntry{Start: n.Offset, End: n.Offset + n.Size, Owner: n.Type, Name: n.Name, Path: path})
+	}
+	cur := n.Offset
+	gap := func(end uint64, header bool) {
+		if end <= cur {
+			return
+		}
+		owner := MemoryMapUnknown
+		switch {
+		case header:
+			owner = n.Type + " header"
+		case end <= uint64(len(buf)) && isErased(buf[cur:end]):
+			owner = MemoryMapPadding
+		}
+		e := MemoryMapEntry{Start: cur, End: end, Owner: owner, Path: childPath}
+		if header {
+			e.Name, e.Path = n.Name, path
+		}
+		m = append(m, e)
+		cur = end
+	}
+	for idx, child := range n.Children {
+		gap(child.Offset, idx == 0 && n.Type != "FlashImage" && n.Type != "Region")
+		if child.Offset < cur {
+			// skip children overlapping the ranges already mapped
+			continue
+		}
+		m = memoryMap(m, buf, child, childPath)
+		cur = child.Offset + child.Size
+	}
+	gap(n.Offset+n.Size, false)
+	return m
+}
+
+// MemoryMap returns the memory map of the flash image, listing every range
+// of bytes with the deepest parsed element that owns it.
+func (f FlashImage) MemoryMap() MemoryMap {
+	return memoryMap(nil, f.buf, f.Tree(), "")
+}
@@ -0,0 +1,146 @@
+package uefi
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// MeRegion represents the Intel Management Engine region of the flash image.
+// The $FPT partition table is parsed, the partitions are kept in the raw
+// buffer.
+type MeRegion struct {
+	// FPT is the partition table, nil if the region has none, e.g. when
+	// the ME firmware was removed
+	FPT *MeFPT
+	// Manifest is the manifest header of the FTPR partition, nil if it
+	// was not found
+	Manifest *MeManifestHeader
+	// Family is the kind of engine, guessed by DetectMeFamily
+	Family MeFamily
+	// Directories are the $CPD directories of the partitions, on CSME 11
+	// and later
+	Directories []*MeCPD
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the region
+func (mr MeRegion) Buf() []byte {
+	return mr.buf
+}
+
+// Type returns RegionTypeME
+func (mr MeRegion) Type() FlashRegionType {
+	return RegionTypeME
+}
+
+// PartitionData returns the bytes of the partition with the given name
+func (mr MeRegion) PartitionData(name string) ([]byte, error) {
+	if mr.FPT == nil {
+		return nil, fmt.Errorf("The ME region has no partition table")
+	}
+	e, ok := mr.FPT.Partition(name)
+	if !ok || !e.Present() {
+		return nil, fmt.Errorf("ME partition %s not present", name)
+	}
+	end := uint64(e.Offset) + uint64(e.Length)
+	if end > uint64(len(mr.buf)) {
+		return nil, fmt.Errorf("ME partition %s [0x%x-0x%x] exceeds the region size 0x%x", name, e.Offset, end, len(mr.buf))
+	}
+	return mr.buf[e.Offset:end], nil
+}
+
+// Version returns the version of the ME firmware from the manifest of the
+// FTPR partition, and whether it was found
+func (mr MeRegion) Version() (MeVersion, bool) {
+	if mr.Manifest == nil {
+		return MeVersion{}, false
+	}
+	return mr.Manifest.Version, true
+}
+
+// Summary prints a multi-line description of the region
+func (mr MeRegion) Summary() string {
+	fpt, version := "<none>", "<unknown>"
+	if mr.FPT != nil {
+		fpt = mr.FPT.Summary()
+	}
+	var directories, profiles []string
+	for _, c := range mr.Directories {
+		directories = append(directories, c.Summary())
+	}
+	for _, p := range mr.IccProfiles() {
+		profiles = append(profiles, p.String())
+	}
+	if v, ok := mr.Version(); ok {
+		version = v.String()
+	}
+	return fmt.Sprintf("MeRegion{\n"+
+		"    Size=%v\n"+
+		"    Family=%v\n"+
+		"    Version=%v\n"+
+		"    FPT=%v\n"+
+		"    IccProfiles=[%v]\n"+
+		"    Directories=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}", len(mr.buf), mr.Family, version, Indent(fpt, 4), strings.Join(profiles, ", "), Indent(strings.Join(directories, "\n"), 8))
+}
+
+// Validate checks that the partitions of the partition table fit in the
+// region
+func (mr MeRegion) Validate() []error {
+	if mr.FPT == nil {
+		return []error{}
+	}
+	return mr.FPT.Validate(uint32(len(mr.buf)))
+}
+
+// MarshalBinary serializes the region
+func (mr MeRegion) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, mr.buf...), nil
+}
+
+// NewMeRegion parses a sequence of bytes and returns a MeRegion object, if a valid
+// one is passed, or an error
+func NewMeRegion(data []byte) (*MeRegion, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Intel Management Engine region is empty")
+	}
+	mr := MeRegion{buf: data}
+	if FindMeFPT(data) < 0 {
+		debugf("No ME partition table found")
+		return &mr, nil
+	}
+	fpt, err := NewMeFPT(data)
+	if err != nil {
+		return nil, err
+	}
+	mr.FPT = fpt
+	for _, e := range fpt.Entries {
+		data, err := mr.PartitionData(e.PartitionName())
+		if err != nil || !bytes.HasPrefix(data, MeCPDSignature) {
+			continue
+		}
+		c, err := NewMeCPD(data, e.PartitionName())
+		if err != nil {
+			return nil, err
+		}
+		mr.Directories = append(mr.Directories, c)
+	}
+	// the version is informative, the region is valid without it
+	if ftpr, err := mr.PartitionData("FTPR"); err != nil {
+		debugf("Cannot read the ME version: %v", err)
+	} else if offset := FindMeManifest(ftpr); offset >= 0 {
+		mr.Manifest, err = NewMeManifestHeader(ftpr[offset:])
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		debugf("No manifest found in the FTPR partition")
+	}
+	mr.Family = DetectMeFamily(mr.FPT, mr.Manifest)
+	debugf("Detected ME family: %v", mr.Family)
+	return &mr, nil
+}
@@ -0,0 +1,347 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// MicrocodeHeaderSize is the size of the header of a microcode update
+	MicrocodeHeaderSize = 48
+	// MicrocodeExtendedHeaderSize is the size of the header of the extended
+	// signature table
+	MicrocodeExtendedHeaderSize = 20
+	// MicrocodeExtendedSignatureSize is the size of an extended signature
+	MicrocodeExtendedSignatureSize = 12
+	// microcodeDefaultDataSize and microcodeDefaultTotalSize are the sizes
+	// of the updates whose size fields are 0
+	microcodeDefaultDataSize  = 2000
+	microcodeDefaultTotalSize = 2048
+	// microcodeMaxSize bounds the size of an update, to reject garbage
+	microcodeMaxSize = 1 << 20
+)
+
+// MicrocodeFileGUID is the GUID of the FFS files holding the microcode
+// updates on Intel platforms
+var MicrocodeFileGUID = "197db236-f856-4924-90f8-cdf12fb875f3"
+
+// MicrocodeHeader is the header of an Intel microcode update
+type MicrocodeHeader struct {
+	HeaderVersion  uint32
+	UpdateRevision uint32
+	// Date is BCD encoded as 0xMMDDYYYY
+	Date uint32
+	// ProcessorSignature is the CPUID(1).EAX of the processors the update
+	// applies to
+	ProcessorSignature uint32
+	Checksum           uint32
+	LoaderRevision     uint32
+	// ProcessorFlags is the mask of the platform IDs the update applies to
+	ProcessorFlags uint32
+	DataSize       uint32
+	TotalSize      uint32
+	Reserved       [12]uint8
+}
+
+// MicrocodeExtendedSignature is an additional processor signature an update
+// applies to
+type MicrocodeExtendedSignature struct {
+	ProcessorSignature uint32
+	ProcessorFlags     uint32
+	Checksum           uint32
+}
+
+func (s MicrocodeExtendedSignature) String() string {
+	return fmt.Sprintf("CPUID=0x%08x, Platforms=0x%02x", s.ProcessorSignature, s.ProcessorFlags)
+}
+
+// Microcode is an Intel microcode update
+type Microcode struct {
+	Header             MicrocodeHeader
+	ExtendedSignatures []MicrocodeExtendedSignature
+	// Offset is the position of the update from the start of the BIOS
+	// region
+	Offset uint64
+	// Source is where the update was found: the GUID of its file, or "FIT"
+	Source string
+	// Holds the raw buffer, including the header
+	buf []byte
+}
+
+// Buf returns the raw bytes of the update
+func (m Microcode) Buf() []byte {
+	return m.buf
+}
+
+// DataSize returns the size of the update data, without the header
+func (m Microcode) DataSize() uint32 {
+	if m.Header.DataSize == 0 {
+		return microcodeDefaultDataSize
+	}
+	return m.Header.DataSize
+}
+
+// TotalSize returns the size of the update, including the header and the
+// extended signature table
+func (m Microcode) TotalSize() uint32 {
+	if m.Header.DataSize == 0 {
+		return microcodeDefaultTotalSize
+	}
+	return m.Header.TotalSize
+}
+
+// Date returns the date of the update as YYYY-MM-DD
+func (m Microcode) Date() string {
+	d := m.Header.Date
+	return fmt.Sprintf("%04x-%02x-%02x", d&0xffff, d>>24, (d>>16)&0xff)
+}
+
+// Matches returns whether the update applies to the processor with the given
+// CPUID signature and platform ID, from its header or from the extended
+// signatures
+func (m Microcode) Matches(signature uint32, platformID uint) bool {
+	if m.Header.ProcessorSignature == signature && m.Header.ProcessorFlags&(1<<platformID) != 0 {
+		return true
+	}
+	for _, s := range m.ExtendedSignatures {
+		if s.ProcessorSignature == signature && s.ProcessorFlags&(1<<platformID) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ChecksumValid returns whether the 32-bit words of the update sum to 0
+func (m Microcode) ChecksumValid() bool {
+	var sum uint32
+	for i := 0; i+4 <= len(m.buf); i += 4 {
+		sum += binary.LittleEndian.Uint32(m.buf[i:])
+	}
+	return sum == 0
+}
+
+func (m Microcode) String() string {
+	return fmt.Sprintf("Microcode{CPUID=0x%08x, Platforms=0x%02x, Revision=0x%x, Date=%s, Size=%v}",
+		m.Header.ProcessorSignature, m.Header.ProcessorFlags, m.Header.UpdateRevision, m.Date(), m.TotalSize())
+}
+
+// Summary prints a multi-line description of the update
+func (m Microcode) Summary() string {
+	var signatures []string
+	for _, s := range m.ExtendedSignatures {
+		signatures = append(signatures, s.String())
+	}
+	return fmt.Sprintf("Microcode{\n"+
+		"    Offset=0x%x\n"+
+		"    Source=%s\n"+
+		"    CPUID=0x%08x\n"+
+		"    Platforms=0x%02x\n"+
+		"    Revision=0x%x\n"+
+		"    Date=%s\n"+
+		"    DataSize=%v\n"+
+		"    TotalSize=%v\n"+
+		"    ChecksumValid=%v\n"+
+		"    ExtendedSignatures=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		m.Offset,
+		m.Source,
+		m.Header.ProcessorSignature,
+		m.Header.ProcessorFlags,
+		m.Header.UpdateRevision,
+		m.Date(),
+		m.DataSize(),
+		m.TotalSize(),
+		m.ChecksumValid(),
+		Indent(strings.Join(signatures, "\n"), 8),
+	)
+}
+
+// IsMicrocode returns whether buf starts with something that looks like a
+// microcode update header
+func IsMicrocode(buf []byte) bool {
+	if len(buf) < MicrocodeHeaderSize {
+		return false
+	}
+	var h MicrocodeHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+		return false
+	}
+	if h.HeaderVersion != 1 || h.LoaderRevision != 1 {
+		return false
+	}
+	if h.DataSize == 0 {
+		return h.TotalSize == 0
+	}
+	return h.TotalSize >= h.DataSize+MicrocodeHeaderSize && h.TotalSize <= microcodeMaxSize && h.TotalSize%1024 == 0
+}
+
+// NewMicrocode parses the microcode update at the start of buf
+func NewMicrocode(buf []byte) (*Microcode, error) {
+	if !IsMicrocode(buf) {
+		return nil, fmt.Errorf("No microcode update header found")
+	}
+	var m Microcode
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &m.Header); err != nil {
+		return nil, err
+	}
+	size := uint64(m.TotalSize())
+	if size > uint64(len(buf)) {
+		return nil, fmt.Errorf("Microcode update of 0x%x bytes exceeds the buffer size 0x%x", size, len(buf))
+	}
+	m.buf = buf[:size]
+	tableStart := uint64(MicrocodeHeaderSize) + uint64(m.DataSize())
+	if tableStart+MicrocodeExtendedHeaderSize <= size {
+		count := uint64(binary.LittleEndian.Uint32(m.buf[tableStart:]))
+		start := tableStart + MicrocodeExtendedHeaderSize
+		if start+count*MicrocodeExtendedSignatureSize > size {
+			return nil, fmt.Errorf("Microcode extended signature table of %v entries exceeds the update size 0x%x", count, size)
+		}
+		m.ExtendedSignatures = make([]MicrocodeExtendedSignature, count)
+		if err := binary.Read(bytes.NewReader(m.buf[start:]), binary.LittleEndian, m.ExtendedSignatures); err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
+
+// FindMicrocodes returns the microcode updates in buf, which may be
+// separated by padding, with their offsets from the start of buf
+func FindMicrocodes(buf []byte) []*Microcode {
+	var found []*Microcode
+	for offset := 0; offset+MicrocodeHeaderSize <= len(buf); {
+		m, err := NewMicrocode(buf[offset:])
+		if err != nil {
+			offset += 16
+			continue
+		}
+		m.Offset = uint64(offset)
+		found = append(found, m)
+		offset += int(m.TotalSize())
+	}
+	return found
+}
+
+// Microcodes returns the microcode updates of the region, from the microcode
+// files and from the FIT, sorted by offset
+func (br BiosRegion) Microcodes() []*Microcode {
+	byOffset := make(map[uint64]*Microcode)
+	add := func(buf []byte, base uint64, source string) {
+		for _, m := range FindMicrocodes(buf) {
+			m.Offset += base
+			m.Source = source
+			if _, ok := byOffset[m.Offset]; !ok {
+				byOffset[m.Offset] = m
+			}
+		}
+	}
+	for _, fv := range br.FirmwareVolumes {
+		for _, f := range fv.Files {
+			if f.GUID() != MicrocodeFileGUID {
+				continue
+			}
+			base := fv.Offset + f.Offset
+			if !f.HasSections() {
+				add(f.Data(), base+f.HeaderLen(), f.GUID())
+				continue
+			}
+			for _, s := range f.Sections {
+				if s.Type == SectionTypeRaw {
+					add(s.Data(), base+s.Offset+s.DataOffset(), f.GUID())
+				}
+			}
+		}
+	}
+	if br.FIT != nil {
+		for _, e := range br.FIT.EntriesOfType(FITTypeMicrocode) {
+			offset, err := br.AddressToOffset(e.Address)
+			if err != nil {
+				continue
+			}
+			if _, ok := byOffset[offset]; ok {
+				continue
+			}
+			if m, err := NewMicrocode(br.buf[offset:]); err == nil {
+				m.Offset = offset
+				m.Source = "FIT"
+				byOffset[offset] = m
+			}
+		}
+	}
+	microcodes := make([]*Microcode, 0, len(byOffset))
+	for _, m := range byOffset {
+		microcodes = append(microcodes, m)
+	}
+	sort.Slice(microcodes, func(i, j int) bool { return microcodes[i].Offset < microcodes[j].Offset })
+	return microcodes
+}
+
+// FamilyModelStepping returns the family, model and stepping of a processor
+// signature, as computed by Linux
+func FamilyModelStepping(signature uint32) (family, model, stepping uint32) {
+	family = (signature >> 8) & 0xf
+	if family == 0xf {
+		family += (signature >> 20) & 0xff
+	}
+	model = (signature >> 4) & 0xf
+	if family >= 0x6 {
+		model |= ((signature >> 16) & 0xf) << 4
+	}
+	return family, model, signature & 0xf
+}
+
+// LinuxName returns the name of the file of the update in the intel-ucode
+// directory of Linux, i.e. family-model-stepping in hexadecimal
+func (m Microcode) LinuxName() string {
+	family, model, stepping := FamilyModelStepping(m.Header.ProcessorSignature)
+	return fmt.Sprintf("%02x-%02x-%02x", family, model, stepping)
+}
+
+// ExtractMicrocodes writes the microcode updates of the region to dir in the
+// formats of the Linux microcode loader: one file per update, named after
+// its signature, platforms and revision, the updates grouped by processor
+// in intel-ucode/ as the linux-firmware package does, and all of them
+// concatenated in kernel/x86/microcode/GenuineIntel.bin for the early
+// loader.
+func (br BiosRegion) ExtractMicrocodes(dir string) error {
+	microcodes := br.Microcodes()
+	if len(microcodes) == 0 {
+		return fmt.Errorf("No microcode update found in the BIOS region")
+	}
+	ucodeDir := filepath.Join(dir, "intel-ucode")
+	earlyDir := filepath.Join(dir, "kernel", "x86", "microcode")
+	for _, d := range []string{ucodeDir, earlyDir} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+	var (
+		all    []byte
+		groups = make(map[string][]byte)
+		names  []string
+	)
+	for _, m := range microcodes {
+		name := fmt.Sprintf("cpu%08x_plat%02x_ver%08x.bin", m.Header.ProcessorSignature, m.Header.ProcessorFlags, m.Header.UpdateRevision)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), m.buf, 0644); err != nil {
+			return err
+		}
+		if _, ok := groups[m.LinuxName()]; !ok {
+			names = append(names, m.LinuxName())
+		}
+		groups[m.LinuxName()] = append(groups[m.LinuxName()], m.buf...)
+		all = append(all, m.buf...)
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(ucodeDir, name), groups[name], 0644); err != nil {
+			return err
+		}
+	}
+	return ioutil.WriteFile(filepath.Join(earlyDir, "GenuineIntel.bin"), all, 0644)
+}
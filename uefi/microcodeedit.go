@@ -0,0 +1,226 @@
+package uefi
+
+import (
+	"fmt"
+)
+
+// microcodeFile returns the index of the volume and the microcode file of
+// the volume containing the given offset, or of the first volume with one if
+// the offset is not in a volume, and whether there is one. Only the first
+// microcode file of a volume is considered.
+func (br BiosRegion) microcodeFile(offset uint64) (int, *File, bool) {
+	first := -1
+	for i, fv := range br.FirmwareVolumes {
+		idx := fv.findFile(MicrocodeFileGUID)
+		if idx == -1 {
+			continue
+		}
+		if offset >= fv.Offset && offset < fv.Offset+fv.Length {
+			return i, fv.Files[idx], true
+		}
+		if first == -1 {
+			first = i
+		}
+	}
+	if first == -1 {
+		return 0, nil, false
+	}
+	fv := br.FirmwareVolumes[first]
+	return first, fv.Files[fv.findFile(MicrocodeFileGUID)], true
+}
+
+// fileMicrocodes returns the updates of the region inside the given file, in
+// order
+func (br BiosRegion) fileMicrocodes(fv FirmwareVolume, f *File) []*Microcode {
+	start := fv.Offset + f.Offset
+	var found []*Microcode
+	for _, m := range br.Microcodes() {
+		if m.Offset >= start && m.Offset < start+f.FileSize() {
+			found = append(found, m)
+		}
+	}
+	return found
+}
+
+// ReplaceMicrocode replaces the microcode update for the processor signature
+// and platforms of update with it, which must be a newer revision, or adds it
+// to the microcode file if the image has no update for that processor.
+// Updates in the microcode file are replaced in the file, which is resized
+// as needed, while the updates only referenced by the FIT are overwritten in
+// place and the new update must fit in the old one. The FIT entries are
+// updated to point to the new positions of the updates, and an entry is
+// added for an inserted update, using an unused entry or the erased space
+// after the table. The image is then serialized and parsed again.
+func (f *FlashImage) ReplaceMicrocode(update []byte) error {
+	m, err := NewMicrocode(update)
+	if err != nil {
+		return err
+	}
+	if uint64(len(update)) != uint64(m.TotalSize()) {
+		return fmt.Errorf("Microcode update is %v bytes, but its header says %v", len(update), m.TotalSize())
+	}
+	if !m.ChecksumValid() {
+		return fmt.Errorf("Invalid microcode update checksum")
+	}
+	if f.BiosRegion == nil {
+		return fmt.Errorf("The image has no BIOS region")
+	}
+	old := f.BiosRegion.clone()
+	var target *Microcode
+	for _, c := range old.Microcodes() {
+		if c.Header.ProcessorSignature == m.Header.ProcessorSignature && c.Header.ProcessorFlags&m.Header.ProcessorFlags != 0 {
+			target = c
+			break
+		}
+	}
+	if target != nil && m.Header.UpdateRevision <= target.Header.UpdateRevision {
+		return fmt.Errorf("Microcode update for CPUID 0x%08x has revision 0x%x, not newer than revision 0x%x in the image",
+			m.Header.ProcessorSignature, m.Header.UpdateRevision, target.Header.UpdateRevision)
+	}
+	offset := uint64(len(old.buf))
+	if target != nil {
+		offset = target.Offset
+	}
+	fvIdx, file, ok := old.microcodeFile(offset)
+	if target != nil {
+		if inFile, _, _ := old.fileAt(target.Offset); inFile == nil || inFile != file {
+			return f.overwriteMicrocode(*old, target, update)
+		}
+	}
+	if !ok {
+		return fmt.Errorf("The image has no microcode file to add the update for CPUID 0x%08x to", m.Header.ProcessorSignature)
+	}
+
+	// rebuild the contents of the file, or of its raw section, with the new
+	// update
+	fv := &f.BiosRegion.FirmwareVolumes[fvIdx]
+	base := fv.Offset + file.Offset + file.HeaderLen()
+	data := file.Data()
+	var section *Section
+	if file.HasSections() {
+		for _, s := range file.Sections {
+			start := fv.Offset + file.Offset + s.Offset + s.DataOffset()
+			if s.Type == SectionTypeRaw && (target == nil || target.Offset >= start && target.Offset < start+uint64(len(s.Data()))) {
+				section, base, data = s, start, s.Data()
+			}
+		}
+		if section == nil {
+			return fmt.Errorf("No raw section in microcode file %s", file.GUID())
+		}
+	}
+	var newData []byte
+	if target != nil {
+		start := target.Offset - base
+		newData = append(append(append([]byte{}, data[:start]...), update...), data[start+uint64(target.TotalSize()):]...)
+		debugf("Replacing microcode update 0x%x for CPUID 0x%08x with revision 0x%x",
+			target.Header.UpdateRevision, m.Header.ProcessorSignature, m.Header.UpdateRevision)
+	} else {
+		newData = append(append([]byte{}, data...), update...)
+		debugf("Adding microcode update for CPUID 0x%08x", m.Header.ProcessorSignature)
+	}
+	oldUpdates := old.fileMicrocodes(old.FirmwareVolumes[fvIdx], file)
+	// the table moves with its file until it is updated
+	f.BiosRegion.FIT = nil
+	if section != nil {
+		err = section.SetData(newData)
+	} else {
+		err = fv.ReplaceFile(file.GUID(), newData)
+	}
+	if err != nil {
+		return err
+	}
+	if err := f.reparse(); err != nil {
+		return err
+	}
+
+	// the updates keep their order in the file
+	nfv := f.BiosRegion.FirmwareVolumes[fvIdx]
+	nfile := nfv.Files[nfv.findFile(MicrocodeFileGUID)]
+	newUpdates := f.BiosRegion.fileMicrocodes(nfv, nfile)
+	if len(newUpdates) < len(oldUpdates) {
+		return fmt.Errorf("Microcode file %s has %v updates after the edit, expected at least %v",
+			nfile.GUID(), len(newUpdates), len(oldUpdates))
+	}
+	moved := make(map[uint64]uint64)
+	for i, u := range oldUpdates {
+		moved[u.Offset] = newUpdates[i].Offset
+	}
+	if old.FIT == nil {
+		return nil
+	}
+	if err := f.BiosRegion.updateFIT(*old, moved); err != nil {
+		return err
+	}
+	if target == nil && len(old.FIT.EntriesOfType(FITTypeMicrocode)) != 0 {
+		if err := f.BiosRegion.addFITEntry(FITEntry{
+			Address:           f.BiosRegion.offsetToAddress(newUpdates[len(newUpdates)-1].Offset),
+			Version:           0x100,
+			TypeChecksumValid: uint8(FITTypeMicrocode),
+		}); err != nil {
+			return err
+		}
+	}
+	return f.reparse()
+}
+
+// overwriteMicrocode writes update over the target update, which is outside
+// of the microcode files
+func (f *FlashImage) overwriteMicrocode(old BiosRegion, target *Microcode, update []byte) error {
+	if file, _, ok := old.fileAt(target.Offset); ok {
+		return fmt.Errorf("Microcode update for CPUID 0x%08x is in file %s, which is not a microcode file",
+			target.Header.ProcessorSignature, file.GUID())
+	}
+	if uint64(len(update)) > uint64(target.TotalSize()) {
+		return fmt.Errorf("Microcode update of %v bytes does not fit in the %v bytes of the update it replaces",
+			len(update), target.TotalSize())
+	}
+	buf := append([]byte{}, old.buf...)
+	end := target.Offset + uint64(target.TotalSize())
+	fill(buf[target.Offset:end], 0xff)
+	copy(buf[target.Offset:], update)
+	br, err := NewBiosRegion(buf)
+	if err != nil {
+		return err
+	}
+	f.BiosRegion = br
+	return f.reparse()
+}
+
+// addFITEntry adds an entry to the FIT, after the entries of the same type.
+// An unused entry is taken if there is one, otherwise the table grows into
+// the erased space that follows it.
+func (br *BiosRegion) addFITEntry(e FITEntry) error {
+	fit := *br.FIT
+	entries := make([]FITEntry, 0, len(fit.Entries)+1)
+	unused := -1
+	for i, c := range fit.Entries {
+		if c.Type() == FITTypeUnused {
+			unused = i
+			break
+		}
+	}
+	if unused == -1 {
+		end := fit.Offset + uint64(len(fit.Entries)+1)*FITEntrySize
+		if end+FITEntrySize > uint64(len(br.buf)) || !isErased(br.buf[end:end+FITEntrySize]) {
+			return fmt.Errorf("No room to add an entry to the FIT at 0x%x", fit.Offset)
+		}
+	}
+	added := false
+	for i, c := range fit.Entries {
+		if i == unused {
+			continue
+		}
+		if !added && c.Type() > e.Type() {
+			entries = append(entries, e)
+			added = true
+		}
+		entries = append(entries, c)
+	}
+	if !added {
+		entries = append(entries, e)
+	}
+	fit.Entries = entries
+	fit.FixChecksum()
+	br.FIT = &fit
+	return nil
+}
@@ -0,0 +1,139 @@
+package uefi
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+)
+
+// ShimLockGUID is the vendor GUID of the variables of shim, the first stage
+// boot loader of the Linux distributions, including the machine owner key
+// (MOK) lists
+const ShimLockGUID = "605dab50-e046-4300-abb6-3dd810dd8b23"
+
+// TrustVariables are the variables holding signature lists that make the
+// trust configuration of the firmware and of shim, in the order they are
+// reported by TrustConfiguration. MokList holds the keys and hashes trusted
+// by shim in addition to db, MokListX the revoked ones.
+var TrustVariables = []struct {
+	Name string
+	GUID string
+}{
+	{"PK", GlobalVariableGUID},
+	{"KEK", GlobalVariableGUID},
+	{"db", ImageSecurityDatabaseGUID},
+	{"dbx", ImageSecurityDatabaseGUID},
+	{"MokList", ShimLockGUID},
+	{"MokListX", ShimLockGUID},
+}
+
+// TrustEntry is a signature of a Secure Boot or MOK variable
+type TrustEntry struct {
+	// Variable is the name of the variable holding the signature
+	Variable string
+	// Type is the name of the signature type, e.g. X509 or SHA256
+	Type  string
+	Owner string
+	// Certificate is set for the X.509 certificates, Digest for the hashes
+	Certificate *CertificateInfo `json:",omitempty"`
+	Digest      string           `json:",omitempty"`
+}
+
+func (e TrustEntry) String() string {
+	if e.Certificate != nil {
+		return fmt.Sprintf("%s %s (owner %s): Subject=%q Issuer=%q SHA256=%s",
+			e.Variable, e.Type, e.Owner, e.Certificate.Subject, e.Certificate.Issuer, e.Certificate.SHA256)
+	}
+	return fmt.Sprintf("%s %s (owner %s): %s", e.Variable, e.Type, e.Owner, e.Digest)
+}
+
+// TrustConfiguration is the decoded content of the Secure Boot and MOK
+// variables of an image, as returned by FlashImage.TrustConfiguration
+type TrustConfiguration struct {
+	Entries []TrustEntry
+	// ShimValidationDisabled is set if MokSBState tells shim not to verify
+	// the images it loads
+	ShimValidationDisabled bool
+	// Errors holds the variables that could not be decoded
+	Errors []string `json:",omitempty"`
+}
+
+// variableDataOffset returns the valid variable with the given name and
+// vendor GUID in the region, with the position of its data from the start
+// of the region, or nil if it is not found
+func (br BiosRegion) variableDataOffset(name, guid string) (*Variable, uint64) {
+	for _, fv := range br.FirmwareVolumes {
+		if fv.VariableStore == nil {
+			continue
+		}
+		if v := fv.VariableStore.Find(name, guid); v != nil {
+			return v, fv.Offset + fv.DataOffset() + v.Offset + v.DataOffset()
+		}
+	}
+	return nil, 0
+}
+
+// MokList returns the signature lists of the MokList variable, the machine
+// owner keys and hashes trusted by shim, or nil if the variable is missing
+func (br BiosRegion) MokList() ([]*SignatureList, error) {
+	v := br.FindVariable("MokList", ShimLockGUID)
+	if v == nil {
+		return nil, nil
+	}
+	return ParseSignatureLists(v.Data())
+}
+
+// MokListX returns the signature lists of the MokListX variable, the keys
+// and hashes revoked by shim, or nil if the variable is missing
+func (br BiosRegion) MokListX() ([]*SignatureList, error) {
+	v := br.FindVariable("MokListX", ShimLockGUID)
+	if v == nil {
+		return nil, nil
+	}
+	return ParseSignatureLists(v.Data())
+}
+
+// TrustConfiguration decodes the Secure Boot variables (PK, KEK, db, dbx)
+// and the shim MOK lists (MokList, MokListX) of the NVRAM, to audit which
+// keys and images the firmware and shim trust.
+func (f FlashImage) TrustConfiguration() (*TrustConfiguration, error) {
+	if f.BiosRegion == nil {
+		return nil, fmt.Errorf("The image has no BIOS region")
+	}
+	start, _ := f.Region.BiosOffset()
+	t := TrustConfiguration{Entries: make([]TrustEntry, 0)}
+	for _, tv := range TrustVariables {
+		v, offset := f.BiosRegion.variableDataOffset(tv.Name, tv.GUID)
+		if v == nil {
+			continue
+		}
+		lists, err := ParseSignatureLists(v.Data())
+		if err != nil {
+			t.Errors = append(t.Errors, fmt.Sprintf("%s: %v", tv.Name, err))
+			continue
+		}
+		for _, l := range lists {
+			for _, s := range l.Signatures {
+				e := TrustEntry{Variable: tv.Name, Type: l.TypeName(), Owner: s.Owner}
+				if l.Type() == CertX509GUID {
+					cert, err := x509.ParseCertificate(s.Data)
+					if err != nil {
+						t.Errors = append(t.Errors, fmt.Sprintf("%s: certificate at 0x%x: %v", tv.Name, s.Offset, err))
+						continue
+					}
+					abs := uint64(start) + offset + s.Offset
+					info := newCertificateInfo(cert, abs, f.nodePath(abs))
+					e.Certificate = &info
+				} else {
+					e.Digest = hex.EncodeToString(s.Data)
+				}
+				t.Entries = append(t.Entries, e)
+			}
+		}
+	}
+	if v := f.BiosRegion.FindVariable("MokSBState", ShimLockGUID); v != nil {
+		data := v.Data()
+		t.ShimValidationDisabled = len(data) > 0 && data[0] == 1
+	}
+	return &t, nil
+}
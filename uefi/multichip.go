@@ -0,0 +1,89 @@
+package uefi
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checkComponentSizes checks that the sizes match the densities of the
+// components in the descriptor, in order
+func (f FlashImage) checkComponentSizes(sizes []uint64) error {
+	densities := f.Component.Densities()
+	if len(densities) != len(sizes) {
+		return fmt.Errorf("The descriptor has %d flash components, got %d dumps", len(densities), len(sizes))
+	}
+	for i, density := range densities {
+		if sizes[i] != density {
+			return fmt.Errorf("Dump %d has size 0x%x, but component %d has density 0x%x", i, sizes[i], i, density)
+		}
+	}
+	return nil
+}
+
+// CombineDumps parses the dumps of the flash chips of a board as one logical
+// image. The dumps must be in the order of the components, the first one
+// holding the descriptor, and their sizes must match the component
+// densities.
+func CombineDumps(dumps ...[]byte) (*FlashImage, error) {
+	if len(dumps) == 0 {
+		return nil, fmt.Errorf("No flash dumps to combine")
+	}
+	var (
+		buf   []byte
+		sizes []uint64
+	)
+	for _, d := range dumps {
+		buf = append(buf, d...)
+		sizes = append(sizes, uint64(len(d)))
+	}
+	f, err := NewFlashImage(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.checkComponentSizes(sizes); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SplitDumps serializes the image and splits it into one dump per flash
+// chip, at the boundaries given by the component densities
+func (f FlashImage) SplitDumps() ([][]byte, error) {
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	densities := f.Component.Densities()
+	if total := f.Component.TotalSize(); total != uint64(len(buf)) {
+		return nil, fmt.Errorf("The image size 0x%x does not match the total density 0x%x of the flash components", len(buf), total)
+	}
+	var (
+		dumps  [][]byte
+		offset uint64
+	)
+	for _, density := range densities {
+		dumps = append(dumps, buf[offset:offset+density])
+		offset += density
+	}
+	return dumps, nil
+}
+
+// WriteDumps writes the dumps returned by SplitDumps to dir, in files named
+// chip0.bin, chip1.bin and so on, creating dir if needed
+func (f FlashImage) WriteDumps(dir string) error {
+	dumps, err := f.SplitDumps()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i, d := range dumps {
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("chip%d.bin", i)), d, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package uefi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Node is a generic view of a parsed element of a firmware image, with its
+// absolute position in the image. Nodes form a tree rooted at the image.
+type Node struct {
+	Type     string  `json:"type"`
+	Name     string  `json:"name,omitempty"`
+	Offset   uint64  `json:"offset"`
+	Size     uint64  `json:"size"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// Contains returns whether the given absolute offset falls within the node
+func (n Node) Contains(offset uint64) bool {
+	return offset >= n.Offset && offset < n.Offset+n.Size
+}
+
+func (n Node) String() string {
+	s := n.Type
+	if n.Name != "" {
+		s += " " + n.Name
+	}
+	return fmt.Sprintf("%s [0x%x-0x%x]", s, n.Offset, n.Offset+n.Size)
+}
+
+// FormatNodePath returns a one-line representation of a list of nodes, as
+// returned by NodeAt.
+func FormatNodePath(path []*Node) string {
+	var parts []string
+	for _, n := range path {
+		parts = append(parts, n.String())
+	}
+	return strings.Join(parts, " > ")
+}
+
+// brokenNodes returns the nodes of a list of broken elements, based at the
+// given absolute offset
+func brokenNodes(base uint64, broken []BrokenNode) []*Node {
+	var nodes []*Node
+	for _, b := range broken {
+		nodes = append(nodes, &Node{
+			Type:   "Broken",
+			Offset: base + b.Offset,
+			Size:   uint64(len(b.Data)),
+		})
+	}
+	return nodes
+}
+
+func sortNodes(nodes []*Node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Offset < nodes[j].Offset
+	})
+}
+
+// node returns the tree of the section, based at the given absolute offset
+func (s Section) node(base uint64) *Node {
+	n := Node{
+		Type:   "Section",
+		Name:   s.Type.String(),
+		Offset: base + s.Offset,
+		Size:   s.SectionSize(),
+	}
+	// the children of compressed sections are not in the image
+	if !s.IsCompressed() {
+		for _, child := range s.Sections {
+			n.Children = append(n.Children, child.node(n.Offset))
+		}
+	}
+	n.Children = append(n.Children, brokenNodes(n.Offset, s.Broken)...)
+	return &n
+}
+
+// node returns the tree of the file, based at the given absolute offset
+func (f File) node(base uint64) *Node {
+	n := Node{
+		Type:   "File",
+		Name:   f.GUID(),
+		Offset: base + f.Offset,
+		Size:   f.FileSize(),
+	}
+	for _, s := range f.Sections {
+		n.Children = append(n.Children, s.node(n.Offset))
+	}
+	n.Children = append(n.Children, brokenNodes(n.Offset, f.Broken)...)
+	return &n
+}
+
+// node returns the tree of the variable store, based at the given absolute
+// offset
+func (s VariableStore) node(base uint64) *Node {
+	n := Node{
+		Type:   "VariableStore",
+		Offset: base,
+		Size:   uint64(len(s.buf)),
+	}
+	for _, v := range s.Variables {
+		n.Children = append(n.Children, &Node{
+			Type:   "Variable",
+			Name:   v.Name,
+			Offset: base + v.Offset,
+			Size:   uint64(len(v.buf)),
+		})
+	}
+	n.Children = append(n.Children, brokenNodes(base, s.Broken)...)
+	return &n
+}
+
+// node returns the tree of the firmware volume, based at the given absolute
+// offset
+func (fv FirmwareVolume) node(base uint64) *Node {
+	n := Node{
+		Type:   "FirmwareVolume",
+		Name:   fv.guidString(),
+		Offset: base + fv.Offset,
+		Size:   fv.Length,
+	}
+	for _, f := range fv.Files {
+		n.Children = append(n.Children, f.node(n.Offset))
+	}
+	if fv.VariableStore != nil {
+		n.Children = append(n.Children, fv.VariableStore.node(n.Offset+fv.DataOffset()))
+	}
+	n.Children = append(n.Children, brokenNodes(n.Offset, fv.Broken)...)
+	return &n
+}
+
+// nodes returns the trees of the firmware volumes in the region, based at
+// the given absolute offset
+func (br BiosRegion) nodes(base uint64) []*Node {
+	var nodes []*Node
+	amd := br.AMDFirmware()
+	if amd != nil {
+		// the volumes are usually within the BIOS binary entry
+		nodes = amd.nodes(base)
+	}
+	for _, fv := range br.FirmwareVolumes {
+		nodes = insertNode(nodes, fv.node(base))
+	}
+	for _, n := range brokenNodes(base, br.Broken) {
+		nodes = insertNode(nodes, n)
+	}
+	if amd != nil {
+		for _, n := range amd.agesaNodes(base) {
+			nodes = insertNode(nodes, n)
+		}
+	}
+	sortNodes(nodes)
+	return nodes
+}
+
+// insertNode inserts n in the deepest node of the list that contains it
+// entirely, or in the list itself
+func insertNode(nodes []*Node, n *Node) []*Node {
+	for _, p := range nodes {
+		if p != n && p.Offset <= n.Offset && n.Offset+n.Size <= p.Offset+p.Size && p.Size > n.Size {
+			p.Children = insertNode(p.Children, n)
+			sortNodes(p.Children)
+			return nodes
+		}
+	}
+	return append(nodes, n)
+}
+
+// nodes returns the partitions of the region with data, based at the given
+// absolute offset
+func (mr MeRegion) nodes(base uint64) []*Node {
+	if mr.FPT == nil {
+		return nil
+	}
+	var nodes []*Node
+	for _, e := range mr.FPT.Entries {
+		if !e.Present() || uint64(e.Offset)+uint64(e.Length) > uint64(len(mr.buf)) {
+			continue
+		}
+		n := &Node{
+			Type:   "MePartition",
+			Name:   e.PartitionName(),
+			Offset: base + uint64(e.Offset),
+			Size:   uint64(e.Length),
+		}
+		for _, c := range mr.Directories {
+			if c.Partition != n.Name {
+				continue
+			}
+			for _, m := range c.Entries {
+				if uint64(m.Offset())+uint64(m.Length) > n.Size {
+					continue
+				}
+				n.Children = append(n.Children, &Node{
+					Type:   "MeModule",
+					Name:   m.ModuleName(),
+					Offset: n.Offset + uint64(m.Offset()),
+					Size:   uint64(m.Length),
+				})
+			}
+			sortNodes(n.Children)
+		}
+		nodes = append(nodes, n)
+	}
+	sortNodes(nodes)
+	return nodes
+}
+
+// Tree returns the hierarchy of the parsed elements of the flash image.
+func (f FlashImage) Tree() *Node {
+	root := Node{Type: "FlashImage", Size: uint64(len(f.buf))}
+	root.Children = append(root.Children, &Node{
+		Type: "Region",
+		Name: "Descriptor",
+		Size: FlashDescriptorMapSize,
+	})
+	for _, t := range []FlashRegionType{RegionTypeBIOS, RegionTypeME, RegionTypeGbE, RegionTypePDR} {
+		start, end := f.Region.RegionOffset(t)
+		if end == 0 {
+			continue
+		}
+		// the regions exceeding the image, kept in permissive mode, are
+		// in the tree as broken nodes
+		if uint64(end) > uint64(len(f.buf)) {
+			continue
+		}
+		n := Node{Type: "Region", Name: t.String(), Offset: uint64(start), Size: uint64(end - start)}
+		if t == RegionTypeBIOS && f.BiosRegion != nil {
+			n.Children = f.BiosRegion.nodes(n.Offset)
+		}
+		if t == RegionTypeME && f.MeRegion != nil {
+			n.Children = f.MeRegion.nodes(n.Offset)
+		}
+		root.Children = append(root.Children, &n)
+	}
+	// the contents of the regions of recent descriptors are not in the tree
+	for i, r := range f.Region.Extended {
+		if !r.Valid() || r.Offset()+r.Size() > uint64(len(f.buf)) {
+			continue
+		}
+		root.Children = append(root.Children, &Node{
+			Type:   "Region",
+			Name:   FlashRegionType(i + flashRegionsBasic).String(),
+			Offset: r.Offset(),
+			Size:   r.Size(),
+		})
+	}
+	root.Children = append(root.Children, brokenNodes(0, f.Broken)...)
+	sortNodes(root.Children)
+	return &root
+}
+
+// Tree returns the hierarchy of the parsed elements of a BIOS region that
+// was parsed on its own, without a flash descriptor.
+func (br BiosRegion) Tree() *Node {
+	return &Node{Type: "Region", Name: "BIOS", Size: uint64(len(br.buf)), Children: br.nodes(0)}
+}
+
+// NodeAt returns the path from the root of the image to the deepest parsed
+// node containing the given absolute offset.
+func (f FlashImage) NodeAt(offset uint64) ([]*Node, error) {
+	return nodeAt(f.Tree(), offset)
+}
+
+// NodeAt returns the path from the root of the region to the deepest parsed
+// node containing the given offset.
+func (br BiosRegion) NodeAt(offset uint64) ([]*Node, error) {
+	return nodeAt(br.Tree(), offset)
+}
+
+func nodeAt(node *Node, offset uint64) ([]*Node, error) {
+	if !node.Contains(offset) {
+		return nil, fmt.Errorf("Offset 0x%x out of the image boundaries (size 0x%x)", offset, node.Size)
+	}
+	path := []*Node{node}
+	for {
+		var next *Node
+		for _, child := range node.Children {
+			if child.Contains(offset) {
+				next = child
+				break
+			}
+		}
+		if next == nil {
+			return path, nil
+		}
+		path = append(path, next)
+		node = next
+	}
+}
+
+// nodePath returns the path of the parsed elements containing the given
+// absolute offset in one line, or an empty string if there is none
+func (f FlashImage) nodePath(offset uint64) string {
+	path, err := f.NodeAt(offset)
+	if err != nil {
+		return ""
+	}
+	var names []string
+	for _, n := range path {
+		names = append(names, strings.TrimSpace(n.Type+" "+n.Name))
+	}
+	return strings.Join(names, " > ")
+}
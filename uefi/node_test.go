@@ -0,0 +1,34 @@
+package uefi
+
+import "testing"
+
+func TestTreeTruncatedImage(t *testing.T) {
+	buf, err := NewSyntheticImage(DefaultSyntheticConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf = buf[:len(buf)/2]
+	SetParseMode(ParsePermissive)
+	defer SetParseMode(ParseStrict)
+	f, err := NewFlashImage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range f.Tree().Children {
+		if n.Offset+n.Size > uint64(len(buf)) {
+			t.Errorf("%s %s 0x%x-0x%x exceeds the image (size 0x%x)", n.Type, n.Name, n.Offset, n.Offset+n.Size, len(buf))
+		}
+	}
+	for _, e := range f.MemoryMap() {
+		if e.End > uint64(len(buf)) {
+			t.Errorf("memory map entry %s 0x%x-0x%x exceeds the image (size 0x%x)", e.Owner, e.Start, e.End, len(buf))
+		}
+	}
+	path, err := f.NodeAt(uint64(len(buf)) - 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := path[len(path)-1]; n.Type != "Broken" {
+		t.Errorf("got %s %s at the end of the image, want the broken BIOS region", n.Type, n.Name)
+	}
+}
@@ -0,0 +1,338 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// NVARSignature starts each entry of the AMI Aptio NVRAM stores
+var NVARSignature = []byte("NVAR")
+
+// NVAR file GUIDs
+const (
+	// NVARStoreFileGUID is the file holding the NVAR store of the AMI
+	// Aptio images, when it is not in a volume of its own
+	NVARStoreFileGUID = "cef5b9a3-476d-497f-9fdc-e98143e0422c"
+	// NVARDefaultsFileGUID is the file holding the default values of the
+	// variables, restored on a setup reset
+	NVARDefaultsFileGUID = "9221315b-30bb-46b5-813e-1b1bf4712bd3"
+)
+
+// NVAR entry attributes
+const (
+	NVARAttributeRuntime       = 0x01
+	NVARAttributeASCIIName     = 0x02
+	NVARAttributeGUID          = 0x04
+	NVARAttributeDataOnly      = 0x08
+	NVARAttributeExtHeader     = 0x10
+	NVARAttributeHWErrorRecord = 0x20
+	NVARAttributeAuthWrite     = 0x40
+	NVARAttributeValid         = 0x80
+)
+
+const (
+	// NVAREntryHeaderSize is the size of the header of an NVAR entry
+	NVAREntryHeaderSize = 10
+	// nvarNoNext is the offset of the entries that were not updated
+	nvarNoNext = 0xffffff
+	// nvarGUIDSize is the size of the GUIDs of the GUID store
+	nvarGUIDSize = 16
+)
+
+// NVAREntryHeader is the header of an NVAR entry. NextAttributes holds the
+// offset of the next entry of the variable, relative to this one, in its 24
+// low bits and the attributes in the 8 high bits.
+type NVAREntryHeader struct {
+	Signature      [4]byte
+	Size           uint16
+	NextAttributes uint32
+}
+
+// Next returns the offset of the entry updating this one, relative to it,
+// or 0xffffff if there is none
+func (h NVAREntryHeader) Next() uint32 {
+	return h.NextAttributes & 0xffffff
+}
+
+// Attributes returns the attributes of the entry
+func (h NVAREntryHeader) Attributes() uint8 {
+	return uint8(h.NextAttributes >> 24)
+}
+
+// NVARVariable is a variable of an NVAR store. The entries updating a
+// variable only hold data, and are chained to the entry naming it.
+type NVARVariable struct {
+	Name string
+	GUID string
+	// GUIDIndex is the index of the GUID in the GUID store, -1 if the GUID
+	// is in the entry
+	GUIDIndex  int
+	Attributes uint8
+	// Valid is false for the deleted variables
+	Valid bool
+	// Offset is the position of the entry naming the variable, from the
+	// start of the store
+	Offset uint64
+	// Updates is the number of entries chained to the first one. Data is
+	// the data of the last one.
+	Updates int
+	Data    []byte `json:"-"`
+}
+
+func (v NVARVariable) String() string {
+	return fmt.Sprintf("NVARVariable{Name=%s, GUID=%s, Attributes=0x%02x, Valid=%v, Updates=%d, DataSize=%v}",
+		v.Name, v.GUID, v.Attributes, v.Valid, v.Updates, len(v.Data))
+}
+
+// NVARStore is the variable store of the AMI Aptio images, a sequence of
+// NVAR entries. Most entries refer to their vendor GUID by its index in the
+// GUID store, an array of GUIDs growing down from the end of the store.
+type NVARStore struct {
+	Variables []*NVARVariable
+	// GUIDs are the GUIDs of the GUID store, by index
+	GUIDs []string
+	// Errors holds the broken chains and unresolved GUID indexes
+	Errors []error `json:"-"`
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the store
+func (s NVARStore) Buf() []byte {
+	return s.buf
+}
+
+// Find returns the valid variable with the given name and vendor GUID, or
+// nil if it is not found
+func (s NVARStore) Find(name, guid string) *NVARVariable {
+	for _, v := range s.Variables {
+		if v.Valid && v.Name == name && v.GUID == strings.ToLower(guid) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Summary prints a multi-line description of the store
+func (s NVARStore) Summary() string {
+	var vars []string
+	for _, v := range s.Variables {
+		vars = append(vars, v.String())
+	}
+	return fmt.Sprintf("NVARStore{\n"+
+		"    Size=%v\n"+
+		"    GUIDs=%v\n"+
+		"    Variables=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		len(s.buf), s.GUIDs, Indent(strings.Join(vars, "\n"), 8),
+	)
+}
+
+// Validate returns the errors found while parsing the store
+func (s NVARStore) Validate() []error {
+	return append([]error{}, s.Errors...)
+}
+
+// IsNVARStore returns whether buf starts with an NVAR entry
+func IsNVARStore(buf []byte) bool {
+	return len(buf) >= NVAREntryHeaderSize && bytes.Equal(buf[:len(NVARSignature)], NVARSignature)
+}
+
+// nvarEntry is a raw entry of an NVAR store
+type nvarEntry struct {
+	NVAREntryHeader
+	offset uint64
+	buf    []byte
+}
+
+// body returns the GUID index or GUID, name and data of the entry, skipping
+// the extended header at its end
+func (e nvarEntry) body() (guidIndex int, guid string, name string, data []byte, err error) {
+	attrs := e.Attributes()
+	end := uint64(len(e.buf))
+	if attrs&NVARAttributeExtHeader != 0 {
+		if end < NVAREntryHeaderSize+2 {
+			return 0, "", "", nil, fmt.Errorf("NVAR entry at 0x%x too small for its extended header", e.offset)
+		}
+		extSize := uint64(binary.LittleEndian.Uint16(e.buf[end-2:]))
+		if extSize > end-NVAREntryHeaderSize {
+			return 0, "", "", nil, fmt.Errorf("NVAR entry at 0x%x: invalid extended header size 0x%x", e.offset, extSize)
+		}
+		end -= extSize
+	}
+	body := e.buf[NVAREntryHeaderSize:end]
+	guidIndex = -1
+	if attrs&NVARAttributeDataOnly != 0 {
+		return guidIndex, "", "", body, nil
+	}
+	if attrs&NVARAttributeGUID != 0 {
+		if len(body) < nvarGUIDSize {
+			return 0, "", "", nil, fmt.Errorf("NVAR entry at 0x%x too small for its GUID", e.offset)
+		}
+		u, err := uuid.FromBytes(body[:nvarGUIDSize])
+		if err != nil {
+			return 0, "", "", nil, err
+		}
+		guid, body = u.String(), body[nvarGUIDSize:]
+	} else {
+		if len(body) < 1 {
+			return 0, "", "", nil, fmt.Errorf("NVAR entry at 0x%x too small for its GUID index", e.offset)
+		}
+		guidIndex, body = int(body[0]), body[1:]
+	}
+	if attrs&NVARAttributeASCIIName != 0 {
+		i := bytes.IndexByte(body, 0)
+		if i == -1 {
+			return 0, "", "", nil, fmt.Errorf("NVAR entry at 0x%x: unterminated name", e.offset)
+		}
+		return guidIndex, guid, string(body[:i]), body[i+1:], nil
+	}
+	for i := 0; i+1 < len(body); i += 2 {
+		if body[i] == 0 && body[i+1] == 0 {
+			return guidIndex, guid, decodeUCS2(body[:i]), body[i+2:], nil
+		}
+	}
+	return 0, "", "", nil, fmt.Errorf("NVAR entry at 0x%x: unterminated name", e.offset)
+}
+
+// NewNVARStore parses an NVAR store, up to the free space. The GUID store
+// is read from the end of buf, which must end where the store does, e.g. at
+// the end of its volume or file.
+func NewNVARStore(buf []byte) (*NVARStore, error) {
+	if !IsNVARStore(buf) {
+		return nil, fmt.Errorf("NVAR signature not found")
+	}
+	s := NVARStore{buf: buf}
+	var entries []*nvarEntry
+	byOffset := make(map[uint64]*nvarEntry)
+	var offset uint64
+	for offset+NVAREntryHeaderSize <= uint64(len(buf)) && bytes.Equal(buf[offset:offset+4], NVARSignature) {
+		var e nvarEntry
+		if err := binary.Read(bytes.NewReader(buf[offset:]), binary.LittleEndian, &e.NVAREntryHeader); err != nil {
+			return nil, err
+		}
+		size := uint64(e.Size)
+		if size == 0xffff {
+			// an entry that was started but never written
+			break
+		}
+		if size < NVAREntryHeaderSize || offset+size > uint64(len(buf)) {
+			return nil, fmt.Errorf("Invalid NVAR entry size 0x%x at 0x%x", size, offset)
+		}
+		e.offset, e.buf = offset, buf[offset:offset+size]
+		entries = append(entries, &e)
+		byOffset[offset] = &e
+		offset += size
+	}
+	// the entries updating a variable are chained to the previous ones
+	chained := make(map[uint64]bool)
+	for _, e := range entries {
+		if e.Next() != nvarNoNext {
+			chained[e.offset+uint64(e.Next())] = true
+		}
+	}
+	maxIndex := -1
+	for _, e := range entries {
+		if chained[e.offset] {
+			continue
+		}
+		guidIndex, guid, name, data, err := e.body()
+		if err != nil {
+			s.Errors = append(s.Errors, err)
+			continue
+		}
+		v := NVARVariable{Name: name, GUID: guid, GUIDIndex: guidIndex, Attributes: e.Attributes(), Offset: e.offset, Data: data}
+		last := e
+		for last.Next() != nvarNoNext && v.Updates < len(entries) {
+			next, ok := byOffset[last.offset+uint64(last.Next())]
+			if !ok {
+				s.Errors = append(s.Errors, fmt.Errorf("NVAR entry at 0x%x: next entry at 0x%x not found", last.offset, last.offset+uint64(last.Next())))
+				break
+			}
+			last = next
+			v.Updates++
+		}
+		if last != e {
+			if _, _, _, v.Data, err = last.body(); err != nil {
+				s.Errors = append(s.Errors, err)
+			}
+		}
+		v.Valid = last.Attributes()&NVARAttributeValid != 0
+		if guidIndex > maxIndex {
+			maxIndex = guidIndex
+		}
+		s.Variables = append(s.Variables, &v)
+	}
+	// the GUID store grows down from the end of the buffer
+	for i := 0; i <= maxIndex; i++ {
+		start := uint64(len(buf)) - uint64(i+1)*nvarGUIDSize
+		if uint64(i+1)*nvarGUIDSize > uint64(len(buf)) || start < offset {
+			s.Errors = append(s.Errors, fmt.Errorf("NVAR GUID index %d out of the GUID store", i))
+			break
+		}
+		u, err := uuid.FromBytes(buf[start : start+nvarGUIDSize])
+		if err != nil {
+			return nil, err
+		}
+		s.GUIDs = append(s.GUIDs, u.String())
+	}
+	for _, v := range s.Variables {
+		if v.GUIDIndex == -1 {
+			continue
+		}
+		if v.GUIDIndex < len(s.GUIDs) {
+			v.GUID = s.GUIDs[v.GUIDIndex]
+		} else {
+			v.GUID = "<unresolved>"
+		}
+	}
+	return &s, nil
+}
+
+// NVARStores returns the NVAR stores of the region, from the NVRAM volumes
+// and from the store and defaults files
+func (br BiosRegion) NVARStores() []*NVARStore {
+	var stores []*NVARStore
+	for _, fv := range br.FirmwareVolumes {
+		if fv.NVARStore != nil {
+			stores = append(stores, fv.NVARStore)
+		}
+		for _, f := range fv.Files {
+			if g := f.GUID(); g != NVARStoreFileGUID && g != NVARDefaultsFileGUID {
+				continue
+			}
+			data := f.Data()
+			if f.HasSections() {
+				data = nil
+				for _, s := range f.Sections {
+					if s.Type == SectionTypeRaw {
+						data = s.Data()
+					}
+				}
+			}
+			if !IsNVARStore(data) {
+				continue
+			}
+			if s, err := NewNVARStore(data); err == nil {
+				stores = append(stores, s)
+			} else {
+				debugf("NVAR store file %s: %v", f.GUID(), err)
+			}
+		}
+	}
+	return stores
+}
+
+// NVARStores returns the NVAR stores of the BIOS region
+func (f FlashImage) NVARStores() []*NVARStore {
+	if f.BiosRegion == nil {
+		return nil
+	}
+	return f.BiosRegion.NVARStores()
+}
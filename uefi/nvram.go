@@ -0,0 +1,314 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// Variable store signatures and well-known vendor GUIDs
+const (
+	VariableStoreGUID     = "ddcf3616-3275-4164-98b6-fe85707ffe7d"
+	AuthVariableStoreGUID = "aaf32c78-947b-439a-a180-2e144ec37792"
+	GlobalVariableGUID    = "8be4df61-93ca-11d2-aa0d-00e098032b8c"
+	// ImageSecurityDatabaseGUID is the vendor GUID of the db, dbx, dbt and
+	// dbr variables
+	ImageSecurityDatabaseGUID = "d719b2cb-3d3a-4596-a3bc-dad00e67656f"
+)
+
+// Variable store constants
+const (
+	VariableStoreHeaderSize  = 28
+	VariableHeaderSize       = 32
+	AuthVariableHeaderSize   = 60
+	VariableStartID          = 0x55aa
+	VariableAlignment        = 4
+	VariableStoreFormatted   = 0x5a
+	VariableStoreHealthy     = 0xfe
+	VariableStateAdded       = 0x3f
+	VariableStateInDeletion  = 0xfe
+	VariableStateDeleted     = 0xfd
+	VariableStateHeaderValid = 0x7f
+)
+
+// Variable attributes
+const (
+	VariableNonVolatile                       = 0x01
+	VariableBootServiceAccess                 = 0x02
+	VariableRuntimeAccess                     = 0x04
+	VariableHardwareErrorRecord               = 0x08
+	VariableAuthenticatedWriteAccess          = 0x10
+	VariableTimeBasedAuthenticatedWriteAccess = 0x20
+	VariableAppendWrite                       = 0x40
+)
+
+// VariableStoreHeader is the header of a variable store
+type VariableStoreHeader struct {
+	Signature [16]uint8
+	Size      uint32
+	Format    uint8
+	State     uint8
+	Reserved  uint16
+	Reserved1 uint32
+}
+
+// VariableHeader contains the fields common to all the variable header formats
+type VariableHeader struct {
+	StartID    uint16
+	State      uint8
+	Reserved   uint8
+	Attributes uint32
+}
+
+// AuthVariableFields are the additional fields of authenticated variables
+type AuthVariableFields struct {
+	MonotonicCount uint64
+	TimeStamp      [16]uint8
+	PubKeyIndex    uint32
+}
+
+// Variable represents an NVRAM variable inside a variable store
+type Variable struct {
+	VariableHeader
+	// Auth holds the authentication fields, in authenticated variable stores
+	Auth       *AuthVariableFields
+	NameSize   uint32
+	DataSize   uint32
+	VendorGUID [16]uint8
+	Name       string
+	// Offset is the position of the variable from the start of the store
+	Offset uint64
+	// Holds the raw buffer, including the header
+	buf []byte
+}
+
+// HeaderLen returns the size of the variable header
+func (v Variable) HeaderLen() uint64 {
+	if v.Auth != nil {
+		return AuthVariableHeaderSize
+	}
+	return VariableHeaderSize
+}
+
+// DataOffset returns the offset of the variable data from the start of the
+// variable
+func (v Variable) DataOffset() uint64 {
+	return v.HeaderLen() + uint64(v.NameSize)
+}
+
+// Data returns the data of the variable
+func (v Variable) Data() []byte {
+	return v.buf[v.DataOffset():]
+}
+
+// Buf returns the raw bytes of the variable, including its header
+func (v Variable) Buf() []byte {
+	return v.buf
+}
+
+// GUID returns the vendor GUID of the variable as a string
+func (v Variable) GUID() string {
+	guid, err := uuid.FromBytes(v.VendorGUID[:])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return guid.String()
+}
+
+// IsValid returns whether the variable is in use, i.e. it was added and not
+// deleted. Variables being deleted are still valid.
+func (v Variable) IsValid() bool {
+	return v.State == VariableStateAdded || v.State == VariableStateAdded&VariableStateInDeletion
+}
+
+func (v Variable) String() string {
+	return fmt.Sprintf("Variable{Name=%s, GUID=%s, Attributes=0x%x, State=0x%02x, DataSize=%v}",
+		v.Name, v.GUID(), v.Attributes, v.State, v.DataSize)
+}
+
+// decodeUCS2 decodes a NUL-terminated UCS-2 sequence of bytes
+func decodeUCS2(buf []byte) string {
+	var chars []uint16
+	for i := 0; i+1 < len(buf); i += 2 {
+		c := uint16(buf[i]) | uint16(buf[i+1])<<8
+		if c == 0 {
+			break
+		}
+		chars = append(chars, c)
+	}
+	return string(utf16.Decode(chars))
+}
+
+// NewVariable parses a sequence of bytes and returns a Variable object, if a
+// valid one is passed, or an error
+func NewVariable(buf []byte, authenticated bool) (*Variable, error) {
+	var v Variable
+	reader := bytes.NewReader(buf)
+	if err := binary.Read(reader, binary.LittleEndian, &v.VariableHeader); err != nil {
+		return nil, err
+	}
+	if v.StartID != VariableStartID {
+		return nil, fmt.Errorf("Invalid variable start ID: expected 0x%04x, got 0x%04x", VariableStartID, v.StartID)
+	}
+	if authenticated {
+		var auth AuthVariableFields
+		if err := binary.Read(reader, binary.LittleEndian, &auth); err != nil {
+			return nil, err
+		}
+		v.Auth = &auth
+	}
+	for _, field := range []interface{}{&v.NameSize, &v.DataSize, &v.VendorGUID} {
+		if err := binary.Read(reader, binary.LittleEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	size := v.DataOffset() + uint64(v.DataSize)
+	if size > uint64(len(buf)) {
+		return nil, fmt.Errorf("Variable too large: %v bytes, %v available", size, len(buf))
+	}
+	v.buf = buf[:size]
+	v.Name = decodeUCS2(v.buf[v.HeaderLen():v.DataOffset()])
+	return &v, nil
+}
+
+// VariableStore represents a variable store, the format used by EDK2-based
+// firmware to store the NVRAM variables.
+type VariableStore struct {
+	VariableStoreHeader
+	Variables []*Variable
+	// Broken holds the elements that could not be parsed in permissive mode
+	Broken []BrokenNode
+	// Holds the raw buffer, including the header
+	buf []byte
+}
+
+// IsAuthenticated returns whether the store uses the authenticated variable
+// header format
+func (s VariableStore) IsAuthenticated() bool {
+	guid, err := uuid.FromBytes(s.Signature[:])
+	return err == nil && guid.String() == AuthVariableStoreGUID
+}
+
+// Buf returns the raw bytes of the variable store
+func (s VariableStore) Buf() []byte {
+	return s.buf
+}
+
+// ValidVariables returns the variables that are in use
+func (s VariableStore) ValidVariables() []*Variable {
+	var vars []*Variable
+	for _, v := range s.Variables {
+		if v.IsValid() {
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// Find returns the valid variable with the given name and vendor GUID, or
+// nil if it is not found
+func (s VariableStore) Find(name, guid string) *Variable {
+	for _, v := range s.ValidVariables() {
+		if v.Name == name && v.GUID() == strings.ToLower(guid) {
+			return v
+		}
+	}
+	return nil
+}
+
+// FindVariable returns the valid variable with the given name and vendor
+// GUID in the variable stores of the region, or nil if it is not found
+func (br BiosRegion) FindVariable(name, guid string) *Variable {
+	for _, fv := range br.FirmwareVolumes {
+		if fv.VariableStore == nil {
+			continue
+		}
+		if v := fv.VariableStore.Find(name, guid); v != nil {
+			return v
+		}
+	}
+	return nil
+}
+
+// Summary prints a multi-line description of the variable store
+func (s VariableStore) Summary() string {
+	var vars []string
+	for _, v := range s.Variables {
+		vars = append(vars, v.String())
+	}
+	return fmt.Sprintf("VariableStore{\n"+
+		"    Size=%v\n"+
+		"    Authenticated=%v\n"+
+		"    Variables=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		s.Size, s.IsAuthenticated(),
+		Indent(strings.Join(vars, "\n"), 8),
+	)
+}
+
+// MarshalBinary serializes the variable store, with each variable at its
+// offset. Anything else is copied from the parsed buffer.
+func (s VariableStore) MarshalBinary() ([]byte, error) {
+	out := append([]byte{}, s.buf...)
+	for _, v := range s.Variables {
+		if err := splice(out, v.Offset, v.buf, v.String()); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// IsVariableStore returns whether buf starts with a known variable store
+// signature
+func IsVariableStore(buf []byte) bool {
+	if len(buf) < VariableStoreHeaderSize {
+		return false
+	}
+	guid, err := uuid.FromBytes(buf[:16])
+	if err != nil {
+		return false
+	}
+	return guid.String() == VariableStoreGUID || guid.String() == AuthVariableStoreGUID
+}
+
+// NewVariableStore parses a sequence of bytes and returns a VariableStore
+// object, if a valid one is passed, or an error
+func NewVariableStore(buf []byte) (*VariableStore, error) {
+	if !IsVariableStore(buf) {
+		return nil, fmt.Errorf("Variable store signature not found")
+	}
+	var s VariableStore
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &s.VariableStoreHeader); err != nil {
+		return nil, err
+	}
+	size := uint64(s.Size)
+	if size > uint64(len(buf)) || size < VariableStoreHeaderSize {
+		return nil, fmt.Errorf("Invalid variable store size %v, %v bytes available", s.Size, len(buf))
+	}
+	s.buf = buf[:size]
+	offset := uint64(VariableStoreHeaderSize)
+	for offset = alignUp(offset, VariableAlignment); offset+2 <= size; {
+		if binary.LittleEndian.Uint16(s.buf[offset:]) != VariableStartID {
+			// end of the variables
+			break
+		}
+		v, err := NewVariable(s.buf[offset:], s.IsAuthenticated())
+		if err != nil {
+			err = fmt.Errorf("Variable at offset 0x%x: %v", offset, err)
+			if err := tolerate(&s.Broken, offset, s.buf[offset:], err); err != nil {
+				return nil, err
+			}
+			break
+		}
+		v.Offset = offset
+		s.Variables = append(s.Variables, v)
+		offset = alignUp(offset+uint64(len(v.buf)), VariableAlignment)
+	}
+	return &s, nil
+}
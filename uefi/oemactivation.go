@@ -0,0 +1,186 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// ACPI table constants
+const (
+	ACPIHeaderSize = 36
+	// maximum size accepted for licensing tables, to discard false positives
+	licensingTableMaxSize = 0x1000
+)
+
+// ACPIHeader is the common header of all the ACPI tables
+type ACPIHeader struct {
+	Signature       [4]uint8
+	Length          uint32
+	Revision        uint8
+	Checksum        uint8
+	OEMID           [6]uint8
+	OEMTableID      [8]uint8
+	OEMRevision     uint32
+	CreatorID       [4]uint8
+	CreatorRevision uint32
+}
+
+// SLICMarker is the OEM Windows marker stored in a SLIC table, after the
+// OEM public key structure
+type SLICMarker struct {
+	Type        uint32
+	Length      uint32
+	Version     uint32
+	OEMID       [6]uint8
+	OEMTableID  [8]uint8
+	WindowsFlag [8]uint8
+	SLICVersion uint32
+	Reserved    [16]uint8
+	Signature   [128]uint8
+}
+
+// LicensingTable describes an OEM activation table (SLIC or MSDM) found in
+// an image.
+type LicensingTable struct {
+	ACPIHeader
+	// Offset is the position of the table from the start of the image
+	Offset        uint64
+	ChecksumValid bool
+	// Marker is the Windows marker, for SLIC tables
+	Marker *SLICMarker
+	// ProductKey is the embedded Windows product key, for MSDM tables
+	ProductKey string
+}
+
+// Name returns the signature of the table, e.g. "SLIC"
+func (t LicensingTable) Name() string {
+	return string(t.Signature[:])
+}
+
+// MarkerVersion returns the SLIC marker version in the major.minor form, as
+// used by Microsoft to identify the OEM activation version, or an empty
+// string if there is no marker.
+func (t LicensingTable) MarkerVersion() string {
+	if t.Marker == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d", t.Marker.Version>>16, t.Marker.Version&0xffff)
+}
+
+func (t LicensingTable) String() string {
+	s := fmt.Sprintf("%s at 0x%x: OEMID=%q, OEMTableID=%q, Length=%v, ChecksumValid=%v",
+		t.Name(), t.Offset,
+		strings.TrimRight(string(t.OEMID[:]), " \x00"),
+		strings.TrimRight(string(t.OEMTableID[:]), " \x00"),
+		t.Length, t.ChecksumValid,
+	)
+	if t.Marker != nil {
+		s += fmt.Sprintf(", MarkerVersion=%s, WindowsFlag=%q", t.MarkerVersion(), string(t.Marker.WindowsFlag[:]))
+	}
+	if t.ProductKey != "" {
+		s += fmt.Sprintf(", ProductKey=%s", t.ProductKey)
+	}
+	return s
+}
+
+// newLicensingTable parses the table at the start of buf
+func newLicensingTable(buf []byte) (*LicensingTable, error) {
+	var t LicensingTable
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &t.ACPIHeader); err != nil {
+		return nil, err
+	}
+	if t.Length < ACPIHeaderSize || t.Length > licensingTableMaxSize || uint64(t.Length) > uint64(len(buf)) {
+		return nil, fmt.Errorf("Invalid %s table length %v", t.Name(), t.Length)
+	}
+	table := buf[:t.Length]
+	t.ChecksumValid = checksum8(table) == 0
+	body := table[ACPIHeaderSize:]
+	switch t.Name() {
+	case "SLIC":
+		// the OEM public key structure comes first, its length is the second
+		// dword
+		if len(body) < 8 {
+			return nil, fmt.Errorf("SLIC table too short")
+		}
+		keyLen := binary.LittleEndian.Uint32(body[4:])
+		if uint64(keyLen) < uint64(len(body)) {
+			var marker SLICMarker
+			if err := binary.Read(bytes.NewReader(body[keyLen:]), binary.LittleEndian, &marker); err == nil && marker.Type == 1 {
+				t.Marker = &marker
+			}
+		}
+	case "MSDM":
+		// Version, Reserved, DataType, DataReserved, DataLength, Data
+		if len(body) < 20 {
+			return nil, fmt.Errorf("MSDM table too short")
+		}
+		dataLen := binary.LittleEndian.Uint32(body[16:])
+		if uint64(dataLen) <= uint64(len(body)-20) {
+			t.ProductKey = strings.TrimRight(string(body[20:20+dataLen]), "\x00")
+		}
+	}
+	return &t, nil
+}
+
+// FindLicensingTables scans buf for SLIC and MSDM ACPI tables, used for
+// Windows OEM activation, and returns the ones that look valid.
+func FindLicensingTables(buf []byte) []LicensingTable {
+	var tables []LicensingTable
+	for _, sig := range []string{"SLIC", "MSDM"} {
+		for offset := 0; ; {
+			idx := bytes.Index(buf[offset:], []byte(sig))
+			if idx == -1 {
+				break
+			}
+			offset += idx
+			if t, err := newLicensingTable(buf[offset:]); err == nil {
+				t.Offset = uint64(offset)
+				tables = append(tables, *t)
+			}
+			offset += len(sig)
+		}
+	}
+	return tables
+}
+
+// OEMActivation1Marker is the string that OEM activation 1.0 looks for in
+// the BIOS memory range.
+var OEMActivation1Marker = []byte("Microsoft Corporation")
+
+// LicensingReport summarizes the OEM activation data found in an image
+type LicensingReport struct {
+	Tables []LicensingTable
+	// OA1MarkerOffsets lists the positions of the OEM activation 1.0 marker
+	OA1MarkerOffsets []uint64
+}
+
+// LicensingReport looks for Windows OEM activation data in the image: SLIC
+// and MSDM tables, and OEM activation 1.0 markers.
+func (f FlashImage) LicensingReport() LicensingReport {
+	r := LicensingReport{Tables: FindLicensingTables(f.buf)}
+	for offset := 0; ; {
+		idx := bytes.Index(f.buf[offset:], OEMActivation1Marker)
+		if idx == -1 {
+			break
+		}
+		r.OA1MarkerOffsets = append(r.OA1MarkerOffsets, uint64(offset+idx))
+		offset += idx + len(OEMActivation1Marker)
+	}
+	return r
+}
+
+func (r LicensingReport) String() string {
+	var lines []string
+	for _, t := range r.Tables {
+		lines = append(lines, t.String())
+	}
+	for _, off := range r.OA1MarkerOffsets {
+		lines = append(lines, fmt.Sprintf("OEM activation 1.0 marker at 0x%x", off))
+	}
+	if len(lines) == 0 {
+		return "No OEM activation data found"
+	}
+	return strings.Join(lines, "\n")
+}
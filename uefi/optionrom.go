@@ -0,0 +1,317 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/insomniacslk/uefi/compression"
+)
+
+// Option ROM constants
+const (
+	// OptionROMSignature starts each image of a PCI expansion ROM
+	OptionROMSignature = 0xaa55
+	// EFIOptionROMSignature identifies the headers of the EFI images
+	EFIOptionROMSignature = 0x0ef1
+	// OptionROMImageUnit is the unit of the image lengths
+	OptionROMImageUnit = 512
+	// PCIDataStructureSize is the size of the PCI data structure of the PCI
+	// 3.0 specification
+	PCIDataStructureSize = 24
+	// EFIOptionROMHeaderSize is the size of the header of an EFI image
+	EFIOptionROMHeaderSize = 28
+	// pciDataLastImage is set in the indicator of the last image of the ROM
+	pciDataLastImage = 0x80
+	// efiOptionROMCompressed is the compression type of the images
+	// compressed with the EFI algorithm
+	efiOptionROMCompressed = 1
+)
+
+// PCIDataSignature starts the PCI data structure of the images
+var PCIDataSignature = []byte("PCIR")
+
+// PCI code types
+const (
+	PCICodeTypeX86          = 0
+	PCICodeTypeOpenFirmware = 1
+	PCICodeTypeHPPA         = 2
+	PCICodeTypeEFI          = 3
+)
+
+var pciCodeTypeNames = map[uint8]string{
+	PCICodeTypeX86:          "Legacy x86",
+	PCICodeTypeOpenFirmware: "Open Firmware",
+	PCICodeTypeHPPA:         "HP PA-RISC",
+	PCICodeTypeEFI:          "EFI",
+}
+
+// EFIMachineTypeNames maps the PE machine types of the EFI images to names
+var EFIMachineTypeNames = map[uint16]string{
+	0x014c: "IA32",
+	0x0200: "IA64",
+	0x0ebc: "EBC",
+	0x8664: "X64",
+	0x01c2: "ARM",
+	0xaa64: "AArch64",
+	0x5064: "RISCV64",
+}
+
+// PCIDataStructure is the PCI data structure of an option ROM image,
+// identifying the device and the code type of the image
+type PCIDataStructure struct {
+	Signature        [4]byte
+	VendorID         uint16
+	DeviceID         uint16
+	DeviceListOffset uint16
+	Length           uint16
+	Revision         uint8
+	ClassCode        [3]uint8
+	// ImageLength is in units of 512 bytes
+	ImageLength           uint16
+	CodeRevision          uint16
+	CodeType              uint8
+	Indicator             uint8
+	MaxRuntimeImageLength uint16
+}
+
+// EFIOptionROMHeader is the header of the EFI images of an option ROM
+type EFIOptionROMHeader struct {
+	Signature uint16
+	// InitializationSize is in units of 512 bytes
+	InitializationSize   uint16
+	EFISignature         uint32
+	EFISubsystem         uint16
+	EFIMachineType       uint16
+	CompressionType      uint16
+	Reserved             [8]uint8
+	EFIImageHeaderOffset uint16
+	PCIROffset           uint16
+}
+
+// OptionROMImage is an image of a PCI option ROM, either a legacy one
+// holding x86 code or an EFI driver
+type OptionROMImage struct {
+	// Offset is the position of the image from the start of the ROM
+	Offset uint64
+	PCIR   PCIDataStructure
+	// EFI is only set on the EFI images
+	EFI  *EFIOptionROMHeader
+	Data []byte `json:"-"`
+	// Executable is the x86 code of the legacy images, starting with the
+	// ROM header, or the decompressed PE image of the EFI images
+	Executable []byte `json:"-"`
+	// Errors holds the checksum and decompression errors
+	Errors []error `json:"-"`
+}
+
+// Compressed returns whether the EFI driver of the image is compressed
+func (i OptionROMImage) Compressed() bool {
+	return i.EFI != nil && i.EFI.CompressionType != 0
+}
+
+func (i OptionROMImage) String() string {
+	codeType, ok := pciCodeTypeNames[i.PCIR.CodeType]
+	if !ok {
+		codeType = fmt.Sprintf("Unknown 0x%02x", i.PCIR.CodeType)
+	}
+	s := fmt.Sprintf("%s %04x:%04x class %02x%02x%02x [0x%x-0x%x]", codeType, i.PCIR.VendorID, i.PCIR.DeviceID,
+		i.PCIR.ClassCode[2], i.PCIR.ClassCode[1], i.PCIR.ClassCode[0], i.Offset, i.Offset+uint64(len(i.Data)))
+	if i.EFI != nil {
+		machine, ok := EFIMachineTypeNames[i.EFI.EFIMachineType]
+		if !ok {
+			machine = fmt.Sprintf("0x%04x", i.EFI.EFIMachineType)
+		}
+		s += fmt.Sprintf(" %s subsystem %d", machine, i.EFI.EFISubsystem)
+		if i.Compressed() {
+			s += " compressed"
+		}
+	}
+	return s
+}
+
+// OptionROM is a PCI expansion ROM, a sequence of images for the same device
+type OptionROM struct {
+	Images []*OptionROMImage
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the ROM
+func (r OptionROM) Buf() []byte {
+	return r.buf
+}
+
+// Summary prints a multi-line description of the ROM
+func (r OptionROM) Summary() string {
+	var images []string
+	for _, i := range r.Images {
+		images = append(images, i.String())
+	}
+	return fmt.Sprintf("OptionROM{\n"+
+		"    Size=%v\n"+
+		"    Images=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}", len(r.buf), Indent(strings.Join(images, "\n"), 8))
+}
+
+// Validate returns the errors found while parsing the images
+func (r OptionROM) Validate() []error {
+	errors := make([]error, 0)
+	for _, i := range r.Images {
+		errors = append(errors, i.Errors...)
+	}
+	return errors
+}
+
+// MarshalBinary serializes the ROM
+func (r OptionROM) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, r.buf...), nil
+}
+
+// parseOptionROMImage parses the image at the start of buf, or returns nil
+// if it is not followed by a valid PCI data structure
+func parseOptionROMImage(buf []byte) *OptionROMImage {
+	if len(buf) < 0x1a || binary.LittleEndian.Uint16(buf) != OptionROMSignature {
+		return nil
+	}
+	pcir := uint64(binary.LittleEndian.Uint16(buf[0x18:]))
+	if pcir+PCIDataStructureSize > uint64(len(buf)) || !bytes.Equal(buf[pcir:pcir+4], PCIDataSignature) {
+		return nil
+	}
+	var i OptionROMImage
+	if err := binary.Read(bytes.NewReader(buf[pcir:]), binary.LittleEndian, &i.PCIR); err != nil {
+		return nil
+	}
+	size := uint64(i.PCIR.ImageLength) * OptionROMImageUnit
+	if size == 0 || size > uint64(len(buf)) {
+		return nil
+	}
+	i.Data = buf[:size]
+	if i.PCIR.CodeType != PCICodeTypeEFI {
+		i.Executable = i.Data
+		if i.PCIR.CodeType == PCICodeTypeX86 {
+			var sum uint8
+			for _, b := range i.Data {
+				sum += b
+			}
+			if sum != 0 {
+				i.Errors = append(i.Errors, fmt.Errorf("Option ROM image %04x:%04x: invalid checksum", i.PCIR.VendorID, i.PCIR.DeviceID))
+			}
+		}
+		return &i
+	}
+	var h EFIOptionROMHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil || h.EFISignature != EFIOptionROMSignature {
+		return &i
+	}
+	i.EFI = &h
+	start := uint64(h.EFIImageHeaderOffset)
+	end := uint64(h.InitializationSize) * OptionROMImageUnit
+	if end > size {
+		end = size
+	}
+	if start < EFIOptionROMHeaderSize || start >= end {
+		i.Errors = append(i.Errors, fmt.Errorf("Option ROM image %04x:%04x: invalid EFI image offset 0x%x", i.PCIR.VendorID, i.PCIR.DeviceID, start))
+		return &i
+	}
+	i.Executable = i.Data[start:end]
+	if h.CompressionType == efiOptionROMCompressed {
+		exe, err := compression.EFI.Decode(i.Executable)
+		if err != nil {
+			i.Errors = append(i.Errors, fmt.Errorf("Option ROM image %04x:%04x: %v", i.PCIR.VendorID, i.PCIR.DeviceID, err))
+			exe = nil
+		}
+		i.Executable = exe
+	}
+	return &i
+}
+
+// IsOptionROM returns whether buf starts with an option ROM image
+func IsOptionROM(buf []byte) bool {
+	return parseOptionROMImage(buf) != nil
+}
+
+// NewOptionROM parses the images of the option ROM at the start of buf, up
+// to the one flagged as the last
+func NewOptionROM(buf []byte) (*OptionROM, error) {
+	var r OptionROM
+	offset := uint64(0)
+	for offset < uint64(len(buf)) {
+		i := parseOptionROMImage(buf[offset:])
+		if i == nil {
+			break
+		}
+		i.Offset = offset
+		r.Images = append(r.Images, i)
+		offset += uint64(len(i.Data))
+		if i.PCIR.Indicator&pciDataLastImage != 0 {
+			break
+		}
+	}
+	if len(r.Images) == 0 {
+		return nil, fmt.Errorf("No option ROM image found")
+	}
+	r.buf = buf[:offset]
+	return &r, nil
+}
+
+// FindOptionROMs returns the option ROMs in buf
+func FindOptionROMs(buf []byte) []*OptionROM {
+	var roms []*OptionROM
+	signature := []byte{OptionROMSignature & 0xff, OptionROMSignature >> 8}
+	for offset := 0; offset < len(buf); {
+		idx := bytes.Index(buf[offset:], signature)
+		if idx == -1 {
+			break
+		}
+		offset += idx
+		r, err := NewOptionROM(buf[offset:])
+		if err != nil {
+			offset += len(signature)
+			continue
+		}
+		roms = append(roms, r)
+		offset += len(r.buf)
+	}
+	return roms
+}
+
+// FileOptionROM is an option ROM of the BIOS region, as returned by
+// BiosRegion.OptionROMs
+type FileOptionROM struct {
+	// File is the GUID of the file holding the ROM, Name its module
+	// name, see File.ModuleName
+	File string
+	Name string
+	OptionROM
+}
+
+func (r FileOptionROM) String() string {
+	var images []string
+	for _, i := range r.Images {
+		images = append(images, i.String())
+	}
+	return fmt.Sprintf("%s: %s", strings.TrimSpace(r.File+" "+r.Name), strings.Join(images, ", "))
+}
+
+// OptionROMs returns the option ROMs stored in the files of the region,
+// either in raw sections or as the data of files without sections
+func (br BiosRegion) OptionROMs() []FileOptionROM {
+	var roms []FileOptionROM
+	isRaw := func(s *Section) bool { return s.Type == SectionTypeRaw }
+	br.walkFileData(isRaw, func(f *File, data []byte) {
+		for _, r := range FindOptionROMs(data) {
+			roms = append(roms, FileOptionROM{File: f.GUID(), Name: f.ModuleName(), OptionROM: *r})
+		}
+	})
+	return roms
+}
+
+// OptionROMs returns the option ROMs stored in the region, e.g. the PXE
+// ROM of the network controller
+func (gr GbeRegion) OptionROMs() []*OptionROM {
+	return FindOptionROMs(gr.buf)
+}
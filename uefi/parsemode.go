@@ -0,0 +1,92 @@
+package uefi
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ParseMode controls how the parsers react to malformed structures.
+type ParseMode int
+
+// Parse modes. In strict mode the parsers fail on the first malformed
+// structure. In permissive mode the problem is recorded, the broken element
+// is kept as raw bytes and the parsing continues.
+const (
+	ParseStrict ParseMode = iota
+	ParsePermissive
+)
+
+func (m ParseMode) String() string {
+	switch m {
+	case ParseStrict:
+		return "strict"
+	case ParsePermissive:
+		return "permissive"
+	}
+	return fmt.Sprintf("Unknown (%d)", int(m))
+}
+
+// parseMode is the package-level parse mode
+var parseMode = ParseStrict
+
+// SetParseMode sets the parse mode used by all the parsers.
+func SetParseMode(m ParseMode) {
+	parseMode = m
+}
+
+// GetParseMode returns the parse mode currently in use.
+func GetParseMode() ParseMode {
+	return parseMode
+}
+
+// parseModeLock serializes the calls to WithParseMode
+var parseModeLock sync.Mutex
+
+// WithParseMode runs fn, which parses images, in the given mode, and then
+// restores the previous mode. The calls are serialized, so that concurrent
+// callers, e.g. the users of a shared library, each parse in their own mode.
+func WithParseMode(m ParseMode, fn func()) {
+	parseModeLock.Lock()
+	defer parseModeLock.Unlock()
+	old := parseMode
+	parseMode = m
+	defer func() {
+		parseMode = old
+	}()
+	fn()
+}
+
+// BrokenNode holds the raw bytes of an element that could not be parsed in
+// permissive mode, and the error that was encountered.
+type BrokenNode struct {
+	// Offset is the position of the element from the start of its container
+	Offset uint64
+	Data   []byte
+	Err    error
+}
+
+func (b BrokenNode) String() string {
+	return fmt.Sprintf("BrokenNode{Offset=0x%x, Size=%v, Err=%v}", b.Offset, len(b.Data), b.Err)
+}
+
+// tolerate handles a parse error according to the parse mode. In strict mode
+// the error is returned unchanged, in permissive mode it is recorded in
+// broken and nil is returned.
+func tolerate(broken *[]BrokenNode, offset uint64, data []byte, err error) error {
+	if parseMode == ParseStrict {
+		return err
+	}
+	warnf("Tolerating parse error at offset 0x%x: %v", offset, err)
+	*broken = append(*broken, BrokenNode{Offset: offset, Data: data, Err: err})
+	return nil
+}
+
+// brokenErrors returns the errors of a list of broken nodes, prefixed with
+// the name of their container.
+func brokenErrors(container string, broken []BrokenNode) []error {
+	var errors []error
+	for _, b := range broken {
+		errors = append(errors, fmt.Errorf("%s: broken element at offset 0x%x: %v", container, b.Offset, b.Err))
+	}
+	return errors
+}
@@ -0,0 +1,26 @@
+package uefi
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestWithParseMode(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		mode := ParseMode(i % 2)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			WithParseMode(mode, func() {
+				if got := GetParseMode(); got != mode {
+					t.Errorf("parse mode %v, want %v", got, mode)
+				}
+			})
+		}()
+	}
+	wg.Wait()
+	if got := GetParseMode(); got != ParseStrict {
+		t.Errorf("parse mode %v after the calls, want %v", got, ParseStrict)
+	}
+}
@@ -0,0 +1,226 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// EventType is the type of a TCG event log entry
+type EventType uint32
+
+// TCG event types of the measurements simulated by BiosRegion.PCRs
+const (
+	EventTypeSeparator            EventType = 0x00000004
+	EventTypeSCRTMContents        EventType = 0x00000007
+	EventTypeSCRTMVersion         EventType = 0x00000008
+	EventTypeEFIAction            EventType = 0x80000007
+	EventTypePlatformFirmwareBlob EventType = 0x80000008
+)
+
+var eventTypeNames = map[EventType]string{
+	EventTypeSeparator:            "EV_SEPARATOR",
+	EventTypeSCRTMContents:        "EV_S_CRTM_CONTENTS",
+	EventTypeSCRTMVersion:         "EV_S_CRTM_VERSION",
+	EventTypeEFIAction:            "EV_EFI_ACTION",
+	EventTypePlatformFirmwareBlob: "EV_EFI_PLATFORM_FIRMWARE_BLOB",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("EventType(0x%08x)", uint32(t))
+}
+
+// efiActionBootOption is the event data measured in PCR4 before the boot
+// options are started
+const efiActionBootOption = "Calling EFI Application from Boot Option"
+
+// PCREvent is a simulated extend of a PCR
+type PCREvent struct {
+	PCR         int
+	Type        EventType
+	Description string
+	// Digest is the hex encoded digest extended in the PCR
+	Digest string
+}
+
+func (e PCREvent) String() string {
+	return fmt.Sprintf("PCR%d %v %s: %s", e.PCR, e.Type, e.Digest, e.Description)
+}
+
+// PCRLog is the simulated event log of the firmware, with the resulting PCR
+// values
+type PCRLog struct {
+	Algorithm HashAlgorithm
+	Events    []PCREvent
+	// PCRs holds the hex encoded values of the PCRs after the events
+	PCRs map[int]string
+	// pcrs holds the values of the PCRs while the events are added
+	pcrs map[int][]byte
+}
+
+// extend adds an event to the log, extending the PCR with the digest of data
+func (l *PCRLog) extend(pcr int, typ EventType, description string, data []byte) error {
+	digest, err := l.Algorithm.Sum(data)
+	if err != nil {
+		return err
+	}
+	value, ok := l.pcrs[pcr]
+	if !ok {
+		value = make([]byte, len(digest))
+	}
+	if value, err = l.Algorithm.Sum(append(append([]byte{}, value...), digest...)); err != nil {
+		return err
+	}
+	l.pcrs[pcr] = value
+	l.PCRs[pcr] = hex.EncodeToString(value)
+	l.Events = append(l.Events, PCREvent{PCR: pcr, Type: typ, Description: description, Digest: hex.EncodeToString(digest)})
+	return nil
+}
+
+func (l PCRLog) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Algorithm=%v\n", l.Algorithm)
+	for _, e := range l.Events {
+		fmt.Fprintln(&b, e)
+	}
+	var pcrs []int
+	for pcr := range l.PCRs {
+		pcrs = append(pcrs, pcr)
+	}
+	sort.Ints(pcrs)
+	for _, pcr := range pcrs {
+		fmt.Fprintf(&b, "PCR%d=%s\n", pcr, l.PCRs[pcr])
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// hasSECCore returns whether the volume holds the SEC core, which makes it
+// the boot volume
+func (fv FirmwareVolume) hasSECCore() bool {
+	for _, f := range fv.Files {
+		if f.Type == FileTypeSecurityCore {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeImageSections appends the firmware volume image sections among
+// sections and their children to found
+func volumeImageSections(found []*Section, sections []*Section) []*Section {
+	for _, s := range sections {
+		if s.Type == SectionTypeFirmwareVolumeImage {
+			found = append(found, s)
+		}
+		found = volumeImageSections(found, s.Sections)
+	}
+	return found
+}
+
+// PCRs simulates the measurements of the firmware in PCR0, PCR2 and PCR4
+// with the given bank algorithm, following the EDK2 measured boot rules.
+//
+// If the region has a Boot Policy Manifest, the ACM measures each IBB in
+// PCR0, starting from locality 3 if the IBB element asks so, and the
+// volumes covered by the IBB are not measured again. The exact format of
+// the ACM measurement depends on the ACM version: the digest of the IBB is
+// used, so the values are only a prediction for the ACMs that measure the
+// IBB digest alone. Without Boot Guard, the firmware measures its empty
+// version string as the S-CRTM instead.
+//
+// Then every firmware volume of the region with files is measured in PCR0,
+// the boot volume with the SEC core first, followed by the volumes in the
+// firmware volume image sections. At ready to boot, the boot option action
+// is measured in PCR4 and a separator in PCR0, PCR2 and PCR4. PCR2 assumes
+// there are no option ROMs on add-in cards, and PCR4 does not include the
+// OS loader, which is measured after the separator.
+func (br BiosRegion) PCRs(a HashAlgorithm) (*PCRLog, error) {
+	if _, err := a.newHash(); err != nil {
+		return nil, err
+	}
+	l := PCRLog{Algorithm: a, PCRs: make(map[int]string), pcrs: make(map[int][]byte)}
+
+	covered := make(map[uint64]bool)
+	bpm, err := br.BootPolicyManifest()
+	if err != nil {
+		return nil, err
+	}
+	if bpm != nil {
+		for i, e := range bpm.IBBs {
+			if i == 0 && e.Flags&IBBFlagInitialMeasureLoc3 != 0 {
+				start := make([]byte, hashAlgorithmSizes[a])
+				start[len(start)-1] = 3
+				l.pcrs[0] = start
+			}
+			data, err := br.IBBData(e)
+			if err != nil {
+				return nil, fmt.Errorf("IBB element %d: %v", i+1, err)
+			}
+			if err := l.extend(0, EventTypeSCRTMContents, fmt.Sprintf("Boot Guard IBB %d", i+1), data); err != nil {
+				return nil, err
+			}
+		}
+		coverage, err := br.BootGuardCoverage()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range coverage {
+			covered[c.Offset] = c.Status() == "covered"
+		}
+	} else {
+		// PcdFirmwareVersionString defaults to L""
+		if err := l.extend(0, EventTypeSCRTMVersion, "S-CRTM version", []byte{0, 0}); err != nil {
+			return nil, err
+		}
+	}
+
+	// the boot volume comes first
+	var volumes []FirmwareVolume
+	for _, fv := range br.FirmwareVolumes {
+		if len(fv.Files) == 0 || covered[fv.Offset] {
+			continue
+		}
+		volumes = append(volumes, fv)
+	}
+	sort.SliceStable(volumes, func(i, j int) bool {
+		return volumes[i].hasSECCore() && !volumes[j].hasSECCore()
+	})
+	for _, fv := range volumes {
+		if err := l.extend(0, EventTypePlatformFirmwareBlob, fmt.Sprintf("FV %s at 0x%x", fv.guidString(), fv.Offset), fv.buf); err != nil {
+			return nil, err
+		}
+	}
+	for _, fv := range br.FirmwareVolumes {
+		for _, f := range fv.Files {
+			for _, s := range volumeImageSections(nil, f.Sections) {
+				if err := l.extend(0, EventTypePlatformFirmwareBlob, fmt.Sprintf("FV image in file %s", f.GUID()), s.Data()); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	if err := l.extend(4, EventTypeEFIAction, efiActionBootOption, []byte(efiActionBootOption)); err != nil {
+		return nil, err
+	}
+	for _, pcr := range []int{0, 2, 4} {
+		if err := l.extend(pcr, EventTypeSeparator, "Separator", []byte{0, 0, 0, 0}); err != nil {
+			return nil, err
+		}
+	}
+	return &l, nil
+}
+
+// PCRs simulates the measurements of the BIOS region of the image, see
+// BiosRegion.PCRs
+func (f FlashImage) PCRs(a HashAlgorithm) (*PCRLog, error) {
+	if f.BiosRegion == nil {
+		return nil, fmt.Errorf("The image has no BIOS region")
+	}
+	return f.BiosRegion.PCRs(a)
+}
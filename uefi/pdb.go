@@ -0,0 +1,167 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"path"
+	"strings"
+)
+
+const (
+	// peDebugDirectory is the index of the data directory of the debug
+	// directory
+	peDebugDirectory = 6
+	// peDebugEntrySize is the size of an entry of the debug directory
+	peDebugEntrySize = 28
+	// peDebugTypeCodeView is the type of the debug entries pointing to the
+	// debug information file
+	peDebugTypeCodeView = 2
+	// teHeaderSize is the size of the header of the TE images, which
+	// replaces the stripped PE headers
+	teHeaderSize = 40
+)
+
+// TESignature starts the TE images, the terse PE images of the PEI phase
+var TESignature = []byte("VZ")
+
+// codeViewPathOffsets maps the signatures of the CodeView records written by
+// the EDK2 tool chains to the offset of the path of the debug information
+// file in the record: the PDB of the Microsoft tool chains, the DLL of the
+// GCC and Xcode ones
+var codeViewPathOffsets = map[string]int{
+	"RSDS": 24,
+	"NB10": 16,
+	"MTOC": 20,
+}
+
+// peDebugDirectoryData returns the debug directory of a PE image, and a
+// function converting the relative virtual addresses of the image to file
+// offsets, or -1 if the address is outside of the image. It returns nil if
+// the image has no debug directory.
+func peDebugDirectoryData(img []byte) ([]byte, func(uint32) int) {
+	if peChecksumOffset(img) == -1 {
+		return nil, nil
+	}
+	coff := int(binary.LittleEndian.Uint32(img[0x3c:])) + 4
+	optional := coff + 20
+	if optional+2 > len(img) {
+		return nil, nil
+	}
+	var countOffset, dirs int
+	switch binary.LittleEndian.Uint16(img[optional:]) {
+	case 0x10b:
+		countOffset, dirs = optional+92, optional+96
+	case 0x20b:
+		countOffset, dirs = optional+108, optional+112
+	default:
+		return nil, nil
+	}
+	entry := dirs + peDebugDirectory*8
+	if entry+8 > len(img) || binary.LittleEndian.Uint32(img[countOffset:]) <= peDebugDirectory {
+		return nil, nil
+	}
+	sections := optional + int(binary.LittleEndian.Uint16(img[coff+16:]))
+	count := int(binary.LittleEndian.Uint16(img[coff+2:]))
+	toOffset := func(rva uint32) int {
+		for i := 0; i < count && sections+(i+1)*40 <= len(img); i++ {
+			s := img[sections+i*40:]
+			start := binary.LittleEndian.Uint32(s[12:])
+			size := binary.LittleEndian.Uint32(s[16:])
+			if rva >= start && rva-start < size {
+				return int(binary.LittleEndian.Uint32(s[20:]) + rva - start)
+			}
+		}
+		// the headers are mapped as is
+		if rva < uint32(len(img)) {
+			return int(rva)
+		}
+		return -1
+	}
+	return dataRange(img, toOffset(binary.LittleEndian.Uint32(img[entry:])), binary.LittleEndian.Uint32(img[entry+4:])), toOffset
+}
+
+// teDebugDirectoryData is peDebugDirectoryData for TE images, whose
+// addresses are relative to the stripped PE headers
+func teDebugDirectoryData(img []byte) ([]byte, func(uint32) int) {
+	if len(img) < teHeaderSize || !bytes.HasPrefix(img, TESignature) {
+		return nil, nil
+	}
+	stripped := uint32(binary.LittleEndian.Uint16(img[6:]))
+	toOffset := func(rva uint32) int {
+		if rva+teHeaderSize < stripped {
+			return -1
+		}
+		return int(rva + teHeaderSize - stripped)
+	}
+	return dataRange(img, toOffset(binary.LittleEndian.Uint32(img[32:])), binary.LittleEndian.Uint32(img[36:])), toOffset
+}
+
+// dataRange returns the size bytes of img at offset, or nil if they are
+// outside of img
+func dataRange(img []byte, offset int, size uint32) []byte {
+	if offset < 0 || size == 0 || uint64(offset)+uint64(size) > uint64(len(img)) {
+		return nil
+	}
+	return img[offset : offset+int(size)]
+}
+
+// imagePDBPath returns the path of the debug information file recorded in
+// the CodeView entry of the debug directory of a PE or TE image, as it was
+// on the build machine, or an empty string if the image has none
+func imagePDBPath(img []byte) string {
+	dir, toOffset := peDebugDirectoryData(img)
+	if dir == nil {
+		dir, toOffset = teDebugDirectoryData(img)
+	}
+	for ; len(dir) >= peDebugEntrySize; dir = dir[peDebugEntrySize:] {
+		if binary.LittleEndian.Uint32(dir[12:]) != peDebugTypeCodeView {
+			continue
+		}
+		record := dataRange(img, toOffset(binary.LittleEndian.Uint32(dir[20:])), binary.LittleEndian.Uint32(dir[16:]))
+		if len(record) < 4 {
+			continue
+		}
+		offset, ok := codeViewPathOffsets[string(record[:4])]
+		if !ok || offset >= len(record) {
+			continue
+		}
+		p := record[offset:]
+		if end := bytes.IndexByte(p, 0); end != -1 {
+			p = p[:end]
+		}
+		return string(p)
+	}
+	return ""
+}
+
+// PDBName returns the base name, without extension, of the debug
+// information file recorded in the PE32 or TE section of the file, e.g.
+// "PchInitSmm" for "c:\build\X64\PchInitSmm\DEBUG\PchInitSmm.pdb", which
+// the EDK2 build names after the module. It returns an empty string if the
+// file has no such section, or its image no CodeView debug entry.
+func (f File) PDBName() string {
+	s := findSection(f.Sections, SectionTypePE32)
+	if s == nil {
+		s = findSection(f.Sections, SectionTypeTE)
+	}
+	if s == nil {
+		return ""
+	}
+	p := imagePDBPath(s.Data())
+	// the path is in the syntax of the build machine
+	if i := strings.LastIndexAny(p, `/\`); i != -1 {
+		p = p[i+1:]
+	}
+	return strings.TrimSuffix(p, path.Ext(p))
+}
+
+// ModuleName returns the name of the file from its user interface section,
+// or else the one of its debug information file, see PDBName. Stripped
+// images often drop the user interface sections but keep the debug
+// directory of the images.
+func (f File) ModuleName() string {
+	if name := f.UIName(); name != "" {
+		return name
+	}
+	return f.PDBName()
+}
@@ -0,0 +1,156 @@
+package uefi
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// PdrDecoder decodes the Platform Data region of a vendor. It returns the
+// decoded fields, e.g. board IDs or configuration flags, and false if the
+// region does not have the layout of the vendor.
+type PdrDecoder func(buf []byte) (map[string]string, bool)
+
+type namedPdrDecoder struct {
+	name   string
+	decode PdrDecoder
+}
+
+var pdrDecoders []namedPdrDecoder
+
+// RegisterPdrDecoder registers a decoder for the Platform Data region. The
+// decoders are tried in registration order by PdrRegion.Decode. Registering
+// a decoder with the name of an existing one replaces it.
+func RegisterPdrDecoder(name string, d PdrDecoder) {
+	for i, pd := range pdrDecoders {
+		if pd.name == name {
+			pdrDecoders[i].decode = d
+			return
+		}
+	}
+	pdrDecoders = append(pdrDecoders, namedPdrDecoder{name, d})
+}
+
+// PdrRegion represents the Platform Data region of the flash image. Its format
+// is defined by the platform vendor, and is decoded by the decoders registered
+// with RegisterPdrDecoder.
+type PdrRegion struct {
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the region
+func (pr PdrRegion) Buf() []byte {
+	return pr.buf
+}
+
+// Type returns RegionTypePDR
+func (pr PdrRegion) Type() FlashRegionType {
+	return RegionTypePDR
+}
+
+// checkRange returns an error if [offset, offset+length) is not in the
+// region
+func (pr PdrRegion) checkRange(offset, length int) error {
+	if offset < 0 || length < 0 || offset+length > len(pr.buf) {
+		return fmt.Errorf("Range [0x%x-0x%x] exceeds the Platform Data region size 0x%x", offset, offset+length, len(pr.buf))
+	}
+	return nil
+}
+
+// ReadAt returns a copy of length bytes of the region at offset
+func (pr PdrRegion) ReadAt(offset, length int) ([]byte, error) {
+	if err := pr.checkRange(offset, length); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, pr.buf[offset:offset+length]...), nil
+}
+
+// WriteAt overwrites the region with data at offset. The raw buffer is
+// copied first, so the image the region was parsed from is not modified.
+func (pr *PdrRegion) WriteAt(offset int, data []byte) error {
+	if err := pr.checkRange(offset, len(data)); err != nil {
+		return err
+	}
+	pr.buf = append([]byte{}, pr.buf...)
+	copy(pr.buf[offset:], data)
+	return nil
+}
+
+// Checksum8 returns the value that, added to the 8-bit sum of the bytes in
+// [offset, offset+length), makes it zero
+func (pr PdrRegion) Checksum8(offset, length int) (uint8, error) {
+	if err := pr.checkRange(offset, length); err != nil {
+		return 0, err
+	}
+	return checksum8(pr.buf[offset : offset+length]), nil
+}
+
+// Checksum16 returns the value that, added to the 16-bit sum of the
+// little-endian words in [offset, offset+length), makes it zero
+func (pr PdrRegion) Checksum16(offset, length int) (uint16, error) {
+	if err := pr.checkRange(offset, length); err != nil {
+		return 0, err
+	}
+	return checksum16(pr.buf[offset : offset+length]), nil
+}
+
+// FixChecksum8 sets the byte at position at so that the 8-bit sum of the
+// bytes in [offset, offset+length), which must include it, is zero
+func (pr *PdrRegion) FixChecksum8(offset, length, at int) error {
+	if at < offset || at >= offset+length {
+		return fmt.Errorf("Checksum byte at 0x%x outside of the range [0x%x-0x%x]", at, offset, offset+length)
+	}
+	if err := pr.WriteAt(at, []byte{0}); err != nil {
+		return err
+	}
+	sum, err := pr.Checksum8(offset, length)
+	if err != nil {
+		return err
+	}
+	return pr.WriteAt(at, []byte{sum})
+}
+
+// IsErased returns true if the region is unused
+func (pr PdrRegion) IsErased() bool {
+	return bytes.Count(pr.buf, []byte{0xff}) == len(pr.buf) || bytes.Count(pr.buf, []byte{0}) == len(pr.buf)
+}
+
+// Decode runs the registered decoders on the region, and returns the
+// results of the ones that recognized it
+func (pr PdrRegion) Decode() []OEMInfo {
+	var infos []OEMInfo
+	for _, d := range pdrDecoders {
+		if fields, ok := d.decode(pr.buf); ok {
+			infos = append(infos, OEMInfo{Decoder: d.name, Fields: fields})
+		}
+	}
+	return infos
+}
+
+// Summary prints a multi-line description of the region
+func (pr PdrRegion) Summary() string {
+	var infos []string
+	for _, i := range pr.Decode() {
+		infos = append(infos, i.String())
+	}
+	return fmt.Sprintf("PdrRegion{\n"+
+		"    Size=%v\n"+
+		"    Erased=%v\n"+
+		"    Decoded=[%v]\n"+
+		"}", len(pr.buf), pr.IsErased(), strings.Join(infos, ", "))
+}
+
+// MarshalBinary serializes the region
+func (pr PdrRegion) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, pr.buf...), nil
+}
+
+// NewPdrRegion parses a sequence of bytes and returns a PdrRegion object, if a valid
+// one is passed, or an error
+func NewPdrRegion(data []byte) (*PdrRegion, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("Platform Data region is empty")
+	}
+	return &PdrRegion{buf: data}, nil
+}
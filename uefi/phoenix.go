@@ -0,0 +1,263 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// PlatformPhoenixSecureCore is the vendor reported by BiosRegion.Platform
+// for the Phoenix SecureCore Technology (SCT) images
+const PlatformPhoenixSecureCore = "Phoenix SecureCore"
+
+var (
+	// PhoenixFlashMapSignature starts the flash map of the Phoenix SCT
+	// images, describing the areas of the BIOS region
+	PhoenixFlashMapSignature = []byte("_FLASH_MAP")
+	// phoenixCopyright is found in the modules built by Phoenix
+	phoenixCopyright = []byte("Phoenix Technologies")
+	// EVSAStoreSignature follows the header of the store entry of the EVSA
+	// variable stores
+	EVSAStoreSignature = []byte("EVSA")
+)
+
+// EVSA entry types. The GUID, name and data entries come in two flavours
+// with the same layout.
+const (
+	EVSAEntryStore       = 0xec
+	EVSAEntryGUID1       = 0xed
+	EVSAEntryGUID2       = 0xe1
+	EVSAEntryName1       = 0xee
+	EVSAEntryName2       = 0xe2
+	EVSAEntryData1       = 0xef
+	EVSAEntryData2       = 0xe3
+	EVSAEntryDataInvalid = 0x83
+)
+
+const (
+	// EVSAEntryHeaderSize is the size of the header common to the EVSA
+	// entries
+	EVSAEntryHeaderSize = 4
+	// EVSAStoreEntrySize is the size of the store entry starting the EVSA
+	// variable stores
+	EVSAStoreEntrySize = 20
+	// evsaDataExtendedHeader is set in the attributes of the data entries
+	// whose data size follows the attributes
+	evsaDataExtendedHeader = 0x10000000
+)
+
+// EVSAEntryHeader is the header of an entry of an EVSA variable store
+type EVSAEntryHeader struct {
+	Type     uint8
+	Checksum uint8
+	Size     uint16
+}
+
+// EVSAVariable is a variable of an EVSA store, made of a data entry and of
+// the GUID and name entries it refers to
+type EVSAVariable struct {
+	Name       string
+	VendorGUID string
+	Attributes uint32
+	// Deleted is set for the data entries that were invalidated
+	Deleted bool
+	// Offset is the position of the data entry from the start of the store
+	Offset uint64
+	Data   []byte
+}
+
+func (v EVSAVariable) String() string {
+	return fmt.Sprintf("EVSAVariable{Name=%s, GUID=%s, Attributes=0x%x, Deleted=%v, DataSize=%v}",
+		v.Name, v.VendorGUID, v.Attributes, v.Deleted, len(v.Data))
+}
+
+// EVSAStore is the variable store format of the Phoenix SCT images, a
+// sequence of entries mapping GUIDs and names to ids, and data entries
+// referring to them
+type EVSAStore struct {
+	Attributes uint32
+	StoreSize  uint32
+	Variables  []*EVSAVariable
+	// Errors holds the checksum and reference errors found while parsing
+	Errors []error
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the store
+func (s EVSAStore) Buf() []byte {
+	return s.buf
+}
+
+// Find returns the variable with the given name and vendor GUID that is not
+// deleted, or nil if it is not found
+func (s EVSAStore) Find(name, guid string) *EVSAVariable {
+	for _, v := range s.Variables {
+		if !v.Deleted && v.Name == name && v.VendorGUID == strings.ToLower(guid) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Summary prints a multi-line description of the store
+func (s EVSAStore) Summary() string {
+	var vars []string
+	for _, v := range s.Variables {
+		vars = append(vars, v.String())
+	}
+	return fmt.Sprintf("EVSAStore{\n"+
+		"    Size=%v\n"+
+		"    Attributes=0x%08x\n"+
+		"    Variables=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		s.StoreSize, s.Attributes,
+		Indent(strings.Join(vars, "\n"), 8),
+	)
+}
+
+// Validate returns the errors found while parsing the store
+func (s EVSAStore) Validate() []error {
+	return append([]error{}, s.Errors...)
+}
+
+// IsEVSAStore returns whether buf starts with the store entry of an EVSA
+// variable store
+func IsEVSAStore(buf []byte) bool {
+	return len(buf) >= EVSAStoreEntrySize && buf[0] == EVSAEntryStore && bytes.Equal(buf[4:8], EVSAStoreSignature)
+}
+
+// NewEVSAStore parses an EVSA variable store. The entries are parsed until
+// the free space or an invalid entry size, and the data entries are
+// resolved to variables.
+func NewEVSAStore(buf []byte) (*EVSAStore, error) {
+	if !IsEVSAStore(buf) {
+		return nil, fmt.Errorf("EVSA store signature not found")
+	}
+	s := EVSAStore{
+		Attributes: binary.LittleEndian.Uint32(buf[8:]),
+		StoreSize:  binary.LittleEndian.Uint32(buf[12:]),
+	}
+	size := uint64(s.StoreSize)
+	if size < EVSAStoreEntrySize || size > uint64(len(buf)) {
+		return nil, fmt.Errorf("Invalid EVSA store size %v, %v bytes available", s.StoreSize, len(buf))
+	}
+	s.buf = buf[:size]
+	guids := make(map[uint16]string)
+	names := make(map[uint16]string)
+	type dataEntry struct {
+		guidID, varID uint16
+		v             *EVSAVariable
+	}
+	var data []dataEntry
+	for offset := uint64(binary.LittleEndian.Uint16(buf[2:])); offset+EVSAEntryHeaderSize <= size; {
+		var h EVSAEntryHeader
+		if err := binary.Read(bytes.NewReader(s.buf[offset:]), binary.LittleEndian, &h); err != nil {
+			return nil, err
+		}
+		entrySize := uint64(h.Size)
+		if h.Type == 0xff || entrySize < EVSAEntryHeaderSize || offset+entrySize > size {
+			// free space, or the end of the usable entries
+			break
+		}
+		entry := s.buf[offset : offset+entrySize]
+		switch h.Type {
+		case EVSAEntryGUID1, EVSAEntryGUID2:
+			if entrySize < 22 {
+				break
+			}
+			guid, err := uuid.FromBytes(entry[6:22])
+			if err != nil {
+				return nil, err
+			}
+			guids[binary.LittleEndian.Uint16(entry[4:])] = guid.String()
+		case EVSAEntryName1, EVSAEntryName2:
+			if entrySize < 6 {
+				break
+			}
+			names[binary.LittleEndian.Uint16(entry[4:])] = decodeUCS2(entry[6:])
+		case EVSAEntryData1, EVSAEntryData2, EVSAEntryDataInvalid:
+			if entrySize < 12 {
+				break
+			}
+			v := EVSAVariable{
+				Attributes: binary.LittleEndian.Uint32(entry[8:]),
+				Deleted:    h.Type == EVSAEntryDataInvalid,
+				Offset:     offset,
+				Data:       entry[12:],
+			}
+			// the size of the extended entries does not count the data
+			if v.Attributes&evsaDataExtendedHeader != 0 && entrySize >= 16 {
+				dataSize := uint64(binary.LittleEndian.Uint32(entry[12:]))
+				if offset+16+dataSize > size {
+					return nil, fmt.Errorf("EVSA data entry at 0x%x of 0x%x bytes exceeds the store", offset, dataSize)
+				}
+				entrySize = 16 + dataSize
+				entry = s.buf[offset : offset+entrySize]
+				v.Data = entry[16:]
+			}
+			data = append(data, dataEntry{binary.LittleEndian.Uint16(entry[4:]), binary.LittleEndian.Uint16(entry[6:]), &v})
+		}
+		var sum uint8
+		for _, b := range entry[2:] {
+			sum += b
+		}
+		if h.Checksum != uint8(-sum) {
+			s.Errors = append(s.Errors, fmt.Errorf("EVSA entry 0x%02x at 0x%x: invalid checksum 0x%02x, expected 0x%02x", h.Type, offset, h.Checksum, uint8(-sum)))
+		}
+		offset += entrySize
+	}
+	for _, d := range data {
+		var ok bool
+		if d.v.VendorGUID, ok = guids[d.guidID]; !ok {
+			s.Errors = append(s.Errors, fmt.Errorf("EVSA data entry at 0x%x refers to the unknown GUID id %d", d.v.Offset, d.guidID))
+		}
+		if d.v.Name, ok = names[d.varID]; !ok {
+			s.Errors = append(s.Errors, fmt.Errorf("EVSA data entry at 0x%x refers to the unknown name id %d", d.v.Offset, d.varID))
+		}
+		s.Variables = append(s.Variables, d.v)
+	}
+	return &s, nil
+}
+
+// Platform is the firmware vendor of a BIOS region, as detected by
+// BiosRegion.Platform, with the elements it was detected from
+type Platform struct {
+	Vendor   string
+	Evidence []string
+}
+
+func (p Platform) String() string {
+	if p.Vendor == "" {
+		return "Unknown"
+	}
+	return fmt.Sprintf("%s (%s)", p.Vendor, strings.Join(p.Evidence, ", "))
+}
+
+// Platform detects the vendor of the firmware of the region. Phoenix SCT
+// images are recognized by their flash map and copyright strings, and
+// their EVSA variable stores are reported as further evidence.
+func (br BiosRegion) Platform() Platform {
+	var p Platform
+	if idx := bytes.Index(br.buf, PhoenixFlashMapSignature); idx != -1 {
+		p.Evidence = append(p.Evidence, fmt.Sprintf("flash map at 0x%x", idx))
+	}
+	if bytes.Contains(br.buf, phoenixCopyright) {
+		p.Evidence = append(p.Evidence, "Phoenix copyright")
+	}
+	if len(p.Evidence) == 0 {
+		return Platform{}
+	}
+	p.Vendor = PlatformPhoenixSecureCore
+	for _, fv := range br.FirmwareVolumes {
+		if fv.EVSAStore != nil {
+			p.Evidence = append(p.Evidence, fmt.Sprintf("EVSA store in volume at 0x%x", fv.Offset))
+		}
+	}
+	return p
+}
@@ -0,0 +1,108 @@
+package uefi
+
+import (
+	"fmt"
+)
+
+// Severity is how serious a security posture finding is
+type Severity int
+
+// Severity levels
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityCritical
+)
+
+var severityNames = map[Severity]string{
+	SeverityInfo:     "Info",
+	SeverityWarning:  "Warning",
+	SeverityCritical: "Critical",
+}
+
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// MarshalText serializes the severity as its name, so that JSON reports are
+// easy to filter
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// PostureFinding is an insecure configuration of the descriptor found by
+// SecurityPosture
+type PostureFinding struct {
+	Check    string
+	Severity Severity
+	// Master and Region are the names of the master and the region the
+	// finding is about, if any
+	Master  string `json:",omitempty"`
+	Region  string `json:",omitempty"`
+	Message string
+}
+
+func (f PostureFinding) String() string {
+	return fmt.Sprintf("[%v] %s: %s", f.Severity, f.Check, f.Message)
+}
+
+// SecurityPosture checks the access permissions of the descriptor and
+// reports the insecure ones: a descriptor region writable by the host or by
+// other masters, an ME region readable or writable by the host, and masters
+// that can write every region, i.e. the region locks were not set.
+func (f FlashImage) SecurityPosture() []PostureFinding {
+	findings := make([]PostureFinding, 0)
+	add := func(check string, severity Severity, master FlashMasterType, region FlashRegionType, format string, args ...interface{}) {
+		findings = append(findings, PostureFinding{
+			Check:    check,
+			Severity: severity,
+			Master:   master.String(),
+			Region:   region.String(),
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+	for _, a := range f.AccessMatrix() {
+		switch {
+		case a.Region == RegionTypeDescriptor && a.Write && a.Master == MasterTypeBIOS:
+			add("descriptor-host-writable", SeverityCritical, a.Master, a.Region,
+				"the host can rewrite the descriptor, and with it the access permissions")
+		case a.Region == RegionTypeDescriptor && a.Write:
+			add("descriptor-writable", SeverityWarning, a.Master, a.Region,
+				"the %v master can rewrite the descriptor", a.Master)
+		case a.Region == RegionTypeME && a.Master == MasterTypeBIOS && a.Write:
+			add("me-host-writable", SeverityCritical, a.Master, a.Region,
+				"the host can rewrite the ME firmware")
+		case a.Region == RegionTypeME && a.Master == MasterTypeBIOS && a.Read:
+			add("me-host-readable", SeverityWarning, a.Master, a.Region,
+				"the host can read the ME firmware and its data")
+		}
+	}
+	// a master that can write every region has no region lock at all
+	var present []FlashRegionType
+	for t := RegionTypeDescriptor; t < FlashRegionsMax; t++ {
+		if t == RegionTypeDescriptor || f.Region.Region(t).Valid() {
+			present = append(present, t)
+		}
+	}
+	for _, m := range f.Master.Masters() {
+		unlocked := true
+		for _, t := range present {
+			if !m.CanWrite(t) {
+				unlocked = false
+				break
+			}
+		}
+		if unlocked {
+			findings = append(findings, PostureFinding{
+				Check:    "regions-unlocked",
+				Severity: SeverityCritical,
+				Master:   m.Type.String(),
+				Message:  fmt.Sprintf("the %v master can write every region, the region locks are not set", m.Type),
+			})
+		}
+	}
+	return findings
+}
@@ -0,0 +1,128 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// RedactionPolicy describes which machine-identifying data to remove from an
+// image before sharing it.
+type RedactionPolicy struct {
+	// NVRAMVariableData overwrites the data of all the NVRAM variables,
+	// keeping their headers and names
+	NVRAMVariableData bool
+	// MACAddresses overwrites the MAC address stored in the GbE region
+	MACAddresses bool
+	// Regions lists the names of the regions to overwrite entirely, as
+	// returned by Tree, e.g. "PDR"
+	Regions []string
+	// Fill is the byte used to overwrite the redacted data
+	Fill byte
+}
+
+// NewRedactionPolicy parses a comma-separated list of redaction items:
+// "nvram", "mac", or the name of a region.
+func NewRedactionPolicy(items string) RedactionPolicy {
+	var p RedactionPolicy
+	for _, item := range strings.Split(items, ",") {
+		switch item = strings.TrimSpace(item); strings.ToLower(item) {
+		case "":
+		case "nvram":
+			p.NVRAMVariableData = true
+		case "mac":
+			p.MACAddresses = true
+		default:
+			p.Regions = append(p.Regions, item)
+		}
+	}
+	return p
+}
+
+func fill(buf []byte, b byte) {
+	for i := range buf {
+		buf[i] = b
+	}
+}
+
+// clampRange returns the size bytes of buf at offset, or the part of them
+// inside buf, as the elements kept in permissive mode may exceed the image
+func clampRange(buf []byte, offset, size uint64) []byte {
+	end := offset + size
+	if end < offset || end > uint64(len(buf)) {
+		end = uint64(len(buf))
+	}
+	if offset > end {
+		offset = end
+	}
+	return buf[offset:end]
+}
+
+// regionNode returns the node of the region with the given name, or nil
+func (f FlashImage) regionNode(name string) *Node {
+	for _, n := range f.Tree().Children {
+		if n.Type == "Region" && strings.EqualFold(n.Name, name) {
+			return n
+		}
+	}
+	return nil
+}
+
+// redactGbeMACs overwrites the MAC address at the start of each copy of the
+// NVM in the GbE region, and fixes the checksums of the valid copies as
+// GbeRegion.SetMAC does
+func redactGbeMACs(region []byte, b byte) {
+	for off := 0; off+6 <= len(region); off += GbeBankSize {
+		bank := region[off:]
+		fill(bank[:6], b)
+		if len(bank) >= 2*(gbeChecksumWord+1) && newGbeBank(bank, uint32(off)).Valid {
+			binary.LittleEndian.PutUint16(bank[2*gbeChecksumWord:], gbeChecksum(bank))
+		}
+	}
+}
+
+// Redact returns a copy of the raw image with the data selected by the
+// policy overwritten. Checksums covering the redacted data are not updated,
+// except the ones of the GbE NVM copies.
+func (f FlashImage) Redact(p RedactionPolicy) ([]byte, error) {
+	out := append([]byte{}, f.buf...)
+	for _, name := range p.Regions {
+		n := f.regionNode(name)
+		if n == nil {
+			return nil, fmt.Errorf("Cannot redact region %s: region not found", name)
+		}
+		debugf("Redacting region %s", n.Name)
+		fill(clampRange(out, n.Offset, n.Size), p.Fill)
+	}
+	if p.MACAddresses {
+		if n := f.regionNode("GbE"); n != nil {
+			redactGbeMACs(clampRange(out, n.Offset, n.Size), p.Fill)
+		}
+	}
+	if p.NVRAMVariableData && f.BiosRegion != nil {
+		start, _ := f.Region.BiosOffset()
+		base := uint64(start)
+		for _, fv := range f.BiosRegion.FirmwareVolumes {
+			if fv.VariableStore == nil {
+				continue
+			}
+			storeBase := base + fv.Offset + fv.DataOffset()
+			for _, v := range fv.VariableStore.Variables {
+				start := storeBase + v.Offset + v.DataOffset()
+				fill(clampRange(out, start, uint64(v.DataSize)), p.Fill)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Redacted returns a new FlashImage parsed from the redacted image, so that
+// every export derived from it (summaries, trees, memory maps, serialized
+// images) is redacted too.
+func (f FlashImage) Redacted(p RedactionPolicy) (*FlashImage, error) {
+	buf, err := f.Redact(p)
+	if err != nil {
+		return nil, err
+	}
+	return NewFlashImage(buf)
+}
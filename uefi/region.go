@@ -0,0 +1,37 @@
+package uefi
+
+// Region is a region of a flash image that was parsed by its own parser,
+// e.g. BiosRegion or MeRegion
+type Region interface {
+	// Type returns the type of the region in the region section
+	Type() FlashRegionType
+	// Buf returns the raw bytes of the region
+	Buf() []byte
+	Summary() string
+	MarshalBinary() ([]byte, error)
+}
+
+// Regions returns the regions of the image that were parsed, in the order
+// of their types
+func (f FlashImage) Regions() []Region {
+	var regions []Region
+	if f.BiosRegion != nil {
+		regions = append(regions, f.BiosRegion)
+	}
+	if f.MeRegion != nil {
+		regions = append(regions, f.MeRegion)
+	}
+	if f.GbeRegion != nil {
+		regions = append(regions, f.GbeRegion)
+	}
+	if f.PdrRegion != nil {
+		regions = append(regions, f.PdrRegion)
+	}
+	if f.EcRegion != nil {
+		regions = append(regions, f.EcRegion)
+	}
+	for _, r := range f.TenGbeRegions {
+		regions = append(regions, r)
+	}
+	return regions
+}
@@ -0,0 +1,67 @@
+package uefi
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// CheckRoundTrip serializes the image without edits and verifies that the
+// result is identical to the parsed data. The parsers keep every byte they
+// do not interpret (reserved fields, padding, unknown or broken elements) in
+// the buffer of the containing element, so that MarshalBinary is lossless; a
+// difference means that a parser dropped something, and that editing the
+// image would change more than requested.
+func (f FlashImage) CheckRoundTrip() error {
+	out, err := f.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("Round trip failed: cannot serialize the image: %v", err)
+	}
+	if len(out) != len(f.buf) {
+		return fmt.Errorf("Round trip failed: expected %v bytes, got %v", len(f.buf), len(out))
+	}
+	first, count := -1, 0
+	for i := range out {
+		if out[i] != f.buf[i] {
+			if first == -1 {
+				first = i
+			}
+			count++
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	where := ""
+	if path, err := f.NodeAt(uint64(first)); err == nil {
+		where = " in " + FormatNodePath(path)
+	}
+	return fmt.Errorf("Round trip failed: %v bytes differ, the first at offset 0x%x%s", count, first, where)
+}
+
+// CheckReproducible verifies that serializing the image is deterministic:
+// serializing it twice yields the same bytes, and parsing and serializing
+// the result again does not change it. The serialization does not depend on
+// the time or on map ordering, pad files are placed at the first position
+// that fits and compression uses fixed settings, so that build pipelines can
+// diff and sign the rebuilt images.
+func (f FlashImage) CheckReproducible() error {
+	first, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	second, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(first, second) {
+		return fmt.Errorf("Serialization is not deterministic")
+	}
+	rebuilt, err := NewFlashImage(first)
+	if err != nil {
+		return fmt.Errorf("Cannot parse the rebuilt image: %v", err)
+	}
+	if err := rebuilt.CheckRoundTrip(); err != nil {
+		return fmt.Errorf("Rebuilt image is not stable: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package uefi
+
+import (
+	"fmt"
+)
+
+// RuleResult is the outcome of a security rule
+type RuleResult int
+
+// Rule results. A rule is not applicable when the image lacks what it
+// checks, e.g. an ME region.
+const (
+	RulePass RuleResult = iota
+	RuleFail
+	RuleNotApplicable
+)
+
+var ruleResultNames = map[RuleResult]string{
+	RulePass:          "Pass",
+	RuleFail:          "Fail",
+	RuleNotApplicable: "N/A",
+}
+
+func (r RuleResult) String() string {
+	if name, ok := ruleResultNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("RuleResult(%d)", int(r))
+}
+
+// MarshalText serializes the result as its name
+func (r RuleResult) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// SecurityRule is a configuration check run on an image by
+// CheckSecurityRules. Check returns the result and a message explaining it.
+type SecurityRule struct {
+	Name string
+	// Severity is the severity of a failure of the rule
+	Severity Severity
+	Check    func(f *FlashImage) (RuleResult, string)
+}
+
+// RuleFinding is the result of a security rule on an image
+type RuleFinding struct {
+	Rule     string
+	Result   RuleResult
+	Severity Severity
+	Message  string
+}
+
+func (f RuleFinding) String() string {
+	if f.Result == RuleFail {
+		return fmt.Sprintf("[%v] %s (%v): %s", f.Result, f.Rule, f.Severity, f.Message)
+	}
+	return fmt.Sprintf("[%v] %s: %s", f.Result, f.Rule, f.Message)
+}
+
+// SMILockModuleNames are the UI names of the modules that set the SMI and
+// BIOS write protection locks of the chipset. The list covers the Intel
+// reference code and can be extended by the users.
+var SMILockModuleNames = []string{
+	"PchInitSmm",
+	"PchInitDxe",
+	"PchInitDxeFsp",
+	"PchInitDxeTgl",
+	"PchSmiDispatcher",
+	"SmmLockBox",
+}
+
+// DefaultSecurityRules are the rules run by CheckSecurityRules when no rules
+// are given
+var DefaultSecurityRules = []SecurityRule{
+	{"descriptor-locked", SeverityCritical, checkPosture("descriptor-host-writable", "the host cannot write the descriptor")},
+	{"me-locked", SeverityCritical, checkPosture("me-host-writable", "the host cannot write the ME region")},
+	{"region-locks", SeverityCritical, checkPosture("regions-unlocked", "no master can write every region")},
+	{"boot-guard", SeverityWarning, checkBootGuard},
+	{"secure-boot-pk", SeverityCritical, checkSignatureVariable("PK", GlobalVariableGUID)},
+	{"secure-boot-kek", SeverityWarning, checkSignatureVariable("KEK", GlobalVariableGUID)},
+	{"secure-boot-db", SeverityWarning, checkSignatureVariable("db", ImageSecurityDatabaseGUID)},
+	{"dbx-not-empty", SeverityWarning, checkSignatureVariable("dbx", ImageSecurityDatabaseGUID)},
+	{"smi-lock-modules", SeverityWarning, checkSMILockModules},
+}
+
+// checkPosture returns a check failing if SecurityPosture reports the given
+// finding
+func checkPosture(finding, pass string) func(f *FlashImage) (RuleResult, string) {
+	return func(f *FlashImage) (RuleResult, string) {
+		if finding == "me-host-writable" && !f.Region.Region(RegionTypeME).Valid() {
+			return RuleNotApplicable, "the image has no ME region"
+		}
+		for _, p := range f.SecurityPosture() {
+			if p.Check == finding {
+				return RuleFail, p.Message
+			}
+		}
+		return RulePass, pass
+	}
+}
+
+// checkBootGuard passes if the BIOS region has a Key Manifest and a Boot
+// Policy Manifest
+func checkBootGuard(f *FlashImage) (RuleResult, string) {
+	if f.BiosRegion == nil {
+		return RuleNotApplicable, "the image has no BIOS region"
+	}
+	km, err := f.BiosRegion.KeyManifest()
+	if err != nil {
+		return RuleFail, err.Error()
+	}
+	bpm, err := f.BiosRegion.BootPolicyManifest()
+	if err != nil {
+		return RuleFail, err.Error()
+	}
+	if km == nil || bpm == nil {
+		return RuleFail, "the FIT has no Boot Guard manifests, the firmware is not verified before it runs"
+	}
+	segments := 0
+	for _, e := range bpm.IBBs {
+		segments += len(e.Segments)
+	}
+	return RulePass, fmt.Sprintf("Boot Guard manifests found, %d IBB segments", segments)
+}
+
+// checkSignatureVariable returns a check passing if the variable holds at
+// least one signature
+func checkSignatureVariable(name, guid string) func(f *FlashImage) (RuleResult, string) {
+	return func(f *FlashImage) (RuleResult, string) {
+		if f.BiosRegion == nil {
+			return RuleNotApplicable, "the image has no BIOS region"
+		}
+		v := f.BiosRegion.FindVariable(name, guid)
+		if v == nil {
+			return RuleFail, fmt.Sprintf("the %s variable is not in the NVRAM", name)
+		}
+		lists, err := ParseSignatureLists(v.Data())
+		if err != nil {
+			return RuleFail, fmt.Sprintf("the %s variable is invalid: %v", name, err)
+		}
+		count := 0
+		for _, l := range lists {
+			count += len(l.Signatures)
+		}
+		if count == 0 {
+			return RuleFail, fmt.Sprintf("the %s variable is empty", name)
+		}
+		return RulePass, fmt.Sprintf("the %s variable holds %d signatures", name, count)
+	}
+}
+
+// checkSMILockModules passes if the image has an SMM core and a module
+// setting the SMI locks, looking into the nested volumes too
+func checkSMILockModules(f *FlashImage) (RuleResult, string) {
+	if f.BiosRegion == nil {
+		return RuleNotApplicable, "the image has no BIOS region"
+	}
+	smm := false
+	names := make(map[string]bool)
+	f.BiosRegion.walkFiles(func(fv *FirmwareVolume, file, parent *File, offset uint64) {
+		if file.Type == FileTypeSMMCore {
+			smm = true
+		}
+		names[file.ModuleName()] = true
+	})
+	if !smm {
+		return RuleNotApplicable, "the image has no SMM core"
+	}
+	for _, name := range SMILockModuleNames {
+		if names[name] {
+			return RulePass, fmt.Sprintf("%s found", name)
+		}
+	}
+	return RuleFail, "no module setting the SMI locks found, SMM may be left unlocked"
+}
+
+// CheckSecurityRules runs the security rules on the image, or
+// DefaultSecurityRules if rules is nil, and returns their results. The
+// checks only use the contents of the image, so they tell how the firmware
+// configures the platform, not how a running system is configured.
+func (f FlashImage) CheckSecurityRules(rules []SecurityRule) []RuleFinding {
+	if rules == nil {
+		rules = DefaultSecurityRules
+	}
+	findings := make([]RuleFinding, 0, len(rules))
+	for _, r := range rules {
+		result, message := r.Check(&f)
+		findings = append(findings, RuleFinding{Rule: r.Name, Result: result, Severity: r.Severity, Message: message})
+	}
+	return findings
+}
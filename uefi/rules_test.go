@@ -0,0 +1,27 @@
+package uefi
+
+import "testing"
+
+// namedFile returns a file of the given type holding a user interface section
+// with the given name
+func namedFile(t *testing.T, guid string, typ FileType, name string) *File {
+	n, err := parseGUID(guid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := CreateFile(n, typ, 0, buildSection(SectionTypeUserInterface, encodeUCS2(name)), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestCheckSMILockModulesNested(t *testing.T) {
+	f := nestVolume(t, syntheticFlashImage(t),
+		namedFile(t, "5a5e7c1f-00f2-4e3a-9f6b-0a1b2c3d4ef2", FileTypeSMMCore, "PiSmmCore"),
+		namedFile(t, "5a5e7c1f-00f3-4e3a-9f6b-0a1b2c3d4ef3", FileTypeSMM, SMILockModuleNames[0]),
+	)
+	if result, message := checkSMILockModules(f); result != RulePass {
+		t.Errorf("got %v (%s), want %v", result, message, RulePass)
+	}
+}
@@ -0,0 +1,101 @@
+package uefi
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+)
+
+// CycloneDX document, restricted to the fields used by SBOM
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxComponent struct {
+	Type       string        `json:"type"`
+	BOMRef     string        `json:"bom-ref,omitempty"`
+	Name       string        `json:"name"`
+	Version    string        `json:"version,omitempty"`
+	Hashes     []cdxHash     `json:"hashes,omitempty"`
+	Properties []cdxProperty `json:"properties,omitempty"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+type cdxDocument struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Component cdxComponent `json:"component"`
+	} `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+// SBOM returns the inventory of the image, as returned by Inventory, as a
+// CycloneDX 1.4 JSON document. The image named name is the main component,
+// and every module a firmware component, identified by the SHA256 of its
+// contents, with its GUID, type, volume and position as uefi: properties.
+// The document is reproducible: its serial number is derived from the hash
+// of the image.
+func (f FlashImage) SBOM(name string) ([]byte, error) {
+	id := sha256Hex(f.buf)
+	// a name-based UUID, with the version and variant bits of the UUIDs
+	// derived from a SHA hash
+	u := sha256.Sum256(f.buf)
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	var doc cdxDocument
+	doc.BOMFormat, doc.SpecVersion, doc.Version = "CycloneDX", "1.4", 1
+	doc.SerialNumber = fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+	doc.Metadata.Component = cdxComponent{
+		Type:   "firmware",
+		BOMRef: "image",
+		Name:   name,
+		Hashes: []cdxHash{{"SHA-256", id}},
+		Properties: []cdxProperty{
+			{"uefi:size", fmt.Sprintf("%d", len(f.buf))},
+		},
+	}
+	doc.Components = make([]cdxComponent, 0)
+	root := cdxDependency{Ref: "image", DependsOn: make([]string, 0)}
+	for i, m := range f.Inventory() {
+		c := cdxComponent{
+			Type:    "firmware",
+			BOMRef:  fmt.Sprintf("module-%d", i),
+			Name:    m.Name,
+			Version: m.Version,
+			Hashes:  []cdxHash{{"SHA-256", m.SHA256}},
+		}
+		if c.Name == "" {
+			c.Name = m.GUID
+		}
+		for _, p := range []cdxProperty{
+			{"uefi:guid", m.GUID},
+			{"uefi:type", m.Type},
+			{"uefi:volume", m.Volume},
+			{"uefi:parent", m.Parent},
+			{"uefi:offset", fmt.Sprintf("0x%x", m.Offset)},
+			{"uefi:size", fmt.Sprintf("%d", m.Size)},
+		} {
+			if p.Value != "" {
+				c.Properties = append(c.Properties, p)
+			}
+		}
+		doc.Components = append(doc.Components, c)
+		root.DependsOn = append(root.DependsOn, c.BOMRef)
+	}
+	doc.Dependencies = []cdxDependency{root}
+	return json.MarshalIndent(doc, "", "    ")
+}
@@ -0,0 +1,172 @@
+package uefi
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Confidence is how likely a scan finding is to be a real issue
+type Confidence int
+
+// Confidence levels
+const (
+	ConfidenceLow Confidence = iota
+	ConfidenceMedium
+	ConfidenceHigh
+)
+
+func (c Confidence) String() string {
+	switch c {
+	case ConfidenceLow:
+		return "Low"
+	case ConfidenceMedium:
+		return "Medium"
+	case ConfidenceHigh:
+		return "High"
+	}
+	return fmt.Sprintf("Confidence(%d)", int(c))
+}
+
+// ScanRule is a pattern matched against the strings found in the image
+type ScanRule struct {
+	Name       string
+	Pattern    *regexp.Regexp
+	Confidence Confidence
+}
+
+// DefaultScanRules are the rules used by Scan to look for hardcoded
+// passwords, password prompts and debug backdoors.
+var DefaultScanRules = []ScanRule{
+	{"hardcoded-password", regexp.MustCompile(`(?i)\b(master|backdoor|default|admin|supervisor|service)[ _-]?pass(word|wd)?\b`), ConfidenceMedium},
+	{"backdoor", regexp.MustCompile(`(?i)back[ _-]?door`), ConfidenceMedium},
+	{"debug-mode", regexp.MustCompile(`(?i)\b(debug|manufactur(e|ing)|mfg)[ _-]?mode\b`), ConfidenceMedium},
+	{"factory-menu", regexp.MustCompile(`(?i)\b(engineering|factory)[ _-]?(mode|menu|unlock)\b`), ConfidenceMedium},
+	{"unlock-code", regexp.MustCompile(`(?i)\bunlock[ _-]?(code|key|password)\b`), ConfidenceLow},
+	{"password-prompt", regexp.MustCompile(`(?i)\benter (the )?(current |new |old )?(admin |user |setup )?password\b`), ConfidenceLow},
+}
+
+// SuspiciousFileGUIDs maps the GUIDs of vendor modules known to expose
+// manufacturing or service modes to a description. Files with these GUIDs are
+// reported by Scan with high confidence. The list is empty by default and is
+// meant to be filled by the users with the GUIDs relevant to their fleet.
+var SuspiciousFileGUIDs = map[string]string{}
+
+// scanStringMinLen is the minimum length of the strings considered by Scan
+const scanStringMinLen = 6
+
+// Finding is a suspicious element found by Scan
+type Finding struct {
+	Rule       string
+	Confidence Confidence
+	// Offset is the absolute position of the match in the image
+	Offset uint64
+	Match  string
+	// Path describes the elements containing the match
+	Path string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("[%v] %s at 0x%x: %q (%s)", f.Confidence, f.Rule, f.Offset, f.Match, f.Path)
+}
+
+// foundString is a printable string found in a buffer
+type foundString struct {
+	Offset uint64
+	Value  string
+}
+
+func isPrintable(b byte) bool {
+	return b >= 0x20 && b < 0x7f
+}
+
+// findStrings returns the ASCII and UCS-2 strings of at least minLen
+// characters in buf
+func findStrings(buf []byte, minLen int) []foundString {
+	var found []foundString
+	// ASCII
+	for i := 0; i < len(buf); {
+		j := i
+		for j < len(buf) && isPrintable(buf[j]) {
+			j++
+		}
+		if j-i >= minLen {
+			found = append(found, foundString{uint64(i), string(buf[i:j])})
+		}
+		i = j + 1
+	}
+	// UCS-2, limited to the ASCII range, at both even and odd offsets
+	for start := 0; start < 2; start++ {
+		for i := start; i+1 < len(buf); {
+			j := i
+			for j+1 < len(buf) && isPrintable(buf[j]) && buf[j+1] == 0 {
+				j += 2
+			}
+			if (j-i)/2 >= minLen {
+				var s []byte
+				for k := i; k < j; k += 2 {
+					s = append(s, buf[k])
+				}
+				found = append(found, foundString{uint64(i), string(s)})
+			}
+			i = j + 2
+		}
+	}
+	return found
+}
+
+// scanBuffer matches the rules against the strings of buf, whose absolute
+// position in the image is base.
+func scanBuffer(buf []byte, base uint64, rules []ScanRule) []Finding {
+	var findings []Finding
+	for _, s := range findStrings(buf, scanStringMinLen) {
+		for _, r := range rules {
+			if r.Pattern.MatchString(s.Value) {
+				findings = append(findings, Finding{
+					Rule:       r.Name,
+					Confidence: r.Confidence,
+					Offset:     base + s.Offset,
+					Match:      s.Value,
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// Scan looks for suspicious content in the image: strings matching the given
+// rules, or DefaultScanRules if nil, and files whose GUID is listed in
+// SuspiciousFileGUIDs. The findings are sorted by decreasing confidence, then
+// by offset. Compressed sections are scanned as stored.
+func (f FlashImage) Scan(rules []ScanRule) []Finding {
+	if rules == nil {
+		rules = DefaultScanRules
+	}
+	findings := scanBuffer(f.buf, 0, rules)
+	if f.BiosRegion != nil {
+		start, _ := f.Region.BiosOffset()
+		base := uint64(start)
+		f.BiosRegion.walkFiles(func(fv *FirmwareVolume, file, parent *File, offset uint64) {
+			desc, ok := SuspiciousFileGUIDs[file.GUID()]
+			if !ok {
+				return
+			}
+			findings = append(findings, Finding{
+				Rule:       "suspicious-guid",
+				Confidence: ConfidenceHigh,
+				Offset:     base + offset,
+				Match:      fmt.Sprintf("%s (%s)", file.GUID(), desc),
+			})
+		})
+	}
+	for i := range findings {
+		findings[i].Path = f.nodePath(findings[i].Offset)
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Confidence != findings[j].Confidence {
+			return findings[i].Confidence > findings[j].Confidence
+		}
+		return findings[i].Offset < findings[j].Offset
+	})
+	return findings
+}
@@ -0,0 +1,519 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/insomniacslk/uefi/compression"
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// Section constants
+const (
+	SectionHeaderMinSize      = 4
+	SectionHeaderExtendedSize = 8
+	// GUIDDefinedSectionHeaderSize is the size of the header following the
+	// common header in GUID-defined sections
+	GUIDDefinedSectionHeaderSize = 20
+	SectionAlignment             = 4
+	SectionMaxSmallSize          = 0xffffff
+)
+
+// GUID-defined section attributes
+const (
+	GUIDedSectionProcessingRequired = 0x01
+	GUIDedSectionAuthStatusValid    = 0x02
+)
+
+// SectionType is the type of a file section
+type SectionType uint8
+
+// Section types, as defined in the PI specification
+const (
+	SectionTypeCompression         SectionType = 0x01
+	SectionTypeGUIDDefined         SectionType = 0x02
+	SectionTypeDisposable          SectionType = 0x03
+	SectionTypePE32                SectionType = 0x10
+	SectionTypePIC                 SectionType = 0x11
+	SectionTypeTE                  SectionType = 0x12
+	SectionTypeDXEDepex            SectionType = 0x13
+	SectionTypeVersion             SectionType = 0x14
+	SectionTypeUserInterface       SectionType = 0x15
+	SectionTypeCompatibility16     SectionType = 0x16
+	SectionTypeFirmwareVolumeImage SectionType = 0x17
+	SectionTypeFreeformSubtypeGUID SectionType = 0x18
+	SectionTypeRaw                 SectionType = 0x19
+	SectionTypePEIDepex            SectionType = 0x1b
+	SectionTypeMMDepex             SectionType = 0x1c
+)
+
+// SectionTypeNames maps the section types to their names
+var SectionTypeNames = map[SectionType]string{
+	SectionTypeCompression:         "EFI_SECTION_COMPRESSION",
+	SectionTypeGUIDDefined:         "EFI_SECTION_GUID_DEFINED",
+	SectionTypeDisposable:          "EFI_SECTION_DISPOSABLE",
+	SectionTypePE32:                "EFI_SECTION_PE32",
+	SectionTypePIC:                 "EFI_SECTION_PIC",
+	SectionTypeTE:                  "EFI_SECTION_TE",
+	SectionTypeDXEDepex:            "EFI_SECTION_DXE_DEPEX",
+	SectionTypeVersion:             "EFI_SECTION_VERSION",
+	SectionTypeUserInterface:       "EFI_SECTION_USER_INTERFACE",
+	SectionTypeCompatibility16:     "EFI_SECTION_COMPATIBILITY16",
+	SectionTypeFirmwareVolumeImage: "EFI_SECTION_FIRMWARE_VOLUME_IMAGE",
+	SectionTypeFreeformSubtypeGUID: "EFI_SECTION_FREEFORM_SUBTYPE_GUID",
+	SectionTypeRaw:                 "EFI_SECTION_RAW",
+	SectionTypePEIDepex:            "EFI_SECTION_PEI_DEPEX",
+	SectionTypeMMDepex:             "EFI_SECTION_MM_DEPEX",
+}
+
+func (t SectionType) String() string {
+	if name, ok := SectionTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (0x%02x)", uint8(t))
+}
+
+// SectionHeader contains the fields of the common section header
+type SectionHeader struct {
+	Size [3]uint8
+	Type SectionType
+}
+
+// CompressionSectionHeader follows the common header in compression sections
+type CompressionSectionHeader struct {
+	UncompressedLength uint32
+	CompressionType    uint8
+}
+
+// GUIDDefinedSectionHeader follows the common header in GUID-defined sections
+type GUIDDefinedSectionHeader struct {
+	SectionDefinitionGUID [16]uint8
+	DataOffset            uint16
+	Attributes            uint16
+}
+
+// Section represents a section inside a firmware file. Encapsulation
+// sections whose contents can be read without further processing hold their
+// child sections in Sections.
+type Section struct {
+	SectionHeader
+	// ExtendedSize is only used for sections larger than 16MB
+	ExtendedSize uint32
+	// Compression holds the compression header, for compression sections
+	Compression *CompressionSectionHeader
+	// GUIDDefined holds the GUID-defined header, for GUID-defined sections
+	GUIDDefined *GUIDDefinedSectionHeader
+	// Sections contained in this section, for encapsulation sections
+	Sections []*Section
+	// Offset is the position of the section from the start of its container
+	Offset uint64
+	// Broken holds the elements that could not be parsed in permissive mode
+	Broken []BrokenNode
+	// Holds the raw buffer, including the header
+	buf []byte
+	// compressor is the algorithm of compressed sections, whose child
+	// sections are parsed from the decompressed data
+	compressor   compression.Compressor
+	decompressed []byte
+}
+
+// IsExtended returns whether the section uses the extended size header
+func (s Section) IsExtended() bool {
+	return s.Size == [3]uint8{0xff, 0xff, 0xff}
+}
+
+// SectionSize returns the size of the section, including its header
+func (s Section) SectionSize() uint64 {
+	if s.IsExtended() {
+		return uint64(s.ExtendedSize)
+	}
+	return uint64(s.Size[0]) | uint64(s.Size[1])<<8 | uint64(s.Size[2])<<16
+}
+
+// CommonHeaderLen returns the size of the common section header
+func (s Section) CommonHeaderLen() uint64 {
+	if s.IsExtended() {
+		return SectionHeaderExtendedSize
+	}
+	return SectionHeaderMinSize
+}
+
+// DataOffset returns the offset of the section contents from the start of
+// the section, skipping the type-specific headers.
+func (s Section) DataOffset() uint64 {
+	switch {
+	case s.Compression != nil:
+		return s.CommonHeaderLen() + 5
+	case s.GUIDDefined != nil:
+		return uint64(s.GUIDDefined.DataOffset)
+	}
+	return s.CommonHeaderLen()
+}
+
+// Buf returns the raw bytes of the section, including its header
+func (s Section) Buf() []byte {
+	return s.buf
+}
+
+// Data returns the contents of the section, excluding the headers
+func (s Section) Data() []byte {
+	return s.buf[s.DataOffset():]
+}
+
+// IsCompressed returns whether the child sections are stored compressed.
+// Sections compressed with an unsupported algorithm are opaque and return
+// false.
+func (s Section) IsCompressed() bool {
+	return s.compressor != nil
+}
+
+// CompressionName returns the name of the algorithm used to compress the
+// contents of the section, or an empty string
+func (s Section) CompressionName() string {
+	if s.compressor == nil {
+		return ""
+	}
+	return s.compressor.Name()
+}
+
+// Decompressed returns the decompressed contents of compressed sections, or
+// nil. The offsets of the child sections are relative to it.
+func (s Section) Decompressed() []byte {
+	return s.decompressed
+}
+
+// setSize updates the size fields of the header
+func (s *Section) setSize(size uint64) error {
+	if s.IsExtended() {
+		if size > 0xffffffff {
+			return fmt.Errorf("Section %v too large: %v bytes", s.Type, size)
+		}
+		s.ExtendedSize = uint32(size)
+		return nil
+	}
+	if size >= SectionMaxSmallSize {
+		return fmt.Errorf("Section %v too large for a standard header: %v bytes", s.Type, size)
+	}
+	s.Size = [3]uint8{uint8(size), uint8(size >> 8), uint8(size >> 16)}
+	return nil
+}
+
+// SetData replaces the contents of a section that does not contain other
+// sections, updating its size. The containing sections and files are
+// resized, and recompressed if needed, when they are serialized.
+func (s *Section) SetData(data []byte) error {
+	if len(s.Sections) != 0 || s.compressor != nil {
+		return fmt.Errorf("Section %v contains other sections, set their data instead", s.Type)
+	}
+	buf := append(append([]byte{}, s.buf[:s.DataOffset()]...), data...)
+	if err := s.setSize(uint64(len(buf))); err != nil {
+		return err
+	}
+	s.buf = buf
+	return nil
+}
+
+// IsEncapsulation returns whether the section can contain other sections
+func (s Section) IsEncapsulation() bool {
+	switch s.Type {
+	case SectionTypeCompression, SectionTypeGUIDDefined, SectionTypeDisposable:
+		return true
+	}
+	return false
+}
+
+func (s Section) String() string {
+	return fmt.Sprintf("Section{Type=%v, Size=%v}", s.Type, s.SectionSize())
+}
+
+// Summary prints a multi-line description of the Section
+func (s Section) Summary() string {
+	var sections []string
+	for _, child := range s.Sections {
+		sections = append(sections, child.Summary())
+	}
+	return fmt.Sprintf("Section{\n"+
+		"    Type=%v\n"+
+		"    Size=%v\n"+
+		"    Sections=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		s.Type, s.SectionSize(),
+		Indent(strings.Join(sections, "\n"), 8),
+	)
+}
+
+// NewSection parses a sequence of bytes and returns a Section object, if a
+// valid one is passed, or an error
+func NewSection(data []byte) (*Section, error) {
+	if len(data) < SectionHeaderMinSize {
+		return nil, fmt.Errorf("Section size too small: expected at least %v bytes, got %v",
+			SectionHeaderMinSize,
+			len(data),
+		)
+	}
+	var s Section
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.LittleEndian, &s.SectionHeader); err != nil {
+		return nil, err
+	}
+	if s.IsExtended() {
+		if err := binary.Read(reader, binary.LittleEndian, &s.ExtendedSize); err != nil {
+			return nil, err
+		}
+	}
+	size := s.SectionSize()
+	if size < s.CommonHeaderLen() || size > uint64(len(data)) {
+		return nil, fmt.Errorf("Section %v: invalid size %v, %v bytes available",
+			s.Type, size, len(data),
+		)
+	}
+	s.buf = data[:size]
+	reader = bytes.NewReader(s.buf[s.CommonHeaderLen():])
+	switch s.Type {
+	case SectionTypeCompression:
+		var hdr CompressionSectionHeader
+		if err := binary.Read(reader, binary.LittleEndian, &hdr); err != nil {
+			return nil, fmt.Errorf("Section %v: %v", s.Type, err)
+		}
+		s.Compression = &hdr
+		switch hdr.CompressionType {
+		case 0:
+			// not compressed, the sections follow
+			if err := s.parseSections(); err != nil {
+				return nil, err
+			}
+		case 1:
+			if err := s.decompress(compression.EFI); err != nil {
+				return nil, err
+			}
+		}
+	case SectionTypeGUIDDefined:
+		var hdr GUIDDefinedSectionHeader
+		if err := binary.Read(reader, binary.LittleEndian, &hdr); err != nil {
+			return nil, fmt.Errorf("Section %v: %v", s.Type, err)
+		}
+		if uint64(hdr.DataOffset) > size {
+			return nil, fmt.Errorf("Section %v: data offset %v past the end of the section", s.Type, hdr.DataOffset)
+		}
+		// the data cannot overlap the headers, or the section would contain
+		// itself
+		if uint64(hdr.DataOffset) < s.CommonHeaderLen()+GUIDDefinedSectionHeaderSize {
+			return nil, fmt.Errorf("Section %v: data offset %v inside the section headers", s.Type, hdr.DataOffset)
+		}
+		s.GUIDDefined = &hdr
+		if hdr.Attributes&GUIDedSectionProcessingRequired == 0 {
+			if err := s.parseSections(); err != nil {
+				return nil, err
+			}
+		} else if c := compression.CompressorForGUID(s.GUIDDefinedGUID()); c != nil {
+			if err := s.decompress(c); err != nil {
+				return nil, err
+			}
+		}
+	case SectionTypeDisposable:
+		if err := s.parseSections(); err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// MarshalBinary serializes the section. The headers are rebuilt from the
+// fields, and the child sections of encapsulation sections are serialized
+// at their offsets. Anything else is copied from the parsed buffer. If the
+// child sections change size, they are laid out again and the size of the
+// section is updated. Modified compressed sections are recompressed with the
+// same algorithm. The checksum of PE32 images is updated if it was valid.
+func (s Section) MarshalBinary() ([]byte, error) {
+	out := append([]byte{}, s.buf...)
+	switch {
+	case s.compressor != nil:
+		data, err := marshalSections(s.decompressed, s.Sections)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(data, s.decompressed) {
+			compressed, err := s.compressor.Encode(data)
+			if err != nil {
+				return nil, err
+			}
+			debugf("Recompressed %v with %s: %v bytes, %v compressed", s.Type, s.compressor.Name(), len(data), len(compressed))
+			out = append(out[:s.DataOffset():s.DataOffset()], compressed...)
+			if s.Compression != nil {
+				hdr := *s.Compression
+				hdr.UncompressedLength = uint32(len(data))
+				s.Compression = &hdr
+			}
+		}
+	case len(s.Sections) != 0:
+		var err error
+		if out, err = marshalSections(out, s.Sections); err != nil {
+			return nil, err
+		}
+	}
+	if uint64(len(out)) != uint64(len(s.buf)) {
+		if err := s.setSize(uint64(len(out))); err != nil {
+			return nil, err
+		}
+	}
+	var hdr bytes.Buffer
+	if err := binary.Write(&hdr, binary.LittleEndian, s.SectionHeader); err != nil {
+		return nil, err
+	}
+	if s.IsExtended() {
+		binary.Write(&hdr, binary.LittleEndian, s.ExtendedSize)
+	}
+	if s.Compression != nil {
+		binary.Write(&hdr, binary.LittleEndian, *s.Compression)
+	}
+	if s.GUIDDefined != nil {
+		binary.Write(&hdr, binary.LittleEndian, *s.GUIDDefined)
+	}
+	if err := splice(out, 0, hdr.Bytes(), "section header"); err != nil {
+		return nil, err
+	}
+	if s.Type == SectionTypePE32 && s.DataOffset() <= uint64(len(out)) {
+		// TE images have no checksum
+		fixPEChecksum(s.Data(), out[s.DataOffset():])
+	}
+	return out, nil
+}
+
+// sectionSizeAt returns the size of the section starting at the beginning
+// of buf, as stored in its header
+func sectionSizeAt(buf []byte) uint64 {
+	size := uint64(buf[0]) | uint64(buf[1])<<8 | uint64(buf[2])<<16
+	if size == SectionMaxSmallSize && len(buf) >= SectionHeaderExtendedSize {
+		size = uint64(binary.LittleEndian.Uint32(buf[4:]))
+	}
+	return size
+}
+
+// marshalSections serializes the sections into a copy of buf, which holds
+// them at their offsets. If a section changed size, the sections are laid
+// out again one after the other, aligned, and the bytes following the last
+// one are kept.
+func marshalSections(buf []byte, sections []*Section) ([]byte, error) {
+	out := append([]byte{}, buf...)
+	parts := make([][]byte, len(sections))
+	resized := false
+	for i, s := range sections {
+		sb, err := s.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = sb
+		if uint64(len(sb)) != sectionSizeAt(buf[s.Offset:]) {
+			resized = true
+		}
+	}
+	if !resized {
+		for i, s := range sections {
+			if err := splice(out, s.Offset, parts[i], s.String()); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	last := sections[len(sections)-1]
+	end := last.Offset + sectionSizeAt(buf[last.Offset:])
+	out = append([]byte{}, buf[:sections[0].Offset]...)
+	for _, p := range parts {
+		for uint64(len(out))%SectionAlignment != 0 {
+			out = append(out, 0)
+		}
+		out = append(out, p...)
+	}
+	return append(out, buf[end:]...), nil
+}
+
+// GUIDDefinedGUID returns the definition GUID of a GUID-defined section as a
+// string, or an empty string for other sections
+func (s Section) GUIDDefinedGUID() string {
+	if s.GUIDDefined == nil {
+		return ""
+	}
+	guid, err := uuid.FromBytes(s.GUIDDefined.SectionDefinitionGUID[:])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return guid.String()
+}
+
+// decompress decodes the contents of the section and parses the child
+// sections from the decompressed data. If the data cannot be decompressed
+// the section is left opaque.
+func (s *Section) decompress(c compression.Compressor) error {
+	data, err := c.Decode(s.Data())
+	if err != nil {
+		warnf("Section %v: cannot decompress %s data: %v", s.Type, c.Name(), err)
+		return nil
+	}
+	var broken []BrokenNode
+	sections, err := parseSections(data, 0, &broken)
+	if err != nil {
+		return err
+	}
+	// the broken elements are not in the section buffer, report them at
+	// the position of the compressed data
+	for _, b := range broken {
+		s.Broken = append(s.Broken, BrokenNode{
+			Offset: s.DataOffset(),
+			Data:   s.Data(),
+			Err:    fmt.Errorf("Decompressed data: %v", b.Err),
+		})
+	}
+	s.compressor = c
+	s.decompressed = data
+	s.Sections = sections
+	return nil
+}
+
+// parseSections reads the child sections of an encapsulation section
+func (s *Section) parseSections() error {
+	sections, err := parseSections(s.buf, s.DataOffset(), &s.Broken)
+	if err != nil {
+		return err
+	}
+	s.Sections = sections
+	return nil
+}
+
+// parseSections reads the sections found in buf starting at the given
+// offset. Sections are aligned to 4 bytes from the start of buf.
+func parseSections(buf []byte, offset uint64, broken *[]BrokenNode) ([]*Section, error) {
+	var sections []*Section
+	for offset = alignUp(offset, SectionAlignment); offset+SectionHeaderMinSize <= uint64(len(buf)); {
+		s, err := NewSection(buf[offset:])
+		if err != nil {
+			err = fmt.Errorf("Section at offset 0x%x: %v", offset, err)
+			return sections, tolerate(broken, offset, buf[offset:], err)
+		}
+		s.Offset = offset
+		sections = append(sections, s)
+		offset = alignUp(offset+s.SectionSize(), SectionAlignment)
+	}
+	return sections, nil
+}
+
+// splice copies child into out at the given offset, failing if it does not
+// fit.
+func splice(out []byte, offset uint64, child []byte, what string) error {
+	if offset+uint64(len(child)) > uint64(len(out)) {
+		return fmt.Errorf("Cannot serialize %s: %v bytes at offset 0x%x exceed the container size %v",
+			what, len(child), offset, len(out),
+		)
+	}
+	copy(out[offset:], child)
+	return nil
+}
+
+// alignUp rounds v up to the next multiple of align, which must be a power
+// of two
+func alignUp(v, align uint64) uint64 {
+	return (v + align - 1) &^ (align - 1)
+}
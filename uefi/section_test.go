@@ -0,0 +1,97 @@
+package uefi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/uefi/compression"
+)
+
+func TestNewSectionGUIDDefinedDataOffset(t *testing.T) {
+	for _, offset := range []byte{0, 4, 23} {
+		// a GUID-defined section whose data would start in its own headers
+		data := make([]byte, 24)
+		data[0], data[3] = 24, byte(SectionTypeGUIDDefined)
+		data[20] = offset
+		if _, err := NewSection(data); err == nil {
+			t.Errorf("data offset %d: expected an error", offset)
+		}
+	}
+	data := make([]byte, 24)
+	data[0], data[3], data[20] = 24, byte(SectionTypeGUIDDefined), 24
+	s, err := NewSection(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Data()) != 0 {
+		t.Errorf("expected no data, got %d bytes", len(s.Data()))
+	}
+}
+
+// TestDecodeImageSections decompresses the compressed sections of the images
+// listed in $UEFI_TEST_IMAGES, separated like $PATH. The images, e.g. vendor
+// or EDK2 builds, are not distributed with the sources, so the test checks
+// the codecs against the sections produced by the EDK2 BaseTools and not
+// only against themselves.
+func TestDecodeImageSections(t *testing.T) {
+	paths := filepath.SplitList(os.Getenv("UEFI_TEST_IMAGES"))
+	if len(paths) == 0 {
+		t.Skip("UEFI_TEST_IMAGES is not set")
+	}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw, err := Parse(buf)
+		if err != nil {
+			t.Errorf("%s: %v", path, err)
+			continue
+		}
+		if c, ok := fw.(*Capsule); ok && c.Firmware != nil {
+			fw = c.Firmware
+		}
+		var br *BiosRegion
+		switch f := fw.(type) {
+		case *FlashImage:
+			br = f.BiosRegion
+		case *BiosRegion:
+			br = f
+		}
+		if br == nil {
+			t.Errorf("%s: no BIOS region", path)
+			continue
+		}
+		count := 0
+		br.walkFiles(func(fv *FirmwareVolume, f, parent *File, offset uint64) {
+			walkSections(f, f.Sections, func(f *File, s *Section) {
+				compressed := s.Compression != nil && s.Compression.CompressionType != 0 ||
+					s.GUIDDefined != nil && s.GUIDDefined.Attributes&GUIDedSectionProcessingRequired != 0 &&
+						compression.CompressorForGUID(s.GUIDDefinedGUID()) != nil
+				if !compressed {
+					return
+				}
+				if !s.IsCompressed() {
+					t.Errorf("%s: file %s: %v section not decompressed", path, f.GUID(), s.Type)
+					return
+				}
+				count++
+				if len(s.Broken) != 0 {
+					t.Errorf("%s: file %s: %s section: invalid decompressed data: %v", path, f.GUID(), s.CompressionName(), s.Broken[0].Err)
+				}
+				encoded, err := s.compressor.Encode(s.Decompressed())
+				if err != nil {
+					t.Errorf("%s: file %s: %s section: Encode: %v", path, f.GUID(), s.CompressionName(), err)
+					return
+				}
+				if decoded, err := s.compressor.Decode(encoded); err != nil || !bytes.Equal(decoded, s.Decompressed()) {
+					t.Errorf("%s: file %s: %s section: the recompressed data does not decode to the same bytes", path, f.GUID(), s.CompressionName())
+				}
+			})
+		})
+		t.Logf("%s: %d compressed sections", path, count)
+	}
+}
@@ -0,0 +1,137 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// Signature types of the EFI_SIGNATURE_LIST structures
+const (
+	CertSHA1GUID          = "826ca512-cf10-4ac9-b187-be01496631bd"
+	CertSHA224GUID        = "0b6e5233-a65c-44c9-9407-d9ab83bfc8bd"
+	CertSHA256GUID        = "c1c41626-504c-4092-aca9-41f936934328"
+	CertSHA384GUID        = "ff3e5307-9fd0-48c9-85f1-8ad56c701e01"
+	CertSHA512GUID        = "093e0fae-a6c4-4f50-9f1b-d41e2b89c19a"
+	CertRSA2048GUID       = "3c5766e8-269c-4e34-aa14-ed776e85b3b6"
+	CertRSA2048SHA1GUID   = "67f8444f-8743-48f1-a328-1eaab8736080"
+	CertRSA2048SHA256GUID = "e2b36190-879b-4a3d-ad8d-f2e7bba32784"
+	CertX509GUID          = "a5c059a1-94e4-4aa7-87b5-ab155c2bf072"
+	CertX509SHA256GUID    = "3bd2a492-96c0-4079-b420-fcf98ef103ed"
+	CertX509SHA384GUID    = "7076876e-80c2-4ee6-aad2-28b349a6865b"
+	CertX509SHA512GUID    = "446dbf63-2502-4cda-bcfa-2465d2b0fe9d"
+)
+
+// SignatureTypeNames maps the signature type GUIDs to their names
+var SignatureTypeNames = map[string]string{
+	CertSHA1GUID:          "SHA1",
+	CertSHA224GUID:        "SHA224",
+	CertSHA256GUID:        "SHA256",
+	CertSHA384GUID:        "SHA384",
+	CertSHA512GUID:        "SHA512",
+	CertRSA2048GUID:       "RSA2048",
+	CertRSA2048SHA1GUID:   "RSA2048_SHA1",
+	CertRSA2048SHA256GUID: "RSA2048_SHA256",
+	CertX509GUID:          "X509",
+	CertX509SHA256GUID:    "X509_SHA256",
+	CertX509SHA384GUID:    "X509_SHA384",
+	CertX509SHA512GUID:    "X509_SHA512",
+}
+
+// SignatureListHeaderSize is the size of the fixed part of an
+// EFI_SIGNATURE_LIST
+const SignatureListHeaderSize = 28
+
+// signatureOwnerSize is the size of the owner GUID preceding each signature
+const signatureOwnerSize = 16
+
+// SignatureListHeader is the header of an EFI_SIGNATURE_LIST
+type SignatureListHeader struct {
+	SignatureType       [16]uint8
+	SignatureListSize   uint32
+	SignatureHeaderSize uint32
+	SignatureSize       uint32
+}
+
+// SignatureData is an EFI_SIGNATURE_DATA: a hash, a key or a certificate,
+// depending on the type of its list
+type SignatureData struct {
+	// Owner is the GUID of the agent that added the signature
+	Owner string
+	Data  []byte
+	// Offset is the position of Data from the start of the buffer given to
+	// ParseSignatureLists
+	Offset uint64
+}
+
+// SignatureList is an EFI_SIGNATURE_LIST, the format of the Secure Boot
+// variables (PK, KEK, db, dbx) and of the shim MOK lists
+type SignatureList struct {
+	SignatureListHeader
+	// Header is the type specific header, usually empty
+	Header     []byte
+	Signatures []SignatureData
+}
+
+// Type returns the signature type GUID of the list
+func (l SignatureList) Type() string {
+	guid, err := uuid.FromBytes(l.SignatureType[:])
+	if err != nil {
+		return "<invalid GUID>"
+	}
+	return guid.String()
+}
+
+// TypeName returns the name of the signature type of the list
+func (l SignatureList) TypeName() string {
+	if name, ok := SignatureTypeNames[l.Type()]; ok {
+		return name
+	}
+	return "Unknown (" + l.Type() + ")"
+}
+
+func (l SignatureList) String() string {
+	return fmt.Sprintf("SignatureList{Type=%s, Signatures=%d}", l.TypeName(), len(l.Signatures))
+}
+
+// ParseSignatureLists parses the EFI_SIGNATURE_LIST structures filling buf,
+// e.g. the data of the db variable
+func ParseSignatureLists(buf []byte) ([]*SignatureList, error) {
+	var lists []*SignatureList
+	for offset := uint64(0); offset < uint64(len(buf)); {
+		if uint64(len(buf))-offset < SignatureListHeaderSize {
+			return nil, fmt.Errorf("Signature list at 0x%x: header too small: %v bytes", offset, uint64(len(buf))-offset)
+		}
+		var l SignatureList
+		if err := binary.Read(bytes.NewReader(buf[offset:]), binary.LittleEndian, &l.SignatureListHeader); err != nil {
+			return nil, err
+		}
+		size := uint64(l.SignatureListSize)
+		dataStart := SignatureListHeaderSize + uint64(l.SignatureHeaderSize)
+		if size < dataStart || offset+size > uint64(len(buf)) {
+			return nil, fmt.Errorf("Signature list at 0x%x: invalid size 0x%x", offset, size)
+		}
+		sigSize := uint64(l.SignatureSize)
+		if sigSize <= signatureOwnerSize || (size-dataStart)%sigSize != 0 {
+			return nil, fmt.Errorf("Signature list at 0x%x: invalid signature size 0x%x", offset, sigSize)
+		}
+		list := buf[offset : offset+size]
+		l.Header = list[SignatureListHeaderSize:dataStart]
+		for s := dataStart; s < size; s += sigSize {
+			owner, err := uuid.FromBytes(list[s : s+signatureOwnerSize])
+			if err != nil {
+				return nil, err
+			}
+			l.Signatures = append(l.Signatures, SignatureData{
+				Owner:  owner.String(),
+				Data:   list[s+signatureOwnerSize : s+sigSize],
+				Offset: offset + s + signatureOwnerSize,
+			})
+		}
+		lists = append(lists, &l)
+		offset += size
+	}
+	return lists, nil
+}
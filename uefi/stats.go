@@ -0,0 +1,116 @@
+package uefi
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ParseStats describes how much of an image the parsers understood, and how
+// long it took. It is meant to track the coverage and the performance of the
+// parsers across firmware generations.
+type ParseStats struct {
+	// TotalBytes is the size of the image
+	TotalBytes uint64
+	// CoveredBytes is the number of bytes inside parsed elements. The space
+	// of a region that is not part of its parsed elements, e.g. between two
+	// firmware volumes, and the broken elements are not covered.
+	CoveredBytes uint64
+	// NodeCounts is the number of nodes of the tree by type
+	NodeCounts map[string]int
+	// ToleratedErrors is the number of errors tolerated in permissive mode
+	ToleratedErrors int
+	// Durations is the time spent parsing the descriptor and each region,
+	// plus the total under "Total"
+	Durations map[string]time.Duration
+}
+
+// Coverage returns the fraction of the image covered by parsed elements
+func (s ParseStats) Coverage() float64 {
+	if s.TotalBytes == 0 {
+		return 0
+	}
+	return float64(s.CoveredBytes) / float64(s.TotalBytes)
+}
+
+func (s ParseStats) String() string {
+	var types, parts []string
+	for t := range s.NodeCounts {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for i, t := range types {
+		types[i] = fmt.Sprintf("%s=%v", t, s.NodeCounts[t])
+	}
+	for p := range s.Durations {
+		parts = append(parts, p)
+	}
+	sort.Strings(parts)
+	for i, p := range parts {
+		parts[i] = fmt.Sprintf("%s=%v", p, s.Durations[p])
+	}
+	return fmt.Sprintf("ParseStats{\n"+
+		"    Coverage=%v/%v bytes (%.1f%%)\n"+
+		"    Nodes=%s\n"+
+		"    ToleratedErrors=%v\n"+
+		"    Durations=%s\n"+
+		"}",
+		s.CoveredBytes, s.TotalBytes, s.Coverage()*100,
+		strings.Join(types, ", "),
+		s.ToleratedErrors,
+		strings.Join(parts, ", "),
+	)
+}
+
+// coveredBytes returns the number of bytes of the node inside parsed
+// elements. parsed reports whether a region without children was parsed.
+func coveredBytes(n *Node, parsed func(*Node) bool) uint64 {
+	switch {
+	case n.Type == "Broken":
+		return 0
+	case n.Type == "Region" && len(n.Children) == 0:
+		if parsed(n) {
+			return n.Size
+		}
+		return 0
+	case n.Type == "Region" || n.Type == "FlashImage":
+		var covered uint64
+		for _, child := range n.Children {
+			covered += coveredBytes(child, parsed)
+		}
+		return covered
+	}
+	return n.Size
+}
+
+// ParseStats returns the coverage statistics of the parsed image, and the
+// time spent parsing it
+func (f FlashImage) ParseStats() ParseStats {
+	stats := ParseStats{
+		TotalBytes:      uint64(len(f.buf)),
+		NodeCounts:      make(map[string]int),
+		ToleratedErrors: len(f.ParseErrors()),
+		Durations:       make(map[string]time.Duration),
+	}
+	for name, d := range f.durations {
+		stats.Durations[name] = d
+	}
+	root := f.Tree()
+	var count func(n *Node)
+	count = func(n *Node) {
+		stats.NodeCounts[n.Type]++
+		for _, child := range n.Children {
+			count(child)
+		}
+	}
+	count(root)
+	parsed := map[string]bool{"Descriptor": true}
+	for _, r := range f.Regions() {
+		parsed[r.Type().String()] = true
+	}
+	stats.CoveredBytes = coveredBytes(root, func(n *Node) bool {
+		return parsed[n.Name]
+	})
+	return stats
+}
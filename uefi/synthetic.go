@@ -0,0 +1,287 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"unicode/utf16"
+
+	uuid "github.com/insomniacslk/uefi/uuid"
+)
+
+// Well-known GUIDs used when generating synthetic images
+const (
+	FFS2GUID             = "8c8ce578-8a3d-4f1c-9935-896185c32dd3"
+	SystemNvDataFVGUID   = "fff12b8d-7696-4c8b-a985-2747075b4f50"
+	syntheticBlockSize   = 0x1000
+	syntheticFVAttribute = 0x0004feff
+)
+
+// SyntheticFile describes a firmware file to put in a synthetic image. Files
+// of type FileTypeRaw contain Body as is, other files contain a raw section
+// with Body and, if Name is not empty, a user interface section with Name.
+type SyntheticFile struct {
+	GUID string
+	Type FileType
+	Name string
+	Body []byte
+}
+
+// SyntheticVariable describes an NVRAM variable to put in the variable store
+// of a synthetic image.
+type SyntheticVariable struct {
+	GUID       string
+	Name       string
+	Attributes uint32
+	Data       []byte
+}
+
+// SyntheticConfig holds the parameters of a synthetic flash image. All the
+// sizes are in bytes and must be multiples of 4KB. The BIOS region takes all
+// the space left after the descriptor and the other regions.
+type SyntheticConfig struct {
+	Size      uint32
+	PCH       bool
+	MeSize    uint32
+	GbeSize   uint32
+	PdrSize   uint32
+	NvramSize uint32
+	Files     []SyntheticFile
+	Variables []SyntheticVariable
+}
+
+// DefaultSyntheticConfig returns the configuration of a small 1MB PCH image
+// with ME and GbE regions, a few files and a few variables.
+func DefaultSyntheticConfig() SyntheticConfig {
+	return SyntheticConfig{
+		Size:      0x100000,
+		PCH:       true,
+		MeSize:    0x10000,
+		GbeSize:   0x2000,
+		NvramSize: 0x10000,
+		Files: []SyntheticFile{
+			{GUID: "5a5e7c1f-0001-4e3a-9f6b-0a1b2c3d4e01", Type: FileTypePEIM, Name: "SyntheticPei", Body: []byte("synthetic PEIM")},
+			{GUID: "5a5e7c1f-0002-4e3a-9f6b-0a1b2c3d4e02", Type: FileTypeDriver, Name: "SyntheticDxe", Body: []byte("synthetic DXE driver")},
+			{GUID: "5a5e7c1f-0003-4e3a-9f6b-0a1b2c3d4e03", Type: FileTypeApplication, Name: "SyntheticApp", Body: []byte("synthetic application")},
+			{GUID: "5a5e7c1f-0004-4e3a-9f6b-0a1b2c3d4e04", Type: FileTypeRaw, Body: bytes.Repeat([]byte{0x5a}, 64)},
+		},
+		Variables: []SyntheticVariable{
+			{GUID: GlobalVariableGUID, Name: "Timeout", Attributes: 0x07, Data: []byte{0x05, 0x00}},
+			{GUID: GlobalVariableGUID, Name: "BootOrder", Attributes: 0x07, Data: []byte{0x00, 0x00}},
+			{GUID: GlobalVariableGUID, Name: "Boot0000", Attributes: 0x07, Data: syntheticLoadOption("Synthetic Boot")},
+			{GUID: GlobalVariableGUID, Name: "PlatformLang", Attributes: 0x07, Data: []byte("en-US\x00")},
+		},
+	}
+}
+
+// parseGUID converts a GUID string to its binary representation
+func parseGUID(s string) ([16]uint8, error) {
+	var guid [16]uint8
+	u, err := uuid.Parse(s)
+	if err != nil {
+		return guid, fmt.Errorf("Invalid GUID %q: %v", s, err)
+	}
+	copy(guid[:], u.Data)
+	return guid, nil
+}
+
+// encodeUCS2 encodes a string as a NUL-terminated UCS-2 sequence of bytes
+func encodeUCS2(s string) []byte {
+	var buf bytes.Buffer
+	for _, c := range utf16.Encode([]rune(s)) {
+		binary.Write(&buf, binary.LittleEndian, c)
+	}
+	buf.Write([]byte{0, 0})
+	return buf.Bytes()
+}
+
+// syntheticLoadOption builds an EFI_LOAD_OPTION with the given description
+// and a device path made only of the end node.
+func syntheticLoadOption(description string) []byte {
+	devicePath := []byte{0x7f, 0xff, 0x04, 0x00}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(1)) // LOAD_OPTION_ACTIVE
+	binary.Write(&buf, binary.LittleEndian, uint16(len(devicePath)))
+	buf.Write(encodeUCS2(description))
+	buf.Write(devicePath)
+	return buf.Bytes()
+}
+
+// buildSection returns a section of the given type, with a header
+func buildSection(typ SectionType, data []byte) []byte {
+	size := SectionHeaderMinSize + len(data)
+	return append([]byte{uint8(size), uint8(size >> 8), uint8(size >> 16), uint8(typ)}, data...)
+}
+
+// padTo appends erased bytes to buf until its length is a multiple of align
+func padTo(buf []byte, align int, erased byte) []byte {
+	for len(buf)%align != 0 {
+		buf = append(buf, erased)
+	}
+	return buf
+}
+
+// buildVariableStore returns a variable store of the given size containing
+// the given variables.
+func buildVariableStore(size uint32, vars []SyntheticVariable) ([]byte, error) {
+	storeGUID, err := parseGUID(VariableStoreGUID)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(storeGUID[:])
+	binary.Write(&buf, binary.LittleEndian, size)
+	buf.Write([]byte{0x5a, 0xfe, 0, 0, 0, 0, 0, 0}) // formatted, healthy
+	for _, v := range vars {
+		vendor, err := parseGUID(v.GUID)
+		if err != nil {
+			return nil, err
+		}
+		name := encodeUCS2(v.Name)
+		binary.Write(&buf, binary.LittleEndian, uint16(0x55aa))
+		buf.Write([]byte{0x3f, 0}) // VAR_ADDED
+		binary.Write(&buf, binary.LittleEndian, v.Attributes)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(name)))
+		binary.Write(&buf, binary.LittleEndian, uint32(len(v.Data)))
+		buf.Write(vendor[:])
+		buf.Write(name)
+		buf.Write(v.Data)
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0xff)
+		}
+	}
+	if uint32(buf.Len()) > size {
+		return nil, fmt.Errorf("Variable store too small: %v bytes do not fit in 0x%x", buf.Len(), size)
+	}
+	return buf.Bytes(), nil
+}
+
+// buildFiles returns the firmware files of a synthetic volume
+func buildFiles(files []SyntheticFile) ([]*File, error) {
+	var ffs []*File
+	for _, sf := range files {
+		name, err := parseGUID(sf.GUID)
+		if err != nil {
+			return nil, err
+		}
+		data := sf.Body
+		if sf.Type != FileTypeRaw {
+			data = buildSection(SectionTypeRaw, sf.Body)
+			if sf.Name != "" {
+				data = append(padTo(data, 4, 0), buildSection(SectionTypeUserInterface, encodeUCS2(sf.Name))...)
+			}
+		}
+		f, err := CreateFile(name, sf.Type, 0, data, 1)
+		if err != nil {
+			return nil, err
+		}
+		ffs = append(ffs, f)
+	}
+	return ffs, nil
+}
+
+// buildDescriptor returns a 4KB flash descriptor for the given regions. Each
+// region is a (base, size) pair in bytes, in the order descriptor, BIOS, ME,
+// GbE, PDR.
+func buildDescriptor(cfg SyntheticConfig, regions [][2]uint32) []byte {
+	desc := bytes.Repeat([]byte{0xff}, FlashDescriptorMapSize)
+	mapStart := 4
+	if cfg.PCH {
+		mapStart = 20
+	}
+	copy(desc[mapStart-4:], FlashSignature)
+	copy(desc[mapStart:], []byte{
+		0x03, 0x00, 0x04, 0x04, // component at 0x30, 1 chip, regions at 0x40
+		0x06, 0x02, 0x10, 0x12, // masters at 0x60, PCH straps at 0x100
+		0x20, 0x01, 0x00, 0x00, // processor straps at 0x200
+		0x00, 0x00, 0x00, 0x00,
+	})
+	// component section: density of the first chip, frequencies at 20MHz
+	var density uint8
+	for s := uint32(512 * 1024); s < cfg.Size && density < 0x0f; s <<= 1 {
+		density++
+	}
+	copy(desc[0x30:], []byte{density, 0x00, 0x00, 0x00})
+	for i, r := range regions {
+		base, limit := uint32(0x7fff), uint32(0)
+		if r[1] != 0 {
+			base, limit = r[0]>>12, (r[0]+r[1]-1)>>12
+		}
+		binary.LittleEndian.PutUint32(desc[0x40+4*i:], base|limit<<16)
+	}
+	// masters: requester ID, read and write access per region
+	copy(desc[0x60:], []byte{
+		0x00, 0x00, 0x0b, 0x0a, // BIOS
+		0x00, 0x00, 0x0d, 0x0c, // ME
+		0x18, 0x01, 0x08, 0x08, // GbE
+	})
+	for i := 0x100; i < 0x100+0x12*4; i++ {
+		desc[i] = 0
+	}
+	for i := 0x200; i < 0x204; i++ {
+		desc[i] = 0
+	}
+	return desc
+}
+
+// syntheticBlocks returns a block map of 4KB blocks covering size bytes
+func syntheticBlocks(size uint32) []Block {
+	return []Block{{Count: size / syntheticBlockSize, Size: syntheticBlockSize}}
+}
+
+// NewSyntheticImage builds a small but fully valid flash image according to
+// the given configuration. The BIOS region contains an NVRAM volume with a
+// variable store, followed by a volume with the configured files.
+func NewSyntheticImage(cfg SyntheticConfig) ([]byte, error) {
+	for _, s := range []uint32{cfg.Size, cfg.MeSize, cfg.GbeSize, cfg.PdrSize, cfg.NvramSize} {
+		if s%0x1000 != 0 {
+			return nil, fmt.Errorf("Synthetic image sizes must be multiples of 4KB, got 0x%x", s)
+		}
+	}
+	offset := uint32(FlashDescriptorMapSize)
+	me := [2]uint32{offset, cfg.MeSize}
+	offset += cfg.MeSize
+	gbe := [2]uint32{offset, cfg.GbeSize}
+	offset += cfg.GbeSize
+	pdr := [2]uint32{offset, cfg.PdrSize}
+	offset += cfg.PdrSize
+	if offset+cfg.NvramSize+syntheticBlockSize > cfg.Size {
+		return nil, fmt.Errorf("Synthetic image too small: 0x%x bytes, no room left for the BIOS region", cfg.Size)
+	}
+	bios := [2]uint32{offset, cfg.Size - offset}
+
+	image := bytes.Repeat([]byte{0xff}, int(cfg.Size))
+	copy(image, buildDescriptor(cfg, [][2]uint32{{0, FlashDescriptorMapSize}, bios, me, gbe, pdr}))
+
+	nvramGUID, err := parseGUID(SystemNvDataFVGUID)
+	if err != nil {
+		return nil, err
+	}
+	ffs2GUID, err := parseGUID(FFS2GUID)
+	if err != nil {
+		return nil, err
+	}
+	biosData := image[bios[0]:]
+	if cfg.NvramSize != 0 {
+		store, err := buildVariableStore(cfg.NvramSize-FirmwareVolumeMinSize-8, cfg.Variables)
+		if err != nil {
+			return nil, err
+		}
+		nvram, err := buildFirmwareVolume(nvramGUID, syntheticBlocks(cfg.NvramSize), syntheticFVAttribute, store)
+		if err != nil {
+			return nil, err
+		}
+		copy(biosData, nvram)
+		biosData = biosData[cfg.NvramSize:]
+	}
+	files, err := buildFiles(cfg.Files)
+	if err != nil {
+		return nil, err
+	}
+	main, err := CreateFirmwareVolume(ffs2GUID, syntheticBlocks(uint32(len(biosData))), syntheticFVAttribute, files)
+	if err != nil {
+		return nil, err
+	}
+	copy(biosData, main.Buf())
+	return image, nil
+}
@@ -0,0 +1,221 @@
+package uefi
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const (
+	// tenGbeChecksumWord is the position of the checksum word of the NVM
+	tenGbeChecksumWord = 0x3f
+	// tenGbeLastWord is the end of the words of the NVM header covered by
+	// the checksum
+	tenGbeLastWord = 0x41
+	// tenGbeSignature is the value of bits 7:6 of the control word of a
+	// valid NVM
+	tenGbeSignature = 1
+)
+
+// Positions of the module pointers in the header of the 10GbE NVM
+const (
+	tenGbePCIeAnalogPtr  = 0x03
+	tenGbePHYPtr         = 0x04
+	tenGbeOptionROMPtr   = 0x05
+	tenGbePCIeGeneralPtr = 0x06
+	tenGbePCIeConfig0Ptr = 0x07
+	tenGbePCIeConfig1Ptr = 0x08
+	tenGbeCore0Ptr       = 0x09
+	tenGbeCore1Ptr       = 0x0a
+	tenGbeFWPtr          = 0x0f
+)
+
+// tenGbeModuleNames are the names of the modules of the pointers
+var tenGbeModuleNames = map[int]string{
+	tenGbePCIeAnalogPtr:  "PCIeAnalog",
+	tenGbePHYPtr:         "PHY",
+	tenGbeOptionROMPtr:   "OptionROM",
+	tenGbePCIeGeneralPtr: "PCIeGeneral",
+	tenGbePCIeConfig0Ptr: "PCIeConfig0",
+	tenGbePCIeConfig1Ptr: "PCIeConfig1",
+	tenGbeCore0Ptr:       "LANCore0",
+	tenGbeCore1Ptr:       "LANCore1",
+	0x0b:                 "MAC0",
+	0x0c:                 "MAC1",
+	0x0d:                 "CSR0Config",
+	0x0e:                 "CSR1Config",
+	tenGbeFWPtr:          "Firmware",
+}
+
+// tenGbeFixedSizes are the sizes in words of the modules that have no
+// length word
+var tenGbeFixedSizes = map[int]int{
+	tenGbePCIeGeneralPtr: 0x24,
+	tenGbePCIeConfig0Ptr: 0x08,
+	tenGbePCIeConfig1Ptr: 0x08,
+}
+
+// TenGbeModule is a module of the 10GbE NVM referenced by the header
+type TenGbeModule struct {
+	Name string
+	// Word is the position of the pointer in the header, Pointer the
+	// position of the module in words
+	Word    int
+	Pointer uint16
+}
+
+// Present returns whether the pointer is set
+func (m TenGbeModule) Present() bool {
+	return m.Pointer != 0 && m.Pointer != 0xffff
+}
+
+func (m TenGbeModule) String() string {
+	if !m.Present() {
+		return fmt.Sprintf("%s=<none>", m.Name)
+	}
+	return fmt.Sprintf("%s=0x%04x", m.Name, m.Pointer)
+}
+
+// TenGbeRegion represents one of the two 10GbE regions of recent server
+// descriptors, which hold the NVM of the X550 family controllers integrated
+// in the SoC. Unlike the GbE NVM, the header points to modules for the
+// PCIe, PHY and LAN cores, and the checksum covers some of them.
+type TenGbeRegion struct {
+	// Control is the first word of the NVM
+	Control uint16
+	Modules []TenGbeModule
+	// MACs are the addresses of the LAN cores whose module is present
+	MACs []MACAddress
+	// Checksum is the checksum word, ChecksumValid tells whether it
+	// matches the computed one
+	Checksum      uint16
+	ChecksumValid bool
+	t             FlashRegionType
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the region
+func (tr TenGbeRegion) Buf() []byte {
+	return tr.buf
+}
+
+// Type returns RegionType10GbE0 or RegionType10GbE1
+func (tr TenGbeRegion) Type() FlashRegionType {
+	return tr.t
+}
+
+// word returns the NVM word at position i, or 0xffff if it is outside of
+// the region
+func (tr TenGbeRegion) word(i int) uint16 {
+	if i < 0 || 2*i+2 > len(tr.buf) {
+		return 0xffff
+	}
+	return binary.LittleEndian.Uint16(tr.buf[2*i:])
+}
+
+// Valid returns whether the signature of the control word is set
+func (tr TenGbeRegion) Valid() bool {
+	return (tr.Control>>6)&3 == tenGbeSignature
+}
+
+// computeChecksum returns the checksum word of the NVM: 0xbaba minus the
+// sum of the header words and of the PCIe and LAN modules
+func (tr TenGbeRegion) computeChecksum() uint16 {
+	var sum uint16
+	for i := 0; i < tenGbeLastWord; i++ {
+		if i != tenGbeChecksumWord {
+			sum += tr.word(i)
+		}
+	}
+	for i := tenGbePCIeAnalogPtr; i < tenGbeFWPtr; i++ {
+		if i == tenGbePHYPtr || i == tenGbeOptionROMPtr {
+			continue
+		}
+		pointer := int(tr.word(i))
+		if pointer == 0 || pointer == 0xffff || 2*pointer >= len(tr.buf) {
+			continue
+		}
+		start, length := pointer, tenGbeFixedSizes[i]
+		if length == 0 {
+			length = int(tr.word(pointer))
+			if length == 0 || length == 0xffff {
+				continue
+			}
+			start++
+		}
+		for j := start; j < start+length; j++ {
+			sum += tr.word(j)
+		}
+	}
+	return GbeChecksumTarget - sum
+}
+
+// Summary prints a multi-line description of the region
+func (tr TenGbeRegion) Summary() string {
+	var modules, macs []string
+	for _, m := range tr.Modules {
+		modules = append(modules, m.String())
+	}
+	for _, m := range tr.MACs {
+		macs = append(macs, m.String())
+	}
+	return fmt.Sprintf("TenGbeRegion{\n"+
+		"    Type=%v\n"+
+		"    Size=%v\n"+
+		"    Control=0x%04x\n"+
+		"    Valid=%v\n"+
+		"    MACs=[%v]\n"+
+		"    Checksum=0x%04x\n"+
+		"    ChecksumValid=%v\n"+
+		"    Modules=[%v]\n"+
+		"}",
+		tr.t, len(tr.buf), tr.Control, tr.Valid(), strings.Join(macs, ", "),
+		tr.Checksum, tr.ChecksumValid, strings.Join(modules, ", "))
+}
+
+// Validate checks the signature and the checksum of the NVM
+func (tr TenGbeRegion) Validate() []error {
+	errors := make([]error, 0)
+	if !tr.Valid() {
+		return append(errors, fmt.Errorf("%v region: invalid NVM signature in control word 0x%04x", tr.t, tr.Control))
+	}
+	if !tr.ChecksumValid {
+		errors = append(errors, fmt.Errorf("%v region: wrong NVM checksum 0x%04x, expected 0x%04x", tr.t, tr.Checksum, tr.computeChecksum()))
+	}
+	return errors
+}
+
+// MarshalBinary serializes the region
+func (tr TenGbeRegion) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, tr.buf...), nil
+}
+
+// NewTenGbeRegion parses a sequence of bytes and returns a TenGbeRegion
+// object of the given type, if a valid one is passed, or an error
+func NewTenGbeRegion(data []byte, t FlashRegionType) (*TenGbeRegion, error) {
+	if t != RegionType10GbE0 && t != RegionType10GbE1 {
+		return nil, fmt.Errorf("Invalid 10GbE region type %v", t)
+	}
+	if len(data) < 2*tenGbeLastWord {
+		return nil, fmt.Errorf("10GbE region too small: expected at least %v bytes, got %v", 2*tenGbeLastWord, len(data))
+	}
+	tr := TenGbeRegion{t: t, buf: data}
+	tr.Control = tr.word(0)
+	for i := tenGbePCIeAnalogPtr; i <= tenGbeFWPtr; i++ {
+		tr.Modules = append(tr.Modules, TenGbeModule{Name: tenGbeModuleNames[i], Word: i, Pointer: tr.word(i)})
+	}
+	// the LAN core modules start with their MAC address, after the length
+	for _, i := range []int{tenGbeCore0Ptr, tenGbeCore1Ptr} {
+		pointer := int(tr.word(i))
+		if pointer == 0 || pointer == 0xffff || 2*(pointer+4) > len(data) {
+			continue
+		}
+		var mac MACAddress
+		copy(mac[:], data[2*(pointer+1):])
+		tr.MACs = append(tr.MACs, mac)
+	}
+	tr.Checksum = tr.word(tenGbeChecksumWord)
+	tr.ChecksumValid = tr.Checksum == tr.computeChecksum()
+	return &tr, nil
+}
@@ -0,0 +1,147 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"github.com/insomniacslk/uefi/compression"
+)
+
+// AMIUDCSignature starts the $UDC containers of the AMI Aptio images, which
+// hold compressed setup data and volumes outside of the GUID-defined
+// sections
+var AMIUDCSignature = []byte("$UDC")
+
+const (
+	// udcMaxHeaderSize bounds the search of the compressed stream after the
+	// signature, as the layout of the header is undocumented
+	udcMaxHeaderSize = 0x40
+	// udcMaxSize bounds the decompressed size of the containers
+	udcMaxSize = 16 << 20
+	// lzmaProperties is the properties byte of the LZMA streams produced
+	// with the default settings
+	lzmaProperties = 0x5d
+)
+
+// AMIUDC is an AMI $UDC container
+type AMIUDC struct {
+	// Offset is the position of the signature in the searched buffer, and
+	// DataOffset the position of the compressed stream from the signature
+	Offset     uint64
+	DataOffset uint64
+	// Compression is the name of the algorithm of the stream
+	Compression string
+	Data        []byte `json:"-"`
+	// Firmware is the parsed data, nil if it is not a known firmware type
+	Firmware Firmware `json:"-"`
+}
+
+func (u AMIUDC) String() string {
+	firmware := "raw data"
+	if u.Firmware != nil {
+		firmware = fmt.Sprintf("%T", u.Firmware)
+	}
+	return fmt.Sprintf("$UDC at 0x%x: %s, %d bytes, %s", u.Offset, u.Compression, len(u.Data), firmware)
+}
+
+// decodeUDC returns the decompressed stream at the start of buf, trying the
+// algorithms in order of likelihood
+func decodeUDC(buf []byte) (compression.Compressor, []byte) {
+	if len(buf) < 8 {
+		return nil, nil
+	}
+	compSize := uint64(binary.LittleEndian.Uint32(buf))
+	origSize := uint64(binary.LittleEndian.Uint32(buf[4:]))
+	if compSize > 0 && compSize+8 <= uint64(len(buf)) && origSize > 0 && origSize <= udcMaxSize {
+		for _, c := range []compression.Compressor{compression.Tiano, compression.EFI} {
+			if data, err := c.Decode(buf); err == nil {
+				return c, data
+			}
+		}
+	}
+	if buf[0] == lzmaProperties {
+		if data, err := compression.LZMA.Decode(buf); err == nil && len(data) <= udcMaxSize {
+			return compression.LZMA, data
+		}
+	}
+	return nil, nil
+}
+
+// NewAMIUDC decompresses the $UDC container at the start of buf
+func NewAMIUDC(buf []byte) (*AMIUDC, error) {
+	if !bytes.HasPrefix(buf, AMIUDCSignature) {
+		return nil, fmt.Errorf("$UDC signature not found")
+	}
+	for offset := len(AMIUDCSignature); offset <= udcMaxHeaderSize && offset < len(buf); offset += 4 {
+		c, data := decodeUDC(buf[offset:])
+		if c == nil {
+			continue
+		}
+		u := AMIUDC{DataOffset: uint64(offset), Compression: c.Name(), Data: data}
+		if fw, err := Parse(data); err == nil {
+			u.Firmware = fw
+		} else {
+			debugf("$UDC data: %v", err)
+		}
+		return &u, nil
+	}
+	return nil, fmt.Errorf("No compressed stream found in $UDC container")
+}
+
+// FindUDCs returns the $UDC containers in buf that could be decompressed
+func FindUDCs(buf []byte) []*AMIUDC {
+	var udcs []*AMIUDC
+	for offset := 0; offset < len(buf); offset += len(AMIUDCSignature) {
+		idx := bytes.Index(buf[offset:], AMIUDCSignature)
+		if idx == -1 {
+			break
+		}
+		offset += idx
+		u, err := NewAMIUDC(buf[offset:])
+		if err != nil {
+			debugf("$UDC at 0x%x: %v", offset, err)
+			continue
+		}
+		u.Offset = uint64(offset)
+		udcs = append(udcs, u)
+	}
+	return udcs
+}
+
+// FileUDC is a $UDC container of the BIOS region, as returned by
+// BiosRegion.UDCs
+type FileUDC struct {
+	// File is the GUID of the file holding the container, Name its module
+	// name, see File.ModuleName
+	File string
+	Name string
+	AMIUDC
+}
+
+func (u FileUDC) String() string {
+	return fmt.Sprintf("%s: %s", strings.TrimSpace(u.File+" "+u.Name), u.AMIUDC)
+}
+
+// UDCs returns the $UDC containers stored in the files of the region,
+// either in raw and freeform sections or as the data of files without
+// sections
+func (br BiosRegion) UDCs() []FileUDC {
+	var udcs []FileUDC
+	isRaw := func(s *Section) bool { return s.Type == SectionTypeRaw || s.Type == SectionTypeFreeformSubtypeGUID }
+	br.walkFileData(isRaw, func(f *File, data []byte) {
+		for _, u := range FindUDCs(data) {
+			udcs = append(udcs, FileUDC{File: f.GUID(), Name: f.ModuleName(), AMIUDC: *u})
+		}
+	})
+	return udcs
+}
+
+// UDCs returns the $UDC containers of the BIOS region
+func (f FlashImage) UDCs() []FileUDC {
+	if f.BiosRegion == nil {
+		return nil
+	}
+	return f.BiosRegion.UDCs()
+}
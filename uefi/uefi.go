@@ -3,6 +3,8 @@ package uefi
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 )
 
 // Firmware is an interface to describe generic firmware types. The
@@ -15,14 +17,50 @@ type Firmware interface {
 
 // Parse exposes a high-level parser for generic firmware types. It does not
 // implement any parser itself, but it calls known parsers that implement the
-// Firmware interface.
+// Firmware interface. Images without an Intel flash descriptor that contain
+// firmware volumes, e.g. BIOS region dumps or coreboot images, are parsed as
+// a BiosRegion. Images starting with a BPDT are parsed as an IFWI, the
+// firmware images of the graphics security controllers as a GscImage, and
+// the PCI expansion ROMs as an OptionROM.
+// Capsules, and the capsule-on-disk files staged on the ESP, are unwrapped
+// and their payloads parsed in turn, like the entries of the Dell PFS
+// containers and the Apple IM4P payloads.
 func Parse(buf []byte) (Firmware, error) {
 	switch {
 	case len(buf) >= 20 && bytes.Equal(buf[16:16+len(FlashSignature)], FlashSignature):
 		return NewFlashImage(buf)
-	case bytes.Equal(buf[:len(FlashSignature)], FlashSignature):
+	case len(buf) >= len(FlashSignature) && bytes.Equal(buf[:len(FlashSignature)], FlashSignature):
 		return NewFlashImage(buf)
+	case IsBPDT(buf):
+		return NewIFWI(buf)
+	case IsGscImage(buf):
+		return NewGscImage(buf)
+	case IsCapsule(buf):
+		return NewCapsule(buf)
+	case IsCapsuleOnDisk(buf):
+		return NewCapsuleOnDisk(buf)
+	case IsDellPFS(buf):
+		return NewDellPFS(buf)
+	case IsInsydeIFlash(buf):
+		return NewInsydeIFlash(buf)
+	case IsIM4P(buf):
+		return NewIM4P(buf)
+	case IsOptionROM(buf):
+		return NewOptionROM(buf)
+	case FindFirmwareVolumeOffset(buf) != -1:
+		return NewBiosRegion(buf)
 	default:
 		return nil, fmt.Errorf("Unknown firmware type")
 	}
 }
+
+// ParseReader reads a firmware image from r and parses it like Parse. It
+// only relies on io.Reader, so it can be used where no file system is
+// available, e.g. in WebAssembly builds.
+func ParseReader(r io.Reader) (Firmware, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(buf)
+}
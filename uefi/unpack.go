@@ -0,0 +1,230 @@
+package uefi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Unpacked directory layout
+const (
+	UnpackManifestName = "manifest.json"
+	UnpackImageName    = "image.bin"
+	// UnpackFormat identifies the manifests written by Unpack
+	UnpackFormat = "unpack"
+)
+
+// UnpackEntry describes an element extracted by Unpack
+type UnpackEntry struct {
+	// Path is relative to the unpacked directory
+	Path string `json:"path"`
+	// Kind is either "region", "file", or "nested" for the files of the
+	// volumes nested in firmware volume image sections, which are only
+	// extracted for inspection and cannot be repacked
+	Kind string `json:"kind"`
+	// Region is the name of the region, for regions
+	Region string `json:"region,omitempty"`
+	// Volume is the index of the firmware volume in the BIOS region, for
+	// files, or of the volume holding the outermost enclosing file, for
+	// nested files
+	Volume int `json:"volume"`
+	// GUID is the name of the file, for files
+	GUID string `json:"guid,omitempty"`
+	// SHA256 is the hash of the extracted data, used to detect changes
+	SHA256 string `json:"sha256"`
+}
+
+// UnpackManifest lists the elements extracted by Unpack
+type UnpackManifest struct {
+	// Format is UnpackFormat
+	Format  string        `json:"format"`
+	Image   string        `json:"image"`
+	Entries []UnpackEntry `json:"entries"`
+}
+
+// unpackFilePath returns the path of a file of the BIOS region in the
+// unpacked directory
+func unpackFilePath(volume int, fv FirmwareVolume, index int, f *File) string {
+	return fmt.Sprintf("volumes/%02d-%s/%s.bin", volume, fv.guidString(), fileBaseName(index, f))
+}
+
+// fileBaseName returns the name of a file of a volume in the unpacked and
+// extracted directories: its index and GUID, followed by its module name if
+// it has one, see File.ModuleName
+func fileBaseName(index int, f *File) string {
+	name := fmt.Sprintf("%03d-%s", index, f.GUID())
+	// keep the names portable
+	module := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, f.ModuleName())
+	if module != "" {
+		name += "-" + module
+	}
+	return name
+}
+
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+// Unpack extracts the image into dir for editing: the raw image, every
+// region except the descriptor, and the contents of every non-pad file of
+// the BIOS region, excluding the file header. The files of the nested
+// volumes are extracted under the directory of their enclosing file. The
+// regions exceeding the image are skipped. Repack rebuilds an image from the
+// directory.
+func (f FlashImage) Unpack(dir string) error {
+	manifest := UnpackManifest{Format: UnpackFormat, Image: UnpackImageName}
+	write := func(e UnpackEntry, data []byte) error {
+		path := filepath.Join(dir, filepath.FromSlash(e.Path))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+		e.SHA256 = sha256Hex(data)
+		manifest.Entries = append(manifest.Entries, e)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, UnpackImageName), f.buf, 0644); err != nil {
+		return err
+	}
+	for _, n := range f.Tree().Children {
+		if n.Type != "Region" || n.Name == "Descriptor" {
+			continue
+		}
+		e := UnpackEntry{Path: "regions/" + n.Name + ".bin", Kind: "region", Region: n.Name}
+		if err := write(e, f.buf[n.Offset:n.Offset+n.Size]); err != nil {
+			return err
+		}
+	}
+	if f.BiosRegion != nil {
+		var err error
+		for i := range f.BiosRegion.FirmwareVolumes {
+			// the paths of the files without extension, and the index of
+			// the next file of each volume
+			paths := make(map[*File]string)
+			indexes := make(map[*FirmwareVolume]int)
+			volume := &f.BiosRegion.FirmwareVolumes[i]
+			walkVolumeFiles(volume, nil, volume.Offset, func(fv *FirmwareVolume, file, parent *File, offset uint64) {
+				j := indexes[fv]
+				indexes[fv]++
+				e := UnpackEntry{Kind: "file", Volume: i, GUID: file.GUID()}
+				if parent == nil {
+					e.Path = strings.TrimSuffix(unpackFilePath(i, *fv, j, file), ".bin")
+				} else {
+					e.Kind = "nested"
+					e.Path = paths[parent] + "/" + fv.guidString() + "/" + fileBaseName(j, file)
+				}
+				paths[file] = e.Path
+				if file.Type == FileTypePad || err != nil {
+					return
+				}
+				e.Path += ".bin"
+				err = write(e, file.Data())
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	out, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, UnpackManifestName), out, 0644)
+}
+
+// Repack rebuilds an image from a directory created by Unpack. Only the
+// elements modified on disk are applied: modified regions, which must keep
+// their size, are copied over the original image, then the modified files
+// are replaced in their firmware volumes with FirmwareVolume.ReplaceFile.
+// The containers that were not touched are left as they are.
+func Repack(dir string) (*FlashImage, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, UnpackManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var manifest UnpackManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest: %v", err)
+	}
+	if manifest.Format != UnpackFormat {
+		return nil, fmt.Errorf("Invalid manifest: format %q, expected %q", manifest.Format, UnpackFormat)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(manifest.Image)))
+	if err != nil {
+		return nil, err
+	}
+	image, err := NewFlashImage(buf)
+	if err != nil {
+		return nil, err
+	}
+	// make sure that only the modified elements will change
+	if err := image.CheckRoundTrip(); err != nil {
+		return nil, err
+	}
+	var files []UnpackEntry
+	modified := make(map[string][]byte)
+	for _, e := range manifest.Entries {
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(e.Path)))
+		if err != nil {
+			return nil, err
+		}
+		if sha256Hex(content) == e.SHA256 {
+			continue
+		}
+		debugf("%s was modified", e.Path)
+		modified[e.Path] = content
+		switch e.Kind {
+		case "region":
+			n := image.regionNode(e.Region)
+			if n == nil {
+				return nil, fmt.Errorf("%s: region %s not found", e.Path, e.Region)
+			}
+			if uint64(len(content)) != n.Size {
+				return nil, fmt.Errorf("%s: region %s must be %v bytes, got %v", e.Path, e.Region, n.Size, len(content))
+			}
+			copy(buf[n.Offset:], content)
+		case "file":
+			files = append(files, e)
+		case "nested":
+			return nil, fmt.Errorf("%s: the files of nested volumes cannot be repacked", e.Path)
+		default:
+			return nil, fmt.Errorf("%s: unknown entry kind %q", e.Path, e.Kind)
+		}
+	}
+	if len(modified) == 0 {
+		return image, nil
+	}
+	if image, err = NewFlashImage(buf); err != nil {
+		return nil, err
+	}
+	for _, e := range files {
+		if image.BiosRegion == nil || e.Volume < 0 || e.Volume >= len(image.BiosRegion.FirmwareVolumes) {
+			return nil, fmt.Errorf("%s: firmware volume %d not found", e.Path, e.Volume)
+		}
+		fv := &image.BiosRegion.FirmwareVolumes[e.Volume]
+		if err := fv.ReplaceFile(e.GUID, modified[e.Path]); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Path, err)
+		}
+	}
+	out, err := image.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return NewFlashImage(out)
+}
@@ -0,0 +1,405 @@
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+var (
+	// VBTSignature starts the Video BIOS Tables of the Intel graphics,
+	// followed by the name of the platform
+	VBTSignature = []byte("$VBT")
+	// BDBSignature starts the BIOS data block of a VBT
+	BDBSignature = []byte("BIOS_DATA_BLOCK ")
+)
+
+// VBT constants
+const (
+	VBTHeaderSize = 48
+	BDBHeaderSize = 22
+	// vbtBlockHeaderSize is the size of the id and size of each BDB block
+	vbtBlockHeaderSize = 3
+	// vbtMaxSize bounds the size of the tables found by signature
+	vbtMaxSize = 0x10000
+)
+
+// BDB block ids
+const (
+	BDBGeneralFeatures    = 1
+	BDBGeneralDefinitions = 2
+	BDBMIPISequence       = 53
+)
+
+// BDBBlockNames maps the ids of the BDB blocks to the names used by Linux
+var BDBBlockNames = map[uint8]string{
+	1:   "GENERAL_FEATURES",
+	2:   "GENERAL_DEFINITIONS",
+	3:   "OLD_TOGGLE_LIST",
+	4:   "MODE_SUPPORT_LIST",
+	5:   "GENERIC_MODE_TABLE",
+	6:   "EXT_MMIO_REGS",
+	7:   "SWF_IO",
+	8:   "SWF_MMIO",
+	9:   "PSR",
+	10:  "MODE_REMOVAL_TABLE",
+	11:  "CHILD_DEVICE_TABLE",
+	12:  "DRIVER_FEATURES",
+	13:  "DRIVER_PERSISTENCE",
+	14:  "EXT_TABLE_PTRS",
+	15:  "DOT_CLOCK_OVERRIDE",
+	16:  "DISPLAY_SELECT",
+	18:  "DRIVER_ROTATION",
+	19:  "DISPLAY_REMOVE",
+	20:  "OEM_CUSTOM",
+	21:  "EFP_LIST",
+	22:  "SDVO_LVDS_OPTIONS",
+	23:  "SDVO_PANEL_DTDS",
+	24:  "SDVO_LVDS_PNP_IDS",
+	25:  "SDVO_LVDS_POWER_SEQ",
+	26:  "TV_OPTIONS",
+	27:  "EDP",
+	40:  "LVDS_OPTIONS",
+	41:  "LVDS_LFP_DATA_PTRS",
+	42:  "LVDS_LFP_DATA",
+	43:  "LVDS_BACKLIGHT",
+	44:  "LFP_POWER",
+	52:  "MIPI_CONFIG",
+	53:  "MIPI_SEQUENCE",
+	56:  "COMPRESSION_PARAMETERS",
+	58:  "GENERIC_DTD",
+	254: "SKIP",
+}
+
+// vbtPortNames maps the DVO ports of the child devices to names
+var vbtPortNames = map[uint8]string{
+	0:  "HDMI-A",
+	1:  "HDMI-B",
+	2:  "HDMI-C",
+	3:  "HDMI-D",
+	4:  "LVDS",
+	5:  "TV",
+	6:  "CRT",
+	7:  "DP-B",
+	8:  "DP-C",
+	9:  "DP-D",
+	10: "DP-A",
+	11: "DP-E",
+	12: "HDMI-E",
+	13: "DP-F",
+	14: "HDMI-F",
+	15: "DP-G",
+	16: "HDMI-G",
+	17: "DP-H",
+	18: "HDMI-H",
+	19: "DP-I",
+	20: "HDMI-I",
+	21: "MIPI-A",
+	22: "MIPI-B",
+	23: "MIPI-C",
+	24: "MIPI-D",
+}
+
+// VBTHeader is the header of a Video BIOS Table
+type VBTHeader struct {
+	// Signature is $VBT followed by the name of the platform
+	Signature  [20]byte
+	Version    uint16
+	HeaderSize uint16
+	VBTSize    uint16
+	Checksum   uint8
+	Reserved   uint8
+	BDBOffset  uint32
+	AIMOffset  [4]uint32
+}
+
+// BDBHeader is the header of the BIOS data block of a VBT
+type BDBHeader struct {
+	Signature  [16]byte
+	Version    uint16
+	HeaderSize uint16
+	BDBSize    uint16
+}
+
+// VBTBlock is a block of the BIOS data block
+type VBTBlock struct {
+	ID uint8
+	// Offset is the position of the block header from the start of the VBT
+	Offset uint64
+	Data   []byte `json:"-"`
+}
+
+// Name returns the name of the block
+func (b VBTBlock) Name() string {
+	if name, ok := BDBBlockNames[b.ID]; ok {
+		return name
+	}
+	return fmt.Sprintf("BLOCK_%d", b.ID)
+}
+
+// VBTChildDevice is an output of the graphics controller, as listed in the
+// general definitions block
+type VBTChildDevice struct {
+	Handle     uint16
+	DeviceType uint16
+	DVOPort    uint8
+	I2CPin     uint8
+	DDCPin     uint8
+}
+
+// Port returns the name of the port of the device
+func (c VBTChildDevice) Port() string {
+	if name, ok := vbtPortNames[c.DVOPort]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", c.DVOPort)
+}
+
+func (c VBTChildDevice) String() string {
+	return fmt.Sprintf("handle 0x%04x type 0x%04x port %s DDC pin 0x%02x", c.Handle, c.DeviceType, c.Port(), c.DDCPin)
+}
+
+// VBT is a Video BIOS Table, the display configuration of the Intel
+// graphics read by the GOP driver, the VBIOS and the OS drivers
+type VBT struct {
+	Header       VBTHeader
+	BDB          BDBHeader
+	Blocks       []*VBTBlock
+	ChildDevices []VBTChildDevice
+	// Holds the raw buffer
+	buf []byte
+}
+
+// Buf returns the raw bytes of the table
+func (v VBT) Buf() []byte {
+	return v.buf
+}
+
+// Platform returns the name of the platform of the signature, e.g. SKYLAKE
+func (v VBT) Platform() string {
+	return strings.Trim(string(v.Header.Signature[len(VBTSignature):]), " \x00")
+}
+
+// Block returns the block with the given id, or nil if there is none
+func (v VBT) Block(id uint8) *VBTBlock {
+	for _, b := range v.Blocks {
+		if b.ID == id {
+			return b
+		}
+	}
+	return nil
+}
+
+// Summary prints a multi-line description of the table
+func (v VBT) Summary() string {
+	var blocks, devices []string
+	for _, b := range v.Blocks {
+		blocks = append(blocks, fmt.Sprintf("%s (%d) at 0x%x, %d bytes", b.Name(), b.ID, b.Offset, len(b.Data)))
+	}
+	for _, c := range v.ChildDevices {
+		devices = append(devices, c.String())
+	}
+	return fmt.Sprintf("VBT{\n"+
+		"    Platform=%s\n"+
+		"    Version=%d\n"+
+		"    BDBVersion=%d\n"+
+		"    Size=%v\n"+
+		"    Blocks=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"    ChildDevices=[\n"+
+		"        %v\n"+
+		"    ]\n"+
+		"}",
+		v.Platform(), v.Header.Version, v.BDB.Version, len(v.buf),
+		Indent(strings.Join(blocks, "\n"), 8),
+		Indent(strings.Join(devices, "\n"), 8),
+	)
+}
+
+// Validate checks the checksum of the table
+func (v VBT) Validate() []error {
+	errors := make([]error, 0)
+	var sum uint8
+	for _, b := range v.buf {
+		sum += b
+	}
+	if sum != 0 {
+		errors = append(errors, fmt.Errorf("VBT %s: invalid checksum 0x%02x", v.Platform(), v.Header.Checksum))
+	}
+	return errors
+}
+
+// MarshalBinary serializes the table
+func (v VBT) MarshalBinary() ([]byte, error) {
+	return append([]byte{}, v.buf...), nil
+}
+
+// vbtBlockSize returns the size of the data of the block at the start of
+// buf. The MIPI sequence blocks of version 3 and later have a 32 bits size
+// in their data.
+func vbtBlockSize(buf []byte) uint64 {
+	if buf[0] == BDBMIPISequence && len(buf) >= 8 && buf[3] >= 3 {
+		return uint64(binary.LittleEndian.Uint32(buf[4:]))
+	}
+	return uint64(binary.LittleEndian.Uint16(buf[1:]))
+}
+
+// parseChildDevices decodes the child devices of the general definitions
+// block
+func (v *VBT) parseChildDevices(data []byte) {
+	if len(data) < 5 {
+		return
+	}
+	size := int(data[4])
+	if size < 20 {
+		return
+	}
+	for offset := 5; offset+size <= len(data); offset += size {
+		d := data[offset:]
+		c := VBTChildDevice{
+			Handle:     binary.LittleEndian.Uint16(d),
+			DeviceType: binary.LittleEndian.Uint16(d[2:]),
+			DVOPort:    d[16],
+			I2CPin:     d[17],
+			DDCPin:     d[19],
+		}
+		if c.DeviceType != 0 {
+			v.ChildDevices = append(v.ChildDevices, c)
+		}
+	}
+}
+
+// NewVBT parses the Video BIOS Table at the start of buf
+func NewVBT(buf []byte) (*VBT, error) {
+	if len(buf) < VBTHeaderSize || !bytes.Equal(buf[:len(VBTSignature)], VBTSignature) {
+		return nil, fmt.Errorf("No VBT signature found")
+	}
+	var v VBT
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &v.Header); err != nil {
+		return nil, err
+	}
+	size := uint64(v.Header.VBTSize)
+	if size < VBTHeaderSize || size > uint64(len(buf)) {
+		return nil, fmt.Errorf("Invalid VBT size %v, %v bytes available", size, len(buf))
+	}
+	v.buf = buf[:size]
+	bdb := uint64(v.Header.BDBOffset)
+	if bdb+BDBHeaderSize > size || !bytes.Equal(v.buf[bdb:bdb+uint64(len(BDBSignature))], BDBSignature) {
+		return nil, fmt.Errorf("No BIOS data block found at 0x%x", bdb)
+	}
+	if err := binary.Read(bytes.NewReader(v.buf[bdb:]), binary.LittleEndian, &v.BDB); err != nil {
+		return nil, err
+	}
+	end := bdb + uint64(v.BDB.BDBSize)
+	if end > size {
+		return nil, fmt.Errorf("BIOS data block of %v bytes exceeds the VBT", v.BDB.BDBSize)
+	}
+	for offset := bdb + uint64(v.BDB.HeaderSize); offset+vbtBlockHeaderSize <= end; {
+		blockSize := vbtBlockSize(v.buf[offset:end])
+		if offset+vbtBlockHeaderSize+blockSize > end {
+			return nil, fmt.Errorf("BDB block %d at 0x%x exceeds the BIOS data block", v.buf[offset], offset)
+		}
+		b := VBTBlock{ID: v.buf[offset], Offset: offset, Data: v.buf[offset+vbtBlockHeaderSize : offset+vbtBlockHeaderSize+blockSize]}
+		v.Blocks = append(v.Blocks, &b)
+		if b.ID == BDBGeneralDefinitions {
+			v.parseChildDevices(b.Data)
+		}
+		offset += vbtBlockHeaderSize + blockSize
+	}
+	return &v, nil
+}
+
+// FindVBTs returns the Video BIOS Tables in buf, e.g. in the VBT file of the
+// GOP driver or in the legacy VBIOS
+func FindVBTs(buf []byte) []*VBT {
+	var tables []*VBT
+	for offset := 0; offset < len(buf); {
+		idx := bytes.Index(buf[offset:], VBTSignature)
+		if idx == -1 {
+			break
+		}
+		offset += idx
+		end := len(buf)
+		if end-offset > vbtMaxSize {
+			end = offset + vbtMaxSize
+		}
+		v, err := NewVBT(buf[offset:end])
+		if err != nil {
+			offset += len(VBTSignature)
+			continue
+		}
+		tables = append(tables, v)
+		offset += len(v.buf)
+	}
+	return tables
+}
+
+// FileVBT is a Video BIOS Table of the BIOS region, as returned by
+// BiosRegion.VBTs
+type FileVBT struct {
+	// File is the GUID of the file holding the table, Name its module
+	// name, see File.ModuleName
+	File string
+	Name string
+	VBT
+}
+
+func (v FileVBT) String() string {
+	return fmt.Sprintf("%s: VBT %s version %d, BDB version %d, %d blocks, %d child devices",
+		strings.TrimSpace(v.File+" "+v.Name), v.Platform(), v.Header.Version, v.BDB.Version, len(v.Blocks), len(v.ChildDevices))
+}
+
+// VBTs returns the Video BIOS Tables stored in the files of the region,
+// usually in the VBT file of the GOP driver and in the VBIOS option ROM
+func (br BiosRegion) VBTs() []FileVBT {
+	var tables []FileVBT
+	isLeaf := func(s *Section) bool { return len(s.Sections) == 0 }
+	br.walkFileData(isLeaf, func(f *File, data []byte) {
+		for _, v := range FindVBTs(data) {
+			tables = append(tables, FileVBT{File: f.GUID(), Name: f.ModuleName(), VBT: *v})
+		}
+	})
+	return tables
+}
+
+// VBTs returns the Video BIOS Tables of the BIOS region, see BiosRegion.VBTs
+func (f FlashImage) VBTs() []FileVBT {
+	if f.BiosRegion == nil {
+		return nil
+	}
+	return f.BiosRegion.VBTs()
+}
+
+// vbtFields returns the fields compared by DiffVBTs, in order, and their
+// formatted values. The blocks that are not decoded are compared by size
+// and CRC32.
+func (v VBT) vbtFields() ([]string, map[string]string) {
+	var names []string
+	values := make(map[string]string)
+	set := func(name, format string, args ...interface{}) {
+		names = append(names, name)
+		values[name] = fmt.Sprintf(format, args...)
+	}
+	set("Platform", "%s", v.Platform())
+	set("Version", "%d", v.Header.Version)
+	set("BDBVersion", "%d", v.BDB.Version)
+	for _, b := range v.Blocks {
+		set("Block."+b.Name(), "%d bytes, CRC32 0x%08x", len(b.Data), crc32.ChecksumIEEE(b.Data))
+	}
+	for i, c := range v.ChildDevices {
+		set(fmt.Sprintf("ChildDevice[%d]", i), "%v", c)
+	}
+	return names, values
+}
+
+// DiffVBTs compares two Video BIOS Tables, e.g. from two versions of a
+// vendor update: versions, blocks and child devices. It returns the fields
+// that differ.
+func DiffVBTs(from, to *VBT) []DescriptorChange {
+	oldNames, oldValues := from.vbtFields()
+	newNames, newValues := to.vbtFields()
+	return diffFields(oldNames, oldValues, newNames, newValues)
+}
@@ -0,0 +1,101 @@
+package uefi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Vulnerability is a known vulnerability of a module
+type Vulnerability struct {
+	// ID is the identifier of the vulnerability, e.g. a CVE
+	ID          string
+	Description string
+}
+
+func (v Vulnerability) String() string {
+	if v.Description == "" {
+		return v.ID
+	}
+	return v.ID + ": " + v.Description
+}
+
+// VulnerabilityDatabase is a database of modules with known vulnerabilities,
+// e.g. the DXE drivers affected by LogoFAIL. Once set with
+// SetVulnerabilityDatabase, the files of the BIOS regions are looked up in
+// it by Validate, and every match is reported as an error.
+type VulnerabilityDatabase interface {
+	// Lookup returns the vulnerabilities affecting the file, if any
+	Lookup(f *File) []Vulnerability
+}
+
+// vulnerabilityDatabase is the package-level vulnerability database, nil if
+// the lookups are disabled
+var vulnerabilityDatabase VulnerabilityDatabase
+
+// SetVulnerabilityDatabase sets the database used by Validate to report the
+// known vulnerable modules. A nil database disables the lookups.
+func SetVulnerabilityDatabase(db VulnerabilityDatabase) {
+	vulnerabilityDatabase = db
+}
+
+// KnownVulnerableModule is an entry of a KnownVulnerableModules database.
+// The empty GUID or SHA256 match any file, so a module can be identified by
+// its GUID, by its digest or by both.
+type KnownVulnerableModule struct {
+	Vulnerability
+	GUID string `json:",omitempty"`
+	// SHA256 is the digest of the file, header included
+	SHA256 string `json:",omitempty"`
+}
+
+// KnownVulnerableModules is a VulnerabilityDatabase made of a list of
+// modules, e.g. loaded from JSON
+type KnownVulnerableModules []KnownVulnerableModule
+
+// Lookup returns the vulnerabilities of the entries matching the file
+func (l KnownVulnerableModules) Lookup(f *File) []Vulnerability {
+	var found []Vulnerability
+	var digest string
+	for _, m := range l {
+		if m.GUID == "" && m.SHA256 == "" {
+			continue
+		}
+		if m.GUID != "" && !strings.EqualFold(m.GUID, f.GUID()) {
+			continue
+		}
+		if m.SHA256 != "" {
+			if digest == "" {
+				digest = sha256Hex(f.buf)
+			}
+			if !strings.EqualFold(m.SHA256, digest) {
+				continue
+			}
+		}
+		found = append(found, m.Vulnerability)
+	}
+	return found
+}
+
+// vulnerabilityErrors returns the known vulnerabilities of the files of the
+// region, including the ones of the nested volumes, as errors, if a database
+// is set
+func (br BiosRegion) vulnerabilityErrors() []error {
+	if vulnerabilityDatabase == nil {
+		return nil
+	}
+	var errors []error
+	br.walkFiles(func(fv *FirmwareVolume, f, parent *File, offset uint64) {
+		for _, v := range vulnerabilityDatabase.Lookup(f) {
+			name := f.GUID()
+			if ui := f.ModuleName(); ui != "" {
+				name += " (" + ui + ")"
+			}
+			where := fmt.Sprintf("at 0x%x", offset)
+			if parent != nil {
+				where = fmt.Sprintf("in the volume nested in file %s at 0x%x", parent.GUID(), offset)
+			}
+			errors = append(errors, fmt.Errorf("File %s %s in the BIOS region: known vulnerable module: %v", name, where, v))
+		}
+	})
+	return errors
+}
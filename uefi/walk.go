@@ -0,0 +1,67 @@
+package uefi
+
+// fileVisitor is called by walkFiles on each file, with the volume holding
+// it, the file holding that volume for nested volumes or nil, and the offset
+// of the file in the region. The files of nested volumes, whose contents may
+// be compressed, get the offset of their outermost enclosing file.
+type fileVisitor func(fv *FirmwareVolume, f *File, parent *File, offset uint64)
+
+// walkVolumeFiles calls visit on the files of fv, and on the ones of the
+// volumes nested in their firmware volume image sections
+func walkVolumeFiles(fv *FirmwareVolume, parent *File, offset uint64, visit fileVisitor) {
+	for _, f := range fv.Files {
+		fileOffset := offset
+		if parent == nil {
+			fileOffset += f.Offset
+		}
+		visit(fv, f, parent, fileOffset)
+		for _, s := range volumeImageSections(nil, f.Sections) {
+			nested, err := NewFirmwareVolume(s.Data())
+			if err != nil {
+				debugf("File %s: nested volume: %v", f.GUID(), err)
+				continue
+			}
+			walkVolumeFiles(nested, f, fileOffset, visit)
+		}
+	}
+}
+
+// walkFiles calls visit on every file of the region, in order, including the
+// files of the volumes nested in firmware volume image sections, where the
+// DXE and SMM drivers usually are
+func (br BiosRegion) walkFiles(visit fileVisitor) {
+	for i := range br.FirmwareVolumes {
+		fv := &br.FirmwareVolumes[i]
+		walkVolumeFiles(fv, nil, fv.Offset, visit)
+	}
+}
+
+// walkSections calls visit on the sections of f and on the ones they
+// encapsulate, except the firmware volume images, whose files are walked by
+// walkFiles
+func walkSections(f *File, sections []*Section, visit func(f *File, s *Section)) {
+	for _, s := range sections {
+		if s.Type == SectionTypeFirmwareVolumeImage {
+			continue
+		}
+		visit(f, s)
+		walkSections(f, s.Sections, visit)
+	}
+}
+
+// walkFileData calls visit on the data of the files of the region without
+// sections, and on the data of the sections of the other files selected by
+// match, including the compressed ones and the files of the nested volumes
+func (br BiosRegion) walkFileData(match func(s *Section) bool, visit func(f *File, data []byte)) {
+	br.walkFiles(func(fv *FirmwareVolume, f, parent *File, offset uint64) {
+		if !f.HasSections() {
+			visit(f, f.Data())
+			return
+		}
+		walkSections(f, f.Sections, func(f *File, s *Section) {
+			if match(s) {
+				visit(f, s.Data())
+			}
+		})
+	})
+}
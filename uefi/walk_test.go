@@ -0,0 +1,135 @@
+package uefi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const nestedFileGUID = "5a5e7c1f-0002-4e3a-9f6b-0a1b2c3d4e02"
+
+// nestVolume inserts in the files volume of the image a firmware volume
+// image file holding a volume with the given files, and returns the image
+// parsed again
+func nestVolume(t *testing.T, f *FlashImage, files ...*File) *FlashImage {
+	fv := &f.BiosRegion.FirmwareVolumes[1]
+	nested, err := CreateFirmwareVolume(fv.FileSystemGUID, []Block{{Count: 1, Size: 0x1000}}, fv.Attributes, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := nested.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := parseGUID("5a5e7c1f-00f1-4e3a-9f6b-0a1b2c3d4ef1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := CreateFile(name, FileTypeFirmwareVolumeImage, 0, buildSection(SectionTypeFirmwareVolumeImage, buf), fv.ErasePolarity())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fv.InsertFile(file); err != nil {
+		t.Fatal(err)
+	}
+	return roundTrip(t, f)
+}
+
+// nestedFlashImage returns the synthetic image with its DXE driver moved to
+// a nested volume
+func nestedFlashImage(t *testing.T) *FlashImage {
+	f := syntheticFlashImage(t)
+	fv := &f.BiosRegion.FirmwareVolumes[1]
+	driver, err := CreateFile(fv.Files[1].Name, FileTypeDriver, 0, fv.Files[1].Data(), fv.ErasePolarity())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if driver.GUID() != nestedFileGUID {
+		t.Fatalf("unexpected synthetic driver %s", driver.GUID())
+	}
+	if err := fv.DeleteFile(nestedFileGUID); err != nil {
+		t.Fatal(err)
+	}
+	return nestVolume(t, f, driver)
+}
+
+func TestWalkFilesNested(t *testing.T) {
+	f := nestedFlashImage(t)
+	var found *File
+	f.BiosRegion.walkFiles(func(fv *FirmwareVolume, file, parent *File, offset uint64) {
+		if file.GUID() == nestedFileGUID {
+			found = parent
+		}
+	})
+	if found == nil {
+		t.Fatal("the nested driver was not visited")
+	}
+	if found.Type != FileTypeFirmwareVolumeImage {
+		t.Errorf("got parent type %v, want %v", found.Type, FileTypeFirmwareVolumeImage)
+	}
+}
+
+func TestValidateNestedVulnerableModule(t *testing.T) {
+	f := nestedFlashImage(t)
+	SetVulnerabilityDatabase(KnownVulnerableModules{{Vulnerability: Vulnerability{ID: "CVE-0000-0000"}, GUID: nestedFileGUID}})
+	defer SetVulnerabilityDatabase(nil)
+	var found bool
+	for _, err := range f.Validate() {
+		if strings.Contains(err.Error(), "CVE-0000-0000") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("expected the nested vulnerable module to be reported")
+	}
+}
+
+func TestUnpackNested(t *testing.T) {
+	f := nestedFlashImage(t)
+	dir, err := ioutil.TempDir("", "unpack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := f.Unpack(dir); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "volumes", "*", "*", "*", "*-"+nestedFileGUID+"*.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("got %d nested driver files, want 1", len(matches))
+	}
+	if _, err := Repack(dir); err != nil {
+		t.Errorf("unmodified: %v", err)
+	}
+	if err := ioutil.WriteFile(matches[0], []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Repack(dir); err == nil {
+		t.Error("expected an error for a modified nested file")
+	}
+}
+
+func TestWalkFileDataNested(t *testing.T) {
+	f := nestedFlashImage(t)
+	var found, volumes int
+	f.BiosRegion.walkFileData(func(s *Section) bool { return true }, func(file *File, data []byte) {
+		if file.GUID() == nestedFileGUID {
+			found++
+		}
+		if _, err := NewFirmwareVolume(data); err == nil {
+			volumes++
+		}
+	})
+	// the raw and user interface sections of the driver
+	if found != 2 {
+		t.Errorf("got %d sections of the nested driver, want 2", found)
+	}
+	if volumes != 0 {
+		t.Errorf("got %d firmware volume images, want them to be walked as volumes", volumes)
+	}
+}
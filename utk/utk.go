@@ -1,35 +1,1165 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 
 	"github.com/insomniacslk/uefi/uefi"
 )
 
+var (
+	flagDebug  = flag.Bool("debug", false, "Print debug messages from the parsers")
+	flagAt     = flag.Int64("at", -1, "Print the parsed elements containing this offset instead of the summary")
+	flagLax    = flag.Bool("permissive", false, "Keep parsing after malformed structures, reporting them as errors")
+	flagMap    = flag.Bool("memmap", false, "Print the memory map of the image instead of the summary")
+	flagJSON   = flag.Bool("json", false, "Use JSON as output format where supported")
+	flagRedact = flag.String("redact", "", "Comma-separated list of data to redact from all the outputs: nvram, mac, or region names")
+	flagOutput = flag.String("o", "", "Write the (possibly redacted) image to this file")
+	flagOEM    = flag.Bool("licensing", false, "Print the Windows OEM activation data (SLIC, MSDM) instead of the summary")
+	flagScan   = flag.Bool("scan", false, "Print suspicious strings and modules (passwords, backdoors) instead of the summary")
+	flagHidden = flag.Bool("hidden", false, "Print the data found in padding and unused areas, with its entropy, instead of the summary")
+	flagBG     = flag.Bool("bootguard", false, "Print which firmware volumes are verified by the Boot Guard IBB segments instead of the summary")
+	flagAuth   = flag.Bool("authenticode", false, "Print the Authenticode signed PE images of the BIOS region, verifying their signatures, instead of the summary")
+	flagOROM   = flag.Bool("oprom", false, "Print the PCI option ROMs of the BIOS and GbE regions, with their device IDs and code types, instead of the summary")
+	flagVBT    = flag.Bool("vbt", false, "Print the Intel Video BIOS Tables of the BIOS region, with their blocks and child devices, instead of the summary")
+	flagAMI    = flag.Bool("ami", false, "Print the AMI NVAR variable stores, with their GUID stores, and the $UDC containers instead of the summary")
+	flagCerts  = flag.Bool("certs", false, "Print the X.509 certificates found in the image instead of the summary")
+	flagBoot   = flag.Bool("boot", false, "Print the boot configuration stored in the NVRAM (boot order, boot entries, consoles) instead of the summary")
+	flagTrust  = flag.Bool("trust", false, "Print the keys and hashes of the Secure Boot and shim MOK variables instead of the summary")
+	flagFMAP   = flag.Bool("fmap", false, "Print the coreboot FMAP embedded in the image instead of the summary")
+	flagDigest = flag.String("digests", "", "Print the digests of the regions, firmware volumes, files and sections with this algorithm (sha1, sha256, sha384, sha512) instead of the summary")
+	flagPCRs   = flag.String("pcrs", "", "Print the expected PCR0, PCR2 and PCR4 values for the PCR bank with this algorithm (sha1, sha256, sha384, sha512) instead of the summary")
+	flagGolden = flag.String("golden", "", "Print the files of the BIOS region that differ from the golden manifest in this file instead of the summary, and exit with an error if any differs")
+	flagReport = flag.String("buildreport", "", "Print the differences between the BIOS region and the EDK2 build report or FV map file in this file instead of the summary, and exit with an error if any differs")
+	flagVulnDB = flag.String("vulndb", "", "Report the files matching the known vulnerable modules listed in this JSON file as validation errors")
+	flagStats  = flag.Bool("stats", false, "Print the parser coverage and timing statistics instead of the summary")
+	flagSQL    = flag.Bool("sql", false, "Print the inventory of the image as SQL statements, for a firmware inventory database, instead of the summary")
+	flagSBOM   = flag.Bool("sbom", false, "Print the inventory of the modules of the image, with their GUIDs, names, versions and hashes, as a CycloneDX SBOM instead of the summary")
+	flagRules  = flag.Bool("rules", false, "Run the built-in security checks instead of the summary, and exit with an error if a critical one fails")
+	flagSec    = flag.Bool("posture", false, "Print the insecure descriptor settings instead of the summary, and exit with an error if any is critical")
+	flagClean  = flag.Bool("meclean", false, "Remove the ME partitions except FTPR and set the ME disable bit before writing the image with -o")
+	flagMAC    = flag.String("mac", "", "Set the MAC address of the GbE region before writing the image with -o")
+	flagUcode  = flag.String("microcode", "", "Replace the microcode update for the same processor with the one in this file, or add it, before writing the image with -o")
+	flagAccess = flag.String("access", "", "Set the descriptor permissions of all the masters before writing the image with -o: lock or unlock")
+)
+
+// unpack extracts an image into a directory, for editing with repack
+func unpack(romfile, dir string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	return image.Unpack(dir)
+}
+
+// fdf unpacks an image into a directory and writes an EDK2 flash
+// description of its layout referring to the unpacked files
+func fdf(romfile, dir string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	return image.ExportFDF(dir, filepath.Base(romfile))
+}
+
+// regions writes the regions of an image to a directory
+func regions(romfile, dir string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	return image.ExtractRegions(dir)
+}
+
+// microcode writes the microcode updates of an image to a directory, in the
+// formats of the Linux microcode loader
+func microcode(romfile, dir string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	if image.BiosRegion == nil {
+		return fmt.Errorf("The image has no BIOS region")
+	}
+	return image.BiosRegion.ExtractMicrocodes(dir)
+}
+
+// ibb writes the Boot Guard IBB segments of an image to a directory, and
+// prints whether their hashes match the Boot Policy Manifest
+func ibb(romfile, dir string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	if image.BiosRegion == nil {
+		return fmt.Errorf("The image has no BIOS region")
+	}
+	if err := image.BiosRegion.ExtractIBB(dir); err != nil {
+		return err
+	}
+	checks, err := image.BiosRegion.VerifyIBB()
+	if err != nil {
+		return err
+	}
+	mismatch := false
+	for _, c := range checks {
+		fmt.Println(c)
+		if c.Computed != nil && !c.Match {
+			mismatch = true
+		}
+	}
+	if mismatch {
+		return fmt.Errorf("The IBB segments do not match the Boot Policy Manifest")
+	}
+	return nil
+}
+
+// split writes the dumps of the flash chips of an image to a directory
+func split(romfile, dir string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	return image.WriteDumps(dir)
+}
+
+// pfs writes the payloads of the PFS containers of a Dell firmware update
+// to a directory, one subdirectory per container
+func pfs(updatefile, dir string) error {
+	buf, err := ioutil.ReadFile(updatefile)
+	if err != nil {
+		return err
+	}
+	packages, err := uefi.FindDellPFS(buf)
+	if err != nil {
+		return err
+	}
+	for i, p := range packages {
+		if err := p.Extract(filepath.Join(dir, fmt.Sprintf("pfs%d", i))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iflash writes the sub-images of an Insyde iFlash update file to a
+// directory
+func iflash(updatefile, dir string) error {
+	buf, err := ioutil.ReadFile(updatefile)
+	if err != nil {
+		return err
+	}
+	update, err := uefi.NewInsydeIFlash(buf)
+	if err != nil {
+		return err
+	}
+	return update.Extract(dir)
+}
+
+// combine writes the image made of the dumps of the flash chips of a board
+func combine(outfile string, dumpfiles []string) error {
+	var dumps [][]byte
+	for _, name := range dumpfiles {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		dumps = append(dumps, buf)
+	}
+	image, err := uefi.CombineDumps(dumps...)
+	if err != nil {
+		return err
+	}
+	out, err := image.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outfile, out, 0644)
+}
+
+// meextract writes the modules of the ME code partitions of an image to a
+// directory
+func meextract(romfile, dir string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	if image.MeRegion == nil {
+		return fmt.Errorf("The image has no ME region")
+	}
+	return image.MeRegion.ExtractModules(dir)
+}
+
+// extract writes the whole hierarchy of an image to a directory, for editing
+// with assemble
+func extract(romfile, dir string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	return image.Extract(dir)
+}
+
+// assemble rebuilds an image from a directory created by extract
+func assemble(dir, romfile string) error {
+	image, err := uefi.Assemble(dir)
+	if err != nil {
+		return err
+	}
+	if err := image.CheckReproducible(); err != nil {
+		return err
+	}
+	out, err := image.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(romfile, out, 0644)
+}
+
+// patch overwrites the data of a section with the given hex bytes, and
+// writes the fixed up image to outfile
+func patch(romfile, path, offset, hexdata, outfile string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	off, err := strconv.ParseUint(offset, 0, 64)
+	if err != nil {
+		return fmt.Errorf("Invalid offset %q: %v", offset, err)
+	}
+	data, err := hex.DecodeString(hexdata)
+	if err != nil {
+		return fmt.Errorf("Invalid patch data: %v", err)
+	}
+	if err := image.Patch(path, off, data); err != nil {
+		return err
+	}
+	out, err := image.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outfile, out, 0644)
+}
+
+// ffsexport writes a file of the BIOS region of an image as a standalone
+// .ffs file, as UEFITool does
+func ffsexport(romfile, path, ffsfile string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	data, err := image.ExportFFS(path)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ffsfile, data, 0644)
+}
+
+// ffsimport adds a standalone .ffs file, e.g. exported by UEFITool or
+// MMTool, to a volume of the BIOS region of an image, replacing the file
+// with the same GUID
+func ffsimport(romfile, volume, ffsfile, outfile string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(volume)
+	if err != nil {
+		return fmt.Errorf("Invalid volume index %q: %v", volume, err)
+	}
+	data, err := ioutil.ReadFile(ffsfile)
+	if err != nil {
+		return err
+	}
+	if err := image.ImportFFS(index, data); err != nil {
+		return err
+	}
+	out, err := image.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outfile, out, 0644)
+}
+
+// mkdesc builds a descriptor region from a JSON layout
+func mkdesc(layoutfile, outfile string) error {
+	data, err := ioutil.ReadFile(layoutfile)
+	if err != nil {
+		return err
+	}
+	layout, err := uefi.ParseDescriptorLayout(data)
+	if err != nil {
+		return err
+	}
+	desc, err := uefi.BuildDescriptor(*layout)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outfile, desc, 0644)
+}
+
+// mkfmap writes the FMAP describing the regions of the flash descriptor of
+// an image, or of a descriptor layout in the format read by mkdesc
+func mkfmap(infile, outfile string) error {
+	data, err := ioutil.ReadFile(infile)
+	if err != nil {
+		return err
+	}
+	var fmap *uefi.FMAP
+	if layout, err := uefi.ParseDescriptorLayout(data); err == nil {
+		fmap, err = layout.FMAP()
+		if err != nil {
+			return err
+		}
+	} else {
+		image, err := uefi.NewFlashImage(data)
+		if err != nil {
+			return err
+		}
+		fmap, err = image.GenerateFMAP()
+		if err != nil {
+			return err
+		}
+	}
+	out, err := fmap.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(outfile, out, 0644)
+}
+
+// diff writes a patch turning one image into another
+func diff(oldfile, newfile, patchfile string) error {
+	source, err := ioutil.ReadFile(oldfile)
+	if err != nil {
+		return err
+	}
+	target, err := ioutil.ReadFile(newfile)
+	if err != nil {
+		return err
+	}
+	patch, err := uefi.Diff(source, target)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(patchfile, patch, 0644)
+}
+
+// golden writes the golden manifest of a known-good image, to be checked
+// with -golden
+func golden(romfile, manifestfile string) error {
+	buf, err := ioutil.ReadFile(romfile)
+	if err != nil {
+		return err
+	}
+	image, err := uefi.NewFlashImage(buf)
+	if err != nil {
+		return err
+	}
+	manifest, err := image.GoldenManifest()
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(manifestfile, out, 0644)
+}
+
+// descdiff prints the descriptor fields that differ between two images
+func descdiff(oldfile, newfile string) error {
+	var images [2]*uefi.FlashImage
+	for i, name := range []string{oldfile, newfile} {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if images[i], err = uefi.NewFlashImage(buf); err != nil {
+			return err
+		}
+	}
+	changes := uefi.DiffDescriptors(images[0], images[1])
+	return printResult(changes, func() {
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+	})
+}
+
+// vbtdiff prints the fields of the first Video BIOS Tables of two images
+// that differ
+func vbtdiff(oldfile, newfile string) error {
+	var tables [2]*uefi.VBT
+	for i, name := range []string{oldfile, newfile} {
+		buf, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		fw, err := uefi.Parse(buf)
+		if err != nil {
+			return err
+		}
+		image, ok := fw.(interface {
+			VBTs() []uefi.FileVBT
+		})
+		if !ok {
+			return fmt.Errorf("%s: VBT reports are not supported on this firmware type", name)
+		}
+		vbts := image.VBTs()
+		if len(vbts) == 0 {
+			return fmt.Errorf("%s: no VBT found", name)
+		}
+		tables[i] = &vbts[0].VBT
+	}
+	changes := uefi.DiffVBTs(tables[0], tables[1])
+	return printResult(changes, func() {
+		for _, c := range changes {
+			fmt.Println(c)
+		}
+	})
+}
+
+// apply applies a patch created by diff
+func apply(oldfile, patchfile, newfile string) error {
+	source, err := ioutil.ReadFile(oldfile)
+	if err != nil {
+		return err
+	}
+	patch, err := ioutil.ReadFile(patchfile)
+	if err != nil {
+		return err
+	}
+	target, err := uefi.ApplyPatch(source, patch)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(newfile, target, 0644)
+}
+
+// repack rebuilds an image from a directory created by unpack
+func repack(dir, romfile string) error {
+	image, err := uefi.Repack(dir)
+	if err != nil {
+		return err
+	}
+	if err := image.CheckReproducible(); err != nil {
+		return err
+	}
+	out, err := image.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(romfile, out, 0644)
+}
+
 func main() {
+	os.Exit(run())
+}
+
+// run runs the command line and returns the exit status
+func run() int {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n"+
+			"  %[1]s [flags] <image>\n"+
+			"  %[1]s [flags] unpack <image> <dir>\n"+
+			"  %[1]s [flags] repack <dir> <image>\n"+
+			"  %[1]s [flags] regions <image> <dir>\n"+
+			"  %[1]s [flags] extract <image> <dir>\n"+
+			"  %[1]s [flags] assemble <dir> <image>\n"+
+			"  %[1]s [flags] meextract <image> <dir>\n"+
+			"  %[1]s [flags] microcode <image> <dir>\n"+
+			"  %[1]s [flags] ibb <image> <dir>\n"+
+			"  %[1]s [flags] split <image> <dir>\n"+
+			"  %[1]s [flags] pfs <dell update> <dir>\n"+
+			"  %[1]s [flags] iflash <insyde update> <dir>\n"+
+			"  %[1]s [flags] fdf <image> <dir>\n"+
+			"  %[1]s [flags] combine <image> <chip0 dump> <chip1 dump...>\n"+
+			"  %[1]s [flags] diff <old image> <new image> <patch>\n"+
+			"  %[1]s [flags] apply <old image> <patch> <new image>\n"+
+			"  %[1]s [flags] descdiff <old image> <new image>\n"+
+			"  %[1]s [flags] vbtdiff <old image> <new image>\n"+
+			"  %[1]s [flags] mkdesc <layout.json> <descriptor>\n"+
+			"  %[1]s [flags] mkfmap <image or layout.json> <fmap>\n"+
+			"  %[1]s [flags] golden <image> <manifest.json>\n"+
+			"  %[1]s [flags] patch <image> <volume/file/section...> <offset> <hex bytes> <output>\n"+
+			"  %[1]s [flags] ffsexport <image> <volume/file> <file.ffs>\n"+
+			"  %[1]s [flags] ffsimport <image> <volume> <file.ffs> <output>\n"+
+			"Flags:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	if *flagDebug {
+		uefi.SetLogger(uefi.NewStdLogger(uefi.LogDebug))
+	}
+	if *flagVulnDB != "" {
+		data, err := ioutil.ReadFile(*flagVulnDB)
+		if err != nil {
+			return exitStatus(err)
+		}
+		var db uefi.KnownVulnerableModules
+		if err := json.Unmarshal(data, &db); err != nil {
+			return exitStatus(err)
+		}
+		uefi.SetVulnerabilityDatabase(db)
+	}
+	if *flagLax {
+		uefi.SetParseMode(uefi.ParsePermissive)
+	}
 	if len(flag.Args()) == 0 {
-		log.Fatal("A file name is required")
+		return exitStatus(fmt.Errorf("A file name is required"))
+	}
+	var err error
+	switch flag.Arg(0) {
+	case "unpack", "repack", "regions", "extract", "assemble", "meextract", "microcode", "ibb", "split", "pfs", "iflash", "fdf":
+		if len(flag.Args()) != 3 {
+			flag.Usage()
+			return 2
+		}
+		switch flag.Arg(0) {
+		case "unpack":
+			err = unpack(flag.Arg(1), flag.Arg(2))
+		case "repack":
+			err = repack(flag.Arg(1), flag.Arg(2))
+		case "regions":
+			err = regions(flag.Arg(1), flag.Arg(2))
+		case "extract":
+			err = extract(flag.Arg(1), flag.Arg(2))
+		case "assemble":
+			err = assemble(flag.Arg(1), flag.Arg(2))
+		case "meextract":
+			err = meextract(flag.Arg(1), flag.Arg(2))
+		case "microcode":
+			err = microcode(flag.Arg(1), flag.Arg(2))
+		case "ibb":
+			err = ibb(flag.Arg(1), flag.Arg(2))
+		case "split":
+			err = split(flag.Arg(1), flag.Arg(2))
+		case "pfs":
+			err = pfs(flag.Arg(1), flag.Arg(2))
+		case "iflash":
+			err = iflash(flag.Arg(1), flag.Arg(2))
+		case "fdf":
+			err = fdf(flag.Arg(1), flag.Arg(2))
+		}
+		return exitStatus(err)
+	case "combine":
+		if len(flag.Args()) < 3 {
+			flag.Usage()
+			return 2
+		}
+		return exitStatus(combine(flag.Arg(1), flag.Args()[2:]))
+	case "diff", "apply", "ffsexport":
+		if len(flag.Args()) != 4 {
+			flag.Usage()
+			return 2
+		}
+		switch flag.Arg(0) {
+		case "diff":
+			err = diff(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		case "apply":
+			err = apply(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		case "ffsexport":
+			err = ffsexport(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+		}
+		return exitStatus(err)
+	case "ffsimport":
+		if len(flag.Args()) != 5 {
+			flag.Usage()
+			return 2
+		}
+		return exitStatus(ffsimport(flag.Arg(1), flag.Arg(2), flag.Arg(3), flag.Arg(4)))
+	case "descdiff", "vbtdiff", "mkdesc", "mkfmap", "golden":
+		if len(flag.Args()) != 3 {
+			flag.Usage()
+			return 2
+		}
+		switch flag.Arg(0) {
+		case "descdiff":
+			err = descdiff(flag.Arg(1), flag.Arg(2))
+		case "vbtdiff":
+			err = vbtdiff(flag.Arg(1), flag.Arg(2))
+		case "mkdesc":
+			err = mkdesc(flag.Arg(1), flag.Arg(2))
+		case "mkfmap":
+			err = mkfmap(flag.Arg(1), flag.Arg(2))
+		case "golden":
+			err = golden(flag.Arg(1), flag.Arg(2))
+		}
+		return exitStatus(err)
+	case "patch":
+		if len(flag.Args()) != 6 {
+			flag.Usage()
+			return 2
+		}
+		return exitStatus(patch(flag.Arg(1), flag.Arg(2), flag.Arg(3), flag.Arg(4), flag.Arg(5)))
+	}
+	failed, err := inspect(flag.Arg(0))
+	if err == nil && failed {
+		return 1
+	}
+	return exitStatus(err)
+}
+
+// exitStatus logs err, if any, and returns the matching exit status
+func exitStatus(err error) int {
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+// requireFlash returns the firmware as a flash image, or an error if the
+// report requested with the given flag does not apply to it
+func requireFlash(flash uefi.Firmware, flag string) (*uefi.FlashImage, error) {
+	image, ok := flash.(*uefi.FlashImage)
+	if !ok {
+		return nil, fmt.Errorf("%s is only supported on flash images", flag)
+	}
+	return image, nil
+}
+
+// requireBIOS is like requireFlash, for the reports on the BIOS region
+func requireBIOS(flash uefi.Firmware, flag string) (*uefi.FlashImage, error) {
+	image, err := requireFlash(flash, flag)
+	if err != nil {
+		return nil, err
+	}
+	if image.BiosRegion == nil {
+		return nil, fmt.Errorf("%s is only supported on flash images with a BIOS region", flag)
+	}
+	return image, nil
+}
+
+// printResult prints v as JSON with -json, or calls text to print it as
+// text otherwise
+func printResult(v interface{}, text func()) error {
+	if !*flagJSON {
+		text()
+		return nil
 	}
-	romfile := flag.Args()[0]
+	out, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// inspect parses an image, applies the edits requested by the flags and
+// prints the requested report, followed by the validation errors. It returns
+// whether the exit status must signal a failure.
+func inspect(romfile string) (failed bool, err error) {
 	buf, err := ioutil.ReadFile(romfile)
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
 	flash, err := uefi.Parse(buf)
 	if err != nil {
-		log.Fatal(err)
+		return false, err
+	}
+	// vendor capsules, e.g. AMI Aptio .CAP, Apple .scap or Lenovo FL1 files,
+	// and Apple IM4P payloads are handled as the firmware image they hold
+	for {
+		if c, ok := flash.(*uefi.Capsule); ok && c.Firmware != nil {
+			flash = c.Firmware
+		} else if p, ok := flash.(*uefi.IM4P); ok && p.Firmware != nil {
+			flash = p.Firmware
+		} else {
+			break
+		}
+	}
+	// the structures skipped in permissive mode are reported, but do not
+	// prevent the reports
+	if p, ok := flash.(interface {
+		ParseErrors() []error
+	}); ok {
+		for _, err := range p.ParseErrors() {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+	}
+	if (*flagAccess != "" || *flagClean || *flagMAC != "" || *flagUcode != "") && *flagOutput == "" {
+		return false, fmt.Errorf("-access, -meclean, -mac and -microcode require -o")
+	}
+	if *flagRedact != "" || *flagOutput != "" {
+		image, err := requireFlash(flash, "-redact or -o")
+		if err != nil {
+			return false, err
+		}
+		if *flagRedact != "" {
+			image, err = image.Redacted(uefi.NewRedactionPolicy(*flagRedact))
+			if err != nil {
+				return false, err
+			}
+			flash = image
+		}
+		if *flagUcode != "" {
+			update, err := ioutil.ReadFile(*flagUcode)
+			if err != nil {
+				return false, err
+			}
+			if err := image.ReplaceMicrocode(update); err != nil {
+				return false, err
+			}
+		}
+		if *flagMAC != "" {
+			mac, err := uefi.ParseMACAddress(*flagMAC)
+			if err != nil {
+				return false, err
+			}
+			if image.GbeRegion == nil {
+				return false, fmt.Errorf("The image has no GbE region")
+			}
+			if err := image.GbeRegion.SetMAC(mac); err != nil {
+				return false, err
+			}
+		}
+		if *flagClean {
+			if err := image.CleanME(nil, true); err != nil {
+				return false, err
+			}
+		}
+		switch *flagAccess {
+		case "":
+		case "lock":
+			err = image.Master.Lock()
+		case "unlock":
+			err = image.Master.Unlock()
+		default:
+			err = fmt.Errorf("Unknown access mode %q, expected lock or unlock", *flagAccess)
+		}
+		if err != nil {
+			return false, err
+		}
+		if *flagOutput != "" {
+			out, err := image.MarshalBinary()
+			if err != nil {
+				return false, err
+			}
+			if err := ioutil.WriteFile(*flagOutput, out, 0644); err != nil {
+				return false, err
+			}
+		}
 	}
+	if *flagSQL {
+		// validation errors are part of the inventory
+		image, err := requireFlash(flash, "-sql")
+		if err != nil {
+			return false, err
+		}
+		return false, image.WriteInventorySQL(os.Stdout, filepath.Base(romfile))
+	}
+	if *flagSBOM {
+		image, err := requireFlash(flash, "-sbom")
+		if err != nil {
+			return false, err
+		}
+		out, err := image.SBOM(filepath.Base(romfile))
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(string(out))
+		return false, nil
+	}
+	if *flagGolden != "" {
+		// tampered images may not validate
+		image, err := requireFlash(flash, "-golden")
+		if err != nil {
+			return false, err
+		}
+		data, err := ioutil.ReadFile(*flagGolden)
+		if err != nil {
+			return false, err
+		}
+		var manifest uefi.GoldenManifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return false, err
+		}
+		changes, err := image.VerifyGolden(&manifest)
+		if err != nil {
+			return false, err
+		}
+		return len(changes) > 0, printResult(changes, func() {
+			for _, c := range changes {
+				fmt.Println(c)
+			}
+		})
+	}
+	if *flagReport != "" {
+		image, err := requireFlash(flash, "-buildreport")
+		if err != nil {
+			return false, err
+		}
+		data, err := ioutil.ReadFile(*flagReport)
+		if err != nil {
+			return false, err
+		}
+		report, err := uefi.ParseBuildReport(data)
+		if err != nil {
+			return false, err
+		}
+		mismatches, err := image.VerifyBuildReport(report)
+		if err != nil {
+			return false, err
+		}
+		return len(mismatches) > 0, printResult(mismatches, func() {
+			for _, m := range mismatches {
+				fmt.Println(m)
+			}
+		})
+	}
+	// the reports are produced for invalid images too, as they are meant to
+	// inspect them: the validation errors follow the output and set the exit
+	// status
 	errlist := flash.Validate()
-	for _, err := range errlist {
-		fmt.Printf("Error found: %v\n", err.Error())
+	defer func() {
+		out := os.Stdout
+		if *flagJSON {
+			// keep the output parseable
+			out = os.Stderr
+		}
+		for _, err := range errlist {
+			fmt.Fprintf(out, "Error found: %v\n", err.Error())
+		}
+		if len(errlist) > 0 {
+			failed = true
+		}
+	}()
+	if *flagMap {
+		image, err := requireFlash(flash, "-memmap")
+		if err != nil {
+			return false, err
+		}
+		mm := image.MemoryMap()
+		return false, printResult(mm, func() {
+			fmt.Println(mm)
+		})
+	}
+	if *flagOEM {
+		image, err := requireFlash(flash, "-licensing")
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(image.LicensingReport())
+		return false, nil
+	}
+	if *flagScan {
+		image, err := requireFlash(flash, "-scan")
+		if err != nil {
+			return false, err
+		}
+		findings := image.Scan(nil)
+		return false, printResult(findings, func() {
+			for _, f := range findings {
+				fmt.Println(f)
+			}
+		})
+	}
+	if *flagHidden {
+		image, err := requireFlash(flash, "-hidden")
+		if err != nil {
+			return false, err
+		}
+		found := image.HiddenData()
+		return false, printResult(found, func() {
+			for _, h := range found {
+				fmt.Println(h)
+			}
+		})
+	}
+	if *flagCerts {
+		image, err := requireFlash(flash, "-certs")
+		if err != nil {
+			return false, err
+		}
+		certs := image.Certificates()
+		return false, printResult(certs, func() {
+			for _, c := range certs {
+				fmt.Println(c)
+			}
+		})
+	}
+	if *flagBoot {
+		image, err := requireBIOS(flash, "-boot")
+		if err != nil {
+			return false, err
+		}
+		boot := image.BiosRegion.BootConfiguration()
+		return false, printResult(boot, func() {
+			fmt.Println(boot.Summary())
+		})
+	}
+	if *flagTrust {
+		image, err := requireFlash(flash, "-trust")
+		if err != nil {
+			return false, err
+		}
+		trust, err := image.TrustConfiguration()
+		if err != nil {
+			return false, err
+		}
+		return false, printResult(trust, func() {
+			for _, e := range trust.Entries {
+				fmt.Println(e)
+			}
+			if trust.ShimValidationDisabled {
+				fmt.Println("MokSBState: shim does not verify the images it loads")
+			}
+			for _, e := range trust.Errors {
+				fmt.Printf("Error found: %s\n", e)
+			}
+		})
+	}
+	if *flagAuth {
+		image, err := requireBIOS(flash, "-authenticode")
+		if err != nil {
+			return false, err
+		}
+		signed := image.BiosRegion.SignedImages()
+		return false, printResult(signed, func() {
+			for _, s := range signed {
+				fmt.Println(s)
+			}
+		})
+	}
+	if *flagOROM {
+		image, err := requireFlash(flash, "-oprom")
+		if err != nil {
+			return false, err
+		}
+		var roms []uefi.FileOptionROM
+		if image.BiosRegion != nil {
+			roms = image.BiosRegion.OptionROMs()
+		}
+		if image.GbeRegion != nil {
+			for _, r := range image.GbeRegion.OptionROMs() {
+				roms = append(roms, uefi.FileOptionROM{Name: "GbE region", OptionROM: *r})
+			}
+		}
+		return false, printResult(roms, func() {
+			for _, r := range roms {
+				fmt.Println(r)
+			}
+		})
+	}
+	if *flagBG {
+		image, err := requireBIOS(flash, "-bootguard")
+		if err != nil {
+			return false, err
+		}
+		coverage, err := image.BiosRegion.BootGuardCoverage()
+		if err != nil {
+			return false, err
+		}
+		return false, printResult(coverage, func() {
+			for _, c := range coverage {
+				fmt.Println(c)
+			}
+		})
+	}
+	if *flagRules {
+		image, err := requireFlash(flash, "-rules")
+		if err != nil {
+			return false, err
+		}
+		findings := image.CheckSecurityRules(nil)
+		critical := false
+		for _, f := range findings {
+			if f.Result == uefi.RuleFail && f.Severity == uefi.SeverityCritical {
+				critical = true
+			}
+		}
+		return critical, printResult(findings, func() {
+			for _, f := range findings {
+				fmt.Println(f)
+			}
+		})
+	}
+	if *flagSec {
+		image, err := requireFlash(flash, "-posture")
+		if err != nil {
+			return false, err
+		}
+		findings := image.SecurityPosture()
+		critical := false
+		for _, f := range findings {
+			if f.Severity == uefi.SeverityCritical {
+				critical = true
+			}
+		}
+		return critical, printResult(findings, func() {
+			for _, f := range findings {
+				fmt.Println(f)
+			}
+		})
+	}
+	if *flagStats {
+		image, err := requireFlash(flash, "-stats")
+		if err != nil {
+			return false, err
+		}
+		stats := image.ParseStats()
+		return false, printResult(stats, func() {
+			fmt.Println(stats)
+		})
+	}
+	if *flagVBT {
+		image, ok := flash.(interface {
+			VBTs() []uefi.FileVBT
+		})
+		if !ok {
+			return false, fmt.Errorf("VBT reports are not supported on this firmware type")
+		}
+		vbts := image.VBTs()
+		return false, printResult(vbts, func() {
+			for _, v := range vbts {
+				fmt.Println(v)
+				fmt.Println(v.Summary())
+			}
+		})
+	}
+	if *flagAMI {
+		image, ok := flash.(interface {
+			NVARStores() []*uefi.NVARStore
+			UDCs() []uefi.FileUDC
+		})
+		if !ok {
+			return false, fmt.Errorf("AMI reports are not supported on this firmware type")
+		}
+		stores, udcs := image.NVARStores(), image.UDCs()
+		return false, printResult(struct {
+			NVARStores []*uefi.NVARStore
+			UDCs       []uefi.FileUDC
+		}{stores, udcs}, func() {
+			for _, s := range stores {
+				fmt.Println(s.Summary())
+			}
+			for _, u := range udcs {
+				fmt.Println(u)
+			}
+		})
+	}
+	if *flagFMAP {
+		image, ok := flash.(interface {
+			FMAP() *uefi.FMAP
+		})
+		if !ok {
+			return false, fmt.Errorf("FMAP reports are not supported on this firmware type")
+		}
+		fmap := image.FMAP()
+		if fmap == nil {
+			return false, fmt.Errorf("No FMAP found in the image")
+		}
+		return false, printResult(fmap, func() {
+			fmt.Println(fmap.Summary())
+		})
+	}
+	if *flagDigest != "" {
+		alg, err := uefi.ParseHashAlgorithm(*flagDigest)
+		if err != nil {
+			return false, err
+		}
+		image, ok := flash.(interface {
+			Digests(uefi.HashAlgorithm) ([]uefi.NodeDigest, error)
+		})
+		if !ok {
+			return false, fmt.Errorf("Digests are not supported on this firmware type")
+		}
+		digests, err := image.Digests(alg)
+		if err != nil {
+			return false, err
+		}
+		return false, printResult(digests, func() {
+			for _, d := range digests {
+				fmt.Println(d)
+			}
+		})
+	}
+	if *flagPCRs != "" {
+		alg, err := uefi.ParseHashAlgorithm(*flagPCRs)
+		if err != nil {
+			return false, err
+		}
+		image, ok := flash.(interface {
+			PCRs(uefi.HashAlgorithm) (*uefi.PCRLog, error)
+		})
+		if !ok {
+			return false, fmt.Errorf("PCR precomputation is not supported on this firmware type")
+		}
+		pcrs, err := image.PCRs(alg)
+		if err != nil {
+			return false, err
+		}
+		return false, printResult(pcrs, func() {
+			fmt.Println(pcrs)
+		})
 	}
-	if len(errlist) > 0 {
-		os.Exit(1)
+	if *flagAt >= 0 {
+		image, ok := flash.(interface {
+			NodeAt(uint64) ([]*uefi.Node, error)
+		})
+		if !ok {
+			return false, fmt.Errorf("Offset lookup is not supported on this firmware type")
+		}
+		path, err := image.NodeAt(uint64(*flagAt))
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(uefi.FormatNodePath(path))
+		return false, nil
 	}
 	fmt.Println(flash.Summary())
+	return false, nil
 }
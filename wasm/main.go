@@ -0,0 +1,108 @@
+//go:build js && wasm
+// +build js,wasm
+
+// wasm exposes the parser to JavaScript when built as a WebAssembly module:
+//
+//	GOOS=js GOARCH=wasm go build -o uefi.wasm ./wasm
+//
+// It registers the following functions, all taking a Uint8Array with the
+// image and returning a JSON string:
+//
+//	uefiParse(image)          summary, tree and validation errors
+//	uefiMemoryMap(image)      memory map of the image
+//	uefiNodeAt(image, offset) path of the nodes containing offset
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"syscall/js"
+
+	"github.com/insomniacslk/uefi/uefi"
+)
+
+type result struct {
+	Summary   string         `json:"summary,omitempty"`
+	Tree      *uefi.Node     `json:"tree,omitempty"`
+	MemoryMap uefi.MemoryMap `json:"memoryMap,omitempty"`
+	Path      []*uefi.Node   `json:"path,omitempty"`
+	Errors    []string       `json:"errors,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+func toJSON(r result) interface{} {
+	out, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Sprintf(`{"error": %q}`, err.Error())
+	}
+	return string(out)
+}
+
+// parseArg parses the Uint8Array passed as first argument
+func parseArg(args []js.Value) (*uefi.FlashImage, uefi.Firmware, error) {
+	if len(args) < 1 {
+		return nil, nil, fmt.Errorf("An image is required")
+	}
+	buf := make([]byte, args[0].Get("length").Int())
+	js.CopyBytesToGo(buf, args[0])
+	fw, err := uefi.Parse(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	image, _ := fw.(*uefi.FlashImage)
+	return image, fw, nil
+}
+
+func parse(this js.Value, args []js.Value) interface{} {
+	image, fw, err := parseArg(args)
+	if err != nil {
+		return toJSON(result{Error: err.Error()})
+	}
+	r := result{Summary: fw.Summary()}
+	for _, err := range fw.Validate() {
+		r.Errors = append(r.Errors, err.Error())
+	}
+	if image != nil {
+		r.Tree = image.Tree()
+	}
+	return toJSON(r)
+}
+
+func memoryMap(this js.Value, args []js.Value) interface{} {
+	image, _, err := parseArg(args)
+	if err != nil {
+		return toJSON(result{Error: err.Error()})
+	}
+	if image == nil {
+		return toJSON(result{Error: "Memory maps are only supported on flash images"})
+	}
+	return toJSON(result{MemoryMap: image.MemoryMap()})
+}
+
+func nodeAt(this js.Value, args []js.Value) interface{} {
+	image, _, err := parseArg(args)
+	if err != nil {
+		return toJSON(result{Error: err.Error()})
+	}
+	if image == nil || len(args) < 2 {
+		return toJSON(result{Error: "A flash image and an offset are required"})
+	}
+	path, err := image.NodeAt(uint64(args[1].Int()))
+	if err != nil {
+		return toJSON(result{Error: err.Error()})
+	}
+	r := result{}
+	for _, n := range path {
+		r.Path = append(r.Path, &uefi.Node{Type: n.Type, Name: n.Name, Offset: n.Offset, Size: n.Size})
+	}
+	return toJSON(r)
+}
+
+func main() {
+	// the browser console is the only output available
+	uefi.SetLogger(uefi.NewStdLogger(uefi.LogWarning))
+	js.Global().Set("uefiParse", js.FuncOf(parse))
+	js.Global().Set("uefiMemoryMap", js.FuncOf(memoryMap))
+	js.Global().Set("uefiNodeAt", js.FuncOf(nodeAt))
+	select {}
+}